@@ -48,6 +48,20 @@ func (b *bitmap) remove(n uint32) {
 	b.bits[idx] &= ^uint64(1 << offset)
 }
 
+// contains reports whether n is set in the bitmap.
+func (b *bitmap) contains(n uint32) bool {
+	var (
+		idx    = n / 64
+		offset = n % 64
+	)
+
+	if int(idx) >= len(b.bits) {
+		return false
+	}
+
+	return b.bits[idx]&(1<<offset) != 0
+}
+
 // next sets and returns the lowest unset bit in the bitmap.
 //
 // bits will be expanded if necessary.
@@ -173,6 +173,25 @@ func TestBitmap_Sequence(t *testing.T) {
 	}
 }
 
+func TestBitmap_Contains(t *testing.T) {
+	bm := &bitmap{max: 200}
+
+	if bm.contains(70) {
+		t.Error("expected empty bitmap not to contain 70")
+	}
+	bm.add(70)
+	if !bm.contains(70) {
+		t.Error("expected bitmap to contain 70")
+	}
+	if bm.contains(71) || bm.contains(6) {
+		t.Error("unexpected neighbouring bits set")
+	}
+	bm.remove(70)
+	if bm.contains(70) {
+		t.Error("expected 70 to be removed")
+	}
+}
+
 func countBitmap(bm *bitmap) uint32 {
 	var count uint32
 	for _, v := range bm.bits {
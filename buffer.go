@@ -9,6 +9,17 @@ import (
 type buffer struct {
 	b []byte
 	i int
+
+	// sortMapKeys makes encoding deterministic by writing map entries
+	// in order of their encoding instead of Go's random map order.
+	// It's slower and intended for tests comparing encoded bytes.
+	sortMapKeys bool
+
+	// depth is the number of composites, lists and maps being decoded,
+	// limited to maxDepth, or defaultMaxDecodeDepth if zero, to prevent
+	// malicious input from exhausting the stack.
+	depth    int
+	maxDepth int
 }
 
 func (b *buffer) next(n int64) ([]byte, bool) {
@@ -117,6 +128,18 @@ func (b *buffer) readFromOnce(r io.Reader) error {
 	return err
 }
 
+// grow ensures there's space to write n more bytes without
+// reallocating, so that large values are copied only once.
+func (b *buffer) grow(n int) {
+	l := len(b.b)
+	if cap(b.b)-l >= n {
+		return
+	}
+	new := make([]byte, l, l+n)
+	copy(new, b.b)
+	b.b = new
+}
+
 func (b *buffer) write(p []byte) {
 	b.b = append(b.b, p...)
 }
@@ -11,6 +11,7 @@ import (
 	"math/rand"
 	"net"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
@@ -23,6 +24,44 @@ var (
 	// ErrLinkClosed returned by send and receive operations when
 	// Sender.Close() or Receiver.Close() are called.
 	ErrLinkClosed = errors.New("amqp: link closed")
+
+	// ErrWouldBlock is returned by Sender.TrySend when the link
+	// has no credit to send a message.
+	ErrWouldBlock = errors.New("amqp: no link credit available")
+)
+
+// Errors used to classify an *Error by its condition, for example when
+// an attach is rejected. The *Error returned by a failed operation matches
+// the corresponding sentinel with errors.Is or its Is method, and remains
+// available for inspection of the description and info.
+var (
+	// ErrAddressNotFound matches ErrorNotFound, indicating the source
+	// or target address of a link does not exist.
+	ErrAddressNotFound = errors.New("amqp: address not found")
+
+	// ErrUnauthorized matches ErrorUnauthorizedAccess, indicating the
+	// client is not authorized for the requested operation.
+	ErrUnauthorized = errors.New("amqp: unauthorized access")
+
+	// ErrResourceLimitExceeded matches ErrorResourceLimitExceeded.
+	ErrResourceLimitExceeded = errors.New("amqp: resource limit exceeded")
+
+	// ErrNotImplemented matches ErrorNotImplemented, indicating the peer
+	// does not support a requested feature or capability.
+	ErrNotImplemented = errors.New("amqp: not implemented")
+
+	// ErrPreconditionFailed matches ErrorPreconditionFailed.
+	ErrPreconditionFailed = errors.New("amqp: precondition failed")
+
+	// ErrConnectionForced matches ErrorConnectionForced, indicating the
+	// server closed the connection for an operator intervention such as
+	// planned maintenance.
+	ErrConnectionForced = errors.New("amqp: connection forced")
+
+	// ErrThrottled matches ErrorTransferLimitExceeded, indicating the
+	// peer rejected a message to limit the rate of transfers. The link
+	// stays attached and the message may be sent again later.
+	ErrThrottled = errors.New("amqp: throttled")
 )
 
 // Client is an AMQP client connection.
@@ -38,6 +77,46 @@ type Client struct {
 // If username and password information is not empty it's used as SASL PLAIN
 // credentials, equal to passing ConnSASLPlain option.
 func Dial(addr string, opts ...ConnOption) (*Client, error) {
+	return dial(context.Background(), addr, opts)
+}
+
+// DialFailover connects to the first of addrs that accepts the connection.
+//
+// Endpoints are tried in the order given; shuffle addrs beforehand to
+// spread connections across them. Each address is handled as by Dial and
+// the same opts are used for every attempt.
+//
+// If ctx has a deadline it bounds all attempts together; the time left is
+// applied as the connect timeout of each attempt when it is shorter than
+// the one configured with ConnConnectTimeout.
+//
+// If every endpoint fails, the returned error lists the error of each attempt.
+func DialFailover(ctx context.Context, addrs []string, opts ...ConnOption) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, errorNew("no addresses to dial")
+	}
+
+	var failures []string
+	for _, addr := range addrs {
+		if err := ctx.Err(); err != nil {
+			failures = append(failures, err.Error())
+			break
+		}
+		client, err := dial(ctx, addr, opts)
+		if err == nil {
+			return client, nil
+		}
+		if client != nil {
+			// the connection failed during establishment and
+			// conn.mux was never started to close it
+			_ = client.conn.net.Close()
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", addr, err))
+	}
+	return nil, errorErrorf("failed to connect to any endpoint: %s", strings.Join(failures, "; "))
+}
+
+func dial(ctx context.Context, addr string, opts []ConnOption) (*Client, error) {
 	u, err := url.Parse(addr)
 	if err != nil {
 		return nil, err
@@ -68,14 +147,33 @@ func Dial(addr string, opts ...ConnOption) (*Client, error) {
 		return nil, err
 	}
 
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, ctx.Err()
+		}
+		if c.connectTimeout == 0 || remaining < c.connectTimeout {
+			c.connectTimeout = remaining
+		}
+	}
+
 	dialer := &net.Dialer{Timeout: c.connectTimeout}
 	switch u.Scheme {
 	case "amqp", "":
-		c.net, err = dialer.Dial("tcp", net.JoinHostPort(host, port))
+		c.net, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
 	case "amqps":
 		c.initTLSConfig()
 		c.tlsNegotiation = false
-		c.net, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), c.tlsConfig)
+		// the connect timeout covers both the dial and the handshake
+		if c.connectTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.connectTimeout)
+			defer cancel()
+		}
+		c.net, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+		if err == nil {
+			c.net, err = tlsHandshake(ctx, c.net, host, c.tlsConfig)
+		}
 	default:
 		return nil, errorErrorf("unsupported scheme %q", u.Scheme)
 	}
@@ -86,6 +184,47 @@ func Dial(addr string, opts ...ConnOption) (*Client, error) {
 	return &Client{conn: c}, err
 }
 
+// tlsHandshake performs the TLS client handshake over conn, failing
+// once ctx is done. conn is closed if the handshake fails.
+func tlsHandshake(ctx context.Context, conn net.Conn, host string, config *tls.Config) (net.Conn, error) {
+	// as with tls.Dial, the dialed host is sent for SNI if no
+	// ServerName is configured
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	errs := make(chan error, 1)
+	go func() { errs <- tlsConn.Handshake() }()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	case <-ctx.Done():
+		conn.Close()
+		<-errs
+		return nil, ctx.Err()
+	}
+
+	// clear the deadline for the connection's reads and writes
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
 // New establishes an AMQP client connection over conn.
 func New(conn net.Conn, opts ...ConnOption) (*Client, error) {
 	c, err := newConn(conn, opts...)
@@ -101,6 +240,54 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
+// CloseWithError disconnects the connection, sending e to the server
+// in the close frame, e.g. to report a protocol violation by the server
+// with ErrorFramingError.
+//
+// If the connection has already been closed, e isn't sent.
+func (c *Client) CloseWithError(e *Error) error {
+	return c.conn.CloseWithError(e)
+}
+
+// ContainerID returns the container-id sent to the server when the
+// connection was opened.
+func (c *Client) ContainerID() string {
+	return c.conn.containerID
+}
+
+// RemoteContainerID returns the container-id the server sent when
+// the connection was opened.
+func (c *Client) RemoteContainerID() string {
+	return c.conn.peerContainerID
+}
+
+// OfferedCapabilities returns the capabilities the server offered
+// when the connection was opened.
+func (c *Client) OfferedCapabilities() []string {
+	caps := make([]string, len(c.conn.peerOfferedCapabilities))
+	for i, capability := range c.conn.peerOfferedCapabilities {
+		caps[i] = string(capability)
+	}
+	return caps
+}
+
+// MaxFrameSize returns the largest frame size that can be used on the
+// connection, the smaller of the local max frame size and the
+// server's, as negotiated when the connection was opened.
+func (c *Client) MaxFrameSize() uint32 {
+	if c.conn.peerMaxFrameSize < c.conn.maxFrameSize {
+		return c.conn.peerMaxFrameSize
+	}
+	return c.conn.maxFrameSize
+}
+
+// ChannelMax returns the highest channel number that can be used on the
+// connection, as negotiated with the server when the connection was
+// opened. At most ChannelMax()+1 sessions can be open at once.
+func (c *Client) ChannelMax() uint16 {
+	return c.conn.channelMax
+}
+
 // NewSession opens a new AMQP session to the server.
 func (c *Client) NewSession(opts ...SessionOption) (*Session, error) {
 	// get a session allocated by Client.mux
@@ -127,11 +314,11 @@ func (c *Client) NewSession(opts ...SessionOption) (*Session, error) {
 	// send Begin to server
 	begin := &performBegin{
 		NextOutgoingID: 0,
-		IncomingWindow: s.incomingWindow,
+		IncomingWindow: s.incomingWindowFor(0),
 		OutgoingWindow: s.outgoingWindow,
 		HandleMax:      s.handleMax,
 	}
-	debug(1, "TX: %s", begin)
+	s.debug(1, "TX: %s", begin)
 	s.txFrame(begin, nil)
 
 	// wait for response
@@ -141,7 +328,7 @@ func (c *Client) NewSession(opts ...SessionOption) (*Session, error) {
 		return nil, c.conn.getErr()
 	case fr = <-s.rx:
 	}
-	debug(1, "RX: %s", fr.body)
+	s.debug(1, "RX: %s", fr.body)
 
 	begin, ok := fr.body.(*performBegin)
 	if !ok {
@@ -173,6 +360,25 @@ func SessionIncomingWindow(window uint32) SessionOption {
 	}
 }
 
+// SessionMaxIncomingFrames bounds the number of incoming transfer frames
+// the session buffers for links that aren't ready to receive them.
+//
+// By default the session waits for each link to accept a frame before
+// reading the next one, so a single slow link stalls the whole session.
+// With this option frames for a slow link are buffered instead, and the
+// incoming-window advertised to the server is reduced by the number of
+// buffered frames so the server stops sending once the buffer is full.
+// A server that sends beyond the window ends the session with a
+// window-violation error.
+//
+// Default: 0 (no buffering).
+func SessionMaxIncomingFrames(n uint32) SessionOption {
+	return func(s *Session) error {
+		s.maxIncomingFrames = n
+		return nil
+	}
+}
+
 // SessionOutgoingWindow sets the maximum number of unacknowledged
 // transfer frames the client can send.
 func SessionOutgoingWindow(window uint32) SessionOption {
@@ -182,6 +388,23 @@ func SessionOutgoingWindow(window uint32) SessionOption {
 	}
 }
 
+// SessionDefaultLinkCredit sets the link credit used by Receivers
+// created on the session that don't set LinkCredit.
+//
+// Other credit options, such as LinkInitialCredit, apply to the
+// inherited credit as they would to one set with LinkCredit.
+//
+// Default: DefaultLinkCredit.
+func SessionDefaultLinkCredit(credit uint32) SessionOption {
+	return func(s *Session) error {
+		if credit == 0 {
+			return errorNew("default link credit cannot be zero")
+		}
+		s.linkCredit = credit
+		return nil
+	}
+}
+
 // SessionMaxLinks sets the maximum number of links (Senders/Receivers)
 // allowed on the session.
 //
@@ -237,11 +460,112 @@ func (e *DetachError) Error() string {
 	return fmt.Sprintf("link detached, reason: %+v", e.RemoteError)
 }
 
+// ConnectionError is returned by a Client, and propagated to its Sessions
+// and links, when the server closes the connection with an error.
+type ConnectionError struct {
+	RemoteError *Error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("connection closed by server, reason: %+v", e.RemoteError)
+}
+
+// Unwrap returns the RemoteError, if any.
+func (e *ConnectionError) Unwrap() error {
+	if e.RemoteError == nil {
+		return nil
+	}
+	return e.RemoteError
+}
+
+// SessionError is returned by a Session, and propagated to its links,
+// when the server ends the session.
+//
+// RemoteError will be nil if the session was ended without an error.
+type SessionError struct {
+	RemoteError *Error
+}
+
+func (e *SessionError) Error() string {
+	return fmt.Sprintf("session ended by server, reason: %+v", e.RemoteError)
+}
+
+// Unwrap returns the RemoteError, if any.
+func (e *SessionError) Unwrap() error {
+	if e.RemoteError == nil {
+		return nil
+	}
+	return e.RemoteError
+}
+
+// OutcomeError is returned by Sender.Send with LinkSenderRequireAccepted
+// when the peer settles the message with an outcome other than accepted.
+type OutcomeError struct {
+	// Outcome the message was settled with, such as OutcomeReleased.
+	Outcome Outcome
+
+	// Fields of a modified outcome.
+	DeliveryFailed     bool
+	UndeliverableHere  bool
+	MessageAnnotations Annotations
+}
+
+func (e *OutcomeError) Error() string {
+	return fmt.Sprintf("message settled with outcome %s, want %s", e.Outcome, OutcomeAccepted)
+}
+
+// IsRetryable reports whether err was caused by a condition the peer
+// expects to be transient, so the operation may succeed if retried,
+// possibly on a new connection or link:
+//
+//   - ErrorConnectionForced, e.g. when a broker closes connections
+//     for planned maintenance
+//   - ErrorConnectionRedirect and ErrorLinkRedirect, see (*Error).Redirect
+//   - ErrorResourceLimitExceeded and ErrorTransferLimitExceeded
+//
+// The *Error is found through ConnectionError, SessionError and
+// DetachError as well as wrapped errors.
+func IsRetryable(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *Error:
+			if e == nil {
+				return false
+			}
+			switch e.Condition {
+			case ErrorConnectionForced,
+				ErrorConnectionRedirect,
+				ErrorLinkRedirect,
+				ErrorResourceLimitExceeded,
+				ErrorTransferLimitExceeded:
+				return true
+			default:
+				return false
+			}
+		case *ConnectionError:
+			return e.RemoteError != nil && IsRetryable(e.RemoteError)
+		case *SessionError:
+			return e.RemoteError != nil && IsRetryable(e.RemoteError)
+		case *DetachError:
+			return e.RemoteError != nil && IsRetryable(e.RemoteError)
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
 // Default link options
 const (
 	DefaultLinkCredit      = 1
 	DefaultLinkBatching    = false
 	DefaultLinkBatchMaxAge = 5 * time.Second
+
+	DefaultLinkDetachOnDispositionError = true
 )
 
 // linkKey uniquely identifies a link on a connection by name and direction.
@@ -321,6 +645,20 @@ func LinkName(name string) LinkOption {
 	}
 }
 
+// LinkHandle requests a specific handle for the link instead of the
+// lowest free handle in the session.
+//
+// Attaching fails if the handle is already in use or exceeds the
+// session's handle max.
+//
+// Default: the lowest unused handle.
+func LinkHandle(handle uint32) LinkOption {
+	return func(l *link) error {
+		l.wantHandle = &handle
+		return nil
+	}
+}
+
 // LinkSourceCapabilities sets the source capabilities.
 func LinkSourceCapabilities(capabilities ...string) LinkOption {
 	return func(l *link) error {
@@ -361,6 +699,26 @@ func LinkTargetAddress(addr string) LinkOption {
 	}
 }
 
+// LinkAnonymousTarget attaches a sender to the peer's anonymous relay,
+// using a target with a null address. Each message is routed by the peer
+// to the address in its To property, which must be set.
+//
+// The peer should offer the ANONYMOUS-RELAY capability, which can be
+// requested with ConnDesiredCapabilities and checked with
+// Client.OfferedCapabilities.
+//
+// This option is not valid for a Receiver, nor with LinkTargetAddress
+// or LinkAddressDynamic.
+func LinkAnonymousTarget() LinkOption {
+	return func(l *link) error {
+		if l.receiver != nil {
+			return errorNew("LinkAnonymousTarget is not valid for Receiver")
+		}
+		l.anonymous = true
+		return nil
+	}
+}
+
 // LinkAddressDynamic requests a dynamically created address from the server.
 func LinkAddressDynamic() LinkOption {
 	return func(l *link) error {
@@ -369,6 +727,53 @@ func LinkAddressDynamic() LinkOption {
 	}
 }
 
+// LinkDynamicNodeProperty sets an entry in the dynamic-node-properties map
+// requested for a dynamically created node.
+//
+// For a Receiver this configures the source, for a Sender the target.
+// It has no effect unless used with LinkAddressDynamic.
+//
+// This option can be used multiple times.
+func LinkDynamicNodeProperty(key string, value interface{}) LinkOption {
+	return func(l *link) error {
+		var props *map[symbol]interface{}
+		if l.receiver != nil {
+			if l.source == nil {
+				l.source = new(source)
+			}
+			props = &l.source.DynamicNodeProperties
+		} else {
+			if l.target == nil {
+				l.target = new(target)
+			}
+			props = &l.target.DynamicNodeProperties
+		}
+
+		if *props == nil {
+			*props = make(map[symbol]interface{})
+		}
+		(*props)[symbol(key)] = value
+		return nil
+	}
+}
+
+// LinkDynamicNodeLifetimePolicy sets the lifetime-policy requested for
+// a dynamically created node.
+//
+// For example, LifetimeDeleteOnClose can be used to create a temporary
+// reply queue that is deleted when the link is closed.
+//
+// It has no effect unless used with LinkAddressDynamic.
+func LinkDynamicNodeLifetimePolicy(p LifetimePolicy) LinkOption {
+	return func(l *link) error {
+		err := p.validate()
+		if err != nil {
+			return err
+		}
+		return LinkDynamicNodeProperty("lifetime-policy", p)(l)
+	}
+}
+
 // LinkCredit specifies the maximum number of unacknowledged messages
 // the sender can transmit.
 func LinkCredit(credit uint32) LinkOption {
@@ -382,6 +787,107 @@ func LinkCredit(credit uint32) LinkOption {
 	}
 }
 
+// LinkInitialCredit controls the credit issued to the sender.
+//
+// If credit is positive, it is issued when the link is attached and
+// replenished as messages are received, limiting the number of messages
+// prefetched. It must not exceed the value set by LinkCredit, which sets
+// the number of messages that can be buffered.
+//
+// If credit is zero, no credit is issued until a call to Receive,
+// ReceiveBatch, or HandleMessage is waiting for a message, and then only
+// enough for the waiting callers.
+//
+// If credit is negative, credit must be issued manually by calling
+// Receiver.IssueCredit.
+//
+// This option is not valid for a Sender.
+//
+// Default: the value set by LinkCredit.
+func LinkInitialCredit(credit int32) LinkOption {
+	return func(l *link) error {
+		if l.receiver == nil {
+			return errorNew("LinkInitialCredit is not valid for Sender")
+		}
+
+		switch {
+		case credit < 0:
+			l.receiver.creditMode = creditManual
+		case credit == 0:
+			l.receiver.creditMode = creditOnDemand
+		default:
+			l.receiver.creditMode = creditAuto
+			l.receiver.creditWindow = uint32(credit)
+		}
+		return nil
+	}
+}
+
+// LinkPrefetchBytes limits the total size of the messages prefetched by
+// a Receiver, for links whose messages vary widely in size.
+//
+// The credit issued is adjusted to the average size of the messages
+// received so far so that the messages buffered, or awaiting settlement
+// in ModeSecond, and those the sender may send stay within about n bytes.
+// Credit is issued one message at a time until the first is received.
+// It never exceeds the credit set by LinkInitialCredit or LinkCredit.
+//
+// This option requires automatic credit (see LinkInitialCredit) and can't
+// be used with LinkCreditOnSettle. It is not valid for a Sender.
+//
+// Default: 0, no limit.
+func LinkPrefetchBytes(n uint64) LinkOption {
+	return func(l *link) error {
+		if l.receiver == nil {
+			return errorNew("LinkPrefetchBytes is not valid for Sender")
+		}
+		l.receiver.prefetchBytes = n
+		return nil
+	}
+}
+
+// LinkCreditOnSettle ties credit renewal to message settlement.
+//
+// By default, a Receiver replenishes credit as messages are returned
+// from Receive. When enabled, one credit is reissued each time a
+// message's disposition has been settled by the sender instead, so
+// deliveries awaiting settlement continue to hold their credit.
+//
+// This option requires ModeSecond and automatic credit (see
+// LinkInitialCredit). It is not valid for a Sender.
+//
+// Default: false.
+func LinkCreditOnSettle(enable bool) LinkOption {
+	return func(l *link) error {
+		if l.receiver == nil {
+			return errorNew("LinkCreditOnSettle is not valid for Sender")
+		}
+		l.receiver.creditOnSettle = enable
+		return nil
+	}
+}
+
+// LinkAutoAccept accepts each message before it's returned by
+// Receiver.Receive, ReceiveBatch, Prefetch or DrainAll, for consumers
+// that don't need to settle messages individually. Dispositions made on
+// an accepted message are ignored.
+//
+// Messages are delivered at most once: one that fails to be processed
+// after it's returned is not redelivered.
+//
+// This option requires ModeFirst. It is not valid for a Sender.
+//
+// Default: false.
+func LinkAutoAccept(enable bool) LinkOption {
+	return func(l *link) error {
+		if l.receiver == nil {
+			return errorNew("LinkAutoAccept is not valid for Sender")
+		}
+		l.receiver.autoAccept = enable
+		return nil
+	}
+}
+
 // LinkBatching toggles batching of message disposition.
 //
 // When enabled, accepting a message does not send the disposition
@@ -419,6 +925,63 @@ func LinkSenderSettle(mode SenderSettleMode) LinkOption {
 	}
 }
 
+// LinkSenderDefaultSettled sets whether messages are sent settled when
+// ModeMixed is negotiated and the message's SendSettled is nil.
+//
+// This option is not valid for a Receiver.
+//
+// Default: false.
+func LinkSenderDefaultSettled(settled bool) LinkOption {
+	return func(l *link) error {
+		if l.receiver != nil {
+			return errorNew("LinkSenderDefaultSettled is not valid for Receiver")
+		}
+		l.defaultSendSettled = settled
+		return nil
+	}
+}
+
+// LinkSenderRequireAccepted sets whether Send fails unless the peer
+// accepts the message.
+//
+// A rejected message always fails the send with the rejection's *Error.
+// When enabled, a message released or modified by the peer fails it with
+// an *OutcomeError rather than succeeding. Messages sent settled have no
+// outcome and aren't affected.
+//
+// This option is not valid for a Receiver.
+//
+// Default: false.
+func LinkSenderRequireAccepted(require bool) LinkOption {
+	return func(l *link) error {
+		if l.receiver != nil {
+			return errorNew("LinkSenderRequireAccepted is not valid for Receiver")
+		}
+		l.requireAccepted = require
+		return nil
+	}
+}
+
+// LinkInitialDeliveryCount sets the initial-delivery-count sent in the
+// attach and used as the starting delivery-count of the link.
+//
+// This is useful when resuming a link whose delivery-count the peer
+// already knows. A Receiver always takes the delivery-count from the
+// sender's attach.
+//
+// This option is not valid for a Receiver.
+//
+// Default: 0.
+func LinkInitialDeliveryCount(count uint32) LinkOption {
+	return func(l *link) error {
+		if l.receiver != nil {
+			return errorNew("LinkInitialDeliveryCount is not valid for Receiver")
+		}
+		l.deliveryCount = count
+		return nil
+	}
+}
+
 // LinkReceiverSettle sets the requested receiver settlement mode.
 //
 // If a settlement mode is explicitly set and the server does not
@@ -441,6 +1004,27 @@ func LinkSelectorFilter(filter string) LinkOption {
 	return LinkSourceFilter("apache.org:selector-filter:string", 0x0000468C00000004, filter)
 }
 
+// session filter used by Azure Service Bus
+const (
+	sessionFilterName = "com.microsoft:session-filter"
+	sessionFilterCode = 0x00000137000000C
+)
+
+// LinkSessionFilter sets a session filter on the source, used by
+// Azure Service Bus to receive the messages of a single message session.
+//
+// If sessionID is nil, the server assigns the next available session.
+// The session accepted by the server can be retrieved with
+// Receiver.SessionID once the link is attached.
+func LinkSessionFilter(sessionID *string) LinkOption {
+	// <descriptor name="com.microsoft:session-filter" code="0x00000137:0x000000C"/>
+	var value interface{}
+	if sessionID != nil {
+		value = *sessionID
+	}
+	return LinkSourceFilter(sessionFilterName, sessionFilterCode, value)
+}
+
 // LinkSourceFilter is an advanced API for setting non-standard source filters.
 // Please file an issue or open a PR if a standard filter is missing from this
 // library.
@@ -454,6 +1038,9 @@ func LinkSelectorFilter(filter string) LinkOption {
 // The value is the value of the descriped types. Acceptable types for value are specific
 // to the filter.
 //
+// Filters are usually set by a Receiver, but are also sent in the source of a
+// Sender's attach for brokers that expect them there.
+//
 // Example:
 //
 // The standard selector-filter is defined as:
@@ -471,7 +1058,7 @@ func LinkSourceFilter(name string, code uint64, value interface{}) LinkOption {
 			l.source = new(source)
 		}
 		if l.source.Filter == nil {
-			l.source.Filter = make(map[symbol]*describedType)
+			l.source.Filter = make(map[symbol]*DescribedType)
 		}
 
 		var descriptor interface{}
@@ -481,10 +1068,131 @@ func LinkSourceFilter(name string, code uint64, value interface{}) LinkOption {
 			descriptor = symbol(name)
 		}
 
-		l.source.Filter[symbol(name)] = &describedType{
-			descriptor: descriptor,
-			value:      value,
+		l.source.Filter[symbol(name)] = &DescribedType{
+			Descriptor: descriptor,
+			Value:      value,
+		}
+		return nil
+	}
+}
+
+// LinkDetachOnDispositionError controls whether a Sender detaches the link
+// when the peer rejects a message.
+//
+// When the receiver settle mode is ModeFirst the peer settles rejected
+// messages without waiting on the sender. Send still returns the rejection
+// error, but by default the link is also detached with that error. Setting
+// this to false keeps the link attached so that subsequent sends may proceed,
+// which is useful when the peer rejects messages for transient reasons.
+//
+// Messages rejected with ErrorTransferLimitExceeded, as when the peer is
+// throttling the sender, never detach the link. Send returns the rejection,
+// an *Error with that condition matching ErrThrottled, and the message may
+// be sent again later, see LinkSenderRetryPolicy.
+//
+// When the receiver settle mode is ModeSecond rejections are always returned
+// from Send without detaching the link, regardless of this setting.
+//
+// This option is not valid for a Receiver.
+//
+// Default: true.
+func LinkDetachOnDispositionError(detach bool) LinkOption {
+	return func(l *link) error {
+		if l.receiver != nil {
+			return errorNew("LinkDetachOnDispositionError is not valid for Receiver")
+		}
+		l.detachOnDispositionError = detach
+		return nil
+	}
+}
+
+// RetryPolicy controls how Sender.Send retries a message the peer
+// rejected with a transient error condition, such as
+// ErrorResourceLimitExceeded or ErrorTransferLimitExceeded.
+type RetryPolicy struct {
+	// The maximum number of attempts to send a message, including
+	// the first. Values below 2 disable retries.
+	MaxAttempts int
+
+	// The delay before the first retry, doubled for each subsequent
+	// retry. Zero retries immediately.
+	Backoff time.Duration
+
+	// The maximum delay between retries. Zero means no maximum.
+	MaxBackoff time.Duration
+}
+
+// LinkSenderRetryPolicy sets the policy used by Send to retry messages
+// rejected by the peer with a transient error condition.
+//
+// Each attempt sends the message with the same delivery tag, generating
+// one if the message doesn't have one, so the peer can identify retries.
+// Only rejected deliveries are retried; a delivery whose outcome is
+// unknown, due to ctx completing or the link detaching, is never resent.
+// Sender-settled messages are never rejected and so aren't retried.
+//
+// Default: no retries.
+func LinkSenderRetryPolicy(p RetryPolicy) LinkOption {
+	return func(l *link) error {
+		if l.receiver != nil {
+			return errorNew("LinkSenderRetryPolicy is not valid for Receiver")
+		}
+		if p.MaxAttempts < 0 || p.Backoff < 0 || p.MaxBackoff < 0 {
+			return errorErrorf("invalid RetryPolicy %+v", p)
 		}
+		l.retryPolicy = p
+		return nil
+	}
+}
+
+// LinkOnDetach sets a function called once the link has detached,
+// whether by Close or by the peer, session or connection ending it.
+//
+// The function is called with the error that ended the link, as returned
+// by the Sender's or Receiver's Err method. It's called from the link's
+// goroutine after the Closed channel has been closed, and must not block.
+func LinkOnDetach(fn func(err error)) LinkOption {
+	return func(l *link) error {
+		l.onDetach = fn
+		return nil
+	}
+}
+
+// LinkFlow is the link state carried by a flow frame received
+// from the peer.
+type LinkFlow struct {
+	DeliveryCount *uint32 // nil if the peer hasn't processed the attach
+	LinkCredit    *uint32
+	Available     *uint32
+	Drain         bool
+}
+
+// LinkFlowEcho sets a function called when the peer sends a flow frame
+// for the link requesting an echo of the link's flow state.
+//
+// By default the link answers such requests automatically. When set,
+// the link only answers if fn returns true. fn is called from the
+// link's goroutine and must not block.
+func LinkFlowEcho(fn func(LinkFlow) bool) LinkOption {
+	return func(l *link) error {
+		l.onFlowEcho = fn
+		return nil
+	}
+}
+
+// LinkOnUnexpectedFrame sets a function called when the link receives
+// a frame it can't process, such as a transfer received by a Sender.
+// kind is the performative of the received frame.
+//
+// If fn returns nil the frame is ignored. Otherwise the link is detached
+// with ErrorNotAllowed, using the error as the description.
+//
+// By default a Sender receiving a transfer is detached and other
+// unexpected frames are ignored. fn is called from the link's goroutine
+// and must not block.
+func LinkOnUnexpectedFrame(fn func(kind FrameKind) error) LinkOption {
+	return func(l *link) error {
+		l.onUnexpectedFrame = fn
 		return nil
 	}
 }
@@ -571,6 +1279,34 @@ func LinkSourceDurability(d Durability) LinkOption {
 	}
 }
 
+// LinkSourceDistributionMode requests the distribution mode of the
+// source, DistributionModeMove to take messages from the node as with
+// a queue, or DistributionModeCopy to leave them available to other
+// links as with a topic subscription.
+//
+// The distribution mode in effect, if any, can be checked with
+// Receiver.Source once the link is attached.
+//
+// This option is not valid for a Sender.
+func LinkSourceDistributionMode(m DistributionMode) LinkOption {
+	return func(l *link) error {
+		if l.receiver == nil {
+			return errorNew("LinkSourceDistributionMode is not valid for Sender")
+		}
+		err := m.validate()
+		if err != nil {
+			return err
+		}
+
+		if l.source == nil {
+			l.source = new(source)
+		}
+		l.source.DistributionMode = m
+
+		return nil
+	}
+}
+
 // LinkSourceExpiryPolicy sets the link expiration policy.
 //
 // Default: ExpirySessionEnd.
@@ -604,6 +1340,151 @@ func LinkSourceTimeout(timeout uint32) LinkOption {
 	}
 }
 
+// LinkSourceOutcomes sets the outcomes that may be used to settle
+// messages on the link.
+//
+// If not set, the peer assumes only OutcomeAccepted is supported.
+//
+// This option can be used multiple times.
+func LinkSourceOutcomes(outcomes ...Outcome) LinkOption {
+	return func(l *link) error {
+		for _, o := range outcomes {
+			err := o.validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		if l.source == nil {
+			l.source = new(source)
+		}
+		for _, o := range outcomes {
+			l.source.Outcomes = append(l.source.Outcomes, symbol(o))
+		}
+
+		return nil
+	}
+}
+
+// LinkSourceDefaultOutcome sets the outcome the peer should apply to
+// unsettled messages when the link is detached.
+//
+// To request a modified outcome with delivery-failed or undeliverable-here
+// set, use LinkSourceDefaultOutcomeModified.
+func LinkSourceDefaultOutcome(o Outcome) LinkOption {
+	return func(l *link) error {
+		err := o.validate()
+		if err != nil {
+			return err
+		}
+
+		if l.source == nil {
+			l.source = new(source)
+		}
+		l.source.DefaultOutcome = o.state()
+
+		return nil
+	}
+}
+
+// LinkSourceDefaultOutcomeModified sets the default outcome to modified
+// with the provided delivery-failed and undeliverable-here flags.
+func LinkSourceDefaultOutcomeModified(deliveryFailed, undeliverableHere bool) LinkOption {
+	return func(l *link) error {
+		if l.source == nil {
+			l.source = new(source)
+		}
+		l.source.DefaultOutcome = &stateModified{
+			DeliveryFailed:    deliveryFailed,
+			UndeliverableHere: undeliverableHere,
+		}
+
+		return nil
+	}
+}
+
+// UnsettledDelivery is a delivery that was not settled when its
+// link was detached.
+type UnsettledDelivery struct {
+	DeliveryTag []byte
+
+	// Outcome applied to the delivery locally before the link was
+	// detached. Empty if no outcome was applied.
+	Outcome Outcome
+}
+
+// LinkResumeUnsettled resumes deliveries that were unsettled when a
+// previous Receiver with the same link name was detached.
+//
+// The deliveries are sent to the peer on attach. Those the peer reports
+// as settled are discarded. Those the peer resends are settled with
+// their Outcome, if set, or are otherwise received again.
+//
+// Use with LinkName to attach to the same link, and with
+// LinkReceiverSettle(ModeSecond) so deliveries remain unsettled until
+// the peer confirms the outcome.
+//
+// This option is not valid for a Sender.
+func LinkResumeUnsettled(deliveries ...UnsettledDelivery) LinkOption {
+	return func(l *link) error {
+		if l.receiver == nil {
+			return errorNew("LinkResumeUnsettled is not valid for Sender")
+		}
+		for _, d := range deliveries {
+			var state deliveryState
+			if d.Outcome != "" {
+				err := d.Outcome.validate()
+				if err != nil {
+					return err
+				}
+				state = d.Outcome.state()
+			}
+			if l.resumeUnsettled == nil {
+				l.resumeUnsettled = make(unsettled)
+			}
+			l.resumeUnsettled[string(d.DeliveryTag)] = state
+		}
+		return nil
+	}
+}
+
+// SettlementStore is notified as deliveries on a link become unsettled
+// and are settled, allowing an application to persist the unsettled
+// deliveries and resume them with LinkResumeUnsettled after a restart.
+//
+// The methods are called synchronously by the goroutines sending and
+// receiving on the link, including the link's own, and hold up the
+// link until they return. They may be called concurrently, including
+// for different links sharing the store, and must be safe for
+// concurrent use. For a given delivery, Unsettled is always called
+// before Settled.
+//
+// Deliveries still unsettled when the link is detached or closed are
+// not reported as settled.
+type SettlementStore interface {
+	// Unsettled is called when a delivery becomes unsettled, and again
+	// with d.Outcome set when a Receiver applies an outcome to it that
+	// the peer has yet to settle.
+	Unsettled(linkName string, d UnsettledDelivery)
+
+	// Settled is called once a delivery is settled and no longer
+	// needs to be resumed.
+	Settled(linkName string, deliveryTag []byte)
+}
+
+// LinkSettlementStore sets the store notified of the link's unsettled
+// deliveries.
+//
+// Only deliveries sent or received unsettled are recorded. Those
+// resumed with LinkResumeUnsettled are reported as settled once
+// the peer settles them.
+func LinkSettlementStore(store SettlementStore) LinkOption {
+	return func(l *link) error {
+		l.settlementStore = store
+		return nil
+	}
+}
+
 const maxTransferFrameHeader = 66 // determined by calcMaxTransferFrameHeader
 
 func calcMaxTransferFrameHeader() int {
@@ -1,11 +1,27 @@
 package amqp
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLinkOptions(t *testing.T) {
+	sessionID := "session-1"
+
 	tests := []struct {
 		label string
 		opts  []LinkOption
@@ -29,14 +45,14 @@ func TestLinkOptions(t *testing.T) {
 			},
 
 			wantSource: &source{
-				Filter: map[symbol]*describedType{
+				Filter: map[symbol]*DescribedType{
 					"apache.org:selector-filter:string": {
-						descriptor: binary.BigEndian.Uint64([]byte{0x00, 0x00, 0x46, 0x8C, 0x00, 0x00, 0x00, 0x04}),
-						value:      "amqp.annotation.x-opt-offset > '100'",
+						Descriptor: binary.BigEndian.Uint64([]byte{0x00, 0x00, 0x46, 0x8C, 0x00, 0x00, 0x00, 0x04}),
+						Value:      "amqp.annotation.x-opt-offset > '100'",
 					},
 					"com.microsoft:session-filter": {
-						descriptor: binary.BigEndian.Uint64([]byte{0x00, 0x00, 0x00, 0x13, 0x70, 0x00, 0x00, 0x0C}),
-						value:      "123",
+						Descriptor: binary.BigEndian.Uint64([]byte{0x00, 0x00, 0x00, 0x13, 0x70, 0x00, 0x00, 0x0C}),
+						Value:      "123",
 					},
 				},
 			},
@@ -54,10 +70,40 @@ func TestLinkOptions(t *testing.T) {
 			},
 
 			wantSource: &source{
-				Filter: map[symbol]*describedType{
+				Filter: map[symbol]*DescribedType{
+					"com.microsoft:session-filter": {
+						Descriptor: binary.BigEndian.Uint64([]byte{0x00, 0x00, 0x00, 0x13, 0x70, 0x00, 0x00, 0x0C}),
+						Value:      nil,
+					},
+				},
+			},
+		},
+		{
+			label: "session-filter",
+			opts: []LinkOption{
+				LinkSessionFilter(&sessionID),
+			},
+
+			wantSource: &source{
+				Filter: map[symbol]*DescribedType{
+					"com.microsoft:session-filter": {
+						Descriptor: binary.BigEndian.Uint64([]byte{0x00, 0x00, 0x00, 0x13, 0x70, 0x00, 0x00, 0x0C}),
+						Value:      "session-1",
+					},
+				},
+			},
+		},
+		{
+			label: "session-filter-next-available",
+			opts: []LinkOption{
+				LinkSessionFilter(nil),
+			},
+
+			wantSource: &source{
+				Filter: map[symbol]*DescribedType{
 					"com.microsoft:session-filter": {
-						descriptor: binary.BigEndian.Uint64([]byte{0x00, 0x00, 0x00, 0x13, 0x70, 0x00, 0x00, 0x0C}),
-						value:      nil,
+						Descriptor: binary.BigEndian.Uint64([]byte{0x00, 0x00, 0x00, 0x13, 0x70, 0x00, 0x00, 0x0C}),
+						Value:      nil,
 					},
 				},
 			},
@@ -71,6 +117,18 @@ func TestLinkOptions(t *testing.T) {
 				Capabilities: []symbol{"cap1", "cap2", "cap3"},
 			},
 		},
+		{
+			label: "link-source-outcomes",
+			opts: []LinkOption{
+				LinkSourceOutcomes(OutcomeAccepted, OutcomeRejected),
+				LinkSourceOutcomes(OutcomeModified),
+				LinkSourceDefaultOutcomeModified(true, true),
+			},
+			wantSource: &source{
+				DefaultOutcome: &stateModified{DeliveryFailed: true, UndeliverableHere: true},
+				Outcomes:       []symbol{"amqp:accepted:list", "amqp:rejected:list", "amqp:modified:list"},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -106,3 +164,467 @@ func TestSourceName(t *testing.T) {
 		t.Errorf("Link Source Name does not match expected: %v got: %v", expectedSourceName, got.key.name)
 	}
 }
+
+// listenPeer starts a listener that writes resp to each accepted
+// connection and then discards anything sent by the client.
+func listenPeer(t *testing.T, resp []byte) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Write(resp); err != nil {
+					return
+				}
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestDialTLSConfig(t *testing.T) {
+	tests := []struct {
+		label     string
+		config    *tls.Config
+		opts      []ConnOption
+		wantSNI   string
+		wantProto []string
+	}{
+		{
+			label: "config ServerName",
+			config: &tls.Config{
+				ServerName: "broker.example.com",
+				NextProtos: []string{"amqp"},
+			},
+			opts:      []ConnOption{ConnServerHostname("other.example.com")},
+			wantSNI:   "broker.example.com",
+			wantProto: []string{"amqp"},
+		},
+		{
+			label:   "hostname",
+			config:  &tls.Config{},
+			opts:    []ConnOption{ConnServerHostname("host.example.com")},
+			wantSNI: "host.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			// record the ClientHello and abort the handshake
+			hellos := make(chan *tls.ClientHelloInfo, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_ = tls.Server(conn, &tls.Config{
+					GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+						hellos <- hello
+						return nil, errors.New("handshake aborted")
+					},
+				}).Handshake()
+			}()
+
+			wantServerName := tt.config.ServerName
+			opts := append([]ConnOption{ConnTLSConfig(tt.config)}, tt.opts...)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err = dial(ctx, "amqps://"+l.Addr().String(), opts); err == nil {
+				t.Fatal("expected error from aborted handshake")
+			}
+
+			var hello *tls.ClientHelloInfo
+			select {
+			case hello = <-hellos:
+			case <-ctx.Done():
+				t.Fatal("no ClientHello received")
+			}
+			if hello.ServerName != tt.wantSNI {
+				t.Errorf("SNI = %q, want %q", hello.ServerName, tt.wantSNI)
+			}
+			if !testEqual(hello.SupportedProtos, tt.wantProto) {
+				t.Errorf("ALPN = %v, want %v", hello.SupportedProtos, tt.wantProto)
+			}
+			if tt.config.ServerName != wantServerName {
+				t.Errorf("config ServerName modified to %q", tt.config.ServerName)
+			}
+		})
+	}
+}
+
+func TestDialTLSClientCertificateCallback(t *testing.T) {
+	const host = "broker.example.com"
+	serverCert, roots := selfSignedCert(t, host)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.(*tls.Conn).Handshake()
+	}()
+
+	// ServerName is left empty so the config is copied to set it,
+	// the copy must keep the callback
+	called := make(chan *tls.CertificateRequestInfo, 1)
+	config := &tls.Config{
+		RootCAs: roots,
+		GetClientCertificate: func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			called <- cri
+			return new(tls.Certificate), nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := dial(ctx, "amqps://"+l.Addr().String(), []ConnOption{
+		ConnServerHostname(host),
+		ConnTLSConfig(config),
+		ConnConnectTimeout(time.Second),
+	})
+	if err == nil {
+		client.Close()
+	}
+
+	select {
+	case <-called:
+	default:
+		t.Fatalf("GetClientCertificate wasn't called, dial error: %v", err)
+	}
+}
+
+func TestDialTLSHandshakeCanceled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// read the start of the ClientHello but never answer it
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			conn.Close()
+			return
+		}
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := dial(ctx, "amqps://"+l.Addr().String(), []ConnOption{
+			ConnTLSConfig(&tls.Config{InsecureSkipVerify: true}),
+		})
+		errs <- err
+	}()
+
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ClientHello")
+	}
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Errorf("dial() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial() didn't return after ctx was canceled")
+	}
+}
+
+// selfSignedCert returns a certificate for host and a pool trusting it.
+func selfSignedCert(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func TestDialFailover(t *testing.T) {
+	// the first endpoint rejects the open
+	rejectResp, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body: &performClose{
+				Error: &Error{Condition: ErrorResourceLimitExceeded},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openResp, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performOpen{ContainerID: "second"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := listenPeer(t, rejectResp)
+	defer first.Close()
+	second := listenPeer(t, openResp)
+	defer second.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := DialFailover(ctx, []string{
+		"amqp://" + first.Addr().String(),
+		"amqp://" + second.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if got, want := client.conn.net.RemoteAddr().String(), second.Addr().String(); got != want {
+		t.Errorf("connected to %s, want %s", got, want)
+	}
+}
+
+func TestDialFailoverAllFail(t *testing.T) {
+	// both endpoints respond with an unsupported protocol version
+	first := listenPeer(t, []byte("AMQP\x00\x02\x00\x00"))
+	defer first.Close()
+	second := listenPeer(t, []byte("AMQP\x00\x02\x00\x00"))
+	defer second.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs := []string{
+		"amqp://" + first.Addr().String(),
+		"amqp://" + second.Addr().String(),
+	}
+	_, err := DialFailover(ctx, addrs)
+	if err == nil {
+		t.Fatal("expected error when all endpoints fail")
+	}
+	for _, addr := range addrs {
+		if !strings.Contains(err.Error(), addr) {
+			t.Errorf("error %q does not mention %s", err, addr)
+		}
+	}
+}
+
+func TestDialFailoverContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := DialFailover(ctx, []string{"amqp://127.0.0.1:1"})
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// readPeerFrame reads a frame sent by the client on the peer's end of conn.
+func readPeerFrame(conn net.Conn) (uint16, frameBody, error) {
+	hb := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(conn, hb); err != nil {
+		return 0, nil, err
+	}
+	header, err := parseFrameHeader(&buffer{b: hb})
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, header.Size-frameHeaderSize)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, nil, err
+	}
+	if len(body) == 0 {
+		return header.Channel, nil, nil // keepalive
+	}
+	fr, err := parseFrameBody(&buffer{b: body})
+	return header.Channel, fr, err
+}
+
+// writePeerFrame writes a frame from the peer's end of conn.
+func writePeerFrame(conn net.Conn, channel uint16, body frameBody) error {
+	buf := &buffer{}
+	err := writeFrame(buf, frame{type_: frameTypeAMQP, channel: channel, body: body})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf.bytes())
+	return err
+}
+
+func TestClientNewSessionInvalidSecondResponse(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+
+	// the peer answers the first begin, and the
+	// second for a channel the client didn't use
+	go func() {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(peerConn, header); err != nil {
+			return
+		}
+		if _, err := peerConn.Write([]byte("AMQP\x00\x01\x00\x00")); err != nil {
+			return
+		}
+		var begins uint16
+		for {
+			channel, fr, err := readPeerFrame(peerConn)
+			if err != nil {
+				return
+			}
+			switch fr.(type) {
+			case *performOpen:
+				err = writePeerFrame(peerConn, 0, &performOpen{ContainerID: "peer"})
+			case *performBegin:
+				remoteChannel := channel
+				if begins > 0 {
+					remoteChannel = 42
+				}
+				begins++
+				err = writePeerFrame(peerConn, begins-1, &performBegin{
+					RemoteChannel:  &remoteChannel,
+					IncomingWindow: DefaultWindow,
+					OutgoingWindow: DefaultWindow,
+					HandleMax:      DefaultMaxLinks - 1,
+				})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	client, err := New(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.NewSession()
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("expected error for begin response to unknown channel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewSession hung on begin response to unknown channel")
+	}
+}
+
+type wrappedError struct{ err error }
+
+func (e wrappedError) Error() string { return "wrapped: " + e.err.Error() }
+func (e wrappedError) Unwrap() error { return e.err }
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		condition ErrorCondition
+		want      bool
+	}{
+		{condition: ErrorConnectionForced, want: true},
+		{condition: ErrorConnectionRedirect, want: true},
+		{condition: ErrorLinkRedirect, want: true},
+		{condition: ErrorResourceLimitExceeded, want: true},
+		{condition: ErrorTransferLimitExceeded, want: true},
+		{condition: ErrorInternalError, want: false},
+		{condition: ErrorUnauthorizedAccess, want: false},
+		{condition: ErrorNotFound, want: false},
+		{condition: ErrorFramingError, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.condition), func(t *testing.T) {
+			remoteErr := &Error{Condition: tt.condition, Description: "test"}
+			for _, err := range []error{
+				remoteErr,
+				&ConnectionError{RemoteError: remoteErr},
+				&SessionError{RemoteError: remoteErr},
+				&DetachError{RemoteError: remoteErr},
+				wrappedError{&ConnectionError{RemoteError: remoteErr}},
+			} {
+				if got := IsRetryable(err); got != tt.want {
+					t.Errorf("IsRetryable(%v) = %t, want %t", err, got, tt.want)
+				}
+			}
+		})
+	}
+
+	for _, err := range []error{
+		nil,
+		ErrConnClosed,
+		ErrTimeout,
+		(*Error)(nil),
+		&ConnectionError{},
+		&SessionError{},
+		&DetachError{},
+	} {
+		if IsRetryable(err) {
+			t.Errorf("IsRetryable(%v) = true, want false", err)
+		}
+	}
+}
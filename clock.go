@@ -0,0 +1,56 @@
+package amqp
+
+import "time"
+
+// clock abstracts the timers used by conn, session and link so that
+// timer dependent behavior can be tested deterministically.
+//
+// Socket deadlines are wall-clock times and are set with time.Now.
+type clock interface {
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) timer
+	NewTicker(d time.Duration) ticker
+}
+
+// timer is the subset of *time.Timer used by the package.
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// ticker is the subset of *time.Ticker used by the package.
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock implements clock using the time package.
+type realClock struct{}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
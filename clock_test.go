@@ -0,0 +1,279 @@
+package amqp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only advances when Advance is called.
+type fakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	return c.add(d, 0)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{
+		clock:  c,
+		ch:     make(chan time.Time, 1),
+		when:   c.now.Add(d),
+		period: period,
+	}
+	c.waiters = append(c.waiters, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by d, firing any timers
+// and tickers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+
+	waiters := c.waiters[:0]
+	for _, t := range c.waiters {
+		if t.when.After(c.now) {
+			waiters = append(waiters, t)
+			continue
+		}
+
+		// like time.Ticker, drop ticks for slow receivers
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+
+		if t.period > 0 {
+			for !t.when.After(c.now) {
+				t.when = t.when.Add(t.period)
+			}
+			waiters = append(waiters, t)
+		}
+	}
+	c.waiters = waiters
+}
+
+// BlockUntil waits until at least n timers or tickers are pending.
+func (c *fakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+func (c *fakeClock) remove(t *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, w := range c.waiters {
+		if w == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	ch     chan time.Time
+	when   time.Time
+	period time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	active := t.clock.remove(t)
+	t.clock.mu.Lock()
+	t.when = t.clock.now.Add(d)
+	t.clock.waiters = append(t.clock.waiters, t)
+	t.clock.cond.Broadcast()
+	t.clock.mu.Unlock()
+	return active
+}
+
+type fakeTicker struct {
+	t *fakeTimer
+}
+
+func (t fakeTicker) C() <-chan time.Time { return t.t.C() }
+func (t fakeTicker) Stop()               { t.t.Stop() }
+
+// writeConn is a net.Conn that sends each write on a channel.
+type writeConn struct {
+	net.Conn
+	writes chan []byte
+}
+
+func (c *writeConn) Write(b []byte) (int, error) {
+	c.writes <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestConnWriterKeepaliveFakeClock(t *testing.T) {
+	clk := newFakeClock()
+	netConn := &writeConn{writes: make(chan []byte, 10)}
+
+	c, err := newConn(netConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.clock = clk
+	c.peerIdleTimeout = time.Minute
+
+	go c.connWriter()
+	clk.BlockUntil(1)
+
+	// no keepalive before half the idle timeout has elapsed
+	clk.Advance(29 * time.Second)
+	select {
+	case b := <-netConn.writes:
+		t.Fatalf("unexpected write % x", b)
+	default:
+	}
+
+	for i := 0; i < 3; i++ {
+		if i == 0 {
+			clk.Advance(time.Second)
+		} else {
+			clk.Advance(30 * time.Second)
+		}
+		select {
+		case b := <-netConn.writes:
+			if !bytes.Equal(b, keepaliveFrame) {
+				t.Fatalf("write % x, want keepalive % x", b, keepaliveFrame)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("keepalive %d not sent", i)
+		}
+	}
+
+	close(c.done)
+	<-c.txDone
+}
+
+func TestConnWriterKeepaliveFraction(t *testing.T) {
+	tests := []struct {
+		label       string
+		opts        []ConnOption
+		idleTimeout time.Duration
+		interval    time.Duration
+	}{
+		{label: "quarter", opts: []ConnOption{ConnKeepaliveFraction(0.25)}, idleTimeout: time.Minute, interval: 15 * time.Second},
+		{label: "small idle timeout", idleTimeout: 10 * time.Millisecond, interval: minKeepaliveInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			clk := newFakeClock()
+			netConn := &writeConn{writes: make(chan []byte, 10)}
+
+			c, err := newConn(netConn, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.clock = clk
+			c.peerIdleTimeout = tt.idleTimeout
+
+			go c.connWriter()
+			clk.BlockUntil(1)
+
+			for i := 0; i < 3; i++ {
+				clk.Advance(tt.interval - time.Millisecond)
+				select {
+				case b := <-netConn.writes:
+					t.Fatalf("unexpected write % x before interval elapsed", b)
+				default:
+				}
+
+				clk.Advance(time.Millisecond)
+				select {
+				case b := <-netConn.writes:
+					if !bytes.Equal(b, keepaliveFrame) {
+						t.Fatalf("write % x, want keepalive % x", b, keepaliveFrame)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("keepalive %d not sent", i)
+				}
+			}
+
+			close(c.done)
+			<-c.txDone
+		})
+	}
+}
+
+func TestConnKeepaliveFractionInvalid(t *testing.T) {
+	for _, f := range []float64{0, -0.5, 1.5} {
+		_, err := newConn(nil, ConnKeepaliveFraction(f))
+		if err == nil {
+			t.Errorf("expected error for fraction %v", f)
+		}
+	}
+}
+
+func TestConnReadProtoHeaderTimeoutFakeClock(t *testing.T) {
+	clk := newFakeClock()
+
+	c, err := newConn(nil, ConnConnectTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.clock = clk
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.readProtoHeader()
+		errs <- err
+	}()
+	clk.BlockUntil(1)
+
+	clk.Advance(59 * time.Second)
+	select {
+	case err := <-errs:
+		t.Fatalf("readProtoHeader() returned early: %v", err)
+	default:
+	}
+
+	clk.Advance(time.Second)
+	select {
+	case err := <-errs:
+		if err != ErrTimeout {
+			t.Errorf("readProtoHeader() error = %v, want %v", err, ErrTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("readProtoHeader() did not time out")
+	}
+}
@@ -1,12 +1,16 @@
 package amqp
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"math"
 	"net"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -37,6 +41,10 @@ type ConnOption func(*conn) error
 // This is useful when the AMQP connection will be established
 // via a pre-established TLS connection as the server may not
 // know which hostname the client is attempting to connect to.
+//
+// It's also used to connect to a virtual host, or through a proxy,
+// where the server's logical name differs from the dialed address.
+// When dialing, it overrides the hostname taken from the URL.
 func ConnServerHostname(hostname string) ConnOption {
 	return func(c *conn) error {
 		c.hostname = hostname
@@ -59,7 +67,15 @@ func ConnTLS(enable bool) ConnOption {
 //
 // This option is for advanced usage, in most scenarios
 // providing a URL scheme of "amqps://" or ConnTLS(true)
-// is sufficient.
+// is sufficient. It allows setting client certificates
+// for mutual TLS, custom RootCAs, the ServerName used for
+// SNI and certificate verification, and ALPN protocols
+// (e.g. NextProtos: []string{"amqp"}). Callbacks such as
+// GetClientCertificate are used as provided.
+//
+// tc is not modified; if ServerName is empty and
+// InsecureSkipVerify is false, a copy with ServerName
+// set to the connection's hostname is used.
 func ConnTLSConfig(tc *tls.Config) ConnOption {
 	return func(c *conn) error {
 		c.tlsConfig = tc
@@ -85,6 +101,25 @@ func ConnIdleTimeout(d time.Duration) ConnOption {
 	}
 }
 
+// ConnKeepaliveFraction sets the interval between keepalive frames
+// as a fraction of the idle timeout advertised by the server.
+//
+// Empty frames are sent at this interval so the server doesn't close
+// the connection as idle. The fraction must be greater than zero and
+// no more than one, smaller values send keepalives more often. If the
+// server doesn't advertise an idle timeout, no keepalives are sent.
+//
+// Default: 0.5.
+func ConnKeepaliveFraction(f float64) ConnOption {
+	return func(c *conn) error {
+		if f <= 0 || f > 1 {
+			return errorErrorf("keepalive fraction %v must be in (0, 1]", f)
+		}
+		c.keepaliveFraction = f
+		return nil
+	}
+}
+
 // ConnMaxFrameSize sets the maximum frame size that
 // the connection will accept.
 //
@@ -101,6 +136,40 @@ func ConnMaxFrameSize(n uint32) ConnOption {
 	}
 }
 
+// ConnDefaultAttachTimeout configures how long NewSender and NewReceiver
+// wait for the server to respond to a link attach.
+//
+// If the server doesn't respond in time ErrTimeout is returned and the
+// link is detached. If duration is zero, no timeout will be applied.
+//
+// Default: 0.
+func ConnDefaultAttachTimeout(d time.Duration) ConnOption {
+	return func(c *conn) error {
+		if d < 0 {
+			return errorNew("attach timeout must not be negative")
+		}
+		c.attachTimeout = d
+		return nil
+	}
+}
+
+// ConnDefaultDetachTimeout configures how long Sender.Close and
+// Receiver.Close wait for the server to respond to a link detach
+// when the context passed to them has no deadline.
+//
+// If duration is zero, no timeout will be applied.
+//
+// Default: 0.
+func ConnDefaultDetachTimeout(d time.Duration) ConnOption {
+	return func(c *conn) error {
+		if d < 0 {
+			return errorNew("detach timeout must not be negative")
+		}
+		c.detachTimeout = d
+		return nil
+	}
+}
+
 // ConnConnectTimeout configures how long to wait for the
 // server during connection establishment.
 //
@@ -112,6 +181,25 @@ func ConnConnectTimeout(d time.Duration) ConnOption {
 	return func(c *conn) error { c.connectTimeout = d; return nil }
 }
 
+// ConnWriteBufferSize enables coalescing of outgoing frames.
+//
+// When n is positive, frames queued for sending while a write is in
+// progress are collected in a buffer of n bytes and written together,
+// reducing the number of writes under load. The buffer is flushed as
+// soon as no more frames are queued, so frames aren't delayed waiting
+// for others. A value of zero writes each frame individually.
+//
+// Default: 0.
+func ConnWriteBufferSize(n int) ConnOption {
+	return func(c *conn) error {
+		if n < 0 {
+			return errorNew("write buffer size cannot be negative")
+		}
+		c.writeBufferSize = n
+		return nil
+	}
+}
+
 // ConnMaxSessions sets the maximum number of channels.
 //
 // n must be in the range 1 to 65536.
@@ -130,8 +218,85 @@ func ConnMaxSessions(n int) ConnOption {
 	}
 }
 
+// Direction indicates whether a frame was received or sent.
+type Direction uint8
+
+// Frame directions
+const (
+	DirectionReceive Direction = iota
+	DirectionSend
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionReceive:
+		return "receive"
+	case DirectionSend:
+		return "send"
+	default:
+		return fmt.Sprintf("Direction(%d)", uint8(d))
+	}
+}
+
+// ConnFrameHook sets a function that is called with the raw bytes
+// of every frame received from or sent to the server, including
+// SASL frames and empty keepalive frames.
+//
+// The hook is called synchronously from the connection's reader and
+// writer goroutines and should return quickly. raw must not be modified
+// or retained after the hook returns; copy it if needed. A panic in
+// the hook is recovered and ignored.
+func ConnFrameHook(hook func(dir Direction, raw []byte)) ConnOption {
+	return func(c *conn) error {
+		c.frameHook = hook
+		return nil
+	}
+}
+
+// ConnFrameInterceptor sets a function that can rewrite or drop frames.
+//
+// WARNING: this is an advanced option intended for test harnesses and for
+// working around peer bugs. Rewriting frames can easily violate the AMQP
+// protocol and desynchronize the connection's state from the peer's.
+//
+// The interceptor is called with the raw bytes of each non-empty frame,
+// including the frame header. Outgoing frames are intercepted after they
+// are encoded and before they are written; incoming frames after they are
+// read and before they are decoded. The returned bytes, which must be a
+// complete frame, replace the original. Returning nil drops the frame.
+//
+// The interceptor is called synchronously from the connection's reader and
+// writer goroutines. raw must not be retained after the interceptor
+// returns. Frames observed by ConnFrameHook are those on the wire, that is
+// outgoing frames after interception and incoming frames before.
+func ConnFrameInterceptor(interceptor func(dir Direction, raw []byte) []byte) ConnOption {
+	return func(c *conn) error {
+		c.frameInterceptor = interceptor
+		return nil
+	}
+}
+
+// ConnLogger sets the logger used for the connection's debug output,
+// including that of its sessions and links, instead of the package logger.
+//
+// This makes it possible to send the output of different connections to
+// different destinations. Debug output is only produced when the package
+// is built with the debug build tag, otherwise the logger is unused.
+func ConnLogger(l *log.Logger) ConnOption {
+	return func(c *conn) error {
+		if l == nil {
+			return errorNew("logger must not be nil")
+		}
+		c.logger = l
+		return nil
+	}
+}
+
 // ConnProperty sets an entry in the connection properties map sent to the server.
 //
+// The "product" and "platform" properties are sent by default to identify
+// the client and may be overridden with this option.
+//
 // This option can be used multiple times.
 func ConnProperty(key, value string) ConnOption {
 	return func(c *conn) error {
@@ -146,16 +311,90 @@ func ConnProperty(key, value string) ConnOption {
 	}
 }
 
+// ConnProperties sets multiple entries in the connection properties map
+// sent to the server. Values must be of a type that can be encoded by
+// this package.
+//
+// This option can be used multiple times and combined with ConnProperty;
+// later values replace earlier ones with the same key.
+func ConnProperties(properties map[string]interface{}) ConnOption {
+	return func(c *conn) error {
+		for key, value := range properties {
+			if key == "" {
+				return errorNew("connection property key must not be empty")
+			}
+			if c.properties == nil {
+				c.properties = make(map[symbol]interface{})
+			}
+			c.properties[symbol(key)] = value
+		}
+		return nil
+	}
+}
+
 // ConnContainerID sets the container-id to use when opening the connection.
 //
 // A container ID will be randomly generated if this option is not used.
+//
+// id must not be empty.
 func ConnContainerID(id string) ConnOption {
 	return func(c *conn) error {
+		if id == "" {
+			return errorNew("container-id cannot be empty")
+		}
 		c.containerID = id
 		return nil
 	}
 }
 
+// ConnDesiredCapabilities adds capabilities the client desires
+// the server to support, such as "DELAYED_DELIVERY", sent in the
+// Open frame.
+//
+// The capabilities the server offers can be read with
+// Client.OfferedCapabilities once connected.
+func ConnDesiredCapabilities(capabilities ...string) ConnOption {
+	return func(c *conn) error {
+		for _, capability := range capabilities {
+			if err := validateSymbol(capability); err != nil {
+				return errorWrapf(err, "invalid capability")
+			}
+			c.desiredCapabilities = append(c.desiredCapabilities, symbol(capability))
+		}
+		return nil
+	}
+}
+
+// validateSymbol checks s is a valid AMQP symbol, a non-empty
+// string of ASCII characters.
+func validateSymbol(s string) error {
+	if s == "" {
+		return errorNew("symbol cannot be empty")
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] > 0x7f {
+			return errorErrorf("symbol %q contains non-ASCII characters", s)
+		}
+	}
+	return nil
+}
+
+// ConnSoleConnectionForContainer advertises the sole-connection-for-container
+// capability, requesting that the server allow only one connection at a time
+// for this client's container-id.
+//
+// Use with ConnContainerID so the container-id is stable across connections.
+func ConnSoleConnectionForContainer() ConnOption {
+	return func(c *conn) error {
+		c.desiredCapabilities = append(c.desiredCapabilities, capabilitySoleConnectionForContainer)
+		return nil
+	}
+}
+
+// capabilitySoleConnectionForContainer is the connection capability
+// indicating at most one connection per container-id is permitted.
+const capabilitySoleConnectionForContainer symbol = "sole-connection-for-container"
+
 // conn is an AMQP connection.
 type conn struct {
 	net            net.Conn      // underlying connection
@@ -168,6 +407,7 @@ type conn struct {
 
 	// SASL
 	saslHandlers map[symbol]stateFunc // map of supported handlers keyed by SASL mechanism, SASL not negotiated if nil
+	saslPrefer   []symbol             // mechanisms in order of preference, the server's order is used if nil
 	saslComplete bool                 // SASL negotiation complete
 
 	// local settings
@@ -178,10 +418,28 @@ type conn struct {
 	properties   map[symbol]interface{} // additional properties sent upon connection open
 	containerID  string                 // set explicitly or randomly generated
 
+	desiredCapabilities multiSymbol // capabilities requested upon connection open
+	keepaliveFraction   float64     // fraction of peerIdleTimeout between keepalives
+	writeBufferSize     int         // size of the buffer for coalescing frames, 0 disables
+
+	// default timeouts for link operations, 0 waits indefinitely
+	attachTimeout time.Duration
+	detachTimeout time.Duration
+
+	frameHook        func(Direction, []byte)        // observes raw frames, may be nil
+	frameInterceptor func(Direction, []byte) []byte // rewrites or drops raw frames, may be nil
+	logger           *log.Logger                    // debug logger, the package logger is used if nil
+
 	// peer settings
 	peerIdleTimeout  time.Duration // maximum period between sending frames
 	peerMaxFrameSize uint32        // maximum frame size peer will accept
 
+	peerContainerID         string      // container-id sent by the peer upon connection open
+	peerOfferedCapabilities multiSymbol // capabilities offered by the peer upon connection open
+
+	// time source for deadlines, keepalives and timeouts; replaced in tests
+	clock clock
+
 	// conn state
 	errMu sync.Mutex    // mux holds errMu from start until shutdown completes; operations are sequential before mux is started
 	err   error         // error to be returned to client
@@ -193,6 +451,8 @@ type conn struct {
 	connErr      chan error          // connReader/Writer notifications of an error
 	closeMux     chan struct{}       // indicates that the mux should stop
 	closeMuxOnce sync.Once
+	closeErrMu   sync.Mutex
+	closeErr     *Error // sent in the close frame when set by CloseWithError
 
 	// connReader
 	rxProto       chan protoHeader // protoHeaders received by connReader
@@ -201,9 +461,10 @@ type conn struct {
 	connReaderRun chan func() // functions to be run by conn reader (set deadline on conn to run)
 
 	// connWriter
-	txFrame chan frame // AMQP frames to be sent by connWriter
-	txBuf   buffer     // buffer for marshaling frames before transmitting
-	txDone  chan struct{}
+	txFrame  chan frame    // AMQP frames to be sent by connWriter
+	txBuf    buffer        // buffer for marshaling frames before transmitting
+	txWriter *bufio.Writer // coalesces frames when writeBufferSize is set, nil otherwise
+	txDone   chan struct{}
 }
 
 type newSessionResp struct {
@@ -213,23 +474,25 @@ type newSessionResp struct {
 
 func newConn(netConn net.Conn, opts ...ConnOption) (*conn, error) {
 	c := &conn{
-		net:              netConn,
-		maxFrameSize:     DefaultMaxFrameSize,
-		peerMaxFrameSize: DefaultMaxFrameSize,
-		channelMax:       DefaultMaxSessions - 1, // -1 because channel-max starts at zero
-		idleTimeout:      DefaultIdleTimeout,
-		containerID:      randString(40),
-		done:             make(chan struct{}),
-		connErr:          make(chan error, 2), // buffered to ensure connReader/Writer won't leak
-		closeMux:         make(chan struct{}),
-		rxProto:          make(chan protoHeader),
-		rxFrame:          make(chan frame),
-		rxDone:           make(chan struct{}),
-		connReaderRun:    make(chan func(), 1), // buffered to allow queueing function before interrupt
-		newSession:       make(chan newSessionResp),
-		delSession:       make(chan *Session),
-		txFrame:          make(chan frame),
-		txDone:           make(chan struct{}),
+		net:               netConn,
+		maxFrameSize:      DefaultMaxFrameSize,
+		peerMaxFrameSize:  DefaultMaxFrameSize,
+		channelMax:        DefaultMaxSessions - 1, // -1 because channel-max starts at zero
+		idleTimeout:       DefaultIdleTimeout,
+		keepaliveFraction: defaultKeepaliveFraction,
+		containerID:       randString(40),
+		done:              make(chan struct{}),
+		connErr:           make(chan error, 2), // buffered to ensure connReader/Writer won't leak
+		closeMux:          make(chan struct{}),
+		rxProto:           make(chan protoHeader),
+		rxFrame:           make(chan frame),
+		rxDone:            make(chan struct{}),
+		connReaderRun:     make(chan func(), 1), // buffered to allow queueing function before interrupt
+		newSession:        make(chan newSessionResp),
+		delSession:        make(chan *Session),
+		txFrame:           make(chan frame),
+		txDone:            make(chan struct{}),
+		clock:             realClock{},
 	}
 
 	// apply options
@@ -238,17 +501,26 @@ func newConn(netConn net.Conn, opts ...ConnOption) (*conn, error) {
 			return nil, err
 		}
 	}
+
+	// preferred mechanisms may be given before they're enabled
+	for _, mech := range c.saslPrefer {
+		if _, ok := c.saslHandlers[mech]; !ok {
+			return nil, errorErrorf("SASL mechanism %s is preferred but not enabled", mech)
+		}
+	}
 	return c, nil
 }
 
 func (c *conn) initTLSConfig() {
 	// create a new config if not already set
 	if c.tlsConfig == nil {
-		c.tlsConfig = new(tls.Config)
+		c.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
 	}
 
-	// TLS config must have ServerName or InsecureSkipVerify set
+	// TLS config must have ServerName or InsecureSkipVerify set,
+	// copy the user's config as it may be shared between connections
 	if c.tlsConfig.ServerName == "" && !c.tlsConfig.InsecureSkipVerify {
+		c.tlsConfig = c.tlsConfig.Clone()
 		c.tlsConfig.ServerName = c.hostname
 	}
 }
@@ -277,7 +549,18 @@ func (c *conn) start() error {
 }
 
 func (c *conn) Close() error {
-	c.closeMuxOnce.Do(func() { close(c.closeMux) })
+	return c.CloseWithError(nil)
+}
+
+// CloseWithError closes the connection, sending e to the peer
+// in the close frame if it's not nil.
+func (c *conn) CloseWithError(e *Error) error {
+	c.closeMuxOnce.Do(func() {
+		c.closeErrMu.Lock()
+		c.closeErr = e
+		c.closeErrMu.Unlock()
+		close(c.closeMux)
+	})
 	err := c.getErr()
 	if err == ErrConnClosed {
 		return nil
@@ -362,7 +645,7 @@ func (c *conn) mux() {
 			// Server initiated close.
 			case *performClose:
 				if body.Error != nil {
-					c.err = body.Error
+					c.err = &ConnectionError{RemoteError: body.Error}
 				} else {
 					c.err = ErrConnClosed
 				}
@@ -446,6 +729,7 @@ func (c *conn) connReader() {
 		negotiating     = true      // true during conn establishment, check for protoHeaders
 		currentHeader   frameHeader // keep track of the current header, for frames split across multiple TCP packets
 		frameInProgress bool        // true if in the middle of receiving data for currentHeader
+		rawHeader       []byte      // copy of currentHeader's bytes, only set if frameHook or frameInterceptor is set
 	)
 
 	for {
@@ -515,6 +799,9 @@ func (c *conn) connReader() {
 
 		// parse the header if a frame isn't in progress
 		if !frameInProgress {
+			if c.frameHook != nil || c.frameInterceptor != nil {
+				rawHeader = append(rawHeader[:0], buf.bytes()[:frameHeaderSize]...)
+			}
 			var err error
 			currentHeader, err = parseFrameHeader(buf)
 			if err != nil {
@@ -540,6 +827,9 @@ func (c *conn) connReader() {
 
 		// check if body is empty (keepalive)
 		if bodySize == 0 {
+			if c.frameHook != nil {
+				c.callFrameHook(DirectionReceive, rawHeader)
+			}
 			continue
 		}
 
@@ -550,6 +840,37 @@ func (c *conn) connReader() {
 			return
 		}
 
+		if c.frameHook != nil {
+			c.callFrameHook(DirectionReceive, append(rawHeader, b...))
+		}
+
+		if c.frameInterceptor != nil {
+			raw := c.frameInterceptor(DirectionReceive, append(rawHeader, b...))
+			if raw == nil {
+				continue
+			}
+
+			// the frame may have been rewritten, parse the replacement
+			r := &buffer{b: raw}
+			var err error
+			currentHeader, err = parseFrameHeader(r)
+			if err != nil {
+				c.connErr <- err
+				return
+			}
+			b, ok = r.next(int64(currentHeader.Size - frameHeaderSize))
+			if !ok {
+				c.connErr <- errorNew("intercepted frame is shorter than its header size")
+				return
+			}
+		}
+
+		// the extended header isn't used by AMQP 1.0, skip it
+		b = b[currentHeader.extendedHeaderSize():]
+		if len(b) == 0 {
+			continue
+		}
+
 		parsedBody, err := parseFrameBody(&buffer{b: b})
 		if err != nil {
 			c.connErr <- err
@@ -574,9 +895,12 @@ func (c *conn) connWriter() {
 		_ = c.net.SetWriteDeadline(time.Time{})
 	}
 
+	if c.writeBufferSize > 0 {
+		c.txWriter = bufio.NewWriterSize(c.net, c.writeBufferSize)
+	}
+
 	var (
-		// keepalives are sent at a rate of 1/2 idle timeout
-		keepaliveInterval = c.peerIdleTimeout / 2
+		keepaliveInterval = c.keepaliveInterval()
 		// 0 disables keepalives
 		keepalivesEnabled = keepaliveInterval > 0
 		// set if enable, nil if not; nil channels block forever
@@ -584,9 +908,9 @@ func (c *conn) connWriter() {
 	)
 
 	if keepalivesEnabled {
-		ticker := time.NewTicker(keepaliveInterval)
+		ticker := c.clock.NewTicker(keepaliveInterval)
 		defer ticker.Stop()
-		keepalive = ticker.C
+		keepalive = ticker.C()
 	}
 
 	var err error
@@ -599,13 +923,13 @@ func (c *conn) connWriter() {
 		select {
 		// frame write request
 		case fr := <-c.txFrame:
-			err = c.writeFrame(fr)
-			if err == nil && fr.done != nil {
-				close(fr.done)
-			}
+			err = c.writeQueuedFrames(fr)
 
 		// keepalive timer
 		case <-keepalive:
+			if c.frameHook != nil {
+				c.callFrameHook(DirectionSend, keepaliveFrame)
+			}
 			_, err = c.net.Write(keepaliveFrame)
 			// It would be slightly more efficient in terms of network
 			// resources to reset the timer each time a frame is sent.
@@ -617,13 +941,22 @@ func (c *conn) connWriter() {
 
 		// connection complete
 		case <-c.done:
-			// send close
-			cls := &performClose{}
-			debug(1, "TX: %s", cls)
+			// send close, with the error if it was detected locally;
+			// the mux sets c.err before closing c.done
+			c.closeErrMu.Lock()
+			cls := &performClose{Error: c.closeErr}
+			c.closeErrMu.Unlock()
+			if amqpErr, ok := c.err.(*Error); ok {
+				cls.Error = amqpErr
+			}
+			c.debug(1, "TX: %s", cls)
 			_ = c.writeFrame(frame{
 				type_: frameTypeAMQP,
 				body:  cls,
 			})
+			if c.txWriter != nil {
+				_ = c.txWriter.Flush()
+			}
 			return
 		}
 	}
@@ -643,17 +976,92 @@ func (c *conn) writeFrame(fr frame) error {
 		return err
 	}
 
+	raw := c.txBuf.bytes()
+	if c.frameInterceptor != nil {
+		raw = c.frameInterceptor(DirectionSend, raw)
+		if raw == nil {
+			return nil
+		}
+	}
+
 	// validate the frame isn't exceeding peer's max frame size
-	requiredFrameSize := c.txBuf.len()
+	requiredFrameSize := len(raw)
 	if uint64(requiredFrameSize) > uint64(c.peerMaxFrameSize) {
-		return errorErrorf("%T frame size %d larger than peer's max frame size", fr, requiredFrameSize, c.peerMaxFrameSize)
+		return errorErrorf("%T frame size %d larger than peer's max frame size %d", fr.body, requiredFrameSize, c.peerMaxFrameSize)
 	}
 
-	// write to network
-	_, err = c.net.Write(c.txBuf.bytes())
+	if c.frameHook != nil {
+		c.callFrameHook(DirectionSend, raw)
+	}
+
+	// write to network, or to txWriter to be flushed by connWriter
+	if c.txWriter != nil {
+		_, err = c.txWriter.Write(raw)
+		return err
+	}
+	_, err = c.net.Write(raw)
 	return err
 }
 
+// writeQueuedFrames writes fr and, when coalescing is enabled, any
+// frames already queued behind it, up to writeBufferSize bytes, with
+// a single flush. Done channels are closed once the frames are written
+// to the network.
+func (c *conn) writeQueuedFrames(fr frame) error {
+	if c.txWriter == nil {
+		err := c.writeFrame(fr)
+		if err == nil && fr.done != nil {
+			close(fr.done)
+		}
+		return err
+	}
+
+	var (
+		done    []chan deliveryState
+		written int
+	)
+	for {
+		err := c.writeFrame(fr)
+		if err != nil {
+			return err
+		}
+		if fr.done != nil {
+			done = append(done, fr.done)
+		}
+		written += c.txBuf.len()
+
+		if written >= c.writeBufferSize {
+			break
+		}
+		select {
+		case fr = <-c.txFrame:
+			continue
+		default:
+		}
+		break
+	}
+
+	err := c.txWriter.Flush()
+	if err != nil {
+		return err
+	}
+	for _, d := range done {
+		close(d)
+	}
+	return nil
+}
+
+// callFrameHook calls c.frameHook, recovering from any panic so
+// a misbehaving hook can't take down the connection.
+func (c *conn) callFrameHook(dir Direction, raw []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.debug(1, "frame hook panic: %v", r)
+		}
+	}()
+	c.frameHook(dir, raw)
+}
+
 // writeProtoHeader writes an AMQP protocol header to the
 // network
 func (c *conn) writeProtoHeader(pID protoID) error {
@@ -664,6 +1072,29 @@ func (c *conn) writeProtoHeader(pID protoID) error {
 	return err
 }
 
+const (
+	// keepalives are sent at a rate of 1/2 idle timeout by default
+	defaultKeepaliveFraction = 0.5
+
+	// minKeepaliveInterval bounds how often keepalives are sent when
+	// the peer advertises a very small idle timeout
+	minKeepaliveInterval = 100 * time.Millisecond
+)
+
+// keepaliveInterval returns the period between keepalive frames derived
+// from the peer's idle timeout, or 0 if keepalives are disabled.
+func (c *conn) keepaliveInterval() time.Duration {
+	if c.peerIdleTimeout <= 0 {
+		return 0
+	}
+	interval := time.Duration(float64(c.peerIdleTimeout) * c.keepaliveFraction)
+	if interval < minKeepaliveInterval {
+		c.debug(1, "peer idle timeout %v too small, sending keepalives every %v", c.peerIdleTimeout, minKeepaliveInterval)
+		interval = minKeepaliveInterval
+	}
+	return interval
+}
+
 // keepaliveFrame is an AMQP frame with no body, used for keepalives
 var keepaliveFrame = []byte{0x00, 0x00, 0x00, 0x08, 0x02, 0x00, 0x00, 0x00}
 
@@ -745,7 +1176,7 @@ func (c *conn) exchangeProtoHeader(pID protoID) stateFunc {
 func (c *conn) readProtoHeader() (protoHeader, error) {
 	var deadline <-chan time.Time
 	if c.connectTimeout != 0 {
-		deadline = time.After(c.connectTimeout)
+		deadline = c.clock.After(c.connectTimeout)
 	}
 	var p protoHeader
 	select {
@@ -797,6 +1228,20 @@ func (c *conn) startTLS() stateFunc {
 	return c.negotiateProto
 }
 
+// openProperties returns the properties sent in the open performative,
+// the default client properties overlaid with any set via ConnProperty
+// or ConnProperties.
+func (c *conn) openProperties() map[symbol]interface{} {
+	props := map[symbol]interface{}{
+		"product":  "go-amqp",
+		"platform": runtime.GOOS + "/" + runtime.GOARCH + " " + runtime.Version(),
+	}
+	for key, value := range c.properties {
+		props[key] = value
+	}
+	return props
+}
+
 // openAMQP round trips the AMQP open performative
 func (c *conn) openAMQP() stateFunc {
 	// send open frame
@@ -806,9 +1251,11 @@ func (c *conn) openAMQP() stateFunc {
 		MaxFrameSize: c.maxFrameSize,
 		ChannelMax:   c.channelMax,
 		IdleTimeout:  c.idleTimeout,
-		Properties:   c.properties,
+		Properties:   c.openProperties(),
+
+		DesiredCapabilities: c.desiredCapabilities,
 	}
-	debug(1, "TX: %s", open)
+	c.debug(1, "TX: %s", open)
 	c.err = c.writeFrame(frame{
 		type_:   frameTypeAMQP,
 		body:    open,
@@ -829,19 +1276,21 @@ func (c *conn) openAMQP() stateFunc {
 		c.err = errorErrorf("unexpected frame type %T", fr.body)
 		return nil
 	}
-	debug(1, "RX: %s", o)
+	c.debug(1, "RX: %s", o)
 
 	// update peer settings
 	if o.MaxFrameSize > 0 {
 		c.peerMaxFrameSize = o.MaxFrameSize
 	}
 	if o.IdleTimeout > 0 {
-		// TODO: reject very small idle timeouts
+		// very small timeouts are bounded by minKeepaliveInterval
 		c.peerIdleTimeout = o.IdleTimeout
 	}
 	if o.ChannelMax < c.channelMax {
 		c.channelMax = o.ChannelMax
 	}
+	c.peerContainerID = o.ContainerID
+	c.peerOfferedCapabilities = o.OfferedCapabilities
 
 	// connection established, exit state machine
 	return nil
@@ -861,18 +1310,35 @@ func (c *conn) negotiateSASL() stateFunc {
 		c.err = errorErrorf("unexpected frame type %T", fr.body)
 		return nil
 	}
-	debug(1, "RX: %s", sm)
+	c.debug(1, "RX: %s", sm)
 
-	// return first match in c.saslHandlers based on order received
-	for _, mech := range sm.Mechanisms {
-		if state, ok := c.saslHandlers[mech]; ok {
-			return state
-		}
+	mech, err := c.selectSASLMechanism(sm.Mechanisms)
+	if err != nil {
+		c.err = err // TODO: send "auth not supported" frame?
+		return nil
 	}
+	return c.saslHandlers[mech]
+}
 
-	// no match
-	c.err = errorErrorf("no supported auth mechanism (%v)", sm.Mechanisms) // TODO: send "auth not supported" frame?
-	return nil
+// selectSASLMechanism returns the first of c.saslPrefer offered by the
+// server, or if c.saslPrefer isn't set, the first mechanism offered by
+// the server that has a handler.
+func (c *conn) selectSASLMechanism(offered []symbol) (symbol, error) {
+	if c.saslPrefer == nil {
+		for _, mech := range offered {
+			if _, ok := c.saslHandlers[mech]; ok {
+				return mech, nil
+			}
+		}
+	}
+	for _, mech := range c.saslPrefer {
+		for _, o := range offered {
+			if o == mech {
+				return mech, nil
+			}
+		}
+	}
+	return "", errorErrorf("no supported auth mechanism (%v)", offered)
 }
 
 // saslOutcome processes the SASL outcome frame and return Client.negotiateProto
@@ -892,7 +1358,7 @@ func (c *conn) saslOutcome() stateFunc {
 		c.err = errorErrorf("unexpected frame type %T", fr.body)
 		return nil
 	}
-	debug(1, "RX: %s", so)
+	c.debug(1, "RX: %s", so)
 
 	// check if auth succeeded
 	if so.Code != codeSASLOK {
@@ -911,7 +1377,7 @@ func (c *conn) saslOutcome() stateFunc {
 func (c *conn) readFrame() (frame, error) {
 	var deadline <-chan time.Time
 	if c.connectTimeout != 0 {
-		deadline = time.After(c.connectTimeout)
+		deadline = c.clock.After(c.connectTimeout)
 	}
 
 	var fr frame
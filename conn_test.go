@@ -1,7 +1,22 @@
 package amqp
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp/internal/frames"
+	"github.com/Azure/go-amqp/internal/testbroker"
+	"github.com/Azure/go-amqp/internal/testconn"
 )
 
 func TestConnOptions(t *testing.T) {
@@ -27,6 +42,21 @@ func TestConnOptions(t *testing.T) {
 				"x-opt-test2": "test2",
 			},
 		},
+		{
+			label: "properties map",
+			opts: []ConnOption{
+				ConnProperty("x-opt-test1", "test1"),
+				ConnProperties(map[string]interface{}{
+					"x-opt-test1": "test2",
+					"x-opt-test3": int64(3),
+				}),
+			},
+
+			wantProperties: map[symbol]interface{}{
+				"x-opt-test1": "test2",
+				"x-opt-test3": int64(3),
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -42,3 +72,909 @@ func TestConnOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestConnRemoteCloseError(t *testing.T) {
+	remoteErr := &Error{
+		Condition:   ErrorConnectionForced,
+		Description: "broker shutting down",
+		Info:        map[string]interface{}{"reason": "maintenance"},
+	}
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performOpen{ContainerID: "test"},
+		},
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performClose{Error: remoteErr},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := New(testconn.New(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.NewSession()
+	connErr, ok := err.(*ConnectionError)
+	if !ok {
+		t.Fatalf("expected *ConnectionError, got %T: %v", err, err)
+	}
+	if !testEqual(connErr.RemoteError, remoteErr) {
+		t.Error(testDiff(connErr.RemoteError, remoteErr))
+	}
+	if connErr.Unwrap() != error(connErr.RemoteError) {
+		t.Errorf("Unwrap() = %v, want %v", connErr.Unwrap(), connErr.RemoteError)
+	}
+	if !connErr.RemoteError.Is(ErrConnectionForced) {
+		t.Errorf("expected %v to match ErrConnectionForced", connErr.RemoteError)
+	}
+	if !IsRetryable(err) {
+		t.Errorf("expected %v to be retryable", err)
+	}
+
+	err = client.Close()
+	if _, ok := err.(*ConnectionError); !ok {
+		t.Errorf("expected *ConnectionError from Close, got %T: %v", err, err)
+	}
+}
+
+func TestConnRemoteCloseErrorLink(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+	broker := testbroker.New(t, peerConn)
+	broker.Attach = func(channel uint16, attach *frames.Attach) {
+		resp := broker.AttachResponse(attach)
+		resp.Target = &frames.Target{}
+		broker.Write(channel, resp)
+	}
+	broker.Flow = func(channel uint16, flow *frames.Flow) {
+		// the broker shuts down once the receiver is attached
+		// and has issued credit
+		broker.Write(0, &frames.Close{Error: &frames.Error{
+			Condition:   frames.Symbol(ErrorConnectionForced),
+			Description: "broker shutting down",
+		}})
+		broker.Stop()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		broker.Run()
+	}()
+
+	client, err := New(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := sess.NewReceiver(LinkSourceAddress("orders"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = r.Receive(ctx)
+
+	// the link reports the error the connection was closed with
+	connErr, ok := err.(*ConnectionError)
+	if !ok {
+		t.Fatalf("expected *ConnectionError, got %T: %v", err, err)
+	}
+	if connErr.RemoteError == nil || connErr.RemoteError.Condition != ErrorConnectionForced {
+		t.Errorf("RemoteError = %v, want condition %s", connErr.RemoteError, ErrorConnectionForced)
+	}
+	if !IsRetryable(err) {
+		t.Errorf("expected %v to be retryable", err)
+	}
+	_ = client.Close()
+	<-done
+}
+
+func TestConnFrameHook(t *testing.T) {
+	openFrame, err := peerResponse(frame{
+		type_:   frameTypeAMQP,
+		channel: 0,
+		body:    &performOpen{ContainerID: "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu       sync.Mutex
+		captured = map[Direction][][]byte{}
+	)
+	hook := func(dir Direction, raw []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		captured[dir] = append(captured[dir], append([]byte(nil), raw...))
+	}
+
+	client, err := New(testconn.New(append([]byte("AMQP\x00\x01\x00\x00"), openFrame...)),
+		ConnFrameHook(hook),
+		ConnContainerID("client"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// received open is passed through unmodified
+	if len(captured[DirectionReceive]) != 1 {
+		t.Fatalf("captured %d received frames, want 1", len(captured[DirectionReceive]))
+	}
+	if got := captured[DirectionReceive][0]; !bytes.Equal(got, openFrame) {
+		t.Errorf("received frame = % x, want % x", got, openFrame)
+	}
+
+	// sent open decodes back to the frame the client sent
+	if len(captured[DirectionSend]) != 1 {
+		t.Fatalf("captured %d sent frames, want 1", len(captured[DirectionSend]))
+	}
+	buf := &buffer{b: captured[DirectionSend][0]}
+	header, err := parseFrameHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(header.Size) != len(captured[DirectionSend][0]) {
+		t.Errorf("frame size = %d, captured %d bytes", header.Size, len(captured[DirectionSend][0]))
+	}
+	body, err := parseFrameBody(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, ok := body.(*performOpen)
+	if !ok {
+		t.Fatalf("sent frame is %T, want *performOpen", body)
+	}
+	if open.ContainerID != "client" {
+		t.Errorf("ContainerID = %q, want %q", open.ContainerID, "client")
+	}
+}
+
+func TestConnFrameHookPanic(t *testing.T) {
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performOpen{ContainerID: "test"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := New(testconn.New(buf), ConnFrameHook(func(Direction, []byte) {
+		panic("hook failure")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Close()
+	if err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestConnOpenContainerID(t *testing.T) {
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performOpen{ContainerID: "test"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan []byte, 1)
+	client, err := New(testconn.New(buf),
+		ConnContainerID("my-container"),
+		ConnSoleConnectionForContainer(),
+		ConnFrameHook(func(dir Direction, raw []byte) {
+			if dir == DirectionSend {
+				sent <- append([]byte(nil), raw...)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	r := &buffer{b: <-sent}
+	_, err = parseFrameHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := parseFrameBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, ok := body.(*performOpen)
+	if !ok {
+		t.Fatalf("sent frame is %T, want *performOpen", body)
+	}
+	if open.ContainerID != "my-container" {
+		t.Errorf("ContainerID = %q, want %q", open.ContainerID, "my-container")
+	}
+	wantCaps := multiSymbol{"sole-connection-for-container"}
+	if !testEqual(open.DesiredCapabilities, wantCaps) {
+		t.Errorf("DesiredCapabilities = %v, want %v", open.DesiredCapabilities, wantCaps)
+	}
+}
+
+func TestConnOpenProperties(t *testing.T) {
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performOpen{ContainerID: "test"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan []byte, 1)
+	client, err := New(testconn.New(buf),
+		ConnProperty("product", "my-app"),
+		ConnProperties(map[string]interface{}{
+			"version":  "1.2.3",
+			"x-opt-id": int64(42),
+		}),
+		ConnFrameHook(func(dir Direction, raw []byte) {
+			if dir == DirectionSend {
+				sent <- append([]byte(nil), raw...)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	r := &buffer{b: <-sent}
+	_, err = parseFrameHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := parseFrameBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, ok := body.(*performOpen)
+	if !ok {
+		t.Fatalf("sent frame is %T, want *performOpen", body)
+	}
+	wantProperties := map[symbol]interface{}{
+		"product":  "my-app",
+		"platform": runtime.GOOS + "/" + runtime.GOARCH + " " + runtime.Version(),
+		"version":  "1.2.3",
+		"x-opt-id": int64(42),
+	}
+	if !testEqual(open.Properties, wantProperties) {
+		t.Error(testDiff(open.Properties, wantProperties))
+	}
+}
+
+func TestConnCapabilities(t *testing.T) {
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body: &performOpen{
+				ContainerID:         "test",
+				OfferedCapabilities: multiSymbol{"DELAYED_DELIVERY", "SHARED-SUBS"},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan []byte, 1)
+	client, err := New(testconn.New(buf),
+		ConnDesiredCapabilities("DELAYED_DELIVERY", "ANONYMOUS-RELAY"),
+		ConnFrameHook(func(dir Direction, raw []byte) {
+			if dir == DirectionSend {
+				sent <- append([]byte(nil), raw...)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	r := &buffer{b: <-sent}
+	_, err = parseFrameHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := parseFrameBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, ok := body.(*performOpen)
+	if !ok {
+		t.Fatalf("sent frame is %T, want *performOpen", body)
+	}
+	wantDesired := multiSymbol{"DELAYED_DELIVERY", "ANONYMOUS-RELAY"}
+	if !testEqual(open.DesiredCapabilities, wantDesired) {
+		t.Error(testDiff(open.DesiredCapabilities, wantDesired))
+	}
+
+	wantOffered := []string{"DELAYED_DELIVERY", "SHARED-SUBS"}
+	if got := client.OfferedCapabilities(); !testEqual(got, wantOffered) {
+		t.Error(testDiff(got, wantOffered))
+	}
+}
+
+func TestConnNegotiatedLimits(t *testing.T) {
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body: &performOpen{
+				ContainerID:  "test",
+				MaxFrameSize: 1024,
+				ChannelMax:   3,
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := New(testconn.New(buf), ConnMaxFrameSize(4096), ConnMaxSessions(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if got := client.MaxFrameSize(); got != 1024 {
+		t.Errorf("MaxFrameSize() = %d, want 1024", got)
+	}
+	if got := client.ChannelMax(); got != 3 {
+		t.Errorf("ChannelMax() = %d, want 3", got)
+	}
+}
+
+func TestConnContainerIDs(t *testing.T) {
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performOpen{ContainerID: "broker-1"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := New(testconn.New(buf), ConnContainerID("client-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if got := client.ContainerID(); got != "client-1" {
+		t.Errorf("ContainerID() = %q, want %q", got, "client-1")
+	}
+	if got := client.RemoteContainerID(); got != "broker-1" {
+		t.Errorf("RemoteContainerID() = %q, want %q", got, "broker-1")
+	}
+}
+
+func TestConnDesiredCapabilitiesInvalid(t *testing.T) {
+	for _, capability := range []string{"", "caf\u00e9"} {
+		_, err := newConn(nil, ConnDesiredCapabilities(capability))
+		if err == nil {
+			t.Errorf("expected error for capability %q", capability)
+		}
+	}
+}
+
+func TestConnPropertiesEmptyKey(t *testing.T) {
+	_, err := newConn(nil, ConnProperties(map[string]interface{}{"": "value"}))
+	if err == nil {
+		t.Error("expected error for empty property key")
+	}
+}
+
+func TestConnContainerIDEmpty(t *testing.T) {
+	_, err := newConn(nil, ConnContainerID(""))
+	if err == nil {
+		t.Error("expected error for empty container-id")
+	}
+}
+
+func TestConnFrameInterceptor(t *testing.T) {
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performOpen{ContainerID: "test", MaxFrameSize: 4096},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rewriteOpen decodes an open frame, applies f, and re-encodes it
+	rewriteOpen := func(raw []byte, f func(*performOpen)) []byte {
+		r := &buffer{b: raw}
+		header, err := parseFrameHeader(r)
+		if err != nil {
+			t.Error(err)
+			return raw
+		}
+		body, err := parseFrameBody(r)
+		if err != nil {
+			t.Error(err)
+			return raw
+		}
+		open, ok := body.(*performOpen)
+		if !ok {
+			return raw
+		}
+		f(open)
+		var out buffer
+		err = writeFrame(&out, frame{type_: header.FrameType, channel: header.Channel, body: open})
+		if err != nil {
+			t.Error(err)
+			return raw
+		}
+		return out.bytes()
+	}
+
+	sent := make(chan []byte, 1)
+	client, err := New(testconn.New(buf),
+		ConnFrameInterceptor(func(dir Direction, raw []byte) []byte {
+			if dir == DirectionReceive {
+				return rewriteOpen(raw, func(o *performOpen) { o.MaxFrameSize = 1024 })
+			}
+			return rewriteOpen(raw, func(o *performOpen) { o.ContainerID = "rewritten" })
+		}),
+		ConnFrameHook(func(dir Direction, raw []byte) {
+			if dir == DirectionSend {
+				sent <- append([]byte(nil), raw...)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.conn.peerMaxFrameSize != 1024 {
+		t.Errorf("peerMaxFrameSize = %d, want 1024", client.conn.peerMaxFrameSize)
+	}
+
+	r := &buffer{b: <-sent}
+	_, err = parseFrameHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := parseFrameBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open, ok := body.(*performOpen); !ok || open.ContainerID != "rewritten" {
+		t.Errorf("sent frame = %v, want open with ContainerID %q", body, "rewritten")
+	}
+}
+
+func TestConnFrameInterceptorDrop(t *testing.T) {
+	netConn := &writeConn{writes: make(chan []byte, 1)}
+	c, err := newConn(netConn, ConnFrameInterceptor(func(Direction, []byte) []byte {
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.writeFrame(frame{type_: frameTypeAMQP, body: &performClose{}})
+	if err != nil {
+		t.Fatalf("writeFrame() error = %v", err)
+	}
+	select {
+	case b := <-netConn.writes:
+		t.Errorf("dropped frame was written: % x", b)
+	default:
+	}
+}
+
+func TestParseFrameHeaderMalformed(t *testing.T) {
+	tests := []struct {
+		label  string
+		header []byte
+	}{
+		{label: "size less than header", header: []byte{0, 0, 0, 4, 2, 0, 0, 0}},
+		{label: "data offset 0", header: []byte{0, 0, 0, 8, 0, 0, 0, 0}},
+		{label: "data offset 1", header: []byte{0, 0, 0, 16, 1, 0, 0, 0}},
+		{label: "data offset beyond size", header: []byte{0, 0, 0, 12, 4, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			_, err := parseFrameHeader(&buffer{b: tt.header})
+			amqpErr, ok := err.(*Error)
+			if !ok || amqpErr.Condition != ErrorFramingError {
+				t.Errorf("parseFrameHeader() error = %v, want %s", err, ErrorFramingError)
+			}
+		})
+	}
+}
+
+func TestConnMalformedFrame(t *testing.T) {
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performOpen{ContainerID: "test"},
+		},
+		[]byte{0, 0, 0, 8, 1, 0, 0, 0}, // data offset 1
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan []byte, 2)
+	client, err := New(testconn.New(buf), ConnFrameHook(func(dir Direction, raw []byte) {
+		if dir == DirectionSend {
+			sent <- append([]byte(nil), raw...)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sent // open
+
+	select {
+	case <-client.conn.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed")
+	}
+	err = client.Close()
+	amqpErr, ok := err.(*Error)
+	if !ok || amqpErr.Condition != ErrorFramingError {
+		t.Fatalf("Close() error = %v, want %s", err, ErrorFramingError)
+	}
+
+	// the error is sent to the peer in the close frame
+	r := &buffer{b: <-sent}
+	_, err = parseFrameHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := parseFrameBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cls, ok := body.(*performClose)
+	if !ok {
+		t.Fatalf("sent frame is %T, want *performClose", body)
+	}
+	if cls.Error == nil || cls.Error.Condition != ErrorFramingError {
+		t.Errorf("close Error = %v, want %s", cls.Error, ErrorFramingError)
+	}
+}
+
+func TestConnServerHostnameOpen(t *testing.T) {
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performOpen{ContainerID: "test"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan []byte, 2)
+	client, err := New(testconn.New(buf),
+		ConnServerHostname("vhost.example.com"),
+		ConnFrameHook(func(dir Direction, raw []byte) {
+			if dir == DirectionSend {
+				sent <- append([]byte(nil), raw...)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	r := &buffer{b: <-sent}
+	_, err = parseFrameHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := parseFrameBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, ok := body.(*performOpen)
+	if !ok {
+		t.Fatalf("sent frame is %T, want *performOpen", body)
+	}
+	if open.Hostname != "vhost.example.com" {
+		t.Errorf("open Hostname = %q, want %q", open.Hostname, "vhost.example.com")
+	}
+}
+
+func TestClientCloseWithError(t *testing.T) {
+	buf, err := peerResponse(
+		[]byte("AMQP\x00\x01\x00\x00"),
+		frame{
+			type_:   frameTypeAMQP,
+			channel: 0,
+			body:    &performOpen{ContainerID: "test"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan []byte, 2)
+	client, err := New(testconn.New(buf), ConnFrameHook(func(dir Direction, raw []byte) {
+		if dir == DirectionSend {
+			sent <- append([]byte(nil), raw...)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sent // open
+
+	want := &Error{Condition: ErrorFramingError, Description: "unexpected frame"}
+	if err := client.CloseWithError(want); err != nil {
+		t.Fatalf("CloseWithError() error = %v", err)
+	}
+
+	var raw []byte
+	select {
+	case raw = <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close frame wasn't sent")
+	}
+	r := &buffer{b: raw}
+	_, err = parseFrameHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := parseFrameBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cls, ok := body.(*performClose)
+	if !ok {
+		t.Fatalf("sent frame is %T, want *performClose", body)
+	}
+	if !testEqual(cls.Error, want) {
+		t.Errorf("close Error = %v, want %v", cls.Error, want)
+	}
+
+	// the error is only sent once
+	if err := client.CloseWithError(&Error{Condition: ErrorInternalError}); err != nil {
+		t.Errorf("second CloseWithError() error = %v", err)
+	}
+}
+
+func TestConnExtendedFrameHeader(t *testing.T) {
+	open, err := peerResponse(frame{
+		type_:   frameTypeAMQP,
+		channel: 0,
+		body:    &performOpen{ContainerID: "test", MaxFrameSize: 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a 4 byte extended header, the open must still be parsed
+	extended := append([]byte(nil), open[:frameHeaderSize]...)
+	extended = append(extended, 0xde, 0xad, 0xbe, 0xef)
+	extended = append(extended, open[frameHeaderSize:]...)
+	binary.BigEndian.PutUint32(extended, uint32(len(extended)))
+	extended[4] = 3
+
+	client, err := New(testconn.New(append([]byte("AMQP\x00\x01\x00\x00"), extended...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.conn.peerMaxFrameSize != 1024 {
+		t.Errorf("peerMaxFrameSize = %d, want 1024", client.conn.peerMaxFrameSize)
+	}
+}
+
+// gatedConn is a net.Conn that records writes. If release isn't nil,
+// each write is reported on started and blocks until a value is
+// received on release.
+type gatedConn struct {
+	net.Conn
+	started chan struct{}
+	release chan struct{}
+	mu      sync.Mutex
+	writes  [][]byte
+}
+
+func (c *gatedConn) Write(b []byte) (int, error) {
+	if c.release != nil {
+		c.started <- struct{}{}
+		<-c.release
+	}
+	c.mu.Lock()
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+func (c *gatedConn) numWrites() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.writes)
+}
+
+func TestConnWriteBufferCoalesces(t *testing.T) {
+	netConn := &gatedConn{started: make(chan struct{}), release: make(chan struct{})}
+	c, err := newConn(netConn, ConnWriteBufferSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// buffered so frames can be queued while a write is blocked
+	c.txFrame = make(chan frame, 3)
+	go c.connWriter()
+
+	emptyFrame := func() frame {
+		return frame{type_: frameTypeAMQP, body: &performFlow{}, done: make(chan deliveryState)}
+	}
+
+	// allow waits for the next write to start and lets it complete
+	allow := func(what string) {
+		t.Helper()
+		select {
+		case <-netConn.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not written after %d writes", what, netConn.numWrites())
+		}
+		netConn.release <- struct{}{}
+	}
+
+	// the first frame is the only one in flight once its write has
+	// started, the others are queued while it blocks the writer
+	first := emptyFrame()
+	c.txFrame <- first
+	select {
+	case <-netConn.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first frame not written")
+	}
+	queued := make([]frame, 3)
+	for i := range queued {
+		queued[i] = emptyFrame()
+		c.txFrame <- queued[i]
+	}
+	netConn.release <- struct{}{}
+	<-first.done
+
+	allow("queued frames")
+	for i, fr := range queued {
+		select {
+		case <-fr.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("frame %d not written", i)
+		}
+	}
+
+	if n := netConn.numWrites(); n != 2 {
+		t.Fatalf("%d writes, want 2", n)
+	}
+	frameSize := len(netConn.writes[0])
+	if got := len(netConn.writes[1]); got != 3*frameSize {
+		t.Errorf("coalesced write is %d bytes, want %d", got, 3*frameSize)
+	}
+
+	close(c.done)
+	allow("close frame")
+	<-c.txDone
+}
+
+func TestConnWriteBufferSizeInvalid(t *testing.T) {
+	_, err := newConn(nil, ConnWriteBufferSize(-1))
+	if err == nil {
+		t.Error("expected error for negative write buffer size")
+	}
+}
+
+// countingConn is a net.Conn that counts writes.
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func BenchmarkConnWriter(b *testing.B) {
+	for _, size := range []int{0, 64 * 1024} {
+		b.Run(fmt.Sprintf("WriteBufferSize=%d", size), func(b *testing.B) {
+			// write to a TCP connection so each write is a syscall
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}()
+			tcpConn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer tcpConn.Close()
+
+			netConn := &countingConn{Conn: tcpConn}
+			c, err := newConn(netConn, ConnWriteBufferSize(size))
+			if err != nil {
+				b.Fatal(err)
+			}
+			go c.connWriter()
+			defer func() {
+				close(c.done)
+				<-c.txDone
+			}()
+
+			payload := make([]byte, 128)
+			b.ReportAllocs()
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					fr := frame{
+						type_: frameTypeAMQP,
+						body:  &performTransfer{Payload: payload},
+						done:  make(chan deliveryState),
+					}
+					c.txFrame <- fr
+					<-fr.done
+				}
+			})
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&netConn.writes))/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -3,6 +3,7 @@ package amqp
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math"
 	"reflect"
 	"time"
@@ -10,7 +11,8 @@ import (
 
 // parseFrameHeader reads the header from r and returns the result.
 //
-// No validation is done.
+// An *Error with condition ErrorFramingError is returned if the
+// size or data offset is invalid.
 func parseFrameHeader(r *buffer) (frameHeader, error) {
 	buf, ok := r.next(8)
 	if !ok {
@@ -26,12 +28,27 @@ func parseFrameHeader(r *buffer) (frameHeader, error) {
 	}
 
 	if fh.Size < frameHeaderSize {
-		return fh, errorErrorf("received frame header with invalid size %d", fh.Size)
+		return fh, &Error{
+			Condition:   ErrorFramingError,
+			Description: fmt.Sprintf("received frame header with invalid size %d", fh.Size),
+		}
+	}
+	if fh.DataOffset < 2 || uint32(fh.DataOffset)*4 > fh.Size {
+		return fh, &Error{
+			Condition:   ErrorFramingError,
+			Description: fmt.Sprintf("received frame header with invalid data offset %d for size %d", fh.DataOffset, fh.Size),
+		}
 	}
 
 	return fh, nil
 }
 
+// extendedHeaderSize returns the size of the extended header
+// between the frame header and the frame body.
+func (fh frameHeader) extendedHeaderSize() int {
+	return int(fh.DataOffset)*4 - frameHeaderSize
+}
+
 // parseProtoHeader reads the proto header from r and returns the results
 //
 // An error is returned if the protocol is not "AMQP" or if the version is not 1.0.0.
@@ -316,7 +333,8 @@ func unmarshal(r *buffer, i interface{}) error {
 		case typeCodeStateReleased:
 			*t = new(stateReleased)
 		default:
-			return errorErrorf("unexpected type %d for deliveryState", type_)
+			// e.g. transactional or proprietary states
+			*t = new(DescribedType)
 		}
 		return unmarshal(r, *t)
 
@@ -364,10 +382,12 @@ func unmarshalComposite(r *buffer, type_ amqpType, fields ...unmarshalField) err
 		return errorErrorf("invalid header %#0x for %#0x", cType, type_)
 	}
 
-	// Validate the field count is less than or equal to the number of fields
-	// provided. Fields may be omitted by the sender if they are not set.
-	if numFields > int64(len(fields)) {
-		return errorErrorf("invalid field count %d for %#0x", numFields, type_)
+	// Fields may be omitted by the sender if they are not set. Fields
+	// beyond those known may be added by later versions of the
+	// specification or by extensions, they're read and discarded.
+	extraFields := numFields - int64(len(fields))
+	if extraFields > 0 {
+		numFields = int64(len(fields))
 	}
 
 	for i, field := range fields[:numFields] {
@@ -389,6 +409,13 @@ func unmarshalComposite(r *buffer, type_ amqpType, fields ...unmarshalField) err
 		}
 	}
 
+	for i := int64(0); i < extraFields; i++ {
+		_, err = readAny(r)
+		if err != nil {
+			return errorWrapf(err, "unmarshaling field %d", numFields+i)
+		}
+	}
+
 	// check and call handleNull for the remaining fields
 	for _, field := range fields[numFields:] {
 		if field.handleNull != nil {
@@ -517,9 +544,34 @@ func readArrayHeader(r *buffer) (length int64, _ error) {
 	default:
 		return 0, errorErrorf("type code %#02x is not a recognized array type", type_)
 	}
+
+	// bound the length to avoid huge allocations, elements take at least
+	// a byte unless their constructor is one that takes no space
+	limit := int64(r.len())
+	if b := r.bytes(); len(b) > 0 && isZeroWidth(amqpType(b[0])) {
+		limit = maxZeroWidthArrayLength
+	}
+	if length > limit {
+		return 0, errorErrorf("invalid length %d", length)
+	}
 	return length, nil
 }
 
+// maxZeroWidthArrayLength is the maximum length of an array
+// whose elements take no space, such as an array of uint0.
+const maxZeroWidthArrayLength = 1 << 16
+
+// isZeroWidth reports whether values with the constructor type_
+// are encoded without any bytes following it.
+func isZeroWidth(type_ amqpType) bool {
+	switch type_ {
+	case typeCodeUint0, typeCodeUlong0, typeCodeBoolTrue, typeCodeBoolFalse:
+		return true
+	default:
+		return false
+	}
+}
+
 func readString(r *buffer) (string, error) {
 	type_, err := r.readType()
 	if err != nil {
@@ -601,7 +653,7 @@ func readAny(r *buffer) (interface{}, error) {
 	switch type_ {
 	// composite
 	case 0x0:
-		return readComposite(r)
+		return readNested(r, readComposite)
 
 	// bool
 	case typeCodeBool, typeCodeBoolTrue, typeCodeBoolFalse:
@@ -667,13 +719,13 @@ func readAny(r *buffer) (interface{}, error) {
 
 	// lists
 	case typeCodeList0, typeCodeList8, typeCodeList32:
-		return readAnyList(r)
+		return readNested(r, readAnyList)
 
 	// maps
 	case typeCodeMap8:
-		return readAnyMap(r)
+		return readNested(r, readAnyMap)
 	case typeCodeMap32:
-		return readAnyMap(r)
+		return readNested(r, readAnyMap)
 
 	// TODO: implement
 	case typeCodeDecimal32:
@@ -689,6 +741,26 @@ func readAny(r *buffer) (interface{}, error) {
 	}
 }
 
+// defaultMaxDecodeDepth is the maximum nesting of composites, lists
+// and maps decoded by readAny unless buffer.maxDepth is set.
+const defaultMaxDecodeDepth = 1024
+
+// readNested calls read to decode a value which may contain other
+// values, returning an error if the maximum nesting depth is exceeded.
+func readNested(r *buffer, read func(*buffer) (interface{}, error)) (interface{}, error) {
+	max := r.maxDepth
+	if max == 0 {
+		max = defaultMaxDecodeDepth
+	}
+	if r.depth >= max {
+		return nil, errorErrorf("maximum nesting depth of %d exceeded", max)
+	}
+	r.depth++
+	v, err := read(r)
+	r.depth--
+	return v, err
+}
+
 func readAnyMap(r *buffer) (interface{}, error) {
 	var m map[interface{}]interface{}
 	err := (*mapAnyAny)(&m).unmarshal(r)
@@ -852,7 +924,7 @@ func readComposite(r *buffer) (interface{}, error) {
 
 	if compositeType > math.MaxUint8 {
 		// try as described type
-		var dt describedType
+		var dt DescribedType
 		err := dt.unmarshal(r)
 		return dt, err
 	}
@@ -866,19 +938,19 @@ func readComposite(r *buffer) (interface{}, error) {
 
 	// Lifetime Policies
 	case typeCodeDeleteOnClose:
-		t := deleteOnClose
+		t := LifetimeDeleteOnClose
 		err := t.unmarshal(r)
 		return t, err
 	case typeCodeDeleteOnNoMessages:
-		t := deleteOnNoMessages
+		t := LifetimeDeleteOnNoMessages
 		err := t.unmarshal(r)
 		return t, err
 	case typeCodeDeleteOnNoLinks:
-		t := deleteOnNoLinks
+		t := LifetimeDeleteOnNoLinks
 		err := t.unmarshal(r)
 		return t, err
 	case typeCodeDeleteOnNoLinksOrMessages:
-		t := deleteOnNoLinksOrMessages
+		t := LifetimeDeleteOnNoLinksOrMessages
 		err := t.unmarshal(r)
 		return t, err
 
@@ -933,7 +1005,7 @@ func readComposite(r *buffer) (interface{}, error) {
 
 	default:
 		// try as described type
-		var dt describedType
+		var dt DescribedType
 		err := dt.unmarshal(r)
 		return dt, err
 	}
@@ -950,8 +1022,12 @@ func readTimestamp(r *buffer) (time.Time, error) {
 	}
 
 	n, err := r.readUint64()
-	ms := int64(n)
-	return time.Unix(ms/1000, (ms%1000)*1000000).UTC(), err
+	return unixMilliTime(int64(n)), err
+}
+
+// unixMilliTime returns the UTC time ms milliseconds since the Unix epoch.
+func unixMilliTime(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC()
 }
 
 func readInt(r *buffer) (int, error) {
@@ -1,8 +1,11 @@
 package amqp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"math"
+	"reflect"
+	"sort"
 	"time"
 	"unicode/utf8"
 )
@@ -41,6 +44,13 @@ type marshaler interface {
 }
 
 func marshal(wr *buffer, i interface{}) error {
+	// a nil pointer carries no value, encode it as null
+	// rather than dereferencing it below
+	if v := reflect.ValueOf(i); v.Kind() == reflect.Ptr && v.IsNil() {
+		wr.writeByte(byte(typeCodeNull))
+		return nil
+	}
+
 	switch t := i.(type) {
 	case nil:
 		wr.writeByte(byte(typeCodeNull))
@@ -294,8 +304,14 @@ func writeDouble(wr *buffer, f float64) {
 
 func writeTimestamp(wr *buffer, t time.Time) {
 	wr.writeByte(byte(typeCodeTimestamp))
-	ms := t.UnixNano() / int64(time.Millisecond)
-	wr.writeUint64(uint64(ms))
+	wr.writeUint64(uint64(unixMilli(t)))
+}
+
+// unixMilli returns t as milliseconds since the Unix epoch, as encoded
+// in a timestamp. Precision below a millisecond is truncated towards the
+// earlier millisecond, for times before the epoch as for those after it.
+func unixMilli(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
 }
 
 // marshalField is a field to be marshaled
@@ -430,6 +446,12 @@ func writeBinary(wr *buffer, bin []byte) error {
 }
 
 func writeMap(wr *buffer, m interface{}) error {
+	if wr.sortMapKeys {
+		if v := reflect.ValueOf(m); v.Kind() == reflect.Map && v.Len() > 1 {
+			return writeSortedMap(wr, v)
+		}
+	}
+
 	startIdx := wr.len()
 	wr.write([]byte{
 		byte(typeCodeMap32), // type
@@ -478,7 +500,7 @@ func writeMap(wr *buffer, m interface{}) error {
 	case unsettled:
 		pairs = len(m) * 2
 		for key, val := range m {
-			err := writeString(wr, key)
+			err := writeBinary(wr, []byte(key))
 			if err != nil {
 				return err
 			}
@@ -545,6 +567,46 @@ func writeMap(wr *buffer, m interface{}) error {
 	return nil
 }
 
+// writeSortedMap writes m with its entries ordered by their encoding,
+// so that equal maps are always encoded to the same bytes.
+func writeSortedMap(wr *buffer, m reflect.Value) error {
+	const headerSize = 9 // type, size and length of a map32
+
+	entries := make([][]byte, 0, m.Len())
+	iter := m.MapRange()
+	for iter.Next() {
+		// encode each entry as a map of one, dropping its header
+		single := reflect.MakeMapWithSize(m.Type(), 1)
+		single.SetMapIndex(iter.Key(), iter.Value())
+		entry := &buffer{sortMapKeys: true}
+		err := writeMap(entry, single.Interface())
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry.bytes()[headerSize:])
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i], entries[j]) < 0
+	})
+
+	pairs := len(entries) * 2
+	if uint(pairs) > math.MaxUint32-4 {
+		return errorNew("map contains too many elements")
+	}
+
+	length := 4 // length field
+	for _, entry := range entries {
+		length += len(entry)
+	}
+	wr.writeByte(byte(typeCodeMap32))
+	wr.writeUint32(uint32(length))
+	wr.writeUint32(uint32(pairs))
+	for _, entry := range entries {
+		wr.write(entry)
+	}
+	return nil
+}
+
 // type length sizes
 const (
 	array8TLSize  = 2
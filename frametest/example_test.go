@@ -0,0 +1,34 @@
+package frametest_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Azure/go-amqp/frametest"
+)
+
+func Example() {
+	// a fake broker answering a receiver's attach
+	b, err := frametest.Encode(frametest.Frame{
+		Channel: 0,
+		Body: &frametest.Attach{
+			Name:   "receiver-link",
+			Handle: 0,
+			Role:   frametest.RoleSender,
+			Source: &frametest.Source{Address: "orders"},
+			Target: &frametest.Target{},
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fr, _, err := frametest.Decode(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	attach := fr.Body.(*frametest.Attach)
+	fmt.Println(attach.Name, attach.Role == frametest.RoleSender, attach.Source.Address)
+	// Output:
+	// receiver-link true orders
+}
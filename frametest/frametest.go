@@ -0,0 +1,126 @@
+// Package frametest encodes and decodes AMQP 1.0 frames, for tests that
+// stand in for the peer of a go-amqp Client, such as a fake broker.
+//
+// It covers the performatives of the connection, session and link
+// protocols and the delivery outcomes they carry, with the fields most
+// fake peers need. Other fields, such as properties, filters and the
+// unsettled map of an Attach, aren't encoded and are skipped when
+// decoding. It doesn't implement SASL or the message format; a
+// Transfer's Payload holds the encoded message, for example from
+// (*amqp.Message).MarshalBinary.
+//
+// Zero values of optional fields are omitted from the encoding, and
+// omitted fields decode as zero values. Defaults from the specification
+// aren't applied. Fields for which zero is meaningful are pointers.
+package frametest
+
+import (
+	"io"
+
+	"github.com/Azure/go-amqp/internal/frames"
+)
+
+// ProtocolHeader is the header exchanged by both peers before the Open
+// frame of an AMQP connection without SASL.
+var ProtocolHeader = frames.ProtocolHeader
+
+// Frame is an AMQP frame. Body is nil for an empty frame, as sent to
+// keep a connection alive.
+type Frame = frames.Frame
+
+// Performative is the body of a Frame, one of *Open, *Begin, *Attach,
+// *Flow, *Transfer, *Disposition, *Detach, *End or *Close.
+type Performative = frames.Performative
+
+// DeliveryState is the outcome of a delivery, one of *Accepted,
+// *Rejected, *Released or *Modified.
+type DeliveryState = frames.DeliveryState
+
+// Role is the role of a link endpoint.
+type Role = frames.Role
+
+// Roles of link endpoints, as encoded in Attach and Disposition.
+const (
+	RoleSender   = frames.RoleSender
+	RoleReceiver = frames.RoleReceiver
+)
+
+// Symbol is an AMQP symbol, an ASCII string used for names such as
+// capabilities and error conditions.
+type Symbol = frames.Symbol
+
+// Open is the first frame sent on a connection.
+type Open = frames.Open
+
+// Begin begins a session on a channel.
+type Begin = frames.Begin
+
+// Attach attaches a link to a session.
+//
+// InitialDeliveryCount is only encoded when Role is RoleSender.
+type Attach = frames.Attach
+
+// Source is the source terminus of a link.
+type Source = frames.Source
+
+// Target is the target terminus of a link.
+type Target = frames.Target
+
+// Flow updates the flow state of a session and, if Handle is set, a link.
+type Flow = frames.Flow
+
+// Transfer transfers a message, or part of one, on a link.
+//
+// Payload is the encoded message following the performative in the frame.
+type Transfer = frames.Transfer
+
+// Disposition informs the peer of the state of a range of deliveries.
+type Disposition = frames.Disposition
+
+// Detach detaches a link, closing it if Closed is set.
+type Detach = frames.Detach
+
+// End ends a session.
+type End = frames.End
+
+// Close closes a connection.
+type Close = frames.Close
+
+// Error is the error carried by Detach, End, Close and Rejected.
+type Error = frames.Error
+
+// Accepted is the outcome of a successfully processed delivery.
+type Accepted = frames.Accepted
+
+// Rejected is the outcome of an invalid delivery.
+type Rejected = frames.Rejected
+
+// Released is the outcome of a delivery that wasn't processed.
+type Released = frames.Released
+
+// Modified is the outcome of a delivery that wasn't processed and
+// should be modified before it's redelivered.
+type Modified = frames.Modified
+
+// Encode returns the encoding of fr, including the frame header.
+func Encode(fr Frame) ([]byte, error) {
+	return frames.Encode(fr)
+}
+
+// Write encodes fr and writes it to w.
+func Write(w io.Writer, fr Frame) error {
+	return frames.Write(w, fr)
+}
+
+// Decode decodes the frame at the start of b, returning it and the
+// number of bytes it used.
+//
+// If b doesn't hold a complete frame, the error is io.ErrUnexpectedEOF.
+func Decode(b []byte) (Frame, int, error) {
+	return frames.Decode(b)
+}
+
+// Read reads and decodes a frame from r.
+func Read(r io.Reader) (Frame, error) {
+	return frames.Read(r)
+}
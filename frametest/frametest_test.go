@@ -0,0 +1,338 @@
+package frametest_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/Azure/go-amqp/frametest"
+	"github.com/Azure/go-amqp/internal/testbroker"
+	"github.com/google/go-cmp/cmp"
+)
+
+func uint8Ptr(n uint8) *uint8    { return &n }
+func uint16Ptr(n uint16) *uint16 { return &n }
+func uint32Ptr(n uint32) *uint32 { return &n }
+
+func TestRoundTrip(t *testing.T) {
+	errInfo := &frametest.Error{
+		Condition:   "amqp:internal-error",
+		Description: "failed",
+	}
+	tests := []frametest.Performative{
+		&frametest.Open{
+			ContainerID:         "container",
+			Hostname:            "example.com",
+			MaxFrameSize:        65536,
+			ChannelMax:          uint16Ptr(0),
+			IdleTimeout:         30 * time.Second,
+			OfferedCapabilities: []frametest.Symbol{"ANONYMOUS-RELAY"},
+		},
+		&frametest.Begin{
+			RemoteChannel:  uint16Ptr(1),
+			NextOutgoingID: 7,
+			IncomingWindow: 5000,
+			OutgoingWindow: 1000,
+			HandleMax:      uint32Ptr(0),
+		},
+		&frametest.Attach{
+			Name:                 "link",
+			Handle:               3,
+			Role:                 frametest.RoleSender,
+			SenderSettleMode:     uint8Ptr(0),
+			ReceiverSettleMode:   uint8Ptr(1),
+			Source:               &frametest.Source{Address: "queue", Durable: 2},
+			Target:               &frametest.Target{Dynamic: true, Capabilities: []frametest.Symbol{"queue"}},
+			InitialDeliveryCount: 42,
+			MaxMessageSize:       1 << 40,
+		},
+		&frametest.Flow{
+			NextIncomingID: uint32Ptr(0),
+			IncomingWindow: 100,
+			NextOutgoingID: 1,
+			OutgoingWindow: 100,
+			Handle:         uint32Ptr(0),
+			DeliveryCount:  uint32Ptr(0),
+			LinkCredit:     uint32Ptr(300),
+			Drain:          true,
+		},
+		&frametest.Transfer{
+			Handle:        1,
+			DeliveryID:    uint32Ptr(9),
+			DeliveryTag:   []byte("tag"),
+			MessageFormat: uint32Ptr(0),
+			More:          true,
+			State:         &frametest.Rejected{Error: errInfo},
+			Payload:       []byte{0x00, 0x53, 0x75, 0xa0, 0x02, 'h', 'i'},
+		},
+		&frametest.Disposition{
+			Role:    frametest.RoleReceiver,
+			First:   1,
+			Last:    uint32Ptr(3),
+			Settled: true,
+			State:   &frametest.Modified{DeliveryFailed: true, UndeliverableHere: true},
+		},
+		&frametest.Disposition{Role: frametest.RoleSender, State: &frametest.Accepted{}},
+		&frametest.Disposition{Role: frametest.RoleSender, State: &frametest.Released{}},
+		&frametest.Detach{Handle: 2, Closed: true, Error: errInfo},
+		&frametest.End{},
+		&frametest.Close{Error: errInfo},
+	}
+
+	for _, body := range tests {
+		t.Run(fmt.Sprintf("%T", body), func(t *testing.T) {
+			want := frametest.Frame{Channel: 5, Body: body}
+			b, err := frametest.Encode(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// trailing data belongs to the next frame
+			got, n, err := frametest.Decode(append(b, 0xff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(b) {
+				t.Errorf("Decode() used %d bytes, want %d", n, len(b))
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Error(diff)
+			}
+			if _, _, err := frametest.Decode(b[:len(b)-1]); err != io.ErrUnexpectedEOF {
+				t.Errorf("Decode() of a truncated frame error = %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+		})
+	}
+}
+
+// frame returns an AMQP frame on channel 0 holding body.
+func frame(body ...byte) []byte {
+	b := append([]byte{0, 0, 0, 0, 2, 0, 0, 0}, body...)
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// open returns the body of an Open frame with the encoded fields.
+func open(count byte, fields ...byte) []byte {
+	return append([]byte{0x00, 0x53, 0x10, 0xc0, byte(len(fields) + 1), count}, fields...)
+}
+
+func TestDecodeSkipsFields(t *testing.T) {
+	b := frame(open(10,
+		0xa1, 1, 'c', // container-id
+		0x40, 0x40, 0x40, 0x40, // hostname to idle-time-out
+		0xe0, 2, 3, 0x43, // outgoing-locales, an array of three uint0
+		0x40, 0x40, 0x40, // incoming-locales to desired-capabilities
+		0xc1, 13, 2, 0xa3, 1, 'k', 0x83, 0, 0, 0, 0, 0, 0, 0, 1, // properties, a timestamp
+	)...)
+	fr, _, err := frametest.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &frametest.Open{ContainerID: "c"}
+	if diff := cmp.Diff(want, fr.Body); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	var nested []byte
+	for i := 0; i < 100; i++ {
+		nested = append(nested, 0x00, 0x53, 0x10)
+	}
+	nested = append(nested, 0x45)
+
+	tests := []struct {
+		label string
+		frame []byte
+	}{
+		{label: "data offset in header", frame: []byte{0, 0, 0, 8, 1, 0, 0, 0}},
+		{label: "data offset past frame", frame: []byte{0, 0, 0, 8, 3, 0, 0, 0}},
+		{label: "nesting", frame: frame(nested...)},
+		{label: "list length", frame: frame(0x00, 0x53, 0x10, 0xd0, 0, 0, 0, 4, 0xff, 0xff, 0xff, 0xff)},
+		{label: "array length", frame: frame(open(1, 0xf0, 0, 0, 0, 5, 0x7f, 0xff, 0xff, 0xff, 0xb3)...)},
+		{label: "zero width array length", frame: frame(open(1, 0xf0, 0, 0, 0, 5, 0x7f, 0xff, 0xff, 0xff, 0x43)...)},
+		{label: "element past list", frame: frame(open(1, 0xa1, 5, 'c')...)},
+		{label: "map with odd count", frame: frame(open(2, 0xa1, 1, 'c', 0xc1, 2, 1, 0x40)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			if fr, _, err := frametest.Decode(tt.frame); err == nil {
+				t.Errorf("Decode() = %#v, want error", fr)
+			}
+		})
+	}
+}
+
+func TestEmptyFrame(t *testing.T) {
+	b, err := frametest.Encode(frametest.Frame{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0, 0, 8, 2, 0, 0, 0}; !bytes.Equal(b, want) {
+		t.Errorf("Encode() = %x, want %x", b, want)
+	}
+	fr, err := frametest.Read(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Body != nil {
+		t.Errorf("unexpected body %#v", fr.Body)
+	}
+}
+
+// TestClient exchanges every performative with a Client, checking the
+// package is compatible with the encoding used by go-amqp.
+func TestClient(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+
+	var (
+		broker          = testbroker.New(t, peerConn)
+		receiverHandle  *uint32 // the client's handle for its receiver
+		sentOrder       bool
+		acceptedOrder   bool
+		invoiceReceived bool
+	)
+	broker.Open = func(open *frametest.Open) {
+		if open.ContainerID != "client" {
+			t.Errorf("Open.ContainerID = %q, want %q", open.ContainerID, "client")
+		}
+		broker.Write(0, &frametest.Open{ContainerID: testbroker.ContainerID})
+	}
+	broker.Attach = func(channel uint16, attach *frametest.Attach) {
+		resp := broker.AttachResponse(attach)
+		switch attach.Role {
+		case frametest.RoleReceiver:
+			if attach.Source == nil || attach.Source.Address != "orders" {
+				t.Errorf("unexpected receiver attach %#v", attach)
+			}
+			receiverHandle = &attach.Handle
+			resp.Target = &frametest.Target{}
+			broker.Write(channel, resp)
+		case frametest.RoleSender:
+			if attach.Target == nil || attach.Target.Address != "invoices" {
+				t.Errorf("unexpected sender attach %#v", attach)
+			}
+			resp.Source = &frametest.Source{}
+			broker.Write(channel, resp)
+			broker.Write(channel, &frametest.Flow{
+				NextIncomingID: uint32Ptr(0),
+				IncomingWindow: 100,
+				OutgoingWindow: 100,
+				Handle:         &resp.Handle,
+				DeliveryCount:  uint32Ptr(0),
+				LinkCredit:     uint32Ptr(10),
+			})
+		}
+	}
+	broker.Flow = func(channel uint16, flow *frametest.Flow) {
+		if sentOrder || receiverHandle == nil || flow.Handle == nil || *flow.Handle != *receiverHandle {
+			return
+		}
+		if flow.LinkCredit == nil || *flow.LinkCredit == 0 {
+			t.Errorf("unexpected flow %#v", flow)
+		}
+		payload, err := amqp.NewMessage([]byte("order 1")).MarshalBinary()
+		if err != nil {
+			t.Error(err)
+		}
+		broker.Write(channel, &frametest.Transfer{
+			Handle:        broker.Handle(*receiverHandle),
+			DeliveryID:    uint32Ptr(0),
+			DeliveryTag:   []byte{1},
+			MessageFormat: uint32Ptr(0),
+			Payload:       payload,
+		})
+		sentOrder = true
+	}
+	broker.Disposition = func(channel uint16, disp *frametest.Disposition) {
+		if _, ok := disp.State.(*frametest.Accepted); !ok || disp.Role != frametest.RoleReceiver || disp.First != 0 {
+			t.Errorf("unexpected disposition %#v", disp)
+		}
+		acceptedOrder = true
+	}
+	broker.Transfer = func(channel uint16, transfer *frametest.Transfer) {
+		msg := new(amqp.Message)
+		if err := msg.UnmarshalBinary(transfer.Payload); err != nil {
+			t.Error(err)
+		} else if got := string(msg.GetData()); got != "invoice 1" {
+			t.Errorf("sent message data = %q, want %q", got, "invoice 1")
+		}
+		invoiceReceived = true
+		broker.Write(channel, &frametest.Disposition{
+			Role:    frametest.RoleReceiver,
+			First:   *transfer.DeliveryID,
+			Settled: true,
+			State:   &frametest.Accepted{},
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		broker.Run()
+	}()
+
+	client, err := amqp.New(clientConn, amqp.ConnContainerID("client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := client.RemoteContainerID(); got != "broker" {
+		t.Errorf("RemoteContainerID() = %q, want %q", got, "broker")
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := sess.NewReceiver(amqp.LinkSourceAddress("orders"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := r.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(msg.GetData()); got != "order 1" {
+		t.Errorf("received message data = %q, want %q", got, "order 1")
+	}
+	if err := msg.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := sess.NewSender(amqp.LinkTargetAddress("invoices"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(ctx, amqp.NewMessage([]byte("invoice 1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sess.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker didn't finish")
+	}
+	if !acceptedOrder || !invoiceReceived {
+		t.Errorf("broker received disposition = %t, transfer = %t, want true, true", acceptedOrder, invoiceReceived)
+	}
+}
@@ -79,6 +79,27 @@ func FuzzConn(data []byte) int {
 	return 1
 }
 
+// FuzzUnmarshalMessage decodes data with Message.UnmarshalBinary and
+// checks that a decoded message can be encoded and decoded again.
+func FuzzUnmarshalMessage(data []byte) int {
+	var msg Message
+	if err := msg.UnmarshalBinary(data); err != nil {
+		return 0
+	}
+
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		// decoding is more lenient than encoding, e.g. for the
+		// types of annotation keys
+		return 1
+	}
+	var again Message
+	if err := again.UnmarshalBinary(b); err != nil {
+		panic(err)
+	}
+	return 1
+}
+
 func FuzzUnmarshal(data []byte) int {
 	types := []interface{}{
 		new(performAttach),
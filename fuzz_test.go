@@ -386,6 +386,19 @@ func TestFuzzMarshalCrashers(t *testing.T) {
 	}
 }
 
+func TestFuzzMessageCrashers(t *testing.T) {
+	tests := []string{
+		0: "\x00Sw\xf0\x00\x00\x00\x05\x7f\xff\xff\xff\x43", // array of uint0 with a huge length
+		1: "\x00Sx\xc1\x06\x02\xa0\x0200\x40",               // annotations with a binary key
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			FuzzUnmarshalMessage([]byte(tt))
+		})
+	}
+}
+
 func testDirFiles(t *testing.T, dir string) []string {
 	finfos, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -434,3 +447,20 @@ func TestFuzzMarshalCorpus(t *testing.T) {
 		})
 	}
 }
+
+func TestFuzzMessageCorpus(t *testing.T) {
+	if os.Getenv("TEST_CORPUS") == "" {
+		t.Skip("set TEST_CORPUS to enable")
+	}
+
+	for _, path := range testDirFiles(t, "fuzz/message/corpus") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			FuzzUnmarshalMessage(data)
+		})
+	}
+}
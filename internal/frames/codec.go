@@ -0,0 +1,476 @@
+package frames
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// AMQP type codes used by the encoder and decoder.
+const (
+	codeDescribed  = 0x00
+	codeNull       = 0x40
+	codeBoolTrue   = 0x41
+	codeBoolFalse  = 0x42
+	codeBool       = 0x56
+	codeUbyte      = 0x50
+	codeUshort     = 0x60
+	codeUint       = 0x70
+	codeSmallUint  = 0x52
+	codeUint0      = 0x43
+	codeUlong      = 0x80
+	codeSmallUlong = 0x53
+	codeUlong0     = 0x44
+	codeVbin8      = 0xa0
+	codeVbin32     = 0xb0
+	codeStr8       = 0xa1
+	codeStr32      = 0xb1
+	codeSym8       = 0xa3
+	codeSym32      = 0xb3
+	codeList0      = 0x45
+	codeList8      = 0xc0
+	codeList32     = 0xd0
+	codeMap8       = 0xc1
+	codeMap32      = 0xd1
+	codeArray8     = 0xe0
+	codeArray32    = 0xf0
+)
+
+// fixedWidth is the size of the values of the remaining fixed width
+// types, such as timestamps. Fields of these types aren't represented
+// by this package, so their values are skipped when decoding.
+var fixedWidth = map[byte]int{
+	0x51: 1,  // byte
+	0x54: 1,  // smallint
+	0x55: 1,  // smalllong
+	0x61: 2,  // short
+	0x71: 4,  // int
+	0x72: 4,  // float
+	0x73: 4,  // char
+	0x74: 4,  // decimal32
+	0x81: 8,  // long
+	0x82: 8,  // double
+	0x83: 8,  // timestamp
+	0x84: 8,  // decimal64
+	0x94: 16, // decimal128
+	0x98: 16, // uuid
+}
+
+const (
+	// maxDepth is the maximum nesting of described values, lists, maps
+	// and arrays. Performatives only nest a few levels deep, the limit
+	// stops a malformed frame from exhausting the stack.
+	maxDepth = 32
+
+	// maxZeroWidthArrayLength is the maximum length of an array
+	// whose elements take no space, such as an array of uint0.
+	maxZeroWidthArrayLength = 1 << 16
+)
+
+// Symbol is an AMQP symbol, an ASCII string used for names such as
+// capabilities and error conditions.
+type Symbol string
+
+// composite is implemented by the described list types of this package.
+type composite interface {
+	code() uint64
+	fields() []interface{}
+}
+
+// described is a decoded described value.
+type described struct {
+	descriptor interface{}
+	value      interface{}
+}
+
+// skipped is decoded in place of a map or a value of a type that
+// isn't represented by this package.
+type skipped struct{}
+
+// encoder appends AMQP encoded values to b.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) byte(b byte) {
+	e.b = append(e.b, b)
+}
+
+func (e *encoder) uint16(n uint16) {
+	e.b = append(e.b, byte(n>>8), byte(n))
+}
+
+func (e *encoder) uint32(n uint32) {
+	e.b = append(e.b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// variable writes a variable width value using the 8 bit form if
+// it fits and the 32 bit form otherwise.
+func (e *encoder) variable(code8, code32 byte, b []byte) {
+	if len(b) <= math.MaxUint8 {
+		e.byte(code8)
+		e.byte(byte(len(b)))
+	} else {
+		e.byte(code32)
+		e.uint32(uint32(len(b)))
+	}
+	e.b = append(e.b, b...)
+}
+
+// compound writes the 32 bit form of a list or array: the size,
+// the count and the elements written by fn.
+func (e *encoder) compound(code byte, count int, fn func() error) error {
+	e.byte(code)
+	sizeIdx := len(e.b)
+	e.uint32(0) // size, filled in below
+	e.uint32(uint32(count))
+	if err := fn(); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(e.b[sizeIdx:], uint32(len(e.b)-sizeIdx-4))
+	return nil
+}
+
+func (e *encoder) value(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.byte(codeNull)
+	case bool:
+		if v {
+			e.byte(codeBoolTrue)
+		} else {
+			e.byte(codeBoolFalse)
+		}
+	case uint8:
+		e.byte(codeUbyte)
+		e.byte(v)
+	case uint16:
+		e.byte(codeUshort)
+		e.uint16(v)
+	case uint32:
+		switch {
+		case v == 0:
+			e.byte(codeUint0)
+		case v <= math.MaxUint8:
+			e.byte(codeSmallUint)
+			e.byte(byte(v))
+		default:
+			e.byte(codeUint)
+			e.uint32(v)
+		}
+	case uint64:
+		switch {
+		case v == 0:
+			e.byte(codeUlong0)
+		case v <= math.MaxUint8:
+			e.byte(codeSmallUlong)
+			e.byte(byte(v))
+		default:
+			e.byte(codeUlong)
+			e.uint32(uint32(v >> 32))
+			e.uint32(uint32(v))
+		}
+	case string:
+		e.variable(codeStr8, codeStr32, []byte(v))
+	case Symbol:
+		e.variable(codeSym8, codeSym32, []byte(v))
+	case []byte:
+		e.variable(codeVbin8, codeVbin32, v)
+	case []Symbol:
+		// an array shares the element constructor, sym32
+		// is used so that any symbol fits
+		return e.compound(codeArray32, len(v), func() error {
+			e.byte(codeSym32)
+			for _, s := range v {
+				e.uint32(uint32(len(s)))
+				e.b = append(e.b, s...)
+			}
+			return nil
+		})
+	case composite:
+		e.byte(codeDescribed)
+		e.value(v.code())
+		fields := v.fields()
+		// trailing null fields are omitted
+		for len(fields) > 0 && fields[len(fields)-1] == nil {
+			fields = fields[:len(fields)-1]
+		}
+		if len(fields) == 0 {
+			e.byte(codeList0)
+			return nil
+		}
+		return e.compound(codeList32, len(fields), func() error {
+			for _, field := range fields {
+				if err := e.value(field); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	default:
+		return fmt.Errorf("frametest: cannot encode %T", v)
+	}
+	return nil
+}
+
+// decoder reads AMQP encoded values from b.
+type decoder struct {
+	b     []byte
+	depth int // nesting of the values being decoded
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.b) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b, nil
+}
+
+func (d *decoder) byte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) uint16() (uint16, error) {
+	b, err := d.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (d *decoder) uint64() (uint64, error) {
+	b, err := d.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// value decodes the next value.
+//
+// Lists and arrays are decoded as []interface{} and described values
+// as described. Maps and values of types without a representation in
+// this package are checked and decoded as skipped.
+func (d *decoder) value() (interface{}, error) {
+	code, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	return d.valueWithCode(code)
+}
+
+func (d *decoder) valueWithCode(code byte) (interface{}, error) {
+	switch code {
+	case codeDescribed:
+		if d.depth >= maxDepth {
+			return nil, fmt.Errorf("frametest: maximum nesting depth of %d exceeded", maxDepth)
+		}
+		d.depth++
+		defer func() { d.depth-- }()
+		descriptor, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		return described{descriptor: descriptor, value: value}, nil
+	case codeNull:
+		return nil, nil
+	case codeBoolTrue:
+		return true, nil
+	case codeBoolFalse:
+		return false, nil
+	case codeBool:
+		b, err := d.byte()
+		return b != 0, err
+	case codeUbyte:
+		return d.byte()
+	case codeUshort:
+		return d.uint16()
+	case codeUint:
+		return d.uint32()
+	case codeSmallUint:
+		b, err := d.byte()
+		return uint32(b), err
+	case codeUint0:
+		return uint32(0), nil
+	case codeUlong:
+		return d.uint64()
+	case codeSmallUlong:
+		b, err := d.byte()
+		return uint64(b), err
+	case codeUlong0:
+		return uint64(0), nil
+	case codeVbin8, codeVbin32, codeStr8, codeStr32, codeSym8, codeSym32:
+		var n uint32
+		if code&0xf0 == 0xa0 {
+			b, err := d.byte()
+			if err != nil {
+				return nil, err
+			}
+			n = uint32(b)
+		} else {
+			var err error
+			if n, err = d.uint32(); err != nil {
+				return nil, err
+			}
+		}
+		if uint64(n) > uint64(len(d.b)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b, _ := d.next(int(n))
+		switch code {
+		case codeStr8, codeStr32:
+			return string(b), nil
+		case codeSym8, codeSym32:
+			return Symbol(b), nil
+		default:
+			return append([]byte(nil), b...), nil
+		}
+	case codeList0:
+		return []interface{}{}, nil
+	case codeList8, codeList32, codeMap8, codeMap32:
+		elems, count, err := d.compound(code == codeList8 || code == codeMap8)
+		if err != nil {
+			return nil, err
+		}
+		// each element takes at least its constructor
+		if count > len(elems.b) {
+			return nil, fmt.Errorf("frametest: invalid length %d", count)
+		}
+		if (code == codeMap8 || code == codeMap32) && count%2 != 0 {
+			return nil, fmt.Errorf("frametest: map has odd number of elements %d", count)
+		}
+		list := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			v, err := elems.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		if err := elems.end(); err != nil {
+			return nil, err
+		}
+		if code == codeMap8 || code == codeMap32 {
+			return skipped{}, nil
+		}
+		return list, nil
+	case codeArray8, codeArray32:
+		elems, count, err := d.compound(code == codeArray8)
+		if err != nil {
+			return nil, err
+		}
+		elemCode, err := elems.byte()
+		if err != nil {
+			return nil, err
+		}
+		var descriptor interface{}
+		if elemCode == codeDescribed {
+			if descriptor, err = elems.value(); err != nil {
+				return nil, err
+			}
+			if elemCode, err = elems.byte(); err != nil {
+				return nil, err
+			}
+		}
+		// bound the length to avoid huge allocations, elements take at
+		// least a byte unless their constructor is one that takes no space
+		limit := len(elems.b)
+		switch elemCode {
+		case codeNull, codeBoolTrue, codeBoolFalse, codeUint0, codeUlong0, codeList0:
+			limit = maxZeroWidthArrayLength
+		}
+		if count > limit {
+			return nil, fmt.Errorf("frametest: invalid length %d", count)
+		}
+		array := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			v, err := elems.valueWithCode(elemCode)
+			if err != nil {
+				return nil, err
+			}
+			if descriptor != nil {
+				v = described{descriptor: descriptor, value: v}
+			}
+			array = append(array, v)
+		}
+		if err := elems.end(); err != nil {
+			return nil, err
+		}
+		return array, nil
+	default:
+		n, ok := fixedWidth[code]
+		if !ok {
+			return nil, fmt.Errorf("frametest: unsupported type code %#02x", code)
+		}
+		_, err := d.next(n)
+		return skipped{}, err
+	}
+}
+
+// compound reads the size and count of a list, map or array and
+// returns a decoder for its elements, nested one level deeper.
+func (d *decoder) compound(small bool) (*decoder, int, error) {
+	if d.depth >= maxDepth {
+		return nil, 0, fmt.Errorf("frametest: maximum nesting depth of %d exceeded", maxDepth)
+	}
+	var size uint32
+	if small {
+		b, err := d.byte()
+		if err != nil {
+			return nil, 0, err
+		}
+		size = uint32(b)
+	} else {
+		var err error
+		if size, err = d.uint32(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if uint64(size) > uint64(len(d.b)) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	b, _ := d.next(int(size))
+
+	// the size includes the count
+	elems := &decoder{b: b, depth: d.depth + 1}
+	if small {
+		count, err := elems.byte()
+		return elems, int(count), err
+	}
+	count, err := elems.uint32()
+	if err != nil {
+		return nil, 0, err
+	}
+	if count > math.MaxInt32 {
+		return nil, 0, fmt.Errorf("frametest: invalid length %d", count)
+	}
+	return elems, int(count), nil
+}
+
+// end returns an error if d has data left over after decoding
+// the elements of a compound value.
+func (d *decoder) end() error {
+	if len(d.b) > 0 {
+		return fmt.Errorf("frametest: %d bytes left over after the last element", len(d.b))
+	}
+	return nil
+}
@@ -0,0 +1,900 @@
+// Package frames encodes and decodes AMQP 1.0 frames for fake peers in
+// tests. It's exported by package frametest, which documents its
+// behavior, and shared with the tests of package amqp.
+package frames
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ProtocolHeader is the header exchanged by both peers before the Open
+// frame of an AMQP connection without SASL.
+var ProtocolHeader = []byte{'A', 'M', 'Q', 'P', 0, 1, 0, 0}
+
+const (
+	frameHeaderSize = 8
+	frameTypeAMQP   = 0x0
+)
+
+// Frame is an AMQP frame.
+type Frame struct {
+	Channel uint16
+	Body    Performative // nil for an empty frame, as sent to keep a connection alive
+}
+
+// Performative is the body of a Frame, one of *Open, *Begin, *Attach,
+// *Flow, *Transfer, *Disposition, *Detach, *End or *Close.
+type Performative interface {
+	composite
+	performative()
+}
+
+// DeliveryState is the outcome of a delivery, one of *Accepted,
+// *Rejected, *Released or *Modified.
+type DeliveryState interface {
+	composite
+	deliveryState()
+}
+
+// Role is the role of a link endpoint.
+type Role bool
+
+// Roles of link endpoints, as encoded in Attach and Disposition.
+const (
+	RoleSender   Role = false
+	RoleReceiver Role = true
+)
+
+// Open is the first frame sent on a connection.
+type Open struct {
+	ContainerID         string
+	Hostname            string
+	MaxFrameSize        uint32
+	ChannelMax          *uint16
+	IdleTimeout         time.Duration // encoded in milliseconds
+	OfferedCapabilities []Symbol
+	DesiredCapabilities []Symbol
+}
+
+// Begin begins a session on a channel.
+type Begin struct {
+	RemoteChannel  *uint16
+	NextOutgoingID uint32
+	IncomingWindow uint32
+	OutgoingWindow uint32
+	HandleMax      *uint32
+}
+
+// Attach attaches a link to a session.
+//
+// InitialDeliveryCount is only encoded when Role is RoleSender.
+type Attach struct {
+	Name                 string
+	Handle               uint32
+	Role                 Role
+	SenderSettleMode     *uint8
+	ReceiverSettleMode   *uint8
+	Source               *Source
+	Target               *Target
+	InitialDeliveryCount uint32
+	MaxMessageSize       uint64
+	OfferedCapabilities  []Symbol
+	DesiredCapabilities  []Symbol
+}
+
+// Source is the source terminus of a link.
+type Source struct {
+	Address      string
+	Durable      uint32
+	Dynamic      bool
+	Capabilities []Symbol
+}
+
+// Target is the target terminus of a link.
+type Target struct {
+	Address      string
+	Durable      uint32
+	Dynamic      bool
+	Capabilities []Symbol
+}
+
+// Flow updates the flow state of a session and, if Handle is set, a link.
+type Flow struct {
+	NextIncomingID *uint32
+	IncomingWindow uint32
+	NextOutgoingID uint32
+	OutgoingWindow uint32
+	Handle         *uint32
+	DeliveryCount  *uint32
+	LinkCredit     *uint32
+	Available      *uint32
+	Drain          bool
+	Echo           bool
+}
+
+// Transfer transfers a message, or part of one, on a link.
+//
+// Payload is the encoded message following the performative in the frame.
+type Transfer struct {
+	Handle             uint32
+	DeliveryID         *uint32
+	DeliveryTag        []byte
+	MessageFormat      *uint32
+	Settled            bool
+	More               bool
+	ReceiverSettleMode *uint8
+	State              DeliveryState
+	Resume             bool
+	Aborted            bool
+	Batchable          bool
+	Payload            []byte
+}
+
+// Disposition informs the peer of the state of a range of deliveries.
+type Disposition struct {
+	Role      Role
+	First     uint32
+	Last      *uint32
+	Settled   bool
+	State     DeliveryState
+	Batchable bool
+}
+
+// Detach detaches a link, closing it if Closed is set.
+type Detach struct {
+	Handle uint32
+	Closed bool
+	Error  *Error
+}
+
+// End ends a session.
+type End struct {
+	Error *Error
+}
+
+// Close closes a connection.
+type Close struct {
+	Error *Error
+}
+
+// Error is the error carried by Detach, End, Close and Rejected.
+type Error struct {
+	Condition   Symbol
+	Description string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Condition, e.Description)
+}
+
+// Accepted is the outcome of a successfully processed delivery.
+type Accepted struct{}
+
+// Rejected is the outcome of an invalid delivery.
+type Rejected struct {
+	Error *Error
+}
+
+// Released is the outcome of a delivery that wasn't processed.
+type Released struct{}
+
+// Modified is the outcome of a delivery that wasn't processed and
+// should be modified before it's redelivered.
+type Modified struct {
+	DeliveryFailed    bool
+	UndeliverableHere bool
+}
+
+// descriptor codes of the composite types
+const (
+	codeOpen        = 0x10
+	codeBegin       = 0x11
+	codeAttach      = 0x12
+	codeFlow        = 0x13
+	codeTransfer    = 0x14
+	codeDisposition = 0x15
+	codeDetach      = 0x16
+	codeEnd         = 0x17
+	codeClose       = 0x18
+	codeError       = 0x1d
+	codeAccepted    = 0x24
+	codeRejected    = 0x25
+	codeReleased    = 0x26
+	codeModified    = 0x27
+	codeSource      = 0x28
+	codeTarget      = 0x29
+)
+
+func (*Open) code() uint64        { return codeOpen }
+func (*Begin) code() uint64       { return codeBegin }
+func (*Attach) code() uint64      { return codeAttach }
+func (*Flow) code() uint64        { return codeFlow }
+func (*Transfer) code() uint64    { return codeTransfer }
+func (*Disposition) code() uint64 { return codeDisposition }
+func (*Detach) code() uint64      { return codeDetach }
+func (*End) code() uint64         { return codeEnd }
+func (*Close) code() uint64       { return codeClose }
+func (*Error) code() uint64       { return codeError }
+func (*Accepted) code() uint64    { return codeAccepted }
+func (*Rejected) code() uint64    { return codeRejected }
+func (*Released) code() uint64    { return codeReleased }
+func (*Modified) code() uint64    { return codeModified }
+func (*Source) code() uint64      { return codeSource }
+func (*Target) code() uint64      { return codeTarget }
+
+func (*Open) performative()        {}
+func (*Begin) performative()       {}
+func (*Attach) performative()      {}
+func (*Flow) performative()        {}
+func (*Transfer) performative()    {}
+func (*Disposition) performative() {}
+func (*Detach) performative()      {}
+func (*End) performative()         {}
+func (*Close) performative()       {}
+
+func (*Accepted) deliveryState() {}
+func (*Rejected) deliveryState() {}
+func (*Released) deliveryState() {}
+func (*Modified) deliveryState() {}
+
+// The following helpers return nil, omitting the field, for
+// nil pointers and zero values.
+
+func optString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func optBool(b bool) interface{} {
+	if !b {
+		return nil
+	}
+	return true
+}
+
+func optUint32(n uint32) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+func optUint64(n uint64) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+func optUint8Ptr(p *uint8) interface{} {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+func optUint16Ptr(p *uint16) interface{} {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+func optUint32Ptr(p *uint32) interface{} {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+func optSymbols(s []Symbol) interface{} {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
+
+func optBinary(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+func optState(s DeliveryState) interface{} {
+	if s == nil {
+		return nil
+	}
+	return s
+}
+
+func optError(e *Error) interface{} {
+	if e == nil {
+		return nil
+	}
+	return e
+}
+
+func (o *Open) fields() []interface{} {
+	var idleTimeout interface{}
+	if o.IdleTimeout > 0 {
+		idleTimeout = uint32(o.IdleTimeout / time.Millisecond)
+	}
+	return []interface{}{
+		o.ContainerID,
+		optString(o.Hostname),
+		optUint32(o.MaxFrameSize),
+		optUint16Ptr(o.ChannelMax),
+		idleTimeout,
+		nil, // outgoing-locales
+		nil, // incoming-locales
+		optSymbols(o.OfferedCapabilities),
+		optSymbols(o.DesiredCapabilities),
+	}
+}
+
+func (b *Begin) fields() []interface{} {
+	return []interface{}{
+		optUint16Ptr(b.RemoteChannel),
+		b.NextOutgoingID,
+		b.IncomingWindow,
+		b.OutgoingWindow,
+		optUint32Ptr(b.HandleMax),
+	}
+}
+
+func (a *Attach) fields() []interface{} {
+	var source, target, initialDeliveryCount interface{}
+	if a.Source != nil {
+		source = a.Source
+	}
+	if a.Target != nil {
+		target = a.Target
+	}
+	if a.Role == RoleSender {
+		initialDeliveryCount = a.InitialDeliveryCount
+	}
+	return []interface{}{
+		a.Name,
+		a.Handle,
+		bool(a.Role),
+		optUint8Ptr(a.SenderSettleMode),
+		optUint8Ptr(a.ReceiverSettleMode),
+		source,
+		target,
+		nil, // unsettled
+		nil, // incomplete-unsettled
+		initialDeliveryCount,
+		optUint64(a.MaxMessageSize),
+		optSymbols(a.OfferedCapabilities),
+		optSymbols(a.DesiredCapabilities),
+	}
+}
+
+func (s *Source) fields() []interface{} {
+	return []interface{}{
+		optString(s.Address),
+		optUint32(s.Durable),
+		nil, // expiry-policy
+		nil, // timeout
+		optBool(s.Dynamic),
+		nil, // dynamic-node-properties
+		nil, // distribution-mode
+		nil, // filter
+		nil, // default-outcome
+		nil, // outcomes
+		optSymbols(s.Capabilities),
+	}
+}
+
+func (t *Target) fields() []interface{} {
+	return []interface{}{
+		optString(t.Address),
+		optUint32(t.Durable),
+		nil, // expiry-policy
+		nil, // timeout
+		optBool(t.Dynamic),
+		nil, // dynamic-node-properties
+		optSymbols(t.Capabilities),
+	}
+}
+
+func (f *Flow) fields() []interface{} {
+	return []interface{}{
+		optUint32Ptr(f.NextIncomingID),
+		f.IncomingWindow,
+		f.NextOutgoingID,
+		f.OutgoingWindow,
+		optUint32Ptr(f.Handle),
+		optUint32Ptr(f.DeliveryCount),
+		optUint32Ptr(f.LinkCredit),
+		optUint32Ptr(f.Available),
+		optBool(f.Drain),
+		optBool(f.Echo),
+	}
+}
+
+func (t *Transfer) fields() []interface{} {
+	return []interface{}{
+		t.Handle,
+		optUint32Ptr(t.DeliveryID),
+		optBinary(t.DeliveryTag),
+		optUint32Ptr(t.MessageFormat),
+		optBool(t.Settled),
+		optBool(t.More),
+		optUint8Ptr(t.ReceiverSettleMode),
+		optState(t.State),
+		optBool(t.Resume),
+		optBool(t.Aborted),
+		optBool(t.Batchable),
+	}
+}
+
+func (d *Disposition) fields() []interface{} {
+	return []interface{}{
+		bool(d.Role),
+		d.First,
+		optUint32Ptr(d.Last),
+		optBool(d.Settled),
+		optState(d.State),
+		optBool(d.Batchable),
+	}
+}
+
+func (d *Detach) fields() []interface{} {
+	return []interface{}{d.Handle, optBool(d.Closed), optError(d.Error)}
+}
+
+func (e *End) fields() []interface{} {
+	return []interface{}{optError(e.Error)}
+}
+
+func (c *Close) fields() []interface{} {
+	return []interface{}{optError(c.Error)}
+}
+
+func (e *Error) fields() []interface{} {
+	return []interface{}{e.Condition, optString(e.Description)}
+}
+
+func (*Accepted) fields() []interface{} { return nil }
+
+func (r *Rejected) fields() []interface{} {
+	return []interface{}{optError(r.Error)}
+}
+
+func (*Released) fields() []interface{} { return nil }
+
+func (m *Modified) fields() []interface{} {
+	return []interface{}{optBool(m.DeliveryFailed), optBool(m.UndeliverableHere)}
+}
+
+// Encode returns the encoding of fr, including the frame header.
+func Encode(fr Frame) ([]byte, error) {
+	e := &encoder{b: make([]byte, frameHeaderSize, 64)}
+	if fr.Body != nil {
+		if err := e.value(fr.Body); err != nil {
+			return nil, err
+		}
+		if t, ok := fr.Body.(*Transfer); ok {
+			e.b = append(e.b, t.Payload...)
+		}
+	}
+	binary.BigEndian.PutUint32(e.b[0:4], uint32(len(e.b)))
+	e.b[4] = 2 // data offset in 4 byte words
+	e.b[5] = frameTypeAMQP
+	binary.BigEndian.PutUint16(e.b[6:8], fr.Channel)
+	return e.b, nil
+}
+
+// Write encodes fr and writes it to w.
+func Write(w io.Writer, fr Frame) error {
+	b, err := Encode(fr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Decode decodes the frame at the start of b, returning it and the
+// number of bytes it used.
+//
+// If b doesn't hold a complete frame, the error is io.ErrUnexpectedEOF.
+func Decode(b []byte) (Frame, int, error) {
+	if len(b) < frameHeaderSize {
+		return Frame{}, 0, io.ErrUnexpectedEOF
+	}
+	size := binary.BigEndian.Uint32(b[0:4])
+	dataOffset := int(b[4]) * 4
+	if size < frameHeaderSize || dataOffset < frameHeaderSize || uint64(dataOffset) > uint64(size) {
+		return Frame{}, 0, fmt.Errorf("frametest: invalid frame header size %d, data offset %d", size, dataOffset)
+	}
+	if b[5] != frameTypeAMQP {
+		return Frame{}, 0, fmt.Errorf("frametest: unsupported frame type %#02x", b[5])
+	}
+	if uint64(len(b)) < uint64(size) {
+		return Frame{}, 0, io.ErrUnexpectedEOF
+	}
+
+	fr := Frame{Channel: binary.BigEndian.Uint16(b[6:8])}
+	body := b[dataOffset:size]
+	if len(body) == 0 {
+		return fr, int(size), nil
+	}
+
+	d := &decoder{b: body}
+	v, err := d.value()
+	if err == io.ErrUnexpectedEOF {
+		err = errors.New("frametest: frame body is truncated")
+	}
+	if err != nil {
+		return Frame{}, 0, err
+	}
+	c, err := decodeComposite(v)
+	if err != nil {
+		return Frame{}, 0, err
+	}
+	p, ok := c.(Performative)
+	if !ok {
+		return Frame{}, 0, fmt.Errorf("frametest: frame body is %T, not a performative", c)
+	}
+	if t, ok := p.(*Transfer); ok {
+		t.Payload = append([]byte(nil), d.b...)
+	} else if len(d.b) > 0 {
+		return Frame{}, 0, fmt.Errorf("frametest: %d unexpected bytes after %T", len(d.b), p)
+	}
+	fr.Body = p
+	return fr, int(size), nil
+}
+
+// Read reads and decodes a frame from r.
+func Read(r io.Reader) (Frame, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Frame{}, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size < frameHeaderSize {
+		return Frame{}, fmt.Errorf("frametest: invalid frame size %d", size)
+	}
+	b := make([]byte, size)
+	copy(b, header)
+	if _, err := io.ReadFull(r, b[frameHeaderSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	fr, _, err := Decode(b)
+	return fr, err
+}
+
+// decodeComposite converts a decoded described list to the
+// composite type with its descriptor.
+func decodeComposite(v interface{}) (composite, error) {
+	desc, ok := v.(described)
+	if !ok {
+		return nil, fmt.Errorf("frametest: expected a described type, got %T", v)
+	}
+	code, ok := desc.descriptor.(uint64)
+	if !ok {
+		return nil, fmt.Errorf("frametest: unsupported descriptor %v", desc.descriptor)
+	}
+	list, ok := desc.value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("frametest: descriptor %#02x describes %T, not a list", code, desc.value)
+	}
+	l := &fieldList{code: code, vals: list}
+
+	var c composite
+	switch code {
+	case codeOpen:
+		c = &Open{
+			ContainerID:         l.string(0),
+			Hostname:            l.string(1),
+			MaxFrameSize:        l.uint32(2),
+			ChannelMax:          l.uint16Ptr(3),
+			IdleTimeout:         time.Duration(l.uint32(4)) * time.Millisecond,
+			OfferedCapabilities: l.symbols(7),
+			DesiredCapabilities: l.symbols(8),
+		}
+	case codeBegin:
+		c = &Begin{
+			RemoteChannel:  l.uint16Ptr(0),
+			NextOutgoingID: l.uint32(1),
+			IncomingWindow: l.uint32(2),
+			OutgoingWindow: l.uint32(3),
+			HandleMax:      l.uint32Ptr(4),
+		}
+	case codeAttach:
+		a := &Attach{
+			Name:                 l.string(0),
+			Handle:               l.uint32(1),
+			Role:                 Role(l.bool(2)),
+			SenderSettleMode:     l.uint8Ptr(3),
+			ReceiverSettleMode:   l.uint8Ptr(4),
+			InitialDeliveryCount: l.uint32(9),
+			MaxMessageSize:       l.uint64(10),
+			OfferedCapabilities:  l.symbols(11),
+			DesiredCapabilities:  l.symbols(12),
+		}
+		if s, ok := l.composite(5).(*Source); ok {
+			a.Source = s
+		}
+		if t, ok := l.composite(6).(*Target); ok {
+			a.Target = t
+		}
+		c = a
+	case codeSource:
+		c = &Source{
+			Address:      l.string(0),
+			Durable:      l.uint32(1),
+			Dynamic:      l.bool(4),
+			Capabilities: l.symbols(10),
+		}
+	case codeTarget:
+		c = &Target{
+			Address:      l.string(0),
+			Durable:      l.uint32(1),
+			Dynamic:      l.bool(4),
+			Capabilities: l.symbols(6),
+		}
+	case codeFlow:
+		c = &Flow{
+			NextIncomingID: l.uint32Ptr(0),
+			IncomingWindow: l.uint32(1),
+			NextOutgoingID: l.uint32(2),
+			OutgoingWindow: l.uint32(3),
+			Handle:         l.uint32Ptr(4),
+			DeliveryCount:  l.uint32Ptr(5),
+			LinkCredit:     l.uint32Ptr(6),
+			Available:      l.uint32Ptr(7),
+			Drain:          l.bool(8),
+			Echo:           l.bool(9),
+		}
+	case codeTransfer:
+		c = &Transfer{
+			Handle:             l.uint32(0),
+			DeliveryID:         l.uint32Ptr(1),
+			DeliveryTag:        l.binary(2),
+			MessageFormat:      l.uint32Ptr(3),
+			Settled:            l.bool(4),
+			More:               l.bool(5),
+			ReceiverSettleMode: l.uint8Ptr(6),
+			State:              l.state(7),
+			Resume:             l.bool(8),
+			Aborted:            l.bool(9),
+			Batchable:          l.bool(10),
+		}
+	case codeDisposition:
+		c = &Disposition{
+			Role:      Role(l.bool(0)),
+			First:     l.uint32(1),
+			Last:      l.uint32Ptr(2),
+			Settled:   l.bool(3),
+			State:     l.state(4),
+			Batchable: l.bool(5),
+		}
+	case codeDetach:
+		c = &Detach{Handle: l.uint32(0), Closed: l.bool(1), Error: l.error(2)}
+	case codeEnd:
+		c = &End{Error: l.error(0)}
+	case codeClose:
+		c = &Close{Error: l.error(0)}
+	case codeError:
+		c = &Error{Condition: l.symbol(0), Description: l.string(1)}
+	case codeAccepted:
+		c = &Accepted{}
+	case codeRejected:
+		c = &Rejected{Error: l.error(0)}
+	case codeReleased:
+		c = &Released{}
+	case codeModified:
+		c = &Modified{DeliveryFailed: l.bool(0), UndeliverableHere: l.bool(1)}
+	default:
+		return nil, fmt.Errorf("frametest: unsupported descriptor %#02x", code)
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+	return c, nil
+}
+
+// fieldList converts the fields of a decoded described list. The
+// first conversion error is kept in err and zero values are returned
+// for later fields. Fields that aren't converted are ignored.
+type fieldList struct {
+	code uint64
+	vals []interface{}
+	err  error
+}
+
+func (l *fieldList) get(i int) interface{} {
+	if l.err != nil || i >= len(l.vals) {
+		return nil
+	}
+	return l.vals[i]
+}
+
+func (l *fieldList) fail(i int, v interface{}) {
+	if l.err == nil {
+		l.err = fmt.Errorf("frametest: descriptor %#02x field %d has unexpected type %T", l.code, i, v)
+	}
+}
+
+func (l *fieldList) string(i int) string {
+	switch v := l.get(i).(type) {
+	case nil:
+	case string:
+		return v
+	default:
+		l.fail(i, v)
+	}
+	return ""
+}
+
+func (l *fieldList) symbol(i int) Symbol {
+	switch v := l.get(i).(type) {
+	case nil:
+	case Symbol:
+		return v
+	default:
+		l.fail(i, v)
+	}
+	return ""
+}
+
+func (l *fieldList) binary(i int) []byte {
+	switch v := l.get(i).(type) {
+	case nil:
+	case []byte:
+		return v
+	default:
+		l.fail(i, v)
+	}
+	return nil
+}
+
+func (l *fieldList) bool(i int) bool {
+	switch v := l.get(i).(type) {
+	case nil:
+	case bool:
+		return v
+	default:
+		l.fail(i, v)
+	}
+	return false
+}
+
+// uint converts field i to an unsigned integer no larger than max.
+func (l *fieldList) uint(i int, max uint64) (uint64, bool) {
+	var n uint64
+	switch v := l.get(i).(type) {
+	case nil:
+		return 0, false
+	case uint8:
+		n = uint64(v)
+	case uint16:
+		n = uint64(v)
+	case uint32:
+		n = uint64(v)
+	case uint64:
+		n = v
+	default:
+		l.fail(i, v)
+		return 0, false
+	}
+	if n > max {
+		l.fail(i, l.get(i))
+		return 0, false
+	}
+	return n, true
+}
+
+func (l *fieldList) uint8Ptr(i int) *uint8 {
+	n, ok := l.uint(i, 1<<8-1)
+	if !ok {
+		return nil
+	}
+	v := uint8(n)
+	return &v
+}
+
+func (l *fieldList) uint16Ptr(i int) *uint16 {
+	n, ok := l.uint(i, 1<<16-1)
+	if !ok {
+		return nil
+	}
+	v := uint16(n)
+	return &v
+}
+
+func (l *fieldList) uint32Ptr(i int) *uint32 {
+	n, ok := l.uint(i, 1<<32-1)
+	if !ok {
+		return nil
+	}
+	v := uint32(n)
+	return &v
+}
+
+func (l *fieldList) uint32(i int) uint32 {
+	n, _ := l.uint(i, 1<<32-1)
+	return uint32(n)
+}
+
+func (l *fieldList) uint64(i int) uint64 {
+	n, _ := l.uint(i, 1<<64-1)
+	return n
+}
+
+func (l *fieldList) symbols(i int) []Symbol {
+	switch v := l.get(i).(type) {
+	case nil:
+	case Symbol:
+		// a single symbol may be encoded in place of an array
+		return []Symbol{v}
+	case []interface{}:
+		symbols := make([]Symbol, 0, len(v))
+		for _, elem := range v {
+			s, ok := elem.(Symbol)
+			if !ok {
+				l.fail(i, elem)
+				return nil
+			}
+			symbols = append(symbols, s)
+		}
+		return symbols
+	default:
+		l.fail(i, v)
+	}
+	return nil
+}
+
+func (l *fieldList) composite(i int) composite {
+	v := l.get(i)
+	if v == nil {
+		return nil
+	}
+	c, err := decodeComposite(v)
+	if err != nil {
+		if l.err == nil {
+			l.err = err
+		}
+		return nil
+	}
+	return c
+}
+
+func (l *fieldList) state(i int) DeliveryState {
+	c := l.composite(i)
+	if c == nil {
+		return nil
+	}
+	s, ok := c.(DeliveryState)
+	if !ok {
+		l.fail(i, c)
+		return nil
+	}
+	return s
+}
+
+func (l *fieldList) error(i int) *Error {
+	c := l.composite(i)
+	if c == nil {
+		return nil
+	}
+	e, ok := c.(*Error)
+	if !ok {
+		l.fail(i, c)
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,168 @@
+// Package testbroker provides a fake broker for tests, serving a client
+// over one end of a net.Conn, encoding frames with package frames.
+package testbroker
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Azure/go-amqp/internal/frames"
+)
+
+// ContainerID is the container-id the Broker opens the connection with.
+const ContainerID = "broker"
+
+// Broker answers the frames sent by a client. Opening the connection and
+// beginning sessions is handled by the Broker, the remaining frames are
+// passed to the handler set for their type or given a default response.
+//
+// Handlers are called from Run and may call Write, AttachResponse,
+// Handle and Stop.
+type Broker struct {
+	// Open handles the client's open frame, which by default is
+	// answered with an open for ContainerID.
+	Open func(open *frames.Open)
+
+	// Attach handles attach frames, which by default are answered
+	// with the response from AttachResponse.
+	Attach func(channel uint16, attach *frames.Attach)
+
+	// Flow handles flow frames, which are ignored by default.
+	Flow func(channel uint16, flow *frames.Flow)
+
+	// Transfer handles transfer frames, which are ignored by default.
+	Transfer func(channel uint16, transfer *frames.Transfer)
+
+	// Disposition handles disposition frames, which are ignored by default.
+	Disposition func(channel uint16, disposition *frames.Disposition)
+
+	// Detach handles detach frames, which by default are echoed.
+	Detach func(channel uint16, detach *frames.Detach)
+
+	// End handles end frames, which by default are echoed.
+	End func(channel uint16, end *frames.End)
+
+	t       *testing.T
+	conn    net.Conn
+	handles map[uint32]uint32 // broker handles by client handle
+	stopped bool
+}
+
+// New returns a Broker serving the client connected to conn.
+func New(t *testing.T, conn net.Conn) *Broker {
+	return &Broker{
+		t:       t,
+		conn:    conn,
+		handles: map[uint32]uint32{},
+	}
+}
+
+// Run serves the client until it closes the connection or a handler
+// calls Stop, then closes conn. Failures are reported to the test.
+func (b *Broker) Run() {
+	defer b.conn.Close()
+
+	header := make([]byte, len(frames.ProtocolHeader))
+	if _, err := io.ReadFull(b.conn, header); err != nil {
+		b.t.Errorf("reading protocol header: %v", err)
+		return
+	}
+	if _, err := b.conn.Write(frames.ProtocolHeader); err != nil {
+		b.t.Errorf("writing protocol header: %v", err)
+		return
+	}
+
+	for !b.stopped {
+		fr, err := frames.Read(b.conn)
+		if err != nil {
+			b.t.Errorf("reading frame: %v", err)
+			return
+		}
+		switch body := fr.Body.(type) {
+		case *frames.Open:
+			if b.Open != nil {
+				b.Open(body)
+				continue
+			}
+			b.Write(0, &frames.Open{ContainerID: ContainerID})
+		case *frames.Begin:
+			b.Write(fr.Channel, &frames.Begin{
+				RemoteChannel:  &fr.Channel,
+				IncomingWindow: 100,
+				OutgoingWindow: 100,
+			})
+		case *frames.Attach:
+			if b.Attach != nil {
+				b.Attach(fr.Channel, body)
+				continue
+			}
+			b.Write(fr.Channel, b.AttachResponse(body))
+		case *frames.Flow:
+			if b.Flow != nil {
+				b.Flow(fr.Channel, body)
+			}
+		case *frames.Transfer:
+			if b.Transfer != nil {
+				b.Transfer(fr.Channel, body)
+			}
+		case *frames.Disposition:
+			if b.Disposition != nil {
+				b.Disposition(fr.Channel, body)
+			}
+		case *frames.Detach:
+			if b.Detach != nil {
+				b.Detach(fr.Channel, body)
+				continue
+			}
+			b.Write(fr.Channel, &frames.Detach{Handle: b.Handle(body.Handle), Closed: body.Closed})
+		case *frames.End:
+			if b.End != nil {
+				b.End(fr.Channel, body)
+				continue
+			}
+			b.Write(fr.Channel, &frames.End{})
+		case *frames.Close:
+			// the client may close the connection without reading the reply
+			_ = frames.Write(b.conn, frames.Frame{Body: &frames.Close{}})
+			return
+		}
+	}
+}
+
+// Stop makes Run return once the current handler does.
+func (b *Broker) Stop() {
+	b.stopped = true
+}
+
+// Write sends body to the client on channel.
+func (b *Broker) Write(channel uint16, body frames.Performative) {
+	if err := frames.Write(b.conn, frames.Frame{Channel: channel, Body: body}); err != nil {
+		b.t.Errorf("writing %T: %v", body, err)
+	}
+}
+
+// AttachResponse allocates the broker's handle for the link attached by
+// attach and returns the attach answering it, with the opposite role and
+// the client's source and target.
+func (b *Broker) AttachResponse(attach *frames.Attach) *frames.Attach {
+	handle := uint32(len(b.handles))
+	b.handles[attach.Handle] = handle
+	role := frames.RoleSender
+	if attach.Role == frames.RoleSender {
+		role = frames.RoleReceiver
+	}
+	return &frames.Attach{
+		Name:   attach.Name,
+		Handle: handle,
+		Role:   role,
+		Source: attach.Source,
+		Target: attach.Target,
+	}
+}
+
+// Handle returns the broker's handle for the link the client attached
+// with handle.
+func (b *Broker) Handle(handle uint32) uint32 {
+	return b.handles[handle]
+}
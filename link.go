@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // link is a unidirectional route.
@@ -14,21 +15,29 @@ import (
 type link struct {
 	key           linkKey              // Name and direction
 	handle        uint32               // our handle
+	wantHandle    *uint32              // handle requested with LinkHandle, nil to let the session choose
 	remoteHandle  uint32               // remote's handle
 	dynamicAddr   bool                 // request a dynamic link address from the server
+	anonymous     bool                 // sender attaches with a null target address, messages are routed by To
 	rx            chan frameBody       // sessions sends frames for this link on this channel
 	transfers     chan performTransfer // sender uses to send transfer frames
+	noCredit      chan struct{}        // mux sends on this while the sender has no credit, used by TrySend
 	closeOnce     sync.Once            // closeOnce protects close from being closed multiple times
 	close         chan struct{}        // close signals the mux to shutdown
 	done          chan struct{}        // done is closed by mux/muxDetach when the link is fully detached
-	detachErrorMu sync.Mutex           // protects detachError
+	detachErrorMu sync.Mutex           // protects detachError and detachOnly
 	detachError   *Error               // error to send to remote on detach, set by closeWithError
+	detachOnly    bool                 // detach without closing the link, set by Detach
 	session       *Session             // parent session
 	receiver      *Receiver            // allows link options to modify Receiver
 	source        *source
 	target        *target
 	properties    map[symbol]interface{} // additional properties sent upon link attach
 
+	// source and target as set in the peer's attach
+	remoteSource *source
+	remoteTarget *target
+
 	// "The delivery-count is initialized by the sender when a link endpoint is created,
 	// and is incremented whenever a message is sent. Only the sender MAY independently
 	// modify this field. The receiver's value is calculated based on the last known
@@ -38,15 +47,60 @@ type link struct {
 	deliveryCount      uint32
 	linkCredit         uint32 // maximum number of messages allowed between flow updates
 	senderSettleMode   *SenderSettleMode
+	defaultSendSettled bool // messages are sent settled in ModeMixed unless set otherwise; sender only
 	receiverSettleMode *ReceiverSettleMode
 	maxMessageSize     uint64
 	detachReceived     bool
 	err                error // err returned on Close()
 
+	// indicates that a rejected disposition received by a sender
+	// in ModeFirst should detach the link
+	detachOnDispositionError bool
+
+	// called with err once the link has detached
+	onDetach func(error)
+
+	// called with frames the link can't process, see LinkOnUnexpectedFrame
+	onUnexpectedFrame func(kind FrameKind) error
+
+	// retries of rejected sends; sender only
+	retryPolicy RetryPolicy
+
+	// sends settled with an outcome other than accepted fail; sender only
+	requireAccepted bool
+
+	// decides whether a flow frame requesting an echo is answered,
+	// echo is always answered if nil
+	onFlowEcho func(LinkFlow) bool
+
+	// deliveries from a previous attachment of the link that are
+	// being resumed, keyed by delivery tag; receiver only
+	resumeUnsettled unsettled
+	resumeState     deliveryState // local state of the resumed delivery in progress, if any
+
+	// notified of unsettled deliveries, if set; settlementTags maps the
+	// delivery ID of each unsettled delivery to its tag
+	settlementStore SettlementStore
+	settlementMu    sync.Mutex
+	settlementTags  map[uint32][]byte
+
+	// message sending
+	available     uint32 // atomically accessed; available count in the peer's last flow, used by Sender.Available
+	peerDrain     bool   // set by mux when the peer's last flow requested a drain
+	txDeliveryID  uint32 // delivery being transferred, used with the settlement store
+	txDeliveryTag []byte
+
 	// message receiving
 	paused                uint32              // atomically accessed; indicates that all link credits have been used by sender
+	credit                uint32              // atomically accessed; link credit as last updated by mux, used by TrySend and Credit
 	receiverReady         chan struct{}       // receiver sends on this when mux is paused to indicate it can handle more messages
+	waiting               int32               // atomically accessed; number of callers blocked waiting for a message, used with creditOnDemand
+	issueCredit           chan creditRequest  // receiver sends on this to issue credit, used with creditManual
+	drain                 chan chan error     // receiver sends on this to drain credit, used with creditManual
+	batchCredit           chan uint32         // receiver sends the size of a batch on this to raise credit for it, unused with creditManual
+	drainDone             chan error          // set by mux while a drain is pending, receives once the sender has used all credit
 	messages              chan Message        // used to send completed messages to receiver
+	avgMessageSize        uint64              // moving average of received message sizes, used with prefetchBytes
 	unsettledMessages     map[string]struct{} // used to keep track of messages being handled downstream
 	unsettledMessagesLock sync.RWMutex        // lock to protect concurrent access to unsettledMessages
 	buf                   buffer              // buffered bytes for current message
@@ -62,6 +116,8 @@ func newLink(s *Session, r *Receiver, opts []LinkOption) (*link, error) {
 		close:         make(chan struct{}),
 		done:          make(chan struct{}),
 		receiverReady: make(chan struct{}, 1),
+
+		detachOnDispositionError: DefaultLinkDetachOnDispositionError,
 	}
 
 	// configure options
@@ -72,6 +128,45 @@ func newLink(s *Session, r *Receiver, opts []LinkOption) (*link, error) {
 		}
 	}
 
+	if l.anonymous && (l.dynamicAddr || (l.target != nil && l.target.Address != "")) {
+		return nil, errorNew("LinkAnonymousTarget can't be used with a target address")
+	}
+
+	if r != nil {
+		// the credit window can't exceed the message buffer
+		switch {
+		case r.creditWindow == 0:
+			r.creditWindow = r.maxCredit
+		case r.creditWindow > r.maxCredit:
+			return nil, errorErrorf("initial credit %d exceeds link credit %d", r.creditWindow, r.maxCredit)
+		}
+		if r.creditOnSettle {
+			switch {
+			case r.creditMode != creditAuto:
+				return nil, errorNew("LinkCreditOnSettle requires automatic credit")
+			case l.receiverSettleMode.value() != ModeSecond:
+				return nil, errorNew("LinkCreditOnSettle requires ModeSecond")
+			}
+		}
+		if r.autoAccept && l.receiverSettleMode.value() != ModeFirst {
+			return nil, errorNew("LinkAutoAccept requires ModeFirst")
+		}
+		if r.prefetchBytes > 0 {
+			switch {
+			case r.creditMode != creditAuto:
+				return nil, errorNew("LinkPrefetchBytes requires automatic credit")
+			case r.creditOnSettle:
+				return nil, errorNew("LinkPrefetchBytes can't be used with LinkCreditOnSettle")
+			}
+		}
+		if r.creditMode == creditManual {
+			l.issueCredit = make(chan creditRequest)
+			l.drain = make(chan chan error)
+		} else {
+			l.batchCredit = make(chan uint32)
+		}
+	}
+
 	return l, nil
 }
 
@@ -124,30 +219,43 @@ func attachLink(s *Session, r *Receiver, opts []LinkOption) (*link, error) {
 
 	if isReceiver {
 		attach.Role = roleReceiver
+		attach.Unsettled = l.resumeUnsettled
 		if attach.Source == nil {
-			attach.Source = new(source)
+			l.source = new(source)
+			attach.Source = l.source
 		}
 		attach.Source.Dynamic = l.dynamicAddr
 	} else {
 		attach.Role = roleSender
+		attach.InitialDeliveryCount = l.deliveryCount
 		if attach.Target == nil {
-			attach.Target = new(target)
+			l.target = new(target)
+			attach.Target = l.target
 		}
 		attach.Target.Dynamic = l.dynamicAddr
 	}
 
 	// send Attach frame
-	debug(1, "TX: %s", attach)
+	l.debug(1, "TX: %s", attach)
 	s.txFrame(attach, nil)
 
 	// wait for response
+	var timeout <-chan time.Time
+	if s.conn.attachTimeout > 0 {
+		timer := s.conn.clock.NewTimer(s.conn.attachTimeout)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
 	var fr frameBody
 	select {
 	case <-s.done:
 		return nil, s.err
 	case fr = <-l.rx:
+	case <-timeout:
+		l.abandonAttach()
+		return nil, ErrTimeout
 	}
-	debug(3, "RX: %s", fr)
+	l.debug(3, "RX: %s", fr)
 	resp, ok := fr.(*performAttach)
 	if !ok {
 		return nil, errorErrorf("unexpected attach response: %#v", fr)
@@ -180,7 +288,7 @@ func attachLink(s *Session, r *Receiver, opts []LinkOption) (*link, error) {
 			Handle: l.handle,
 			Closed: true,
 		}
-		debug(1, "TX: %s", fr)
+		l.debug(1, "TX: %s", fr)
 		s.txFrame(fr, nil)
 
 		if detach.Error == nil {
@@ -189,6 +297,9 @@ func attachLink(s *Session, r *Receiver, opts []LinkOption) (*link, error) {
 		return nil, detach.Error
 	}
 
+	l.remoteSource = resp.Source
+	l.remoteTarget = resp.Target
+
 	if l.maxMessageSize == 0 || resp.MaxMessageSize < l.maxMessageSize {
 		l.maxMessageSize = resp.MaxMessageSize
 	}
@@ -204,13 +315,17 @@ func attachLink(s *Session, r *Receiver, opts []LinkOption) (*link, error) {
 		l.messages = make(chan Message, l.receiver.maxCredit)
 		l.unsettledMessages = map[string]struct{}{}
 		// copy the received filter values
-		l.source.Filter = resp.Source.Filter
+		if resp.Source != nil {
+			l.source.Filter = resp.Source.Filter
+		}
+		l.reconcileUnsettled(resp)
 	} else {
 		// if dynamic address requested, copy assigned name to address
 		if l.dynamicAddr && resp.Target != nil {
 			l.target.Address = resp.Target.Address
 		}
 		l.transfers = make(chan performTransfer)
+		l.noCredit = make(chan struct{})
 	}
 
 	err = l.setSettleModes(resp)
@@ -224,6 +339,39 @@ func attachLink(s *Session, r *Receiver, opts []LinkOption) (*link, error) {
 	return l, nil
 }
 
+// abandonAttach detaches a link whose attach wasn't answered in time.
+//
+// The handle remains allocated until the peer has answered the detach,
+// so that a late attach response is still routed to the link and
+// discarded rather than being mistaken for a link the peer initiated.
+func (l *link) abandonAttach() {
+	s := l.session
+	fr := &performDetach{
+		Handle: l.handle,
+		Closed: true,
+	}
+	l.debug(1, "TX: %s", fr)
+	s.txFrame(fr, nil)
+
+	go func() {
+		for {
+			select {
+			case fr := <-l.rx:
+				if fr, ok := fr.(*performDetach); !ok || !fr.Closed {
+					continue
+				}
+				select {
+				case s.deallocateHandle <- l:
+				case <-s.done:
+				}
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
 func (l *link) addUnsettled(msg *Message) {
 	l.unsettledMessagesLock.Lock()
 	l.unsettledMessages[string(msg.DeliveryTag)] = struct{}{}
@@ -243,6 +391,86 @@ func (l *link) countUnsettled() int {
 	return count
 }
 
+// storeUnsettled notifies the settlement store, if set, that the
+// delivery is unsettled.
+func (l *link) storeUnsettled(id uint32, tag []byte) {
+	if l.settlementStore == nil {
+		return
+	}
+	// the sender reuses tag buffers
+	tag = append([]byte(nil), tag...)
+	l.settlementMu.Lock()
+	if l.settlementTags == nil {
+		l.settlementTags = make(map[uint32][]byte)
+	}
+	l.settlementTags[id] = tag
+	l.settlementMu.Unlock()
+	l.settlementStore.Unsettled(l.key.name, UnsettledDelivery{DeliveryTag: tag})
+}
+
+// storeOutcome notifies the settlement store, if set, of the outcome
+// applied locally to the unsettled deliveries first through last.
+func (l *link) storeOutcome(first uint32, last *uint32, outcome Outcome) {
+	if l.settlementStore == nil {
+		return
+	}
+	for _, tag := range l.settlementTagsInRange(first, last, false) {
+		l.settlementStore.Unsettled(l.key.name, UnsettledDelivery{DeliveryTag: tag, Outcome: outcome})
+	}
+}
+
+// storeSettled notifies the settlement store, if set, that the
+// deliveries first through last are settled.
+func (l *link) storeSettled(first uint32, last *uint32) {
+	if l.settlementStore == nil {
+		return
+	}
+	for _, tag := range l.settlementTagsInRange(first, last, true) {
+		l.settlementStore.Settled(l.key.name, tag)
+	}
+}
+
+// settlementTagsInRange returns the tags of the unsettled deliveries
+// first through last, removing them if remove is true.
+func (l *link) settlementTagsInRange(first uint32, last *uint32, remove bool) [][]byte {
+	end := first
+	if last != nil {
+		end = *last
+	}
+	var tags [][]byte
+	l.settlementMu.Lock()
+	for id := first; id <= end; id++ {
+		if tag, ok := l.settlementTags[id]; ok {
+			tags = append(tags, tag)
+			if remove {
+				delete(l.settlementTags, id)
+			}
+		}
+	}
+	l.settlementMu.Unlock()
+	return tags
+}
+
+// reconcileUnsettled drops resumed deliveries that the peer no longer
+// considers unsettled, as they were settled before the link was detached.
+//
+// Deliveries that remain are resolved as the peer resends them.
+func (l *link) reconcileUnsettled(resp *performAttach) {
+	if resp.IncompleteUnsettled {
+		// the peer's map may be missing deliveries it still holds
+		return
+	}
+	for tag := range l.resumeUnsettled {
+		if _, ok := resp.Unsettled[tag]; !ok {
+			l.debug(1, "resumed delivery %q settled by peer", tag)
+			delete(l.resumeUnsettled, tag)
+			if l.settlementStore != nil {
+				l.settlementStore.Settled(l.key.name, []byte(tag))
+			}
+		}
+	}
+}
+
 // setSettleModes sets the settlement modes based on the resp performAttach.
 //
 // If a settlement mode has been explicitly set locally and it was not honored by the
@@ -277,29 +505,79 @@ func (l *link) mux() {
 		isSender   = !isReceiver
 	)
 
-Loop:
 	for {
-		var outgoingTransfers chan performTransfer
+		var (
+			outgoingTransfers chan performTransfer
+			noCredit          chan struct{}
+		)
 		switch {
+		// if the receiver requested a drain, send the transfers that are
+		// ready and then return the remaining credit
+		case isSender && l.linkCredit > 0 && l.peerDrain:
+			select {
+			case tr := <-l.transfers:
+				l.err = l.muxTransfer(tr)
+			default:
+				l.err = l.muxDrained()
+			}
+			if l.err != nil {
+				return
+			}
+			continue
+
 		// enable outgoing transfers case if sender and credits are available
 		case isSender && l.linkCredit > 0:
-			debug(1, "Link Mux isSender: credit: %d, deliveryCount: %d, messages: %d, unsettled: %d", l.linkCredit, l.deliveryCount, len(l.messages), l.countUnsettled())
+			l.debug(1, "Link Mux isSender: credit: %d, deliveryCount: %d, messages: %d, unsettled: %d", l.linkCredit, l.deliveryCount, len(l.messages), l.countUnsettled())
 			outgoingTransfers = l.transfers
 
-		// if receiver && half maxCredits have been processed, send more credits
-		case isReceiver && l.linkCredit+uint32(l.countUnsettled()) <= l.receiver.maxCredit/2:
-			debug(1, "FLOW Link Mux half: source: %s, inflight: %d, credit: %d, deliveryCount: %d, messages: %d, unsettled: %d, maxCredit : %d, settleMode: %s", l.source.Address, len(l.receiver.inFlight.m), l.linkCredit, l.deliveryCount, len(l.messages), l.countUnsettled(), l.receiver.maxCredit, l.receiverSettleMode.String())
-			l.err = l.muxFlow()
+		// tell senders that checked the credit before it was used up
+		// that a transfer would block
+		case isSender:
+			noCredit = l.noCredit
+
+		// if receiver renews credit on settlement and any delivery has settled,
+		// top the credit window back up
+		case isReceiver && l.receiver.creditOnSettle && l.linkCredit+uint32(l.countUnsettled()) < l.receiver.creditWindow:
+			l.err = l.muxFlow(l.receiver.creditWindow-uint32(l.countUnsettled()), false)
+			if l.err != nil {
+				return
+			}
+			atomic.StoreUint32(&l.paused, 0)
+
+		// if receiver limits prefetch by size and half the messages that
+		// fit have been processed, send credit for the rest
+		case isReceiver && l.receiver.prefetchBytes > 0 && l.linkCredit+l.heldMessages() <= l.prefetchWindow()/2:
+			l.err = l.muxFlow(l.prefetchWindow()-l.heldMessages(), false)
+			if l.err != nil {
+				return
+			}
+			atomic.StoreUint32(&l.paused, 0)
+
+		// if receiver && half the credit window has been processed, send more credits
+		case isReceiver && l.receiver.creditMode == creditAuto && l.receiver.prefetchBytes == 0 && l.linkCredit+uint32(l.countUnsettled()) <= l.receiver.creditWindow/2:
+			l.debug(1, "FLOW Link Mux half: source: %s, inflight: %d, credit: %d, deliveryCount: %d, messages: %d, unsettled: %d, maxCredit : %d, settleMode: %s", l.source.Address, l.receiver.inFlight.len(), l.linkCredit, l.deliveryCount, len(l.messages), l.countUnsettled(), l.receiver.maxCredit, l.receiverSettleMode.String())
+			l.err = l.muxFlow(l.receiver.creditWindow-uint32(l.countUnsettled()), false)
+			if l.err != nil {
+				return
+			}
+			atomic.StoreUint32(&l.paused, 0)
+
+		// if receiver issues credit on demand and more callers are waiting
+		// than there are buffered messages, send credit for the difference
+		case isReceiver && l.receiver.creditMode == creditOnDemand && l.linkCredit == 0 && l.onDemandCredit() > 0:
+			l.err = l.muxFlow(l.onDemandCredit(), false)
 			if l.err != nil {
 				return
 			}
 			atomic.StoreUint32(&l.paused, 0)
 
 		case isReceiver && l.linkCredit == 0:
-			debug(1, "PAUSE Link Mux pause: inflight: %d, credit: %d, deliveryCount: %d, messages: %d, unsettled: %d, maxCredit : %d, settleMode: %s", len(l.receiver.inFlight.m), l.linkCredit, l.deliveryCount, len(l.messages), l.countUnsettled(), l.receiver.maxCredit, l.receiverSettleMode.String())
+			l.debug(1, "PAUSE Link Mux pause: inflight: %d, credit: %d, deliveryCount: %d, messages: %d, unsettled: %d, maxCredit : %d, settleMode: %s", l.receiver.inFlight.len(), l.linkCredit, l.deliveryCount, len(l.messages), l.countUnsettled(), l.receiver.maxCredit, l.receiverSettleMode.String())
 			atomic.StoreUint32(&l.paused, 1)
 		}
 
+		atomic.StoreUint32(&l.credit, l.linkCredit)
+
 		select {
 		// received frame
 		case fr := <-l.rx:
@@ -310,32 +588,60 @@ Loop:
 
 		// send data
 		case tr := <-outgoingTransfers:
-			debug(3, "TX(link): %s", tr)
+			l.err = l.muxTransfer(tr)
+			if l.err != nil {
+				return
+			}
 
-			// Ensure the session mux is not blocked
-			for {
-				select {
-				case l.session.txTransfer <- &tr:
-					// decrement link-credit after entire message transferred
-					if !tr.More {
-						l.deliveryCount++
-						l.linkCredit--
-						// we are the sender and we keep track of the peer's link credit
-						debug(3, "TX(link): key:%s, decremented linkCredit: %d", l.key.name, l.linkCredit)
-					}
-					continue Loop
-				case fr := <-l.rx:
-					l.err = l.muxHandleFrame(fr)
-					if l.err != nil {
-						return
-					}
-				case <-l.close:
-					l.err = ErrLinkClosed
-					return
-				case <-l.session.done:
-					l.err = l.session.err
-					return
-				}
+		case noCredit <- struct{}{}:
+
+		case req := <-l.issueCredit:
+			// a flow without the drain flag would cancel a pending drain
+			if l.drainDone != nil {
+				req.err <- errorNew("credit cannot be issued while draining")
+				continue
+			}
+			// credit must not allow the message buffer to overflow
+			if uint64(l.linkCredit)+uint64(req.credit)+uint64(len(l.messages)) > uint64(l.receiver.maxCredit) {
+				req.err <- errorErrorf("issuing %d credit exceeds link credit %d", req.credit, l.receiver.maxCredit)
+				continue
+			}
+			l.err = l.muxFlow(l.linkCredit+req.credit, false)
+			req.err <- l.err
+			if l.err != nil {
+				return
+			}
+			atomic.StoreUint32(&l.paused, 0)
+
+		case n := <-l.batchCredit:
+			// raise credit so the rest of the batch can be sent at
+			// once, without overflowing the message buffer
+			if n > l.receiver.maxCredit {
+				n = l.receiver.maxCredit
+			}
+			buffered := uint32(len(l.messages))
+			if l.drainDone != nil || n <= buffered || n-buffered <= l.linkCredit {
+				continue
+			}
+			l.err = l.muxFlow(n-buffered, false)
+			if l.err != nil {
+				return
+			}
+			atomic.StoreUint32(&l.paused, 0)
+
+		case done := <-l.drain:
+			if l.drainDone != nil {
+				done <- errorNew("drain already in progress")
+				continue
+			}
+			if l.linkCredit == 0 {
+				done <- nil
+				continue
+			}
+			l.drainDone = done
+			l.err = l.muxFlow(l.linkCredit, true)
+			if l.err != nil {
+				return
 			}
 
 		case <-l.receiverReady:
@@ -350,22 +656,147 @@ Loop:
 	}
 }
 
-// muxFlow sends tr to the session mux.
-func (l *link) muxFlow() error {
-	// copy because sent by pointer below; prevent race
+// heldMessages returns the number of received messages held by the
+// receiver, either buffered or, in ModeSecond, awaiting settlement.
+func (l *link) heldMessages() uint32 {
+	n := len(l.messages)
+	if u := l.countUnsettled(); u > n {
+		n = u
+	}
+	return uint32(n)
+}
+
+// prefetchWindow returns the number of messages of the average size
+// received so far that fit in the receiver's prefetch bytes, at least 1
+// and at most the credit window.
+func (l *link) prefetchWindow() uint32 {
+	if l.avgMessageSize == 0 {
+		return 1
+	}
+	window := l.receiver.prefetchBytes / l.avgMessageSize
+	switch {
+	case window < 1:
+		window = 1
+	case window > uint64(l.receiver.creditWindow):
+		window = uint64(l.receiver.creditWindow)
+	}
+	return uint32(window)
+}
+
+// observeMessageSize adds a received message of size bytes
+// to the average message size.
+func (l *link) observeMessageSize(size int) {
+	n := uint64(size)
+	if n == 0 {
+		n = 1 // distinguish from no messages received
+	}
+	if l.avgMessageSize == 0 {
+		l.avgMessageSize = n
+		return
+	}
+	// exponentially weighted, each message counts for 1/8
+	l.avgMessageSize = l.avgMessageSize - l.avgMessageSize/8 + n/8
+	if l.avgMessageSize == 0 {
+		l.avgMessageSize = 1
+	}
+}
+
+// muxTransfer sends tr to the session mux, handling incoming frames
+// while waiting for it to be accepted.
+func (l *link) muxTransfer(tr performTransfer) error {
+	l.debug(3, "TX(link): %s", tr)
+
+	// publish the credit this transfer will consume before the
+	// sender can attempt another one
+	if !tr.More {
+		atomic.StoreUint32(&l.credit, l.linkCredit-1)
+	}
+
+	// record an unsettled delivery before the peer can settle it
+	if tr.DeliveryID != nil {
+		l.txDeliveryID, l.txDeliveryTag = *tr.DeliveryID, tr.DeliveryTag
+	}
+	if !tr.More && !tr.Settled {
+		l.storeUnsettled(l.txDeliveryID, l.txDeliveryTag)
+	}
+
+	// Ensure the session mux is not blocked
+	for {
+		select {
+		case l.session.txTransfer <- &tr:
+			// decrement link-credit after entire message transferred
+			if !tr.More {
+				l.deliveryCount++
+				l.linkCredit--
+				// we are the sender and we keep track of the peer's link credit
+				l.debug(3, "TX(link): key:%s, decremented linkCredit: %d", l.key.name, l.linkCredit)
+			}
+			return nil
+		case fr := <-l.rx:
+			err := l.muxHandleFrame(fr)
+			if err != nil {
+				return err
+			}
+		case <-l.close:
+			return ErrLinkClosed
+		case <-l.session.done:
+			return l.session.err
+		}
+	}
+}
+
+// muxDrained uses up the remaining link credit in response to a drain
+// by advancing the delivery count, and sends a flow telling the receiver.
+func (l *link) muxDrained() error {
+	l.deliveryCount += l.linkCredit
+	l.linkCredit = 0
+	l.peerDrain = false
+
 	var (
-		linkCredit    = l.receiver.maxCredit - uint32(l.countUnsettled())
+		// copy because sent by pointer below; prevent race
+		linkCredit    = l.linkCredit
 		deliveryCount = l.deliveryCount
 	)
+	fr := &performFlow{
+		Handle:        &l.handle,
+		DeliveryCount: &deliveryCount,
+		LinkCredit:    &linkCredit,
+		Drain:         true,
+	}
+	l.debug(1, "TX: %s", fr)
+	return l.session.txFrame(fr, nil)
+}
+
+// onDemandCredit returns the number of callers waiting for a message
+// in excess of the buffered messages.
+func (l *link) onDemandCredit() uint32 {
+	n := int(atomic.LoadInt32(&l.waiting)) - len(l.messages)
+	if max := int(l.receiver.maxCredit) - len(l.messages); n > max {
+		n = max
+	}
+	if n < 0 {
+		return 0
+	}
+	return uint32(n)
+}
 
-	debug(3, "link.muxFlow(): len(l.messages):%d - linkCredit: %d - deliveryCount: %d, inFlight: %d", len(l.messages), l.linkCredit, deliveryCount, len(l.receiver.inFlight.m))
+// muxFlow sends a flow frame granting linkCredit to the sender.
+//
+// If drain is true, the sender is requested to use all of the credit,
+// or return what it can't use by advancing its delivery count.
+func (l *link) muxFlow(linkCredit uint32, drain bool) error {
+	// copy because sent by pointer below; prevent race
+	deliveryCount := l.deliveryCount
+
+	l.debug(3, "link.muxFlow(): len(l.messages):%d - linkCredit: %d - deliveryCount: %d, inFlight: %d", len(l.messages), l.linkCredit, deliveryCount, l.receiver.inFlight.len())
 
 	fr := &performFlow{
 		Handle:        &l.handle,
 		DeliveryCount: &deliveryCount,
 		LinkCredit:    &linkCredit, // max number of messages
+		Drain:         drain,
 	}
-	debug(3, "TX: %s", fr)
+	l.debug(3, "TX: %s", fr)
 
 	// Update credit. This must happen before entering loop below
 	// because incoming messages handled while waiting to transmit
@@ -404,6 +835,13 @@ func (l *link) muxReceive(fr performTransfer) error {
 		}
 		l.msg.DeliveryTag = fr.DeliveryTag
 
+		// a resumed delivery that was already given an outcome locally
+		// is settled with that outcome rather than redelivered
+		l.resumeState = nil
+		if fr.Resume {
+			l.resumeState = l.resumeUnsettled[string(fr.DeliveryTag)]
+		}
+
 		// these fields are required on first transfer of a message
 		if fr.DeliveryID == nil {
 			msg := "received message without a delivery-id"
@@ -470,13 +908,20 @@ func (l *link) muxReceive(fr performTransfer) error {
 		}
 	}
 
-	// discard message if it's been aborted
+	// discard message if it's been aborted. the delivery is
+	// implicitly settled but still counts against link-credit
+	// since the sender advanced its delivery-count when it started
+	// the transfer.
 	if fr.Aborted {
+		l.debug(1, "deliveryID %d aborted - deliveryCount : %d - linkCredit: %d", l.msg.deliveryID, l.deliveryCount, l.linkCredit)
+		l.resumeState = nil
 		l.buf.reset()
 		l.msg = Message{
 			doneSignal: make(chan struct{}),
 		}
 		l.more = false
+		l.deliveryCount++
+		l.linkCredit--
 		return nil
 	}
 
@@ -503,20 +948,50 @@ func (l *link) muxReceive(fr performTransfer) error {
 		return nil
 	}
 
+	// resumed delivery with a local outcome, settle it without
+	// passing it to the receiver
+	delete(l.resumeUnsettled, string(l.msg.DeliveryTag))
+	if l.resumeState != nil {
+		var err error
+		if !l.msg.settled {
+			err = l.session.txFrame(&performDisposition{
+				Role:    roleReceiver,
+				First:   l.msg.deliveryID,
+				Settled: true,
+				State:   l.resumeState,
+			}, nil)
+		}
+		if err == nil && l.settlementStore != nil {
+			l.settlementStore.Settled(l.key.name, l.msg.DeliveryTag)
+		}
+		l.resumeState = nil
+		l.buf.reset()
+		l.msg = Message{}
+		l.deliveryCount++
+		l.linkCredit--
+		return err
+	}
+
 	// last frame in message
+	if l.receiver.prefetchBytes > 0 {
+		l.observeMessageSize(l.buf.len())
+	}
 	err := l.msg.unmarshal(&l.buf)
 	if err != nil {
 		return err
 	}
-	debug(1, "deliveryID %d before push to receiver - deliveryCount : %d - linkCredit: %d, len(messages): %d, len(inflight): %d", l.msg.deliveryID, l.deliveryCount, l.linkCredit, len(l.messages), len(l.receiver.inFlight.m))
+	l.debug(1, "deliveryID %d before push to receiver - deliveryCount : %d - linkCredit: %d, len(messages): %d, len(inflight): %d", l.msg.deliveryID, l.deliveryCount, l.linkCredit, len(l.messages), l.receiver.inFlight.len())
 	// send to receiver, this should never block due to buffering
 	// and flow control.
 	if l.receiverSettleMode.value() == ModeSecond {
 		l.addUnsettled(&l.msg)
 	}
+	if !l.msg.settled {
+		l.storeUnsettled(l.msg.deliveryID, l.msg.DeliveryTag)
+	}
 	l.messages <- l.msg
 
-	debug(1, "deliveryID %d after push to receiver - deliveryCount : %d - linkCredit: %d, len(messages): %d, len(inflight): %d", l.msg.deliveryID, l.deliveryCount, l.linkCredit, len(l.messages), len(l.receiver.inFlight.m))
+	l.debug(1, "deliveryID %d after push to receiver - deliveryCount : %d - linkCredit: %d, len(messages): %d, len(inflight): %d", l.msg.deliveryID, l.deliveryCount, l.linkCredit, len(l.messages), l.receiver.inFlight.len())
 
 	// reset progress
 	l.buf.reset()
@@ -525,7 +1000,7 @@ func (l *link) muxReceive(fr performTransfer) error {
 	// decrement link-credit after entire message received
 	l.deliveryCount++
 	l.linkCredit--
-	debug(1, "deliveryID %d before exit - deliveryCount : %d - linkCredit: %d, len(messages): %d", l.msg.deliveryID, l.deliveryCount, l.linkCredit, len(l.messages))
+	l.debug(1, "deliveryID %d before exit - deliveryCount : %d - linkCredit: %d, len(messages): %d", l.msg.deliveryID, l.deliveryCount, l.linkCredit, len(l.messages))
 	return nil
 }
 
@@ -533,27 +1008,26 @@ func (l *link) muxReceive(fr performTransfer) error {
 func (l *link) muxHandleFrame(fr frameBody) error {
 	var (
 		isSender               = l.receiver == nil
-		errOnRejectDisposition = isSender && (l.receiverSettleMode == nil || *l.receiverSettleMode == ModeFirst)
+		errOnRejectDisposition = isSender && l.detachOnDispositionError && (l.receiverSettleMode == nil || *l.receiverSettleMode == ModeFirst)
 	)
 
 	switch fr := fr.(type) {
 	// message frame
 	case *performTransfer:
-		debug(3, "RX: %s", fr)
+		l.debug(3, "RX: %s", fr)
 		if isSender {
 			// Senders should never receive transfer frames, but handle it just in case.
-			l.closeWithError(&Error{
+			return l.muxUnexpectedFrame(fr, &Error{
 				Condition:   ErrorNotAllowed,
 				Description: "sender cannot process transfer frame",
-			})
-			return errorErrorf("sender received transfer frame")
+			}, errorNew("sender received transfer frame"))
 		}
 
 		return l.muxReceive(*fr)
 
 	// flow control frame
 	case *performFlow:
-		debug(3, "RX: %s", fr)
+		l.debug(3, "RX: %s", fr)
 		if isSender {
 			linkCredit := *fr.LinkCredit - l.deliveryCount
 			if fr.DeliveryCount != nil {
@@ -563,12 +1037,41 @@ func (l *link) muxHandleFrame(fr frameBody) error {
 				linkCredit += *fr.DeliveryCount
 			}
 			l.linkCredit = linkCredit
+			l.peerDrain = fr.Drain
+			if fr.Available != nil {
+				atomic.StoreUint32(&l.available, *fr.Available)
+			}
+		}
+
+		// the sender advances its delivery count to use up the
+		// remaining credit in response to a drain
+		if !isSender && l.drainDone != nil && fr.DeliveryCount != nil {
+			limit := l.deliveryCount + l.linkCredit
+			l.deliveryCount = *fr.DeliveryCount
+			l.linkCredit = 0
+			if int32(limit-l.deliveryCount) > 0 {
+				l.linkCredit = limit - l.deliveryCount
+			}
+			if l.linkCredit == 0 {
+				atomic.StoreUint32(&l.credit, 0)
+				l.drainDone <- nil
+				l.drainDone = nil
+			}
 		}
 
 		if !fr.Echo {
 			return nil
 		}
 
+		if l.onFlowEcho != nil && !l.onFlowEcho(LinkFlow{
+			DeliveryCount: fr.DeliveryCount,
+			LinkCredit:    fr.LinkCredit,
+			Available:     fr.Available,
+			Drain:         fr.Drain,
+		}) {
+			return nil
+		}
+
 		var (
 			// copy because sent by pointer below; prevent race
 			linkCredit    = l.linkCredit
@@ -581,12 +1084,12 @@ func (l *link) muxHandleFrame(fr frameBody) error {
 			DeliveryCount: &deliveryCount,
 			LinkCredit:    &linkCredit, // max number of messages
 		}
-		debug(1, "TX: %s", resp)
+		l.debug(1, "TX: %s", resp)
 		l.session.txFrame(resp, nil)
 
 	// remote side is closing links
 	case *performDetach:
-		debug(1, "RX: %s", fr)
+		l.debug(1, "RX: %s", fr)
 		// don't currently support link detach and reattach
 		if !fr.Closed {
 			return errorErrorf("non-closing detach not supported: %+v", fr)
@@ -598,7 +1101,7 @@ func (l *link) muxHandleFrame(fr frameBody) error {
 		return errorWrapf(&DetachError{fr.Error}, "received detach frame")
 
 	case *performDisposition:
-		debug(3, "RX: %s", fr)
+		l.debug(3, "RX: %s", fr)
 
 		// Unblock receivers waiting for message disposition
 		if l.receiver != nil {
@@ -609,11 +1112,15 @@ func (l *link) muxHandleFrame(fr frameBody) error {
 			}
 			l.receiver.inFlight.remove(fr.First, fr.Last, dispositionError)
 		}
+		if fr.Settled {
+			l.storeSettled(fr.First, fr.Last)
+		}
 
 		// If sending async and a message is rejected, cause a link error.
+		// Throttling is transient, so the link is kept for later sends.
 		//
 		// This isn't ideal, but there isn't a clear better way to handle it.
-		if fr, ok := fr.State.(*stateRejected); ok && errOnRejectDisposition {
+		if fr, ok := fr.State.(*stateRejected); ok && errOnRejectDisposition && !isThrottled(fr.Error) {
 			return fr.Error
 		}
 
@@ -627,17 +1134,39 @@ func (l *link) muxHandleFrame(fr frameBody) error {
 			Last:    fr.Last,
 			Settled: true,
 		}
-		debug(1, "TX: %s", resp)
+		l.debug(1, "TX: %s", resp)
 		l.session.txFrame(resp, nil)
+		l.storeSettled(fr.First, fr.Last)
 
 	default:
-		debug(1, "RX: %s", fr)
-		fmt.Printf("Unexpected frame: %s\n", fr)
+		l.debug(1, "RX: unexpected frame: %s", fr)
+		return l.muxUnexpectedFrame(fr, nil, nil)
 	}
 
 	return nil
 }
 
+// muxUnexpectedFrame handles a frame the link can't process.
+//
+// If set, the link's unexpected frame handler decides whether fr is
+// ignored. Otherwise the link is detached with de and err is returned,
+// or fr is ignored if de is nil.
+func (l *link) muxUnexpectedFrame(fr frameBody, de *Error, err error) error {
+	if l.onUnexpectedFrame != nil {
+		handlerErr := l.onUnexpectedFrame(frameKind(fr))
+		if handlerErr == nil {
+			return nil
+		}
+		de = &Error{Condition: ErrorNotAllowed, Description: handlerErr.Error()}
+		err = handlerErr
+	}
+	if de == nil {
+		return nil
+	}
+	l.closeWithError(de)
+	return err
+}
+
 // close closes and requests deletion of the link.
 //
 // No operations on link are valid after close.
@@ -647,6 +1176,33 @@ func (l *link) muxHandleFrame(fr frameBody) error {
 // is closed.
 func (l *link) Close(ctx context.Context) error {
 	l.closeOnce.Do(func() { close(l.close) })
+	return l.waitForDetach(ctx)
+}
+
+// Detach detaches the link without closing it, leaving the terminus
+// state held by the peer in place so the link can be attached again.
+//
+// No operations on link are valid after detach.
+func (l *link) Detach(ctx context.Context) error {
+	l.closeOnce.Do(func() {
+		l.detachErrorMu.Lock()
+		l.detachOnly = true
+		l.detachErrorMu.Unlock()
+		close(l.close)
+	})
+	return l.waitForDetach(ctx)
+}
+
+// waitForDetach waits for the link to be detached after Close or Detach.
+func (l *link) waitForDetach(ctx context.Context) error {
+	if l.session != nil && l.session.conn != nil && l.session.conn.detachTimeout > 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, l.session.conn.detachTimeout)
+			defer cancel()
+		}
+	}
+
 	select {
 	case <-l.done:
 	case <-ctx.Done():
@@ -687,6 +1243,10 @@ func (l *link) muxDetach() {
 		if l.receiver != nil {
 			l.receiver.inFlight.clear(l.err)
 		}
+
+		if l.onDetach != nil {
+			l.onDetach(l.err)
+		}
 	}()
 
 	// "A peer closes a link by sending the detach frame with the
@@ -702,14 +1262,22 @@ func (l *link) muxDetach() {
 
 	l.detachErrorMu.Lock()
 	detachError := l.detachError
+	detachOnly := l.detachOnly
 	l.detachErrorMu.Unlock()
 
 	fr := &performDetach{
 		Handle: l.handle,
-		Closed: true,
+		Closed: !detachOnly,
 		Error:  detachError,
 	}
 
+	// the peer answers a detach in kind, but may close the link
+	// regardless, so any detach completes a non-closing one
+	isResponse := func(fr frameBody) bool {
+		detach, ok := fr.(*performDetach)
+		return ok && (detach.Closed || detachOnly)
+	}
+
 Loop:
 	for {
 		select {
@@ -718,7 +1286,7 @@ Loop:
 			break Loop
 		case fr := <-l.rx:
 			// discard incoming frames to avoid blocking session.mux
-			if fr, ok := fr.(*performDetach); ok && fr.Closed {
+			if isResponse(fr) {
 				l.detachReceived = true
 			}
 		case <-l.session.done:
@@ -737,10 +1305,10 @@ Loop:
 
 	for {
 		select {
-		// read from link until detach with Close == true is received,
+		// read from link until the peer's detach is received,
 		// other frames are discarded.
 		case fr := <-l.rx:
-			if fr, ok := fr.(*performDetach); ok && fr.Closed {
+			if isResponse(fr) {
 				return
 			}
 
@@ -0,0 +1,2195 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLinkDetachOnDispositionError(t *testing.T) {
+	tests := []struct {
+		label      string
+		opts       []LinkOption
+		settleMode ReceiverSettleMode
+		condition  ErrorCondition
+		wantErr    bool
+	}{
+		{
+			label:      "default ModeFirst",
+			settleMode: ModeFirst,
+			wantErr:    true,
+		},
+		{
+			label:      "default ModeSecond",
+			settleMode: ModeSecond,
+			wantErr:    false,
+		},
+		{
+			label:      "no detach ModeFirst",
+			opts:       []LinkOption{LinkDetachOnDispositionError(false)},
+			settleMode: ModeFirst,
+			wantErr:    false,
+		},
+		{
+			label:      "no detach ModeSecond",
+			opts:       []LinkOption{LinkDetachOnDispositionError(false)},
+			settleMode: ModeSecond,
+			wantErr:    false,
+		},
+		{
+			label:      "throttled ModeFirst",
+			settleMode: ModeFirst,
+			condition:  ErrorTransferLimitExceeded,
+			wantErr:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			l, err := newLink(nil, nil, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.receiverSettleMode = &tt.settleMode
+			condition := tt.condition
+			if condition == "" {
+				condition = ErrorResourceLimitExceeded
+			}
+
+			err = l.muxHandleFrame(&performDisposition{
+				Role:    roleReceiver,
+				First:   1,
+				Settled: true,
+				State: &stateRejected{
+					Error: &Error{Condition: condition},
+				},
+			})
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("muxHandleFrame() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLinkDetachOnDispositionErrorReceiver(t *testing.T) {
+	_, err := newLink(nil, &Receiver{}, []LinkOption{LinkDetachOnDispositionError(false)})
+	if err == nil {
+		t.Error("expected error for Receiver")
+	}
+}
+
+func TestLinkSourceOutcomesAttach(t *testing.T) {
+	l, err := newLink(nil, &Receiver{}, []LinkOption{
+		LinkSourceAddress("q1"),
+		LinkSourceOutcomes(OutcomeAccepted, OutcomeReleased, OutcomeModified),
+		LinkSourceDefaultOutcomeModified(false, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf buffer
+	err = marshal(&buf, &performAttach{
+		Name:   l.key.name,
+		Role:   roleReceiver,
+		Source: l.source,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var attach performAttach
+	err = unmarshal(&buf, &attach)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantOutcomes := multiSymbol{"amqp:accepted:list", "amqp:released:list", "amqp:modified:list"}
+	if !testEqual(attach.Source.Outcomes, wantOutcomes) {
+		t.Errorf("Outcomes = %v, want %v", attach.Source.Outcomes, wantOutcomes)
+	}
+	wantDefault := &stateModified{UndeliverableHere: true}
+	if !testEqual(attach.Source.DefaultOutcome, wantDefault) {
+		t.Errorf("DefaultOutcome = %v, want %v", attach.Source.DefaultOutcome, wantDefault)
+	}
+}
+
+func TestLinkSourceOutcomesInvalid(t *testing.T) {
+	_, err := newLink(nil, &Receiver{}, []LinkOption{LinkSourceOutcomes(OutcomeAccepted, "amqp:bogus:list")})
+	if err == nil {
+		t.Error("expected error for invalid outcome")
+	}
+	_, err = newLink(nil, &Receiver{}, []LinkOption{LinkSourceDefaultOutcome("amqp:bogus:list")})
+	if err == nil {
+		t.Error("expected error for invalid default outcome")
+	}
+}
+
+func TestLinkResumeUnsettled(t *testing.T) {
+	l, err := newLink(nil, &Receiver{}, []LinkOption{
+		LinkName("resumable"),
+		LinkReceiverSettle(ModeSecond),
+		LinkResumeUnsettled(
+			UnsettledDelivery{DeliveryTag: []byte("t1"), Outcome: OutcomeAccepted},
+			UnsettledDelivery{DeliveryTag: []byte("t2")},
+			UnsettledDelivery{DeliveryTag: []byte("t3"), Outcome: OutcomeReleased},
+		),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the unsettled map is carried on attach
+	var buf buffer
+	err = marshal(&buf, &performAttach{
+		Name:      l.key.name,
+		Role:      roleReceiver,
+		Unsettled: l.resumeUnsettled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attach performAttach
+	err = unmarshal(&buf, &attach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantUnsettled := unsettled{
+		"t1": &stateAccepted{},
+		"t2": nil,
+		"t3": &stateReleased{},
+	}
+	if !testEqual(attach.Unsettled, wantUnsettled) {
+		t.Fatal(testDiff(attach.Unsettled, wantUnsettled))
+	}
+
+	// peer settled t3 before the detach
+	l.reconcileUnsettled(&performAttach{
+		Unsettled: unsettled{"t1": nil, "t2": nil},
+	})
+	if _, ok := l.resumeUnsettled["t3"]; ok {
+		t.Error("expected t3 to be dropped after reconciliation")
+	}
+
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.session = newSession(c, 0)
+	l.messages = make(chan Message, 2)
+	l.unsettledMessages = map[string]struct{}{}
+	l.linkCredit = 2
+
+	sent := make(chan frameBody, 1)
+	go func() {
+		fr := <-c.txFrame
+		sent <- fr.body
+	}()
+
+	payload, err := NewMessage([]byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+
+	// t1 was accepted locally, settle it without redelivering
+	err = l.muxReceive(performTransfer{
+		DeliveryID:    uint32Ptr(5),
+		DeliveryTag:   []byte("t1"),
+		MessageFormat: &format,
+		Resume:        true,
+		Payload:       payload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDisposition := &performDisposition{
+		Role:    roleReceiver,
+		First:   5,
+		Settled: true,
+		State:   &stateAccepted{},
+	}
+	if got := <-sent; !testEqual(got, wantDisposition) {
+		t.Error(testDiff(got, wantDisposition))
+	}
+	if len(l.messages) != 0 {
+		t.Errorf("resolved delivery was redelivered")
+	}
+
+	// t2 had no local outcome, redeliver it
+	err = l.muxReceive(performTransfer{
+		DeliveryID:    uint32Ptr(6),
+		DeliveryTag:   []byte("t2"),
+		MessageFormat: &format,
+		Resume:        true,
+		Payload:       payload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-l.messages:
+		if string(msg.DeliveryTag) != "t2" {
+			t.Errorf("DeliveryTag = %q, want %q", msg.DeliveryTag, "t2")
+		}
+	default:
+		t.Error("expected t2 to be redelivered")
+	}
+
+	if len(l.resumeUnsettled) != 0 {
+		t.Errorf("resumeUnsettled not empty: %v", l.resumeUnsettled)
+	}
+	if l.deliveryCount != 2 || l.linkCredit != 0 {
+		t.Errorf("deliveryCount = %d, linkCredit = %d, want 2, 0", l.deliveryCount, l.linkCredit)
+	}
+}
+
+func TestLinkResumeUnsettledSender(t *testing.T) {
+	_, err := newLink(nil, nil, []LinkOption{LinkResumeUnsettled(UnsettledDelivery{DeliveryTag: []byte("t1")})})
+	if err == nil {
+		t.Error("expected error for Sender")
+	}
+}
+
+func TestLinkReceiveAborted(t *testing.T) {
+	l, err := newLink(nil, &Receiver{}, []LinkOption{LinkName("aborted")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.messages = make(chan Message, 1)
+	l.linkCredit = 2
+
+	payload, err := NewMessage([]byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+
+	// two frames of a multi-frame message followed by an abort
+	transfers := []performTransfer{
+		{
+			DeliveryID:    uint32Ptr(1),
+			DeliveryTag:   []byte("partial"),
+			MessageFormat: &format,
+			More:          true,
+			Payload:       payload[:3],
+		},
+		{
+			More:    true,
+			Payload: payload[3:6],
+		},
+		{
+			Aborted: true,
+		},
+	}
+	for _, fr := range transfers {
+		err = l.muxReceive(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(l.messages) != 0 {
+		t.Fatal("aborted message was delivered")
+	}
+	if l.more || l.buf.len() != 0 {
+		t.Errorf("partial delivery not discarded: more = %t, buffered = %d", l.more, l.buf.len())
+	}
+	if l.deliveryCount != 1 || l.linkCredit != 1 {
+		t.Errorf("deliveryCount = %d, linkCredit = %d, want 1, 1", l.deliveryCount, l.linkCredit)
+	}
+
+	// the next delivery is unaffected by the aborted one
+	err = l.muxReceive(performTransfer{
+		DeliveryID:    uint32Ptr(2),
+		DeliveryTag:   []byte("complete"),
+		MessageFormat: &format,
+		Payload:       payload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-l.messages:
+		if string(msg.DeliveryTag) != "complete" || string(msg.GetData()) != "hello" {
+			t.Errorf("unexpected message: tag %q, data %q", msg.DeliveryTag, msg.GetData())
+		}
+	default:
+		t.Fatal("expected message to be delivered")
+	}
+	if l.deliveryCount != 2 || l.linkCredit != 0 {
+		t.Errorf("deliveryCount = %d, linkCredit = %d, want 2, 0", l.deliveryCount, l.linkCredit)
+	}
+}
+
+func TestReceiverReceiveAborted(t *testing.T) {
+	r, s := startReceiverLink(t, nil, LinkCredit(10))
+	defer close(s.done)
+	readFlow(t, s)
+
+	payload, err := NewMessage([]byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	r.link.rx <- &performTransfer{
+		DeliveryID:    uint32Ptr(1),
+		DeliveryTag:   []byte("partial"),
+		MessageFormat: &format,
+		More:          true,
+		Payload:       payload[:4],
+	}
+	r.link.rx <- &performTransfer{
+		Aborted: true,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msg, err := r.Receive(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Receive() = %v, %v; want aborted delivery to be discarded", msg, err)
+	}
+}
+
+func TestLinkReceiveRedeliveredDeliveryCount(t *testing.T) {
+	l, err := newLink(nil, &Receiver{}, []LinkOption{LinkName("redelivered")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.messages = make(chan Message, 1)
+	l.linkCredit = 1
+
+	msg := NewMessage([]byte("retry me"))
+	msg.Header = &MessageHeader{DeliveryCount: 2}
+	payload, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+
+	err = l.muxReceive(performTransfer{
+		DeliveryID:    uint32Ptr(1),
+		DeliveryTag:   []byte("redelivered"),
+		MessageFormat: &format,
+		Payload:       payload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-l.messages:
+		if got.DeliveryCount() != 2 {
+			t.Errorf("DeliveryCount() = %d, want 2", got.DeliveryCount())
+		}
+	default:
+		t.Fatal("expected message to be delivered")
+	}
+
+	if count := (&Message{}).DeliveryCount(); count != 0 {
+		t.Errorf("DeliveryCount() without header = %d, want 0", count)
+	}
+}
+
+func TestLinkReceiveExpiryTime(t *testing.T) {
+	l, err := newLink(nil, &Receiver{}, []LinkOption{LinkName("expiry")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.messages = make(chan Message, 1)
+	l.linkCredit = 1
+
+	created := time.Date(2020, 6, 1, 12, 0, 0, int(250*time.Millisecond), time.UTC)
+	msg := NewMessage([]byte("expiring"))
+	msg.Header = &MessageHeader{TTL: 30 * time.Second}
+	msg.Properties = &MessageProperties{CreationTime: created}
+	payload, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+
+	err = l.muxReceive(performTransfer{
+		DeliveryID:    uint32Ptr(1),
+		DeliveryTag:   []byte("expiry"),
+		MessageFormat: &format,
+		Payload:       payload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Message
+	select {
+	case got = <-l.messages:
+	default:
+		t.Fatal("expected message to be delivered")
+	}
+	if got.Header == nil || got.Header.TTL != 30*time.Second {
+		t.Errorf("Header = %+v, want TTL 30s", got.Header)
+	}
+	if got.Properties == nil || !got.Properties.CreationTime.Equal(created) {
+		t.Fatalf("Properties = %+v, want CreationTime %v", got.Properties, created)
+	}
+	if want := created.Add(30 * time.Second); !got.ExpiryTime().Equal(want) {
+		t.Errorf("ExpiryTime() = %v, want %v", got.ExpiryTime(), want)
+	}
+
+	// an absolute expiry time takes precedence
+	absolute := created.Add(time.Minute)
+	got.Properties.AbsoluteExpiryTime = absolute
+	if !got.ExpiryTime().Equal(absolute) {
+		t.Errorf("ExpiryTime() = %v, want %v", got.ExpiryTime(), absolute)
+	}
+
+	// no expiry without both a TTL and creation time
+	for _, m := range []*Message{
+		{},
+		{Header: &MessageHeader{TTL: time.Second}},
+		{Properties: &MessageProperties{CreationTime: created}},
+	} {
+		if expiry := m.ExpiryTime(); !expiry.IsZero() {
+			t.Errorf("ExpiryTime() = %v, want zero time", expiry)
+		}
+	}
+}
+
+func TestLinkDynamicNodeLifetimePolicy(t *testing.T) {
+	l, err := newLink(nil, &Receiver{}, []LinkOption{
+		LinkAddressDynamic(),
+		LinkDynamicNodeLifetimePolicy(LifetimeDeleteOnClose),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.source.Dynamic = l.dynamicAddr
+
+	var buf buffer
+	err = marshal(&buf, &performAttach{
+		Name:   l.key.name,
+		Role:   roleReceiver,
+		Source: l.source,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var attach performAttach
+	err = unmarshal(&buf, &attach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attach.Source.Dynamic {
+		t.Error("expected dynamic source")
+	}
+	wantProps := map[symbol]interface{}{"lifetime-policy": LifetimeDeleteOnClose}
+	if !testEqual(attach.Source.DynamicNodeProperties, wantProps) {
+		t.Error(testDiff(attach.Source.DynamicNodeProperties, wantProps))
+	}
+}
+
+func TestLinkDynamicNodeLifetimePolicyTarget(t *testing.T) {
+	for _, policy := range []LifetimePolicy{
+		LifetimeDeleteOnClose,
+		LifetimeDeleteOnNoLinks,
+		LifetimeDeleteOnNoMessages,
+		LifetimeDeleteOnNoLinksOrMessages,
+	} {
+		c, err := newConn(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess := newSession(c, 0)
+
+		attaches := make(chan *performAttach, 1)
+		go func() {
+			l := <-sess.allocateHandle
+			l.rx <- nil
+			fr := <-c.txFrame
+			attach := fr.body.(*performAttach)
+			attaches <- attach
+			l.rx <- &performAttach{
+				Name:   l.key.name,
+				Role:   roleReceiver,
+				Source: attach.Source,
+				Target: &target{Address: "dynamic-node"},
+			}
+		}()
+
+		_, err = attachLink(sess, nil, []LinkOption{
+			LinkAddressDynamic(),
+			LinkDynamicNodeLifetimePolicy(policy),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf buffer
+		if err := (<-attaches).marshal(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var attach performAttach
+		if err := attach.unmarshal(&buf); err != nil {
+			t.Fatal(err)
+		}
+		close(sess.done)
+		close(c.done)
+
+		if !attach.Target.Dynamic {
+			t.Errorf("%#02x: expected dynamic target", uint8(policy))
+		}
+		wantProps := map[symbol]interface{}{"lifetime-policy": policy}
+		if !testEqual(attach.Target.DynamicNodeProperties, wantProps) {
+			t.Errorf("%#02x: %s", uint8(policy), testDiff(attach.Target.DynamicNodeProperties, wantProps))
+		}
+	}
+}
+
+func TestLinkDynamicNodePropertySender(t *testing.T) {
+	l, err := newLink(nil, nil, []LinkOption{
+		LinkAddressDynamic(),
+		LinkDynamicNodeLifetimePolicy(LifetimeDeleteOnNoLinks),
+		LinkDynamicNodeProperty("x-opt-test", "value"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.source != nil {
+		t.Errorf("unexpected source %v", l.source)
+	}
+	wantProps := map[symbol]interface{}{
+		"lifetime-policy": LifetimeDeleteOnNoLinks,
+		"x-opt-test":      "value",
+	}
+	if !testEqual(l.target.DynamicNodeProperties, wantProps) {
+		t.Error(testDiff(l.target.DynamicNodeProperties, wantProps))
+	}
+
+	_, err = newLink(nil, nil, []LinkOption{LinkDynamicNodeLifetimePolicy(LifetimePolicy(0x01))})
+	if err == nil {
+		t.Error("expected error for invalid lifetime-policy")
+	}
+}
+
+func TestLinkSourceDistributionMode(t *testing.T) {
+	for _, mode := range []DistributionMode{DistributionModeMove, DistributionModeCopy} {
+		t.Run(string(mode), func(t *testing.T) {
+			l, err := newLink(nil, &Receiver{}, []LinkOption{
+				LinkSourceAddress("topic"),
+				LinkSourceDistributionMode(mode),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf buffer
+			err = marshal(&buf, &performAttach{
+				Name:   l.key.name,
+				Role:   roleReceiver,
+				Source: l.source,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var attach performAttach
+			err = unmarshal(&buf, &attach)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attach.Source.DistributionMode != mode {
+				t.Errorf("DistributionMode = %q, want %q", attach.Source.DistributionMode, mode)
+			}
+		})
+	}
+}
+
+func TestLinkSourceDistributionModeInvalid(t *testing.T) {
+	_, err := newLink(nil, &Receiver{}, []LinkOption{LinkSourceDistributionMode("fanout")})
+	if err == nil {
+		t.Error("expected error for invalid distribution-mode")
+	}
+
+	_, err = newLink(nil, nil, []LinkOption{LinkSourceDistributionMode(DistributionModeCopy)})
+	if err == nil {
+		t.Error("expected error for Sender")
+	}
+}
+
+// startReceiverLink starts the mux for a receiver link on a session stub
+// of c, which may be nil if the link sends no dispositions. Frames sent
+// by the link can be read from the returned Session's tx channel, and
+// dispositions from c's txFrame channel. Close the Session's done channel
+// to stop the link.
+func startReceiverLink(t *testing.T, c *conn, opts ...LinkOption) (*Receiver, *Session) {
+	s := newSession(c, 0)
+	r := &Receiver{maxCredit: DefaultLinkCredit}
+	l, err := newLink(s, r, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.link = l
+	if l.source == nil {
+		l.source = new(source)
+	}
+	l.rx = make(chan frameBody, 1)
+	l.messages = make(chan Message, r.maxCredit)
+	l.unsettledMessages = map[string]struct{}{}
+	go l.mux()
+	return r, s
+}
+
+func readFlow(t *testing.T, s *Session) *performFlow {
+	select {
+	case fr := <-s.tx:
+		flow, ok := fr.(*performFlow)
+		if !ok {
+			t.Fatalf("sent %T, want *performFlow", fr)
+		}
+		return flow
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for flow")
+		return nil
+	}
+}
+
+func TestLinkInitialCredit(t *testing.T) {
+	r, s := startReceiverLink(t, nil, LinkCredit(10), LinkInitialCredit(3))
+	defer close(s.done)
+
+	flow := readFlow(t, s)
+	if *flow.LinkCredit != 3 {
+		t.Errorf("LinkCredit = %d, want 3", *flow.LinkCredit)
+	}
+
+	err := r.IssueCredit(1)
+	if err == nil {
+		t.Error("expected IssueCredit error when not in manual mode")
+	}
+}
+
+func TestLinkInitialCreditOnDemand(t *testing.T) {
+	r, s := startReceiverLink(t, nil, LinkCredit(10), LinkInitialCredit(0))
+	defer close(s.done)
+
+	select {
+	case fr := <-s.tx:
+		t.Fatalf("unexpected frame before Receive: %v", fr)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_, _ = r.Receive(ctx)
+	}()
+
+	flow := readFlow(t, s)
+	if *flow.LinkCredit != 1 {
+		t.Errorf("LinkCredit = %d, want 1", *flow.LinkCredit)
+	}
+}
+
+func TestLinkInitialCreditManual(t *testing.T) {
+	r, s := startReceiverLink(t, nil, LinkCredit(10), LinkInitialCredit(-1))
+	defer close(s.done)
+
+	select {
+	case fr := <-s.tx:
+		t.Fatalf("unexpected frame before IssueCredit: %v", fr)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- r.IssueCredit(5)
+	}()
+	flow := readFlow(t, s)
+	if *flow.LinkCredit != 5 {
+		t.Errorf("LinkCredit = %d, want 5", *flow.LinkCredit)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("IssueCredit() error = %v", err)
+	}
+
+	// 5 outstanding + 6 exceeds the buffer of 10
+	err := r.IssueCredit(6)
+	if err == nil {
+		t.Error("expected error issuing credit beyond buffer size")
+	}
+}
+
+func TestReceiverDrainCredit(t *testing.T) {
+	r, s := startReceiverLink(t, nil, LinkCredit(10), LinkInitialCredit(-1))
+	defer close(s.done)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- r.IssueCredit(5)
+	}()
+	readFlow(t, s)
+	if err := <-errs; err != nil {
+		t.Fatalf("IssueCredit() error = %v", err)
+	}
+
+	go func() {
+		errs <- r.DrainCredit(context.Background())
+	}()
+	flow := readFlow(t, s)
+	if !flow.Drain || *flow.LinkCredit != 5 {
+		t.Errorf("flow Drain = %t, LinkCredit = %d, want true, 5", flow.Drain, *flow.LinkCredit)
+	}
+
+	// the sender delivers two messages, then returns the remaining credit
+	payload, err := NewMessage([]byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	for i := uint32(0); i < 2; i++ {
+		r.link.rx <- &performTransfer{
+			DeliveryID:    uint32Ptr(i),
+			DeliveryTag:   []byte{byte(i)},
+			MessageFormat: &format,
+			Settled:       true,
+			Payload:       payload,
+		}
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("DrainCredit() returned %v before credit was returned", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	deliveryCount, linkCredit := uint32(5), uint32(0)
+	r.link.rx <- &performFlow{
+		Handle:        &r.link.handle,
+		DeliveryCount: &deliveryCount,
+		LinkCredit:    &linkCredit,
+		Drain:         true,
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("DrainCredit() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DrainCredit() didn't return")
+	}
+
+	if n := len(r.link.messages); n != 2 {
+		t.Errorf("%d messages buffered, want 2", n)
+	}
+	if credit := r.Credit(); credit != 0 {
+		t.Errorf("Credit() = %d, want 0", credit)
+	}
+}
+
+func TestReceiverPrefetch(t *testing.T) {
+	r, s := startReceiverLink(t, nil, LinkCredit(10), LinkInitialCredit(-1))
+	defer close(s.done)
+
+	type result struct {
+		msgs []*Message
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		msgs, err := r.Prefetch(context.Background(), 5)
+		results <- result{msgs: msgs, err: err}
+	}()
+
+	if flow := readFlow(t, s); flow.Drain || *flow.LinkCredit != 5 {
+		t.Fatalf("flow Drain = %t, LinkCredit = %d, want false, 5", flow.Drain, *flow.LinkCredit)
+	}
+	if flow := readFlow(t, s); !flow.Drain {
+		t.Fatal("expected drain flow")
+	}
+
+	// the sender has three queued messages, then returns the remaining credit
+	format := uint32(0)
+	for i := uint32(0); i < 3; i++ {
+		payload, err := NewMessage([]byte(fmt.Sprintf("message %d", i))).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.link.rx <- &performTransfer{
+			DeliveryID:    uint32Ptr(i),
+			DeliveryTag:   []byte{byte(i)},
+			MessageFormat: &format,
+			Settled:       true,
+			Payload:       payload,
+		}
+	}
+	deliveryCount, linkCredit := uint32(5), uint32(0)
+	r.link.rx <- &performFlow{
+		Handle:        &r.link.handle,
+		DeliveryCount: &deliveryCount,
+		LinkCredit:    &linkCredit,
+		Drain:         true,
+	}
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Prefetch() didn't return")
+	}
+	if res.err != nil {
+		t.Fatalf("Prefetch() error = %v", res.err)
+	}
+	if len(res.msgs) != 3 {
+		t.Fatalf("Prefetch() returned %d messages, want 3", len(res.msgs))
+	}
+	for i, msg := range res.msgs {
+		if want := fmt.Sprintf("message %d", i); string(msg.GetData()) != want {
+			t.Errorf("message %d data = %q, want %q", i, msg.GetData(), want)
+		}
+	}
+
+	// credit isn't replenished
+	select {
+	case fr := <-s.tx:
+		t.Errorf("unexpected frame %s sent after Prefetch", fr)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if credit := r.Credit(); credit != 0 {
+		t.Errorf("Credit() = %d, want 0", credit)
+	}
+}
+
+func TestReceiverDrainAll(t *testing.T) {
+	r, s := startReceiverLink(t, nil, LinkCredit(10), LinkInitialCredit(-1))
+	defer close(s.done)
+
+	issued := make(chan error, 1)
+	go func() { issued <- r.IssueCredit(5) }()
+	readFlow(t, s)
+	if err := <-issued; err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		msgs []*Message
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		msgs, err := r.DrainAll(context.Background())
+		results <- result{msgs: msgs, err: err}
+	}()
+	if flow := readFlow(t, s); !flow.Drain {
+		t.Fatal("expected drain flow")
+	}
+
+	// two messages are in flight when the sender receives the drain
+	format := uint32(0)
+	for i := uint32(0); i < 2; i++ {
+		payload, err := NewMessage([]byte(fmt.Sprintf("message %d", i))).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.link.rx <- &performTransfer{
+			DeliveryID:    uint32Ptr(i),
+			DeliveryTag:   []byte{byte(i)},
+			MessageFormat: &format,
+			Settled:       true,
+			Payload:       payload,
+		}
+	}
+	deliveryCount, linkCredit := uint32(5), uint32(0)
+	r.link.rx <- &performFlow{
+		Handle:        &r.link.handle,
+		DeliveryCount: &deliveryCount,
+		LinkCredit:    &linkCredit,
+		Drain:         true,
+	}
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DrainAll() didn't return")
+	}
+	if res.err != nil {
+		t.Fatalf("DrainAll() error = %v", res.err)
+	}
+	if len(res.msgs) != 2 {
+		t.Fatalf("DrainAll() returned %d messages, want 2", len(res.msgs))
+	}
+	for i, msg := range res.msgs {
+		if want := fmt.Sprintf("message %d", i); string(msg.GetData()) != want {
+			t.Errorf("message %d data = %q, want %q", i, msg.GetData(), want)
+		}
+	}
+	if credit := r.Credit(); credit != 0 {
+		t.Errorf("Credit() = %d, want 0", credit)
+	}
+}
+
+func TestReceiverDrainCreditNotManual(t *testing.T) {
+	r, s := startReceiverLink(t, nil, LinkCredit(10))
+	defer close(s.done)
+	readFlow(t, s)
+
+	if err := r.DrainCredit(context.Background()); err == nil {
+		t.Error("expected DrainCredit error when not in manual mode")
+	}
+}
+
+func TestLinkInitialCreditExceedsBuffer(t *testing.T) {
+	_, err := newLink(nil, &Receiver{maxCredit: 10}, []LinkOption{LinkInitialCredit(11)})
+	if err == nil {
+		t.Error("expected error for initial credit exceeding link credit")
+	}
+	_, err = newLink(nil, nil, []LinkOption{LinkInitialCredit(1)})
+	if err == nil {
+		t.Error("expected error for Sender")
+	}
+}
+
+func TestAttachLinkErrorCondition(t *testing.T) {
+	tests := []struct {
+		condition ErrorCondition
+		want      error
+	}{
+		{condition: ErrorNotFound, want: ErrAddressNotFound},
+		{condition: ErrorUnauthorizedAccess, want: ErrUnauthorized},
+	}
+
+	sentinels := []error{
+		ErrAddressNotFound,
+		ErrUnauthorized,
+		ErrResourceLimitExceeded,
+		ErrNotImplemented,
+		ErrPreconditionFailed,
+		ErrConnectionForced,
+		ErrThrottled,
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.condition), func(t *testing.T) {
+			c, err := newConn(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer close(c.done)
+			s := newSession(c, 0)
+
+			// stand in for the session mux and the peer
+			go func() {
+				l := <-s.allocateHandle
+				l.rx <- nil
+				<-c.txFrame // attach
+				l.rx <- &performAttach{Name: l.key.name, Role: roleReceiver}
+				l.rx <- &performDetach{
+					Handle: l.handle,
+					Closed: true,
+					Error:  &Error{Condition: tt.condition, Description: "rejected"},
+				}
+				<-c.txFrame // detach
+			}()
+
+			_, err = attachLink(s, nil, []LinkOption{LinkTargetAddress("missing")})
+			amqpErr, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("expected *Error, got %T: %v", err, err)
+			}
+			if amqpErr.Condition != tt.condition || amqpErr.Description != "rejected" {
+				t.Errorf("unexpected error %v", amqpErr)
+			}
+			for _, sentinel := range sentinels {
+				if got := amqpErr.Is(sentinel); got != (sentinel == tt.want) {
+					t.Errorf("Is(%v) = %t, want %t", sentinel, got, sentinel == tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorIsThrottled(t *testing.T) {
+	throttled := &Error{Condition: ErrorTransferLimitExceeded}
+	if !throttled.Is(ErrThrottled) {
+		t.Errorf("expected %v to match ErrThrottled", throttled)
+	}
+	if throttled.Is(ErrResourceLimitExceeded) {
+		t.Errorf("expected %v not to match ErrResourceLimitExceeded", throttled)
+	}
+	limited := &Error{Condition: ErrorResourceLimitExceeded}
+	if limited.Is(ErrThrottled) {
+		t.Errorf("expected %v not to match ErrThrottled", limited)
+	}
+}
+
+func TestReceiverRemoteSourceTarget(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+	s := newSession(c, 0)
+	defer close(s.done)
+
+	const selector = "apache.org:selector-filter:string"
+
+	// stand in for the session mux and the peer, the peer
+	// applies a different selector than the one requested
+	go func() {
+		l := <-s.allocateHandle
+		l.rx <- nil
+		<-c.txFrame // attach
+		l.rx <- &performAttach{
+			Name: l.key.name,
+			Role: roleSender,
+			Source: &source{
+				Address:          "queue",
+				DistributionMode: "copy",
+				Filter: filter{
+					selector: &DescribedType{
+						Descriptor: uint64(0x0000468C00000004),
+						Value:      "color = 'blue'",
+					},
+				},
+				DefaultOutcome: &stateReleased{},
+				Outcomes:       multiSymbol{symbol(OutcomeAccepted), symbol(OutcomeReleased)},
+				Capabilities:   multiSymbol{"queue"},
+			},
+			Target: &target{Address: "local"},
+		}
+	}()
+
+	r := &Receiver{maxCredit: DefaultLinkCredit}
+	l, err := attachLink(s, r, []LinkOption{
+		LinkSourceAddress("queue"),
+		LinkSelectorFilter("color = 'red'"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.link = l
+
+	wantSource := &Source{
+		Address:          "queue",
+		ExpiryPolicy:     ExpirySessionEnd,
+		DistributionMode: "copy",
+		Filter:           map[string]interface{}{selector: "color = 'blue'"},
+		DefaultOutcome:   OutcomeReleased,
+		Outcomes:         []Outcome{OutcomeAccepted, OutcomeReleased},
+		Capabilities:     []string{"queue"},
+	}
+	if got := r.Source(); !testEqual(got, wantSource) {
+		t.Error(testDiff(got, wantSource))
+	}
+	wantTarget := &Target{Address: "local", ExpiryPolicy: ExpirySessionEnd}
+	if got := r.Target(); !testEqual(got, wantTarget) {
+		t.Error(testDiff(got, wantTarget))
+	}
+}
+
+func TestReceiverSessionID(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+	s := newSession(c, 0)
+	defer close(s.done)
+
+	// stand in for the session mux and the peer, the
+	// peer assigns the next available session
+	go func() {
+		l := <-s.allocateHandle
+		l.rx <- nil
+		<-c.txFrame // attach
+		l.rx <- &performAttach{
+			Name: l.key.name,
+			Role: roleSender,
+			Source: &source{
+				Address: "queue",
+				Filter: filter{
+					sessionFilterName: &DescribedType{
+						Descriptor: uint64(sessionFilterCode),
+						Value:      "assigned",
+					},
+				},
+			},
+			Target: &target{},
+		}
+	}()
+
+	r := &Receiver{maxCredit: DefaultLinkCredit}
+	l, err := attachLink(s, r, []LinkOption{
+		LinkSourceAddress("queue"),
+		LinkSessionFilter(nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.link = l
+
+	if id := r.SessionID(); id != "assigned" {
+		t.Errorf("SessionID() = %q, want %q", id, "assigned")
+	}
+}
+
+func TestAttachLinkDefaultTimeout(t *testing.T) {
+	c, err := newConn(nil, ConnDefaultAttachTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+	clk := newFakeClock()
+	c.clock = clk
+	s := newSession(c, 0)
+	defer close(s.done)
+
+	// stand in for the session mux and a peer that never answers the attach
+	errs := make(chan error, 1)
+	go func() {
+		l := <-s.allocateHandle
+		l.rx <- nil
+		<-c.txFrame // attach
+		clk.BlockUntil(1)
+		clk.Advance(5 * time.Second)
+
+		fr := <-c.txFrame
+		if fr, ok := fr.body.(*performDetach); !ok || !fr.Closed {
+			errs <- fmt.Errorf("unexpected frame %v, want closing detach", fr)
+			return
+		}
+
+		// a late attach response must be discarded
+		l.rx <- &performAttach{Name: l.key.name, Role: roleSender}
+		l.rx <- &performDetach{Handle: l.handle, Closed: true}
+		select {
+		case dl := <-s.deallocateHandle:
+			if dl != l {
+				errs <- fmt.Errorf("deallocated unexpected link %v", dl)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			errs <- fmt.Errorf("link handle wasn't deallocated")
+			return
+		}
+		errs <- nil
+	}()
+
+	_, err = attachLink(s, &Receiver{maxCredit: DefaultLinkCredit}, []LinkOption{LinkSourceAddress("queue")})
+	if err != ErrTimeout {
+		t.Fatalf("unexpected error %v, want ErrTimeout", err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkCloseDefaultDetachTimeout(t *testing.T) {
+	c, err := newConn(nil, ConnDefaultDetachTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+	s := newSession(c, 0)
+	defer close(s.done)
+
+	// the link mux isn't running, so the detach is never answered
+	l := makeLink(ModeFirst)
+	l.session = s
+	if err := l.Close(context.Background()); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// an explicit deadline takes precedence over the default
+	l = makeLink(ModeFirst)
+	l.session = s
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Close returned after %v, want at least 50ms", elapsed)
+	}
+}
+
+func TestLinkFlowEcho(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	flows := make(chan LinkFlow, 1)
+	answer := false
+	r, s := startReceiverLink(t, c,
+		LinkFlowEcho(func(f LinkFlow) bool {
+			ok := answer
+			flows <- f
+			return ok
+		}),
+	)
+	defer close(s.done)
+	l := r.link
+
+	readFlow(t, s) // initial credit
+
+	deliveryCount := uint32(0)
+	linkCredit := uint32(5)
+	l.rx <- &performFlow{
+		Handle:        &l.handle,
+		DeliveryCount: &deliveryCount,
+		LinkCredit:    &linkCredit,
+		Echo:          true,
+	}
+	select {
+	case f := <-flows:
+		if f.LinkCredit == nil || *f.LinkCredit != 5 {
+			t.Errorf("LinkCredit = %s, want 5", formatUint32Ptr(f.LinkCredit))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow echo callback not called")
+	}
+	select {
+	case fr := <-c.txFrame:
+		t.Fatalf("unexpected frame %s sent when echo is declined", fr.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// answered when the callback returns true, the flag is read by the
+	// callback before it reports the flow, so it's safe to set here
+	answer = true
+	l.rx <- &performFlow{
+		Handle:     &l.handle,
+		LinkCredit: &linkCredit,
+		Echo:       true,
+	}
+	<-flows
+	select {
+	case fr := <-c.txFrame:
+		if _, ok := fr.body.(*performFlow); !ok {
+			t.Fatalf("sent %T, want *performFlow", fr.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for echo")
+	}
+}
+
+func TestLinkCreditOnSettle(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	r, s := startReceiverLink(t, c,
+		LinkCredit(4),
+		LinkReceiverSettle(ModeSecond),
+		LinkCreditOnSettle(true),
+	)
+	defer close(s.done)
+	l := r.link
+
+	if flow := readFlow(t, s); *flow.LinkCredit != 4 {
+		t.Fatalf("initial LinkCredit = %d, want 4", *flow.LinkCredit)
+	}
+
+	payload, err := NewMessage([]byte("settle")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	var msgs []*Message
+	for i := uint32(0); i < 4; i++ {
+		l.rx <- &performTransfer{
+			Handle:        l.handle,
+			DeliveryID:    uint32Ptr(i),
+			DeliveryTag:   []byte(fmt.Sprintf("tag-%d", i)),
+			MessageFormat: &format,
+			Payload:       payload,
+		}
+		msg, err := r.Receive(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	// received but unsettled deliveries continue to hold credit
+	select {
+	case fr := <-s.tx:
+		t.Fatalf("unexpected frame %s sent before settlement", fr)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i, msg := range msgs {
+		errs := make(chan error, 1)
+		go func() { errs <- msg.Accept(context.Background()) }()
+
+		select {
+		case fr := <-c.txFrame:
+			if _, ok := fr.body.(*performDisposition); !ok {
+				t.Fatalf("sent %T, want *performDisposition", fr.body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for disposition")
+		}
+		l.rx <- &performDisposition{
+			Role:    roleSender,
+			First:   msg.deliveryID,
+			Settled: true,
+			State:   &stateAccepted{},
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		// each settlement reissues the credit the delivery held
+		flow := readFlow(t, s)
+		if want := uint32(i + 1); *flow.LinkCredit != want {
+			t.Errorf("LinkCredit after settling %d = %d, want %d", i+1, *flow.LinkCredit, want)
+		}
+	}
+}
+
+func TestLinkCreditOnSettleCanceled(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	r, s := startReceiverLink(t, c,
+		LinkCredit(1),
+		LinkReceiverSettle(ModeSecond),
+		LinkCreditOnSettle(true),
+	)
+	defer close(s.done)
+	l := r.link
+	readFlow(t, s)
+
+	payload, err := NewMessage([]byte("settle")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	l.rx <- &performTransfer{
+		Handle:        l.handle,
+		DeliveryID:    uint32Ptr(0),
+		DeliveryTag:   []byte("tag-0"),
+		MessageFormat: &format,
+		Payload:       payload,
+	}
+	msg, err := r.Receive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the caller stops waiting before the peer settles
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- msg.Accept(ctx) }()
+	select {
+	case fr := <-c.txFrame:
+		if _, ok := fr.body.(*performDisposition); !ok {
+			t.Fatalf("sent %T, want *performDisposition", fr.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disposition")
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("Accept() error = %v, want %v", err, context.Canceled)
+	}
+
+	// the later settlement still reissues the credit
+	l.rx <- &performDisposition{
+		Role:    roleSender,
+		First:   msg.deliveryID,
+		Settled: true,
+		State:   &stateAccepted{},
+	}
+	if flow := readFlow(t, s); *flow.LinkCredit != 1 {
+		t.Errorf("LinkCredit after settlement = %d, want 1", *flow.LinkCredit)
+	}
+}
+
+func TestReceiverAcceptAsyncCreditOnSettle(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	r, s := startReceiverLink(t, c,
+		LinkCredit(1),
+		LinkReceiverSettle(ModeSecond),
+		LinkCreditOnSettle(true),
+	)
+	defer close(s.done)
+	l := r.link
+	readFlow(t, s)
+
+	payload, err := NewMessage([]byte("settle")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	l.rx <- &performTransfer{
+		Handle:        l.handle,
+		DeliveryID:    uint32Ptr(0),
+		DeliveryTag:   []byte("tag-0"),
+		MessageFormat: &format,
+		Payload:       payload,
+	}
+	msg, err := r.Receive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the settlement isn't awaited
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r.AcceptAsync(msg)
+		errs <- err
+	}()
+	select {
+	case fr := <-c.txFrame:
+		if _, ok := fr.body.(*performDisposition); !ok {
+			t.Fatalf("sent %T, want *performDisposition", fr.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disposition")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	l.rx <- &performDisposition{
+		Role:    roleSender,
+		First:   msg.deliveryID,
+		Settled: true,
+		State:   &stateAccepted{},
+	}
+	if flow := readFlow(t, s); *flow.LinkCredit != 1 {
+		t.Errorf("LinkCredit after settlement = %d, want 1", *flow.LinkCredit)
+	}
+}
+
+func TestLinkCreditOnSettleInvalid(t *testing.T) {
+	tests := []struct {
+		label string
+		opts  []LinkOption
+	}{
+		{label: "mode first", opts: []LinkOption{LinkCreditOnSettle(true)}},
+		{label: "manual credit", opts: []LinkOption{LinkCreditOnSettle(true), LinkReceiverSettle(ModeSecond), LinkInitialCredit(-1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			_, err := newLink(nil, &Receiver{maxCredit: DefaultLinkCredit}, tt.opts)
+			if err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+	_, err := newLink(nil, nil, []LinkOption{LinkCreditOnSettle(true)})
+	if err == nil {
+		t.Error("expected error for Sender")
+	}
+}
+
+func TestReceiverDetach(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	opts := []LinkOption{
+		LinkName("subscription"),
+		LinkSourceDurability(DurabilityUnsettledState),
+		LinkSourceExpiryPolicy(ExpiryNever),
+	}
+	r, s := startReceiverLink(t, c, opts...)
+	defer close(s.done)
+	l := r.link
+	readFlow(t, s)
+
+	errs := make(chan error, 1)
+	go func() { errs <- r.Detach(context.Background()) }()
+
+	var detach *performDetach
+	select {
+	case fr := <-s.tx:
+		var ok bool
+		if detach, ok = fr.(*performDetach); !ok {
+			t.Fatalf("sent %T, want *performDetach", fr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for detach")
+	}
+	var buf buffer
+	if err := detach.marshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var sent performDetach
+	if err := sent.unmarshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := performDetach{Handle: l.handle}
+	if !testEqual(sent, want) {
+		t.Errorf("sent detach: %s", testDiff(sent, want))
+	}
+
+	// the peer answers with its own non-closing detach
+	l.rx <- &performDetach{Handle: l.handle}
+	<-s.deallocateHandle
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Detach() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Detach() didn't return")
+	}
+
+	if err := r.Err(); err != ErrLinkClosed {
+		t.Errorf("Err() = %v, want %v", err, ErrLinkClosed)
+	}
+
+	// a new link with the same options attaches to the durable source again
+	attaches := make(chan *performAttach, 1)
+	go func() {
+		l := <-s.allocateHandle
+		l.rx <- nil
+		fr := <-c.txFrame
+		attach := fr.body.(*performAttach)
+		attaches <- attach
+		l.rx <- &performAttach{
+			Name:   l.key.name,
+			Role:   roleSender,
+			Source: attach.Source,
+			Target: attach.Target,
+		}
+	}()
+	if _, err := s.NewReceiver(opts...); err != nil {
+		t.Fatal(err)
+	}
+	attach := <-attaches
+	if attach.Name != l.key.name {
+		t.Errorf("attach Name = %q, want %q", attach.Name, l.key.name)
+	}
+	if attach.Source == nil || attach.Source.Durable != DurabilityUnsettledState || attach.Source.ExpiryPolicy != ExpiryNever {
+		t.Errorf("attach Source = %+v, want durable unsettled-state source that never expires", attach.Source)
+	}
+}
+
+func TestReceiverAcceptRange(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	r, s := startReceiverLink(t, c, LinkReceiverSettle(ModeSecond))
+	defer close(s.done)
+	l := r.link
+	readFlow(t, s)
+
+	payload, err := NewMessage([]byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	var msgs []*Message
+	for i := uint32(10); i < 14; i++ {
+		l.rx <- &performTransfer{
+			DeliveryID:    uint32Ptr(i),
+			DeliveryTag:   []byte{byte(i)},
+			MessageFormat: &format,
+			Payload:       payload,
+		}
+		msg, err := r.Receive(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	// a gap in the delivery IDs is rejected
+	err = r.AcceptRange(context.Background(), []*Message{msgs[0], msgs[2]})
+	if err == nil {
+		t.Error("expected error for non-contiguous messages")
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- r.AcceptRange(context.Background(), msgs) }()
+
+	var disp *performDisposition
+	select {
+	case fr := <-c.txFrame:
+		var ok bool
+		if disp, ok = fr.body.(*performDisposition); !ok {
+			t.Fatalf("sent %T, want *performDisposition", fr.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disposition")
+	}
+	if disp.First != 10 || disp.Last == nil || *disp.Last != 13 {
+		t.Errorf("disposition First = %d, Last = %s, want 10, 13", disp.First, formatUint32Ptr(disp.Last))
+	}
+	if _, ok := disp.State.(*stateAccepted); !ok {
+		t.Errorf("disposition state = %v, want accepted", disp.State)
+	}
+
+	// the server settles the range
+	l.rx <- &performDisposition{
+		Role:    roleSender,
+		First:   10,
+		Last:    uint32Ptr(13),
+		Settled: true,
+		State:   &stateAccepted{},
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("AcceptRange() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AcceptRange() didn't return")
+	}
+	select {
+	case fr := <-c.txFrame:
+		t.Errorf("unexpected frame %s after ranged disposition", fr.body)
+	default:
+	}
+}
+
+// recordingStore is a SettlementStore recording the calls made to it.
+type recordingStore struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (s *recordingStore) Unsettled(linkName string, d UnsettledDelivery) {
+	s.mu.Lock()
+	s.calls = append(s.calls, fmt.Sprintf("unsettled %s %s", d.DeliveryTag, d.Outcome))
+	s.mu.Unlock()
+}
+
+func (s *recordingStore) Settled(linkName string, deliveryTag []byte) {
+	s.mu.Lock()
+	s.calls = append(s.calls, fmt.Sprintf("settled %s", deliveryTag))
+	s.mu.Unlock()
+}
+
+func (s *recordingStore) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func TestLinkSettlementStoreReceiver(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	store := new(recordingStore)
+	r, s := startReceiverLink(t, c,
+		LinkReceiverSettle(ModeSecond),
+		LinkSettlementStore(store),
+	)
+	defer close(s.done)
+	l := r.link
+	readFlow(t, s)
+
+	payload, err := NewMessage([]byte("store")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	for i, settled := range []bool{false, true} {
+		l.rx <- &performTransfer{
+			Handle:        l.handle,
+			DeliveryID:    uint32Ptr(uint32(i)),
+			DeliveryTag:   []byte(fmt.Sprintf("tag-%d", i)),
+			MessageFormat: &format,
+			Settled:       settled,
+			Payload:       payload,
+		}
+	}
+	msg, err := r.Receive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sender-settled deliveries aren't recorded
+	if _, err := r.Receive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- msg.Accept(context.Background()) }()
+	select {
+	case <-c.txFrame: // disposition
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disposition")
+	}
+	l.rx <- &performDisposition{
+		Role:    roleSender,
+		First:   msg.deliveryID,
+		Settled: true,
+		State:   &stateAccepted{},
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"unsettled tag-0 ",
+		"unsettled tag-0 " + string(OutcomeAccepted),
+		"settled tag-0",
+	}
+	if got := store.Calls(); !testEqual(got, want) {
+		t.Error(testDiff(got, want))
+	}
+}
+
+func TestReceiverAcceptAsync(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	const count = 50
+	r, s := startReceiverLink(t, c, LinkCredit(count), LinkReceiverSettle(ModeSecond))
+	defer close(s.done)
+	l := r.link
+	readFlow(t, s)
+
+	payload, err := NewMessage([]byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	var msgs []*Message
+	for i := uint32(0); i < count; i++ {
+		l.rx <- &performTransfer{
+			DeliveryID:    uint32Ptr(i),
+			DeliveryTag:   []byte{byte(i)},
+			MessageFormat: &format,
+			Payload:       payload,
+		}
+		msg, err := r.Receive(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	sent := make(chan []uint32, 1)
+	go func() {
+		var ids []uint32
+		for len(ids) < count {
+			fr := <-c.txFrame
+			if disp, ok := fr.body.(*performDisposition); ok && !disp.Settled {
+				ids = append(ids, disp.First)
+			}
+		}
+		sent <- ids
+	}()
+
+	// accept all messages without waiting for settlement
+	var pending []*PendingDisposition
+	for _, msg := range msgs {
+		d, err := r.AcceptAsync(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, d)
+	}
+
+	var ids []uint32
+	select {
+	case ids = <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for dispositions")
+	}
+	for i, id := range ids {
+		if id != uint32(i) {
+			t.Fatalf("disposition %d has First = %d, want %d", i, id, i)
+		}
+	}
+
+	// the server settles the deliveries in two ranges, the second first
+	for _, rng := range [][2]uint32{{count / 2, count - 1}, {0, count/2 - 1}} {
+		l.rx <- &performDisposition{
+			Role:    roleSender,
+			First:   rng[0],
+			Last:    uint32Ptr(rng[1]),
+			Settled: true,
+			State:   &stateAccepted{},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, d := range pending {
+		if err := d.Wait(ctx); err != nil {
+			t.Fatalf("Wait() for delivery %d error = %v", i, err)
+		}
+	}
+	if n := r.inFlight.len(); n != 0 {
+		t.Errorf("%d dispositions still in flight", n)
+	}
+}
+
+func TestReceiverModifyAnnotations(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	r, s := startReceiverLink(t, c, LinkCredit(10))
+	defer close(s.done)
+	l := r.link
+	readFlow(t, s)
+
+	// transfer delivers msg to the receiver as delivery id
+	format := uint32(0)
+	transfer := func(id uint32, msg *Message) *Message {
+		payload, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.rx <- &performTransfer{
+			DeliveryID:    uint32Ptr(id),
+			DeliveryTag:   []byte{byte(id)},
+			MessageFormat: &format,
+			Payload:       payload,
+		}
+		got, err := r.Receive(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	orig := NewMessage([]byte("hello"))
+	orig.Annotations = Annotations{"x-opt-kept": "original", "x-opt-retry": int64(0)}
+	msg := transfer(0, orig)
+
+	modified := Annotations{"x-opt-retry": int64(1), "x-opt-reason": "busy"}
+	errs := make(chan error, 1)
+	go func() { errs <- msg.Modify(context.Background(), true, false, modified) }()
+
+	var disp *performDisposition
+	for disp == nil {
+		select {
+		case fr := <-c.txFrame:
+			disp, _ = fr.body.(*performDisposition)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for disposition")
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip the disposition through the codec as the peer would see it
+	buf := new(buffer)
+	if err := writeFrame(buf, frame{type_: frameTypeAMQP, body: disp}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseFrameHeader(buf); err != nil {
+		t.Fatal(err)
+	}
+	body, err := parseFrameBody(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, ok := body.(*performDisposition).State.(*stateModified)
+	if !ok {
+		t.Fatalf("disposition state = %T, want *stateModified", body.(*performDisposition).State)
+	}
+	want := &stateModified{DeliveryFailed: true, MessageAnnotations: modified}
+	if !testEqual(state, want) {
+		t.Fatalf("unexpected modified outcome:\n%s", testDiff(state, want))
+	}
+
+	// the peer merges the annotations into the redelivered message,
+	// overwriting existing keys
+	merged := Annotations{}
+	for k, v := range orig.Annotations {
+		merged[k] = v
+	}
+	for k, v := range state.MessageAnnotations {
+		merged[k] = v
+	}
+	redelivery := NewMessage([]byte("hello"))
+	redelivery.Annotations = merged
+	got := transfer(1, redelivery)
+
+	wantAnnotations := Annotations{
+		"x-opt-kept":   "original",
+		"x-opt-retry":  int64(1),
+		"x-opt-reason": "busy",
+	}
+	if !testEqual(got.Annotations, wantAnnotations) {
+		t.Errorf("unexpected redelivered annotations:\n%s", testDiff(got.Annotations, wantAnnotations))
+	}
+}
+
+func TestReceiverAutoAccept(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	r, s := startReceiverLink(t, c, LinkCredit(10), LinkAutoAccept(true))
+	defer close(s.done)
+	l := r.link
+	readFlow(t, s)
+
+	payload, err := NewMessage([]byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	l.rx <- &performTransfer{
+		DeliveryID:    uint32Ptr(7),
+		DeliveryTag:   []byte{7},
+		MessageFormat: &format,
+		Payload:       payload,
+	}
+
+	type result struct {
+		msg *Message
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		msg, err := r.Receive(context.Background())
+		results <- result{msg: msg, err: err}
+	}()
+
+	// the disposition is sent without an explicit Accept
+	var disp *performDisposition
+	for disp == nil {
+		select {
+		case fr := <-c.txFrame:
+			disp, _ = fr.body.(*performDisposition)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for disposition")
+		}
+	}
+	if disp.First != 7 || !disp.Settled {
+		t.Errorf("disposition first = %d, settled = %t, want 7, true", disp.First, disp.Settled)
+	}
+	if _, ok := disp.State.(*stateAccepted); !ok {
+		t.Errorf("disposition state = %T, want *stateAccepted", disp.State)
+	}
+
+	res := <-results
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if string(res.msg.GetData()) != "hello" {
+		t.Errorf("received %q, want %q", res.msg.GetData(), "hello")
+	}
+
+	// an explicit disposition after the automatic one isn't sent
+	if err := res.msg.Reject(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case fr := <-c.txFrame:
+		if _, ok := fr.body.(*performDisposition); ok {
+			t.Errorf("unexpected second disposition %v", fr.body)
+		}
+	default:
+	}
+
+	// ModeSecond leaves settlement to the receiver
+	_, err = newLink(s, &Receiver{maxCredit: 10}, []LinkOption{LinkAutoAccept(true), LinkReceiverSettle(ModeSecond)})
+	if err == nil {
+		t.Error("expected error using LinkAutoAccept with ModeSecond")
+	}
+	_, err = newLink(s, nil, []LinkOption{LinkAutoAccept(true)})
+	if err == nil {
+		t.Error("expected error using LinkAutoAccept on a Sender")
+	}
+}
+
+func TestReceiverAutoAcceptDrainAll(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+
+	r, s := startReceiverLink(t, c, LinkCredit(10), LinkInitialCredit(-1), LinkAutoAccept(true))
+	defer close(s.done)
+	l := r.link
+
+	issued := make(chan error, 1)
+	go func() { issued <- r.IssueCredit(2) }()
+	readFlow(t, s)
+	if err := <-issued; err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := NewMessage([]byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	l.rx <- &performTransfer{
+		DeliveryID:    uint32Ptr(3),
+		DeliveryTag:   []byte{3},
+		MessageFormat: &format,
+		Payload:       payload,
+	}
+
+	type result struct {
+		msgs []*Message
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		msgs, err := r.DrainAll(context.Background())
+		results <- result{msgs: msgs, err: err}
+	}()
+	if flow := readFlow(t, s); !flow.Drain {
+		t.Fatal("expected drain flow")
+	}
+	deliveryCount, linkCredit := uint32(2), uint32(0)
+	l.rx <- &performFlow{
+		Handle:        &l.handle,
+		DeliveryCount: &deliveryCount,
+		LinkCredit:    &linkCredit,
+		Drain:         true,
+	}
+
+	// buffered messages are accepted as they're returned
+	var disp *performDisposition
+	for disp == nil {
+		select {
+		case fr := <-c.txFrame:
+			disp, _ = fr.body.(*performDisposition)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for disposition")
+		}
+	}
+	if _, ok := disp.State.(*stateAccepted); disp.First != 3 || !disp.Settled || !ok {
+		t.Errorf("disposition first = %d, settled = %t, state = %T, want 3, true, *stateAccepted", disp.First, disp.Settled, disp.State)
+	}
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DrainAll() didn't return")
+	}
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if len(res.msgs) != 1 || string(res.msgs[0].GetData()) != "hello" {
+		t.Fatalf("DrainAll() returned %v, want one hello message", res.msgs)
+	}
+	if err := res.msgs[0].Reject(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case fr := <-c.txFrame:
+		if _, ok := fr.body.(*performDisposition); ok {
+			t.Errorf("unexpected second disposition %v", fr.body)
+		}
+	default:
+	}
+}
+
+func TestLinkPrefetchBytes(t *testing.T) {
+	const budget = 20000
+	r, s := startReceiverLink(t, nil, LinkCredit(100), LinkPrefetchBytes(budget))
+	defer close(s.done)
+
+	var payloads [][]byte
+	for _, size := range []int{4000, 1000, 2500} {
+		payload, err := NewMessage(make([]byte, size)).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, payload)
+	}
+
+	var (
+		format   = uint32(0)
+		limit    uint32 // delivery count up to which credit was issued
+		sent     uint32
+		buffered int // bytes sent and not yet received
+		count    int // messages sent and not yet received
+	)
+	update := func(fr frameBody) {
+		flow, ok := fr.(*performFlow)
+		if !ok {
+			t.Fatalf("sent %T, want *performFlow", fr)
+		}
+		limit = *flow.DeliveryCount + *flow.LinkCredit
+	}
+	// fill sends messages as the receiver issues credit
+	// until no more credit is issued
+	fill := func() {
+		for {
+			if sent == limit {
+				select {
+				case fr := <-s.tx:
+					update(fr)
+					continue
+				case <-time.After(100 * time.Millisecond):
+					return
+				}
+			}
+			select {
+			case fr := <-s.tx:
+				update(fr)
+			default:
+			}
+			payload := payloads[sent%uint32(len(payloads))]
+			r.link.rx <- &performTransfer{
+				DeliveryID:    uint32Ptr(sent),
+				DeliveryTag:   []byte{byte(sent)},
+				MessageFormat: &format,
+				Payload:       payload,
+			}
+			sent++
+			buffered += len(payload)
+			count++
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		fill()
+		if count < 2 {
+			t.Errorf("round %d: %d messages prefetched, want more than 1", i, count)
+		}
+		if buffered > budget*3/2 {
+			t.Errorf("round %d: %d bytes prefetched, want about %d", i, buffered, budget)
+		}
+		for ; count > 0; count-- {
+			if _, err := r.Receive(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buffered = 0
+	}
+
+	_, err := newLink(nil, &Receiver{}, []LinkOption{LinkInitialCredit(0), LinkPrefetchBytes(budget)})
+	if err == nil {
+		t.Error("expected error without automatic credit")
+	}
+}
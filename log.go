@@ -5,3 +5,9 @@ package amqp
 // dummy functions used when debugging is not enabled
 
 func debug(_ int, _ string, _ ...interface{}) {}
+
+func (c *conn) debug(_ int, _ string, _ ...interface{}) {}
+
+func (s *Session) debug(_ int, _ string, _ ...interface{}) {}
+
+func (l *link) debug(_ int, _ string, _ ...interface{}) {}
@@ -2,6 +2,7 @@
 
 package amqp
 
+import "fmt"
 import "log"
 import "os"
 import "strconv"
@@ -25,3 +26,58 @@ func debug(level int, format string, v ...interface{}) {
 		logger.Printf(format, v...)
 	}
 }
+
+// The debug methods prefix messages with key=value fields identifying
+// the connection, session and link, so output can be filtered by them.
+
+func (c *conn) debug(level int, format string, v ...interface{}) {
+	if level <= debugLevel {
+		c.debugLogger().Print(c.debugFields() + " " + fmt.Sprintf(format, v...))
+	}
+}
+
+func (s *Session) debug(level int, format string, v ...interface{}) {
+	if level <= debugLevel {
+		s.debugLogger().Print(s.debugFields() + " " + fmt.Sprintf(format, v...))
+	}
+}
+
+func (l *link) debug(level int, format string, v ...interface{}) {
+	if level <= debugLevel {
+		l.session.debugLogger().Print(l.debugFields() + " " + fmt.Sprintf(format, v...))
+	}
+}
+
+// debugLogger returns the logger set with ConnLogger,
+// or the package logger if there is none.
+func (c *conn) debugLogger() *log.Logger {
+	if c == nil || c.logger == nil {
+		return logger
+	}
+	return c.logger
+}
+
+func (s *Session) debugLogger() *log.Logger {
+	if s == nil {
+		return logger
+	}
+	return s.conn.debugLogger()
+}
+
+func (c *conn) debugFields() string {
+	if c == nil {
+		return "conn="
+	}
+	return "conn=" + c.containerID
+}
+
+func (s *Session) debugFields() string {
+	if s == nil {
+		return "conn= channel="
+	}
+	return fmt.Sprintf("%s channel=%d", s.conn.debugFields(), s.channel)
+}
+
+func (l *link) debugFields() string {
+	return fmt.Sprintf("%s link=%s handle=%d", l.session.debugFields(), l.key.name, l.handle)
+}
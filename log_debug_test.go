@@ -0,0 +1,37 @@
+// +build debug
+
+package amqp
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestConnLogger(t *testing.T) {
+	var buf1, buf2 bytes.Buffer
+	c1, err := newConn(nil, ConnContainerID("conn1"), ConnLogger(log.New(&buf1, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := newConn(nil, ConnContainerID("conn2"), ConnLogger(log.New(&buf2, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1.debug(0, "from conn")
+	newSession(c1, 0).debug(0, "from session")
+	c2.debug(0, "from conn")
+
+	if got := buf1.String(); strings.Count(got, "conn=conn1 ") != 2 || strings.Contains(got, "conn2") {
+		t.Errorf("conn1 logger got %q", got)
+	}
+	if got := buf2.String(); strings.Count(got, "conn=conn2 ") != 1 || strings.Contains(got, "conn1") {
+		t.Errorf("conn2 logger got %q", got)
+	}
+
+	if _, err := newConn(nil, ConnLogger(nil)); err == nil {
+		t.Error("expected error for nil logger")
+	}
+}
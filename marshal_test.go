@@ -1,6 +1,7 @@
 package amqp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -295,13 +297,13 @@ var (
 				Timeout:      635,
 				Dynamic:      true,
 				DynamicNodeProperties: map[symbol]interface{}{
-					"lifetime-policy": deleteOnClose,
+					"lifetime-policy": LifetimeDeleteOnClose,
 				},
 				DistributionMode: "some-mode",
 				Filter: filter{
-					"foo:filter": &describedType{
-						descriptor: "foo:filter",
-						value:      "bar value",
+					"foo:filter": &DescribedType{
+						Descriptor: "foo:filter",
+						Value:      "bar value",
 					},
 				},
 				Outcomes:     []symbol{"amqp:accepted:list"},
@@ -314,7 +316,7 @@ var (
 				Timeout:      635,
 				Dynamic:      true,
 				DynamicNodeProperties: map[symbol]interface{}{
-					"lifetime-policy": deleteOnClose,
+					"lifetime-policy": LifetimeDeleteOnClose,
 				},
 				Capabilities: []symbol{"barCap"},
 			},
@@ -341,13 +343,13 @@ var (
 			Timeout:      635,
 			Dynamic:      true,
 			DynamicNodeProperties: map[symbol]interface{}{
-				"lifetime-policy": deleteOnClose,
+				"lifetime-policy": LifetimeDeleteOnClose,
 			},
 			DistributionMode: "some-mode",
 			Filter: filter{
-				"foo:filter": &describedType{
-					descriptor: "foo:filter",
-					value:      "bar value",
+				"foo:filter": &DescribedType{
+					Descriptor: "foo:filter",
+					Value:      "bar value",
 				},
 			},
 			Outcomes:     []symbol{"amqp:accepted:list"},
@@ -360,7 +362,7 @@ var (
 			Timeout:      635,
 			Dynamic:      true,
 			DynamicNodeProperties: map[symbol]interface{}{
-				"lifetime-policy": deleteOnClose,
+				"lifetime-policy": LifetimeDeleteOnClose,
 			},
 			Capabilities: []symbol{"barCap"},
 		},
@@ -543,7 +545,7 @@ var (
 				"more": "annotations",
 			},
 		},
-		lifetimePolicy(typeCodeDeleteOnClose),
+		LifetimePolicy(typeCodeDeleteOnClose),
 		SenderSettleMode(1),
 		ReceiverSettleMode(1),
 		&saslInit{
@@ -595,9 +597,9 @@ var (
 		float64(-math.Pi),
 		float64(math.NaN()),
 		float64(-math.NaN()),
-		describedType{
-			descriptor: binary.BigEndian.Uint64([]byte{0x00, 0x00, 0x46, 0x8C, 0x00, 0x00, 0x00, 0x04}),
-			value:      "amqp.annotation.x-opt-offset > '312'",
+		DescribedType{
+			Descriptor: binary.BigEndian.Uint64([]byte{0x00, 0x00, 0x46, 0x8C, 0x00, 0x00, 0x00, 0x04}),
+			Value:      "amqp.annotation.x-opt-offset > '312'",
 		},
 		map[interface{}]interface{}{
 			int32(-1234): []uint8{0, 1, 2, 34, 5, 6, 7, 8, 9, 0},
@@ -644,3 +646,1297 @@ func rcvSettle(m ReceiverSettleMode) *ReceiverSettleMode {
 func uint32Ptr(u uint32) *uint32 {
 	return &u
 }
+
+func TestMessagePropertiesIDTypes(t *testing.T) {
+	tests := []struct {
+		label         string
+		messageID     interface{}
+		correlationID interface{}
+	}{
+		{
+			label:         "ulong message-id, uuid correlation-id",
+			messageID:     uint64(9876543210),
+			correlationID: UUID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+		},
+		{
+			label:         "string message-id, binary correlation-id",
+			messageID:     "message-1",
+			correlationID: []byte("correlation-1"),
+		},
+		{
+			label:         "uuid message-id, ulong correlation-id",
+			messageID:     UUID{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+			correlationID: uint64(42),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			want := &Message{
+				Properties: &MessageProperties{
+					MessageID:          tt.messageID,
+					To:                 "queue",
+					Subject:            "subject",
+					ReplyTo:            "reply-queue",
+					CorrelationID:      tt.correlationID,
+					ContentType:        "application/json",
+					AbsoluteExpiryTime: time.Date(2021, 07, 01, 10, 30, 00, 0, time.UTC),
+				},
+			}
+
+			data, err := want.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got Message
+			err = got.UnmarshalBinary(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reflect.TypeOf(got.Properties.MessageID) != reflect.TypeOf(tt.messageID) {
+				t.Errorf("MessageID decoded as %T, want %T", got.Properties.MessageID, tt.messageID)
+			}
+			if reflect.TypeOf(got.Properties.CorrelationID) != reflect.TypeOf(tt.correlationID) {
+				t.Errorf("CorrelationID decoded as %T, want %T", got.Properties.CorrelationID, tt.correlationID)
+			}
+			if !testEqual(want.Properties, got.Properties) {
+				t.Errorf("Roundtrip produced different results:\n %s", testDiff(want.Properties, got.Properties))
+			}
+		})
+	}
+}
+
+func TestMessagePropertiesIDTypeCodes(t *testing.T) {
+	id, err := ParseUUID("00010203-0405-0607-0809-0a0b0c0d0e0f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (UUID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}); id != want {
+		t.Fatalf("ParseUUID() = %s, want %s", id, want)
+	}
+
+	tests := []struct {
+		id   interface{}
+		code amqpType
+	}{
+		{id, typeCodeUUID},
+		{uint64(0), typeCodeUlong0},
+		{uint64(42), typeCodeSmallUlong},
+		{uint64(9876543210), typeCodeUlong},
+		{[]byte("id"), typeCodeVbin8},
+		{"id", typeCodeStr8},
+	}
+
+	for _, tt := range tests {
+		props := &MessageProperties{MessageID: tt.id}
+		var buf buffer
+		if err := props.marshal(&buf); err != nil {
+			t.Fatal(err)
+		}
+		// the descriptor 0x00 0x53 0x73, list32 type code, size and
+		// count precede the message-id
+		if code := amqpType(buf.b[12]); code != tt.code {
+			t.Errorf("MessageID %#v encoded with type code %#02x, want %#02x", tt.id, code, tt.code)
+		}
+	}
+
+	for _, s := range []string{"", "00010203-0405-0607-0809-0a0b0c0d0e0", "00010203x0405-0607-0809-0a0b0c0d0e0f", "0001020g-0405-0607-0809-0a0b0c0d0e0f"} {
+		if _, err := ParseUUID(s); err == nil {
+			t.Errorf("ParseUUID(%q) expected error", s)
+		}
+	}
+}
+
+func TestMessagePropertiesInvalidIDType(t *testing.T) {
+	msg := &Message{
+		Properties: &MessageProperties{
+			MessageID: int32(1),
+		},
+	}
+	if _, err := msg.MarshalBinary(); err == nil {
+		t.Error("expected error for int32 MessageID")
+	}
+
+	msg.Properties = &MessageProperties{
+		CorrelationID: 3.14,
+	}
+	if _, err := msg.MarshalBinary(); err == nil {
+		t.Error("expected error for float64 CorrelationID")
+	}
+}
+
+func TestMessageHeaderDurablePriority(t *testing.T) {
+	msg := &Message{
+		Header: &MessageHeader{
+			Durable:  true,
+			Priority: 5,
+		},
+	}
+
+	got, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		0x0, byte(typeCodeSmallUlong), byte(typeCodeMessageHeader),
+		byte(typeCodeList32),
+		0x0, 0x0, 0x0, 0x7, // size
+		0x0, 0x0, 0x0, 0x2, // count
+		byte(typeCodeBoolTrue),   // durable
+		byte(typeCodeUbyte), 0x5, // priority
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("encoded header = % x, want % x", got, want)
+	}
+
+	var msg2 Message
+	err = msg2.UnmarshalBinary(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHeader := &MessageHeader{Durable: true, Priority: 5}
+	if !testEqual(msg2.Header, wantHeader) {
+		t.Error(testDiff(msg2.Header, wantHeader))
+	}
+}
+
+func TestMessageFooter(t *testing.T) {
+	encoded := []byte{
+		// application-properties: {"foo": "bar"}
+		0x0, byte(typeCodeSmallUlong), byte(typeCodeApplicationProperties),
+		byte(typeCodeMap8), 0xb, 0x2,
+		byte(typeCodeStr8), 0x3, 'f', 'o', 'o',
+		byte(typeCodeStr8), 0x3, 'b', 'a', 'r',
+		// data: "hello"
+		0x0, byte(typeCodeSmallUlong), byte(typeCodeApplicationData),
+		byte(typeCodeVbin8), 0x5, 'h', 'e', 'l', 'l', 'o',
+		// footer: {:hash: 0xdeadbeef}
+		0x0, byte(typeCodeSmallUlong), byte(typeCodeFooter),
+		byte(typeCodeMap8), 0xd, 0x2,
+		byte(typeCodeSym8), 0x4, 'h', 'a', 's', 'h',
+		byte(typeCodeVbin8), 0x4, 0xde, 0xad, 0xbe, 0xef,
+	}
+
+	var msg Message
+	err := msg.UnmarshalBinary(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFooter := Annotations{"hash": []byte{0xde, 0xad, 0xbe, 0xef}}
+	if !testEqual(msg.Footer, wantFooter) {
+		t.Fatal(testDiff(msg.Footer, wantFooter))
+	}
+	if string(msg.GetData()) != "hello" {
+		t.Errorf("data = %q, want %q", msg.GetData(), "hello")
+	}
+
+	// the footer is the last section, after the body
+	reencoded, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	propsIdx := bytes.Index(reencoded, []byte{0x0, byte(typeCodeSmallUlong), byte(typeCodeApplicationProperties)})
+	dataIdx := bytes.Index(reencoded, []byte{0x0, byte(typeCodeSmallUlong), byte(typeCodeApplicationData)})
+	footerIdx := bytes.Index(reencoded, []byte{0x0, byte(typeCodeSmallUlong), byte(typeCodeFooter)})
+	if propsIdx < 0 || dataIdx < propsIdx || footerIdx < dataIdx {
+		t.Errorf("unexpected section order: application-properties at %d, data at %d, footer at %d", propsIdx, dataIdx, footerIdx)
+	}
+
+	var msg2 Message
+	err = msg2.UnmarshalBinary(reencoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(msg2.Footer, wantFooter) {
+		t.Error(testDiff(msg2.Footer, wantFooter))
+	}
+}
+
+func TestMessageDeliveryAnnotations(t *testing.T) {
+	msg := &Message{
+		DeliveryAnnotations: Annotations{
+			"x-opt-hop": int64(1),
+		},
+		Annotations: Annotations{
+			"x-opt-hop":       "message",
+			"x-opt-partition": int64(7),
+		},
+		Data: [][]byte{[]byte("hello")},
+	}
+
+	encoded, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// delivery-annotations precede message-annotations
+	daIdx := bytes.Index(encoded, []byte{0x0, byte(typeCodeSmallUlong), byte(typeCodeDeliveryAnnotations)})
+	maIdx := bytes.Index(encoded, []byte{0x0, byte(typeCodeSmallUlong), byte(typeCodeMessageAnnotations)})
+	if daIdx < 0 || maIdx < daIdx {
+		t.Errorf("unexpected section order: delivery-annotations at %d, message-annotations at %d", daIdx, maIdx)
+	}
+
+	var got Message
+	err = got.UnmarshalBinary(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(got.DeliveryAnnotations, msg.DeliveryAnnotations) {
+		t.Error(testDiff(got.DeliveryAnnotations, msg.DeliveryAnnotations))
+	}
+	if !testEqual(got.Annotations, msg.Annotations) {
+		t.Error(testDiff(got.Annotations, msg.Annotations))
+	}
+}
+
+func TestMessagePropertiesAllFields(t *testing.T) {
+	creation := time.Date(2021, 6, 1, 12, 30, 15, 123000000, time.UTC)
+	props := &MessageProperties{
+		MessageID:          "message-1",
+		UserID:             []byte("user"),
+		To:                 "queue",
+		Subject:            "subject",
+		ReplyTo:            "reply-queue",
+		CorrelationID:      uint64(42),
+		ContentType:        "application/json",
+		ContentEncoding:    "gzip",
+		AbsoluteExpiryTime: creation.Add(time.Hour),
+		CreationTime:       creation,
+		GroupID:            "group",
+		GroupSequence:      7,
+		ReplyToGroupID:     "reply-group",
+	}
+
+	var buf buffer
+	err := marshal(&buf, props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := append([]byte(nil), buf.bytes()...)
+
+	// user-id is binary and creation-time is a timestamp
+	wantUserID := []byte{byte(typeCodeVbin8), 0x4, 'u', 's', 'e', 'r'}
+	if !bytes.Contains(encoded, wantUserID) {
+		t.Errorf("user-id not encoded as binary: % x", encoded)
+	}
+	ms := creation.UnixNano() / int64(time.Millisecond)
+	wantCreation := []byte{byte(typeCodeTimestamp), 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(wantCreation[1:], uint64(ms))
+	if !bytes.Contains(encoded, wantCreation) {
+		t.Errorf("creation-time not encoded as timestamp: % x", encoded)
+	}
+
+	var got MessageProperties
+	err = unmarshal(&buf, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(&got, props) {
+		t.Error(testDiff(&got, props))
+	}
+}
+
+func TestMarshalSortedMapKeys(t *testing.T) {
+	msg := &Message{
+		Annotations: Annotations{
+			"x-opt-b": int64(2),
+			"x-opt-a": int64(1),
+			int64(3):  "three",
+		},
+		ApplicationProperties: map[string]interface{}{
+			"zulu":  "z",
+			"alpha": "a",
+			"mike":  map[string]interface{}{"y": int32(1), "x": int32(2), "w": int32(3)},
+			"kilo":  int64(11),
+		},
+		Data: [][]byte{[]byte("hello")},
+	}
+
+	encode := func() []byte {
+		buf := &buffer{sortMapKeys: true}
+		err := msg.marshal(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.bytes()
+	}
+
+	want := encode()
+	for i := 0; i < 20; i++ {
+		if got := encode(); !bytes.Equal(got, want) {
+			t.Fatalf("encoding differs:\n% x\n% x", got, want)
+		}
+	}
+
+	var got Message
+	err := got.UnmarshalBinary(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(got.Annotations, msg.Annotations) {
+		t.Error(testDiff(got.Annotations, msg.Annotations))
+	}
+	if !testEqual(got.ApplicationProperties, msg.ApplicationProperties) {
+		t.Error(testDiff(got.ApplicationProperties, msg.ApplicationProperties))
+	}
+
+	// entries are ordered by their encoding
+	buf := &buffer{sortMapKeys: true}
+	err = marshal(buf, map[string]interface{}{"b": true, "a": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMap := []byte{
+		byte(typeCodeMap32),
+		0x0, 0x0, 0x0, 0xc, // size
+		0x0, 0x0, 0x0, 0x4, // count
+		byte(typeCodeStr8), 0x1, 'a', byte(typeCodeBoolFalse),
+		byte(typeCodeStr8), 0x1, 'b', byte(typeCodeBoolTrue),
+	}
+	if !bytes.Equal(buf.bytes(), wantMap) {
+		t.Errorf("encoded map = % x, want % x", buf.bytes(), wantMap)
+	}
+}
+
+func TestApplicationPropertiesArrays(t *testing.T) {
+	tests := []struct {
+		label string
+		value interface{}
+	}{
+		{label: "[]string", value: []string{"alpha", "beta", ""}},
+		{label: "[]int32", value: []int32{math.MinInt32, -1, 0, 1, math.MaxInt32}},
+		{label: "[]int64", value: []int64{math.MinInt64, 0, math.MaxInt64}},
+		{label: "[]bool", value: []bool{true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			msg := &Message{
+				ApplicationProperties: map[string]interface{}{
+					"prop": tt.value,
+				},
+			}
+
+			b, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got Message
+			err = got.UnmarshalBinary(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reflect.TypeOf(got.ApplicationProperties["prop"]) != reflect.TypeOf(tt.value) {
+				t.Errorf("decoded type %T, want %T", got.ApplicationProperties["prop"], tt.value)
+			}
+			if !testEqual(got.ApplicationProperties, msg.ApplicationProperties) {
+				t.Error(testDiff(got.ApplicationProperties, msg.ApplicationProperties))
+			}
+		})
+	}
+}
+
+func TestApplicationPropertiesNull(t *testing.T) {
+	msg := &Message{
+		ApplicationProperties: map[string]interface{}{
+			"null":    nil,
+			"nilPtr":  (*string)(nil),
+			"present": "value",
+		},
+		Annotations: Annotations{
+			"x-opt-null": nil,
+		},
+	}
+
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Message
+	err = got.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"null":    Null{},
+		"nilPtr":  Null{},
+		"present": "value",
+	}
+	if !testEqual(got.ApplicationProperties, want) {
+		t.Error(testDiff(got.ApplicationProperties, want))
+	}
+	for _, key := range []string{"null", "nilPtr"} {
+		if v, ok := got.ApplicationProperties[key]; !ok || v != (Null{}) {
+			t.Errorf("ApplicationProperties[%q] = %v, %t; want Null{}, true", key, v, ok)
+		}
+	}
+	if v, ok := got.Annotations["x-opt-null"]; !ok || v != (Null{}) {
+		t.Errorf("Annotations[x-opt-null] = %v, %t; want Null{}, true", v, ok)
+	}
+
+	// null entries are encoded rather than omitted
+	var buf buffer
+	err = marshal(&buf, map[string]interface{}{"null": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc := buf.bytes(); enc[len(enc)-1] != byte(typeCodeNull) {
+		t.Errorf("encoded map % x, want trailing null", enc)
+	}
+}
+
+func TestMessageAnnotationsDescribedType(t *testing.T) {
+	msg := &Message{
+		Annotations: Annotations{
+			"x-opt-sequence": DescribedType{
+				Descriptor: uint64(0x0000468C00000010),
+				Value:      int64(42),
+			},
+			"x-opt-named": DescribedType{
+				Descriptor: "com.example:sequence",
+				Value:      "forty-two",
+			},
+		},
+		Data: [][]byte{[]byte("hello")},
+	}
+
+	encode := func(m *Message) []byte {
+		buf := &buffer{sortMapKeys: true}
+		if err := m.marshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.bytes()
+	}
+	b := encode(msg)
+
+	var got Message
+	err := got.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(got.Annotations, msg.Annotations) {
+		t.Error(testDiff(got.Annotations, msg.Annotations))
+	}
+	dt, ok := got.Annotations["x-opt-sequence"].(DescribedType)
+	if !ok {
+		t.Fatalf("annotation is %T, want DescribedType", got.Annotations["x-opt-sequence"])
+	}
+	if dt.Descriptor != uint64(0x0000468C00000010) || dt.Value != int64(42) {
+		t.Errorf("annotation = %v, want descriptor 0x0000468C00000010 and value 42", dt)
+	}
+
+	// the decoded message is emitted unchanged
+	if !bytes.Equal(encode(&got), b) {
+		t.Error("re-encoded message differs from the original")
+	}
+}
+
+func TestErrorRedirect(t *testing.T) {
+	var buf buffer
+	err := writeFrame(&buf, frame{
+		type_: frameTypeAMQP,
+		body: &performDetach{
+			Handle: 1,
+			Closed: true,
+			Error: &Error{
+				Condition:   ErrorLinkRedirect,
+				Description: "partition moved",
+				Info: map[string]interface{}{
+					"hostname":     "ns.servicebus.windows.net",
+					"network-host": "10.0.0.7",
+					"port":         uint16(5671),
+					"address":      "hub/Partitions/1",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseFrameHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := parseFrameBody(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detach, ok := body.(*performDetach)
+	if !ok {
+		t.Fatalf("parsed %T, want *performDetach", body)
+	}
+
+	got, ok := detach.Error.Redirect()
+	if !ok {
+		t.Fatal("expected redirect")
+	}
+	want := &Redirect{
+		Hostname:    "ns.servicebus.windows.net",
+		NetworkHost: "10.0.0.7",
+		Port:        5671,
+		Address:     "hub/Partitions/1",
+	}
+	if !testEqual(got, want) {
+		t.Error(testDiff(got, want))
+	}
+
+	// other conditions don't carry a redirect
+	if _, ok := (&Error{Condition: ErrorStolen}).Redirect(); ok {
+		t.Error("unexpected redirect for ErrorStolen")
+	}
+	if _, ok := (*Error)(nil).Redirect(); ok {
+		t.Error("unexpected redirect for nil Error")
+	}
+}
+
+func TestMessageClone(t *testing.T) {
+	msg := &Message{
+		DeliveryTag: []byte("tag"),
+		Header:      &MessageHeader{Durable: true, Priority: 4, TTL: time.Minute},
+		Annotations: Annotations{
+			"x-opt-partition-key": "key",
+			"x-opt-list":          []interface{}{int64(1), "two"},
+		},
+		Properties: &MessageProperties{
+			MessageID: "id-1",
+			UserID:    []byte("user"),
+			To:        "queue",
+		},
+		ApplicationProperties: map[string]interface{}{
+			"region": "west",
+			"nested": map[string]interface{}{"level": int64(1)},
+		},
+		Data:       [][]byte{[]byte("hello")},
+		Footer:     Annotations{"x-opt-digest": []byte("digest")},
+		receiver:   &Receiver{},
+		deliveryID: 7,
+		settled:    true,
+		doneSignal: make(chan struct{}),
+	}
+	encode := func(m *Message) []byte {
+		buf := &buffer{sortMapKeys: true}
+		if err := m.marshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.bytes()
+	}
+	original := encode(msg)
+
+	clone := msg.Clone()
+	if !bytes.Equal(encode(clone), original) {
+		t.Fatal("clone doesn't encode the same as the original")
+	}
+	if clone.doneSignal == nil || clone.doneSignal == msg.doneSignal {
+		t.Error("clone shares the original's doneSignal")
+	}
+	if clone.receiver != nil || clone.deliveryID != 0 || clone.settled {
+		t.Errorf("clone kept settlement state: receiver %p, deliveryID %d, settled %t", clone.receiver, clone.deliveryID, clone.settled)
+	}
+
+	clone.DeliveryTag[0] = 'X'
+	clone.Header.Priority = 9
+	clone.Annotations["x-opt-partition-key"] = "other"
+	clone.Annotations["x-opt-list"].([]interface{})[1] = "three"
+	clone.Properties.UserID[0] = 'X'
+	clone.Properties.To = "other-queue"
+	clone.ApplicationProperties["region"] = "east"
+	clone.ApplicationProperties["nested"].(map[string]interface{})["level"] = int64(2)
+	clone.Data[0][0] = 'J'
+	clone.Footer["x-opt-digest"].([]byte)[0] = 'X'
+
+	if !bytes.Equal(encode(msg), original) {
+		t.Error("modifying the clone changed the original")
+	}
+	if string(msg.DeliveryTag) != "tag" {
+		t.Errorf("original DeliveryTag = %q, want %q", msg.DeliveryTag, "tag")
+	}
+
+	// an AMQP value body is copied too
+	msg = &Message{Value: map[string]interface{}{"items": []interface{}{"a", "b"}}}
+	clone = msg.Clone()
+	clone.Value.(map[string]interface{})["items"].([]interface{})[0] = "z"
+	if got := msg.Value.(map[string]interface{})["items"].([]interface{})[0]; got != "a" {
+		t.Errorf("original Value item = %v, want a", got)
+	}
+}
+
+func TestReadAnyMaxDepth(t *testing.T) {
+	// nestedLists returns depth list32s, each containing the next
+	nestedLists := func(depth int) []byte {
+		data := []byte{byte(typeCodeList0)}
+		for i := 0; i < depth; i++ {
+			outer := make([]byte, 9, 9+len(data))
+			outer[0] = byte(typeCodeList32)
+			binary.BigEndian.PutUint32(outer[1:], uint32(len(data)+4))
+			binary.BigEndian.PutUint32(outer[5:], 1)
+			data = append(outer, data...)
+		}
+		return data
+	}
+
+	tests := []struct {
+		label    string
+		depth    int
+		maxDepth int
+		wantErr  bool
+	}{
+		{label: "shallow", depth: 10},
+		{label: "default limit", depth: defaultMaxDecodeDepth - 1},
+		{label: "beyond default limit", depth: 2 * defaultMaxDecodeDepth, wantErr: true},
+		{label: "configured limit", depth: 5, maxDepth: 8},
+		{label: "beyond configured limit", depth: 8, maxDepth: 8, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			buf := &buffer{b: nestedLists(tt.depth), maxDepth: tt.maxDepth}
+			_, err := readAny(buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readAny() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if buf.depth != 0 {
+				t.Errorf("depth = %d after decoding, want 0", buf.depth)
+			}
+		})
+	}
+
+	// nesting through maps in a message is limited too
+	nested := map[string]interface{}{}
+	props := nested
+	for i := 0; i <= defaultMaxDecodeDepth; i++ {
+		inner := map[string]interface{}{}
+		nested["k"] = inner
+		nested = inner
+	}
+	encoded, err := (&Message{ApplicationProperties: props}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg Message
+	if err := msg.UnmarshalBinary(encoded); err == nil {
+		t.Error("expected error decoding deeply nested application properties")
+	}
+}
+
+func TestMessageSubject(t *testing.T) {
+	if got := (&Message{}).Subject(); got != "" {
+		t.Errorf("Subject() = %q without properties, want empty", got)
+	}
+
+	for _, subject := range []string{"orders.created", "注文.作成済み", "ünïcödé-🚀"} {
+		msg := &Message{
+			Properties: &MessageProperties{Subject: subject},
+			Data:       [][]byte{[]byte("hello")},
+		}
+		b, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// subject is the fourth field of the properties list and must
+		// be encoded as a str, not a symbol or binary
+		want := append([]byte{byte(typeCodeStr8), byte(len(subject))}, subject...)
+		if !bytes.Contains(b, want) {
+			t.Errorf("%q: encoded message % x doesn't contain str8 % x", subject, b, want)
+		}
+
+		var got Message
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if got.Subject() != subject {
+			t.Errorf("Subject() = %q, want %q", got.Subject(), subject)
+		}
+	}
+}
+
+func TestMessageGroupSequence(t *testing.T) {
+	if got := (&Message{}).GroupSequence(); got != 0 {
+		t.Errorf("GroupSequence() = %d without properties, want 0", got)
+	}
+	if got := (&Message{}).GroupID(); got != "" {
+		t.Errorf("GroupID() = %q without properties, want empty", got)
+	}
+
+	// the sequence after math.MaxUint32 wraps to 0
+	last := uint32(math.MaxUint32)
+	next := last + 1
+
+	for _, seq := range []uint32{0, 1, math.MaxUint32 - 1, last, next} {
+		msg := &Message{
+			Properties: &MessageProperties{GroupID: "orders", GroupSequence: seq},
+			Data:       [][]byte{[]byte("hello")},
+		}
+		b, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got Message
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if got.GroupID() != "orders" {
+			t.Errorf("GroupID() = %q, want %q", got.GroupID(), "orders")
+		}
+		if got.GroupSequence() != seq {
+			t.Errorf("GroupSequence() = %d, want %d", got.GroupSequence(), seq)
+		}
+	}
+
+	// the largest sequence number is encoded as a full-width uint
+	msg := &Message{Properties: &MessageProperties{GroupSequence: last}}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{byte(typeCodeUint), 0xff, 0xff, 0xff, 0xff}; !bytes.Contains(b, want) {
+		t.Errorf("encoded message % x doesn't contain uint % x", b, want)
+	}
+}
+
+func TestUnmarshalZeroWidthArrays(t *testing.T) {
+	tests := []struct {
+		label string
+		input []byte
+		got   interface{}
+		want  interface{}
+	}{
+		{
+			label: "uint0",
+			input: []byte{byte(typeCodeArray8), 2, 3, byte(typeCodeUint0)},
+			got:   new([]uint32),
+			want:  &[]uint32{0, 0, 0},
+		},
+		{
+			label: "ulong0",
+			input: []byte{byte(typeCodeArray8), 2, 2, byte(typeCodeUlong0)},
+			got:   new([]uint64),
+			want:  &[]uint64{0, 0},
+		},
+		{
+			label: "true",
+			input: []byte{byte(typeCodeArray8), 2, 3, byte(typeCodeBoolTrue)},
+			got:   new([]bool),
+			want:  &[]bool{true, true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			err := unmarshal(&buffer{b: tt.input}, tt.got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testEqual(tt.got, tt.want) {
+				t.Error(testDiff(tt.got, tt.want))
+			}
+		})
+	}
+
+	// the length of zero-width elements is still bounded
+	input := []byte{byte(typeCodeArray32), 0, 0, 0, 5, 0xff, 0xff, 0xff, 0xff, byte(typeCodeUint0)}
+	var got []uint32
+	if err := unmarshal(&buffer{b: input}, &got); err == nil {
+		t.Errorf("expected error decoding %d element array", uint32(0xffffffff))
+	}
+}
+
+func TestMessageNullValues(t *testing.T) {
+	msg := &Message{
+		ApplicationProperties: map[string]interface{}{"null": nil},
+		Footer:                Annotations{int64(1): Null{}},
+	}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Message
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	// a null value is distinct from an absent key
+	if v := got.ApplicationProperties["null"]; v != (Null{}) {
+		t.Errorf("ApplicationProperties[%q] = %#v, want Null{}", "null", v)
+	}
+	if v := got.ApplicationProperties["absent"]; v != nil {
+		t.Errorf("ApplicationProperties[%q] = %#v, want nil", "absent", v)
+	}
+	if v := got.Footer[int64(1)]; v != (Null{}) {
+		t.Errorf("Footer[1] = %#v, want Null{}", v)
+	}
+
+	// Null is encoded as null, so a received message is sent unchanged
+	b2, err := got.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b2, b) {
+		t.Errorf("re-encoded message % x, want % x", b2, b)
+	}
+}
+
+func TestMessageUnknownSections(t *testing.T) {
+	msg := &Message{
+		Properties: &MessageProperties{Subject: "proprietary"},
+		Data:       [][]byte{[]byte("hello")},
+		UnknownSections: []DescribedType{
+			{
+				Descriptor: uint64(0x0000468C00000070), // not a header, despite the low byte
+				Value:      []interface{}{"field", int64(7), true},
+			},
+			{
+				Descriptor: "com.example:trace:list",
+				Value:      []interface{}{"span-1"},
+			},
+		},
+		Footer: Annotations{"hash": "abc"},
+	}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Message
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(got.UnknownSections, msg.UnknownSections) {
+		t.Error(testDiff(got.UnknownSections, msg.UnknownSections))
+	}
+	if got.Header != nil {
+		t.Errorf("unknown section decoded as header %+v", got.Header)
+	}
+	if got.Subject() != "proprietary" || string(got.GetData()) != "hello" || got.Footer["hash"] != "abc" {
+		t.Errorf("known sections not decoded: %+v", got)
+	}
+
+	// the decoded message is forwarded with the same encoding
+	forwarded, err := got.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forwarded, b) {
+		t.Errorf("forwarded message % x, want % x", forwarded, b)
+	}
+}
+
+func TestUnmarshalUnknownDeliveryState(t *testing.T) {
+	// declared, from the transactions specification
+	declared := &DescribedType{Descriptor: uint64(0x33), Value: []interface{}{[]byte("txn-1")}}
+	// a proprietary state whose low byte matches accepted
+	proprietary := &DescribedType{Descriptor: uint64(0x0000468C00000024), Value: []interface{}{"ok"}}
+
+	for _, state := range []*DescribedType{declared, proprietary} {
+		var buf buffer
+		err := marshal(&buf, &performDisposition{Role: roleSender, First: 1, Settled: true, State: state})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got performDisposition
+		if err := unmarshal(&buf, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !testEqual(got.State, state) {
+			t.Error(testDiff(got.State, state))
+		}
+	}
+}
+
+func BenchmarkMessageLargeData(b *testing.B) {
+	for _, size := range []int{1 << 20, 4 << 20, 16 << 20} {
+		data := bytes.Repeat([]byte{0xab}, size)
+		msg := &Message{
+			Properties: &MessageProperties{MessageID: "blob"},
+			Data:       [][]byte{data},
+		}
+		encoded, err := msg.MarshalBinary()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("Marshal/%dMB", size>>20), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bytesSink, err = msg.MarshalBinary()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		chunked := &Message{Data: make([][]byte, 16)}
+		for i := range chunked.Data {
+			chunked.Data[i] = data[i*size/16 : (i+1)*size/16]
+		}
+		b.Run(fmt.Sprintf("MarshalSections/%dMB", size>>20), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bytesSink, err = chunked.MarshalBinary()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Unmarshal/%dMB", size>>20), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var got Message
+				err := got.UnmarshalBinary(encoded)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("ArrayUByte/%dMB", size>>20), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			a := ArrayUByte(data)
+			for i := 0; i < b.N; i++ {
+				buf := new(buffer)
+				err := marshal(buf, a)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var got ArrayUByte
+				err = unmarshal(buf, &got)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageDataSizes(t *testing.T) {
+	tests := []struct {
+		size   int
+		header []byte // binary type and length
+	}{
+		{0, []byte{byte(typeCodeVbin8), 0}},
+		{255, []byte{byte(typeCodeVbin8), 255}},
+		{256, []byte{byte(typeCodeVbin32), 0, 0, 1, 0}},
+		{3 << 20, []byte{byte(typeCodeVbin32), 0, 0x30, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.size), func(t *testing.T) {
+			data := bytes.Repeat([]byte{0xab}, tt.size)
+			msg := &Message{Data: [][]byte{data, data}}
+			b, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			section := append([]byte{0x0, byte(typeCodeSmallUlong), byte(typeCodeApplicationData)}, tt.header...)
+			if !bytes.HasPrefix(b, section) {
+				t.Fatalf("encoded section starts with % x, want % x", b[:len(section)], section)
+			}
+			if want := 2 * (len(section) + tt.size); len(b) != want {
+				t.Errorf("encoded length = %d, want %d", len(b), want)
+			}
+
+			var got Message
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Data) != 2 {
+				t.Fatalf("decoded %d data sections, want 2", len(got.Data))
+			}
+			for _, d := range got.Data {
+				// empty data is distinct from no data
+				if d == nil || !bytes.Equal(d, data) {
+					t.Errorf("decoded data of length %d, want %d", len(d), tt.size)
+				}
+			}
+		})
+	}
+}
+
+func TestArrayUByteSizes(t *testing.T) {
+	tests := []struct {
+		size   int
+		header []byte // array type, size, count and element type
+	}{
+		{0, []byte{byte(typeCodeArray8), 2, 0, byte(typeCodeUbyte)}},
+		{253, []byte{byte(typeCodeArray8), 255, 253, byte(typeCodeUbyte)}},
+		{254, []byte{byte(typeCodeArray32), 0, 0, 1, 3, 0, 0, 0, 254, byte(typeCodeUbyte)}},
+		{3 << 20, []byte{byte(typeCodeArray32), 0, 0x30, 0, 5, 0, 0x30, 0, 0, byte(typeCodeUbyte)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.size), func(t *testing.T) {
+			a := ArrayUByte(bytes.Repeat([]byte{0xab}, tt.size))
+			var buf buffer
+			if err := marshal(&buf, a); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(buf.bytes(), tt.header) || buf.len() != len(tt.header)+tt.size {
+				t.Fatalf("encoded header % x, want % x", buf.bytes()[:len(tt.header)], tt.header)
+			}
+
+			var got ArrayUByte
+			if err := unmarshal(&buf, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || !bytes.Equal(got, a) {
+				t.Errorf("decoded %d bytes, want %d", len(got), tt.size)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCompositeExtraFields(t *testing.T) {
+	// a source with the 11 known fields followed by fields
+	// from a newer version of the specification
+	address := "queue"
+	expiry := ExpiryNever
+	var buf buffer
+	err := marshalComposite(&buf, typeCodeSource, []marshalField{
+		{value: &address},
+		{omit: true},
+		{value: &expiry},
+		{omit: true},
+		{omit: true},
+		{omit: true},
+		{omit: true},
+		{omit: true},
+		{value: &stateReleased{}},
+		{omit: true},
+		{value: []symbol{"queue"}},
+		{value: map[string]interface{}{"future": true}},
+		{value: symbol("unknown")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// followed by another value that must be decoded intact
+	if err := marshal(&buf, "next"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got source
+	if err := unmarshal(&buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := source{
+		Address:        "queue",
+		ExpiryPolicy:   ExpiryNever,
+		DefaultOutcome: &stateReleased{},
+		Capabilities:   multiSymbol{"queue"},
+	}
+	if !testEqual(got, want) {
+		t.Error(testDiff(got, want))
+	}
+
+	next, err := readString(&buf)
+	if err != nil || next != "next" {
+		t.Errorf("value after source = %q, %v, want next", next, err)
+	}
+}
+
+func TestMessageGetData(t *testing.T) {
+	msg := &Message{Data: [][]byte{[]byte("multi"), []byte("part")}}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Message
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(got.Data, msg.Data) {
+		t.Error(testDiff(got.Data, msg.Data))
+	}
+	if data := string(got.GetData()); data != "multipart" {
+		t.Errorf("GetData() = %q, want %q", data, "multipart")
+	}
+
+	if data := (&Message{}).GetData(); data != nil {
+		t.Errorf("GetData() = %q, want nil", data)
+	}
+}
+
+func TestMessageMultipleDataSections(t *testing.T) {
+	sections := [][]byte{[]byte("first"), {}, []byte("third")}
+	msg := &Message{Data: sections}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each element is encoded as its own data section, in order
+	r := &buffer{b: b}
+	for i, want := range sections {
+		descriptor, ok := r.next(3)
+		if !ok {
+			t.Fatalf("section %d is missing", i)
+		}
+		if want := []byte{0x0, byte(typeCodeSmallUlong), byte(typeCodeApplicationData)}; !bytes.Equal(descriptor, want) {
+			t.Fatalf("section %d descriptor = %#x, want %#x", i, descriptor, want)
+		}
+		got, err := readBinary(r)
+		if err != nil {
+			t.Fatalf("section %d: %v", i, err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("section %d = %q, want %q", i, got, want)
+		}
+	}
+	if r.len() != 0 {
+		t.Errorf("%d unexpected bytes after data sections", r.len())
+	}
+
+	var got Message
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(got.Data, sections) {
+		t.Error(testDiff(got.Data, sections))
+	}
+	if data := string(got.GetData()); data != "firstthird" {
+		t.Errorf("GetData() = %q, want %q", data, "firstthird")
+	}
+}
+
+func TestTimestampTruncation(t *testing.T) {
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	tests := []struct {
+		in   time.Time
+		want time.Time
+	}{
+		{
+			in:   time.Date(2021, 7, 1, 12, 30, 0, 123456789, zone),
+			want: time.Date(2021, 7, 1, 10, 30, 0, 123000000, time.UTC),
+		},
+		{
+			in:   time.Date(2021, 7, 1, 10, 30, 0, 123000000, time.UTC),
+			want: time.Date(2021, 7, 1, 10, 30, 0, 123000000, time.UTC),
+		},
+		{
+			// truncated towards the earlier millisecond before the epoch
+			in:   time.Date(1969, 12, 31, 23, 59, 59, 999500000, time.UTC),
+			want: time.Date(1969, 12, 31, 23, 59, 59, 999000000, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		if got := TruncateTimestamp(tt.in); got != tt.want {
+			t.Errorf("TruncateTimestamp(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+		if lossless := tt.in.Equal(TruncateTimestamp(tt.in)); lossless != tt.in.Equal(tt.want) {
+			t.Errorf("precision loss of %v not detected", tt.in)
+		}
+
+		// single values, arrays and values in maps decode the same way
+		var buf buffer
+		writeTimestamp(&buf, tt.in)
+		got, err := readTimestamp(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("timestamp round trip of %v = %v, want %v", tt.in, got, tt.want)
+		}
+
+		buf.reset()
+		if err := (arrayTimestamp{tt.in}).marshal(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var arr arrayTimestamp
+		if err := arr.unmarshal(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if len(arr) != 1 || arr[0] != tt.want {
+			t.Errorf("array round trip of %v = %v, want %v", tt.in, arr, tt.want)
+		}
+
+		msg := &Message{ApplicationProperties: map[string]interface{}{"time": tt.in}}
+		b, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Message
+		if err := decoded.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if got := decoded.ApplicationProperties["time"]; got != tt.want {
+			t.Errorf("property round trip of %v = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewMessageWithValue(t *testing.T) {
+	value := map[string]interface{}{
+		"id":    int64(42),
+		"name":  "order",
+		"items": []interface{}{"a", "b"},
+	}
+	msg := NewMessageWithValue(value)
+	if msg.Data != nil {
+		t.Errorf("Data = %v, want nil", msg.Data)
+	}
+
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Message
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.Data != nil {
+		t.Errorf("received Data = %v, want nil", got.Data)
+	}
+	if !testEqual(got.Value, value) {
+		t.Error(testDiff(got.Value, value))
+	}
+
+	if _, err := NewMessageWithValue(struct{}{}).MarshalBinary(); err == nil {
+		t.Error("expected error for unsupported value type")
+	}
+}
+
+func TestMessageTimestampValues(t *testing.T) {
+	local := time.Date(2021, 7, 1, 12, 30, 0, 123456789, time.FixedZone("UTC+2", 2*60*60))
+	want := time.Date(2021, 7, 1, 10, 30, 0, 123000000, time.UTC)
+
+	// a time is encoded as a timestamp
+	var buf buffer
+	if err := marshal(&buf, local); err != nil {
+		t.Fatal(err)
+	}
+	if code := amqpType(buf.b[0]); code != typeCodeTimestamp {
+		t.Errorf("time encoded with type code %#02x, want %#02x", code, typeCodeTimestamp)
+	}
+
+	msg := &Message{
+		Annotations:           Annotations{"x-opt-times": []time.Time{local, local}},
+		ApplicationProperties: map[string]interface{}{"created": local},
+	}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Message
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if created, ok := got.ApplicationProperties["created"].(time.Time); !ok || created != want {
+		t.Errorf("created = %#v, want %v", got.ApplicationProperties["created"], want)
+	}
+	if times, ok := got.Annotations["x-opt-times"].([]time.Time); !ok || len(times) != 2 || times[0] != want || times[1] != want {
+		t.Errorf("x-opt-times = %#v, want two of %v", got.Annotations["x-opt-times"], want)
+	}
+}
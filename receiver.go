@@ -2,6 +2,7 @@ package amqp
 
 import (
 	"context"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,12 +15,157 @@ type messageDisposition struct {
 
 // Receiver receives messages on a single AMQP link.
 type Receiver struct {
-	link         *link                   // underlying link
-	batching     bool                    // enable batching of message dispositions
-	batchMaxAge  time.Duration           // maximum time between the start n batch and sending the batch to the server
-	dispositions chan messageDisposition // message dispositions are sent on this channel when batching is enabled
-	maxCredit    uint32                  // maximum allowed inflight messages
-	inFlight     inFlight                // used to track message disposition when rcv-settle-mode == second
+	link           *link                   // underlying link
+	batching       bool                    // enable batching of message dispositions
+	batchMaxAge    time.Duration           // maximum time between the start n batch and sending the batch to the server
+	dispositions   chan messageDisposition // message dispositions are sent on this channel when batching is enabled
+	maxCredit      uint32                  // maximum allowed inflight messages
+	inFlight       inFlight                // used to track message disposition when rcv-settle-mode == second
+	creditMode     creditMode              // how credit is issued to the sender
+	creditWindow   uint32                  // credit issued with creditAuto, defaults to maxCredit
+	creditOnSettle bool                    // credit is reissued when a delivery settles rather than when it's received
+	prefetchBytes  uint64                  // limits the size of the messages held with creditAuto, 0 if unlimited
+	autoAccept     bool                    // messages are accepted before Receive returns them
+}
+
+// creditMode determines how a Receiver issues credit.
+type creditMode uint8
+
+const (
+	creditAuto     creditMode = iota // credit is issued up to creditWindow as messages are received
+	creditOnDemand                   // credit is issued only for callers waiting on a message
+	creditManual                     // credit is issued by calling IssueCredit
+)
+
+type creditRequest struct {
+	credit uint32
+	err    chan error
+}
+
+// IssueCredit issues additional credit to the sender.
+//
+// IssueCredit is only valid when LinkInitialCredit was set to a negative
+// value. Outstanding credit plus buffered messages may not exceed the
+// link credit set by LinkCredit.
+func (r *Receiver) IssueCredit(credit uint32) error {
+	if r.link.issueCredit == nil {
+		return errorNew("IssueCredit requires manual credit mode")
+	}
+
+	req := creditRequest{credit: credit, err: make(chan error, 1)}
+	select {
+	case r.link.issueCredit <- req:
+		return <-req.err
+	case <-r.link.done:
+		return r.link.err
+	}
+}
+
+// DrainCredit requests the sender to use or return all outstanding
+// credit, and blocks until it has done so, ctx completes, or the link
+// is closed.
+//
+// Messages sent before the credit was returned are buffered and
+// available from Receive once DrainCredit returns. No further messages
+// are sent until credit is issued with IssueCredit.
+//
+// DrainCredit is only valid when LinkInitialCredit was set to a negative
+// value. If ctx completes before the drain, the drain continues and
+// IssueCredit returns an error until it completes.
+func (r *Receiver) DrainCredit(ctx context.Context) error {
+	if r.link.drain == nil {
+		return errorNew("DrainCredit requires manual credit mode")
+	}
+
+	done := make(chan error, 1)
+	select {
+	case r.link.drain <- done:
+	case <-r.link.done:
+		return r.link.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-r.link.done:
+		return r.link.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Prefetch issues credit for n messages, drains the link and returns
+// the messages received, which may be fewer than n if the sender had
+// fewer available. Credit isn't replenished afterwards.
+//
+// Messages already buffered are returned first and count towards n.
+//
+// Prefetch is only valid when LinkInitialCredit was set to a negative
+// value.
+func (r *Receiver) Prefetch(ctx context.Context, n uint32) ([]*Message, error) {
+	err := r.IssueCredit(n)
+	if err != nil {
+		return nil, err
+	}
+	err = r.DrainCredit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the drain completes after all transfers sent with the
+	// credit, so they're buffered by now
+	return r.takeBuffered(ctx, int(n))
+}
+
+// DrainAll drains the link as DrainCredit does and returns all of the
+// buffered messages, including those sent before the credit was returned.
+// The link is left with no credit.
+//
+// DrainAll is only valid when LinkInitialCredit was set to a negative
+// value.
+func (r *Receiver) DrainAll(ctx context.Context) ([]*Message, error) {
+	err := r.DrainCredit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.takeBuffered(ctx, cap(r.link.messages))
+}
+
+// takeBuffered returns up to max buffered messages without waiting.
+func (r *Receiver) takeBuffered(ctx context.Context, max int) ([]*Message, error) {
+	msgs := make([]*Message, 0, len(r.link.messages))
+	for len(msgs) < max {
+		select {
+		case msg := <-r.link.messages:
+			msg.receiver = r
+			_, err := r.deliver(ctx, &msg)
+			r.link.deleteUnsettled(&msg)
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, &msg)
+		default:
+			return msgs, nil
+		}
+	}
+	return msgs, nil
+}
+
+// waitForMessage registers the caller as waiting for a message so that
+// credit can be issued on demand. The returned func must be called once
+// the caller is no longer waiting.
+func (r *Receiver) waitForMessage() func() {
+	if r.creditMode != creditOnDemand {
+		return func() {}
+	}
+	atomic.AddInt32(&r.link.waiting, 1)
+	select {
+	case r.link.receiverReady <- struct{}{}:
+	default:
+	}
+	return func() { atomic.AddInt32(&r.link.waiting, -1) }
 }
 
 // HandleMessage takes in a func to handle the incoming message.
@@ -28,7 +174,7 @@ type Receiver struct {
 // or the unsettled message tracker will get out of sync, and reduce the flow.
 // When using ModeFirst, the message is spontaneously Accepted at reception.
 func (r *Receiver) HandleMessage(ctx context.Context, handle func(*Message) error) error {
-	debug(3, "Entering link %s Receive()", r.link.key.name)
+	r.link.debug(3, "Entering link %s Receive()", r.link.key.name)
 
 	trackCompletion := func(msg *Message) {
 		if msg.doneSignal == nil {
@@ -36,17 +182,17 @@ func (r *Receiver) HandleMessage(ctx context.Context, handle func(*Message) erro
 		}
 		<-msg.doneSignal
 		r.link.deleteUnsettled(msg)
-		debug(3, "Receive() deleted unsettled %d", msg.deliveryID)
+		r.link.debug(3, "Receive() deleted unsettled %d", msg.deliveryID)
 		if atomic.LoadUint32(&r.link.paused) == 1 {
 			select {
 			case r.link.receiverReady <- struct{}{}:
-				debug(3, "Receive() unpause link on completion")
+				r.link.debug(3, "Receive() unpause link on completion")
 			default:
 			}
 		}
 	}
 	callHandler := func(msg *Message) error {
-		debug(3, "Receive() blocking %d", msg.deliveryID)
+		r.link.debug(3, "Receive() blocking %d", msg.deliveryID)
 		msg.receiver = r
 		// we only need to track message disposition for mode second
 		// spec : http://docs.oasis-open.org/amqp/core/v1.0/os/amqp-core-transport-v1.0-os.html#type-receiver-settle-mode
@@ -55,7 +201,7 @@ func (r *Receiver) HandleMessage(ctx context.Context, handle func(*Message) erro
 		}
 		// tracks messages until exiting handler
 		if err := handle(msg); err != nil {
-			debug(3, "Receive() blocking %d - error: %s", msg.deliveryID, err.Error())
+			r.link.debug(3, "Receive() blocking %d - error: %s", msg.deliveryID, err.Error())
 			return err
 		}
 		return nil
@@ -70,12 +216,16 @@ func (r *Receiver) HandleMessage(ctx context.Context, handle func(*Message) erro
 		// pass through, to buffer msgs when the handler is busy
 	}
 
+	done := r.waitForMessage()
 	select {
 	case msg := <-r.link.messages:
+		done()
 		return callHandler(&msg)
 	case <-r.link.done:
+		done()
 		return r.link.err
 	case <-ctx.Done():
+		done()
 		return ctx.Err()
 	}
 }
@@ -83,6 +233,7 @@ func (r *Receiver) HandleMessage(ctx context.Context, handle func(*Message) erro
 // Receive returns the next message from the sender.
 //
 // Blocks until a message is received, ctx completes, or an error occurs.
+// With LinkAutoAccept, the message is accepted before it's returned.
 // Deprecated: prefer HandleMessage
 func (r *Receiver) Receive(ctx context.Context) (*Message, error) {
 	if atomic.LoadUint32(&r.link.paused) == 1 {
@@ -99,25 +250,31 @@ func (r *Receiver) Receive(ctx context.Context) (*Message, error) {
 		// we remove the message from unsettled map as soon as it's popped off the channel
 		// This makes the unsettled count the same as messages buffer count
 		// and keeps the behavior the same as before the unsettled messages tracking was introduced
-		defer r.link.deleteUnsettled(&msg)
-		debug(3, "Receive() non blocking %d", msg.deliveryID)
+		if !r.creditOnSettle || msg.settled {
+			defer r.link.deleteUnsettled(&msg)
+		}
+		r.link.debug(3, "Receive() non blocking %d", msg.deliveryID)
 		msg.receiver = r
-		return &msg, nil
+		return r.deliver(ctx, &msg)
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	default:
 	}
 
 	// wait for the next message
+	done := r.waitForMessage()
+	defer done()
 	select {
 	case msg := <-r.link.messages:
 		// we remove the message from unsettled map as soon as it's popped off the channel
 		// This makes the unsettled count the same as messages buffer count
 		// and keeps the behavior the same as before the unsettled messages tracking was introduced
-		defer r.link.deleteUnsettled(&msg)
-		debug(3, "Receive() blocking %d", msg.deliveryID)
+		if !r.creditOnSettle || msg.settled {
+			defer r.link.deleteUnsettled(&msg)
+		}
+		r.link.debug(3, "Receive() blocking %d", msg.deliveryID)
 		msg.receiver = r
-		return &msg, nil
+		return r.deliver(ctx, &msg)
 	case <-r.link.done:
 		return nil, r.link.err
 	case <-ctx.Done():
@@ -125,6 +282,71 @@ func (r *Receiver) Receive(ctx context.Context) (*Message, error) {
 	}
 }
 
+// deliver returns a received msg, accepting it first with LinkAutoAccept.
+func (r *Receiver) deliver(ctx context.Context, msg *Message) (*Message, error) {
+	if !r.autoAccept || msg.settled {
+		return msg, nil
+	}
+	if err := r.messageDisposition(ctx, msg, &stateAccepted{}); err != nil {
+		return nil, err
+	}
+	// the caller's own dispositions are no-ops
+	msg.settled = true
+	return msg, nil
+}
+
+// ReceiveBatch returns up to maxCount messages from the sender.
+//
+// Blocks until the first message is received, ctx completes, or an error occurs.
+// Once the first message has been received, ReceiveBatch continues to collect
+// messages until maxCount have been received or maxWait elapses, then returns
+// the messages received so far. If ctx completes or the link is closed after
+// the first message, the partial batch is returned without error; the error
+// will be returned by the next call.
+//
+// Unless credit is issued manually, ReceiveBatch first raises the credit
+// to maxCount, less the messages already buffered, so the sender can
+// send the batch without waiting for more credit. The credit is bounded
+// by LinkCredit, which should be at least maxCount for full batches.
+func (r *Receiver) ReceiveBatch(ctx context.Context, maxCount int, maxWait time.Duration) ([]*Message, error) {
+	if maxCount < 1 {
+		return nil, errorNew("maxCount must be at least 1")
+	}
+
+	if r.link.batchCredit != nil {
+		n := uint32(math.MaxUint32)
+		if uint64(maxCount) < uint64(n) {
+			n = uint32(maxCount)
+		}
+		select {
+		case r.link.batchCredit <- n:
+		case <-r.link.done:
+		case <-ctx.Done():
+		}
+	}
+
+	msg, err := r.Receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*Message, 1, maxCount)
+	msgs[0] = msg
+
+	waitCtx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	for len(msgs) < maxCount {
+		msg, err := r.Receive(waitCtx)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
 // Address returns the link's address.
 func (r *Receiver) Address() string {
 	if r.link.source == nil {
@@ -142,7 +364,58 @@ func (r *Receiver) LinkSourceFilterValue(name string) interface{} {
 	if !ok {
 		return nil
 	}
-	return filter.value
+	return filter.Value
+}
+
+// SessionID returns the id of the message session the link is receiving
+// from when attached with LinkSessionFilter, as accepted by the server.
+// An empty string is returned if the server didn't set a session filter.
+func (r *Receiver) SessionID() string {
+	id, _ := r.LinkSourceFilterValue(sessionFilterName).(string)
+	return id
+}
+
+// Source returns the source terminus as set by the peer when the link
+// was attached, or nil if the peer didn't set one.
+//
+// Per the AMQP specification the receiver must verify that the filter
+// in place meets its needs, as the peer may alter the requested filter.
+func (r *Receiver) Source() *Source {
+	return exportSource(r.link.remoteSource)
+}
+
+// Target returns the target terminus as set by the peer when the link
+// was attached, or nil if the peer didn't set one.
+func (r *Receiver) Target() *Target {
+	return exportTarget(r.link.remoteTarget)
+}
+
+// Credit returns the Receiver's outstanding link credit, the number of
+// messages the peer may currently send before more credit is issued.
+//
+// The value is a snapshot and changes as messages arrive and credit
+// is issued.
+func (r *Receiver) Credit() uint32 {
+	return atomic.LoadUint32(&r.link.credit)
+}
+
+// Closed returns a channel that is closed once the Receiver's link has
+// detached, whether by Close or by the peer, session or connection
+// ending it. The channel is closed exactly once.
+func (r *Receiver) Closed() <-chan struct{} {
+	return r.link.done
+}
+
+// Err returns the error that ended the Receiver's link, or nil if
+// the Closed channel hasn't been closed yet. ErrLinkClosed is
+// returned after Close.
+func (r *Receiver) Err() error {
+	select {
+	case <-r.link.done:
+		return r.link.err
+	default:
+		return nil
+	}
 }
 
 // Close closes the Receiver and AMQP link.
@@ -154,6 +427,19 @@ func (r *Receiver) Close(ctx context.Context) error {
 	return r.link.Close(ctx)
 }
 
+// Detach detaches the Receiver's link without closing it.
+//
+// Unlike Close, the peer keeps the state of a durable source, such as
+// a subscription and its unsettled deliveries, so the link can be
+// resumed by creating a new Receiver with the same LinkName and source
+// options. Use LinkResumeUnsettled to resume unsettled deliveries.
+//
+// The Receiver can't be used after Detach. If ctx expires while
+// waiting for the server's response, ctx.Err() is returned.
+func (r *Receiver) Detach(ctx context.Context) error {
+	return r.link.Detach(ctx)
+}
+
 func (r *Receiver) dispositionBatcher() {
 	// batch operations:
 	// Keep track of the first and last delivery ID, incrementing as
@@ -169,7 +455,7 @@ func (r *Receiver) dispositionBatcher() {
 	)
 
 	// create an unstarted timer
-	batchTimer := time.NewTimer(1 * time.Minute)
+	batchTimer := r.link.session.conn.clock.NewTimer(1 * time.Minute)
 	batchTimer.Stop()
 	defer batchTimer.Stop()
 
@@ -218,12 +504,12 @@ func (r *Receiver) dispositionBatcher() {
 				}
 				batchStarted = false
 				if !batchTimer.Stop() {
-					<-batchTimer.C // batch timer must be drained if stop returns false
+					<-batchTimer.C() // batch timer must be drained if stop returns false
 				}
 			}
 
 		// maxBatchAge elapsed, send batch
-		case <-batchTimer.C:
+		case <-batchTimer.C():
 			lastCopy := last
 			err := r.sendDisposition(first, &lastCopy, &stateAccepted{})
 			if err != nil {
@@ -248,14 +534,162 @@ func (r *Receiver) sendDisposition(first uint32, last *uint32, state interface{}
 		State:   state,
 	}
 
-	debug(1, "TX: %s", fr)
-	return r.link.session.txFrame(fr, nil)
+	// the outcome is recorded before the peer can settle the deliveries
+	if !fr.Settled {
+		r.link.storeOutcome(first, last, outcomeOf(state))
+	}
+
+	r.link.debug(1, "TX: %s", fr)
+	err := r.link.session.txFrame(fr, nil)
+	if err != nil {
+		return err
+	}
+	if fr.Settled {
+		r.link.storeSettled(first, last)
+	}
+	return nil
+}
+
+// AcceptRange accepts msgs with a single disposition, rather than
+// one per message as with Message.Accept.
+//
+// msgs must have been received from r and be given in the order they
+// were received, with no messages missing between them. In ModeSecond,
+// AcceptRange blocks until the server has settled the deliveries or
+// ctx completes.
+func (r *Receiver) AcceptRange(ctx context.Context, msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	first := msgs[0].deliveryID
+	for i, msg := range msgs {
+		if msg.receiver != r {
+			return errorNew("message wasn't received by this Receiver")
+		}
+		if msg.deliveryID != first+uint32(i) {
+			return errorErrorf("delivery ID %d doesn't follow %d", msg.deliveryID, first+uint32(i)-1)
+		}
+	}
+	last := first + uint32(len(msgs)-1)
+	defer func() {
+		for _, msg := range msgs {
+			msg.done()
+		}
+	}()
+
+	var wait []chan error
+	if r.link.receiverSettleMode.value() == ModeSecond {
+		for _, msg := range msgs {
+			wait = append(wait, r.inFlight.add(msg.deliveryID))
+		}
+	}
+
+	err := r.sendDisposition(first, &last, &stateAccepted{})
+	if err != nil {
+		return err
+	}
+
+	// the server may settle the deliveries separately, wait for all
+	// of them and report the first error
+	for i, w := range wait {
+		select {
+		case werr := <-w:
+			if r.creditOnSettle {
+				r.settled(msgs[i])
+			}
+			if err == nil {
+				err = werr
+			}
+		case <-ctx.Done():
+			for j := i; j < len(wait); j++ {
+				r.settleOnCompletion(msgs[j], wait[j])
+			}
+			return ctx.Err()
+		}
+	}
+	return err
 }
 
-func (r *Receiver) messageDisposition(ctx context.Context, id uint32, state interface{}) error {
+// AcceptAsync accepts msg without waiting for the server to settle it,
+// so that messages can be accepted without a round trip for each.
+//
+// The disposition is sent, or queued when batching, before AcceptAsync
+// returns. Settlement can be awaited with the returned PendingDisposition;
+// in ModeFirst, or if msg is already settled, it's complete immediately.
+//
+// With LinkCreditOnSettle, the credit held by msg is reissued once the
+// settlement is received, whether or not it's awaited.
+func (r *Receiver) AcceptAsync(msg *Message) (*PendingDisposition, error) {
+	if msg.receiver != r {
+		return nil, errorNew("message wasn't received by this Receiver")
+	}
+	d := &PendingDisposition{r: r, msg: msg, done: make(chan struct{})}
+	if !msg.shouldSendDisposition() {
+		close(d.done)
+		return d, nil
+	}
+	defer msg.done()
+
+	id := msg.deliveryID
+	var wait chan error
+	if r.link.receiverSettleMode.value() == ModeSecond {
+		wait = r.inFlight.add(id)
+	} else {
+		close(d.done)
+	}
+
+	if r.batching {
+		r.dispositions <- messageDisposition{id: id, state: &stateAccepted{}}
+	} else if err := r.sendDisposition(id, nil, &stateAccepted{}); err != nil {
+		return nil, err
+	}
+	if wait != nil {
+		go d.settle(wait)
+	}
+	return d, nil
+}
+
+// PendingDisposition is a disposition sent by Receiver.AcceptAsync
+// whose settlement by the server can be awaited.
+type PendingDisposition struct {
+	r    *Receiver
+	msg  *Message
+	done chan struct{} // closed once err is set
+	err  error
+}
+
+// settle records the settlement received on wait, whether or not
+// the caller waits for it.
+func (d *PendingDisposition) settle(wait chan error) {
+	select {
+	case d.err = <-wait:
+		if d.r.creditOnSettle {
+			d.r.settled(d.msg)
+		}
+	case <-d.r.link.done:
+		d.err = d.r.link.err
+	}
+	close(d.done)
+}
+
+// Wait blocks until the server has settled the delivery or ctx completes,
+// returning an error if the disposition failed.
+//
+// Wait may be called multiple times and concurrently.
+func (d *PendingDisposition) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Receiver) messageDisposition(ctx context.Context, msg *Message, state interface{}) error {
+	id := msg.deliveryID
 	var wait chan error
 	if r.link.receiverSettleMode != nil && *r.link.receiverSettleMode == ModeSecond {
-		debug(3, "RX: add %d to inflight", id)
+		r.link.debug(3, "RX: add %d to inflight", id)
 		wait = r.inFlight.add(id)
 	}
 
@@ -274,12 +708,41 @@ func (r *Receiver) messageDisposition(ctx context.Context, id uint32, state inte
 
 	select {
 	case err := <-wait:
+		if r.creditOnSettle {
+			r.settled(msg)
+		}
 		return err
 	case <-ctx.Done():
+		r.settleOnCompletion(msg, wait)
 		return ctx.Err()
 	}
 }
 
+// settleOnCompletion calls settled for msg with LinkCreditOnSettle once
+// wait receives its settlement, for callers that stop waiting first.
+func (r *Receiver) settleOnCompletion(msg *Message, wait chan error) {
+	if !r.creditOnSettle {
+		return
+	}
+	go func() {
+		select {
+		case <-wait:
+			r.settled(msg)
+		case <-r.link.done:
+		}
+	}()
+}
+
+// settled removes msg from the unsettled messages and wakes the
+// link mux so the credit it held can be reissued.
+func (r *Receiver) settled(msg *Message) {
+	r.link.deleteUnsettled(msg)
+	select {
+	case r.link.receiverReady <- struct{}{}:
+	default:
+	}
+}
+
 // inFlight tracks in-flight message dispositions allowing receivers
 // to block waiting for the server to respond when an appropriate
 // settlement mode is configured.
@@ -334,3 +797,9 @@ func (f *inFlight) clear(err error) {
 	}
 	f.mu.Unlock()
 }
+
+func (f *inFlight) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.m)
+}
@@ -137,3 +137,151 @@ func TestReceiver_HandleMessageModeSecond_removeFromUnsettledMapOnDisposition(t
 		t.Fatal("expected closed of doneSignal")
 	}
 }
+
+func TestReceiver_ReceiveBatch(t *testing.T) {
+	r := &Receiver{
+		link: makeLink(ModeFirst),
+	}
+	r.link.messages = make(chan Message, 10)
+	for i := 0; i < 3; i++ {
+		msg := makeMessage(ModeFirst)
+		msg.deliveryID = uint32(i)
+		r.link.messages <- msg
+	}
+
+	start := time.Now()
+	msgs, err := r.ReceiveBatch(context.TODO(), 10, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("ReceiveBatch() error = %v", err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("ReceiveBatch() returned %d messages, want 3", len(msgs))
+	}
+	for i, msg := range msgs {
+		if msg.deliveryID != uint32(i) {
+			t.Errorf("msgs[%d].deliveryID = %d, want %d", i, msg.deliveryID, i)
+		}
+		if msg.receiver != r {
+			t.Errorf("msgs[%d].receiver not set", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ReceiveBatch() took %s, expected to return after maxWait", elapsed)
+	}
+}
+
+func TestReceiver_ReceiveBatchMaxCount(t *testing.T) {
+	r := &Receiver{
+		link: makeLink(ModeFirst),
+	}
+	r.link.messages = make(chan Message, 10)
+	for i := 0; i < 5; i++ {
+		r.link.messages <- makeMessage(ModeFirst)
+	}
+
+	msgs, err := r.ReceiveBatch(context.TODO(), 2, time.Hour)
+	if err != nil {
+		t.Fatalf("ReceiveBatch() error = %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Errorf("ReceiveBatch() returned %d messages, want 2", len(msgs))
+	}
+	if len(r.link.messages) != 3 {
+		t.Errorf("%d messages left buffered, want 3", len(r.link.messages))
+	}
+
+	_, err = r.ReceiveBatch(context.TODO(), 0, time.Second)
+	if err == nil {
+		t.Error("expected error for maxCount 0")
+	}
+}
+
+func TestReceiverCredit(t *testing.T) {
+	r, s := startReceiverLink(t, nil, LinkCredit(10))
+	defer close(s.done)
+
+	waitForCredit := func(want uint32) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for r.Credit() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Credit() = %d, want %d", r.Credit(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	flow := readFlow(t, s)
+	waitForCredit(*flow.LinkCredit)
+
+	payload, err := NewMessage([]byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+	r.link.rx <- &performTransfer{
+		DeliveryID:    uint32Ptr(0),
+		DeliveryTag:   []byte("tag"),
+		MessageFormat: &format,
+		Settled:       true,
+		Payload:       payload,
+	}
+	waitForCredit(*flow.LinkCredit - 1)
+}
+
+func TestReceiverReceiveBatchCredit(t *testing.T) {
+	payload, err := NewMessage([]byte("hello")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := uint32(0)
+
+	for _, tt := range []struct {
+		maxCount   int
+		maxWait    time.Duration
+		wantCredit uint32
+	}{
+		{maxCount: 5, maxWait: time.Hour, wantCredit: 5},
+		{maxCount: 20, maxWait: 50 * time.Millisecond, wantCredit: 10}, // bounded by LinkCredit
+	} {
+		// credit is only issued on demand, so flows are sent for batches.
+		// Each batch uses its own link as a waiting Receive may be given
+		// another credit on demand once the batch's credit is used.
+		r, s := startReceiverLink(t, nil, LinkCredit(10), LinkInitialCredit(0))
+
+		type result struct {
+			msgs []*Message
+			err  error
+		}
+		results := make(chan result, 1)
+		go func() {
+			msgs, err := r.ReceiveBatch(context.Background(), tt.maxCount, tt.maxWait)
+			results <- result{msgs: msgs, err: err}
+		}()
+
+		// the batch size drives the credit issued
+		flow := readFlow(t, s)
+		if *flow.LinkCredit != tt.wantCredit {
+			close(s.done)
+			t.Fatalf("ReceiveBatch(%d) LinkCredit = %d, want %d", tt.maxCount, *flow.LinkCredit, tt.wantCredit)
+		}
+		for id := uint32(0); id < tt.wantCredit; id++ {
+			r.link.rx <- &performTransfer{
+				DeliveryID:    uint32Ptr(id),
+				DeliveryTag:   []byte{byte(id)},
+				MessageFormat: &format,
+				Settled:       true,
+				Payload:       payload,
+			}
+		}
+
+		res := <-results
+		close(s.done)
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if uint32(len(res.msgs)) != tt.wantCredit {
+			t.Errorf("ReceiveBatch(%d) returned %d messages, want %d", tt.maxCount, len(res.msgs), tt.wantCredit)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Requester sends request messages to a node and routes the replies,
+// received on a link with a dynamic address, back to the callers
+// waiting for them.
+//
+// Replies are matched to requests by correlation-id. Request sets a
+// generated correlation-id on each request, and its message-id to the
+// same value if unset, so a responder must set the reply's correlation-id
+// to either of them. Replies that don't match a waiting request are
+// accepted and dropped.
+type Requester struct {
+	sender   *Sender
+	receiver *Receiver
+	prefix   string // prefix of generated correlation-ids
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[interface{}]chan *Message // waiting requests by correlation-id and message-id, see replyKey
+	err     error                         // error from the reply receiver, set before done is closed
+
+	done chan struct{} // closed once replies are no longer received
+}
+
+// NewRequester opens a Sender for requests to address and a Receiver
+// for their replies, with an address assigned by the peer.
+//
+// opts are applied to the Sender.
+func (s *Session) NewRequester(address string, opts ...LinkOption) (*Requester, error) {
+	receiver, err := s.NewReceiver(LinkAddressDynamic())
+	if err != nil {
+		return nil, err
+	}
+	if receiver.Address() == "" {
+		_ = receiver.Close(context.Background())
+		return nil, errorNew("peer didn't assign an address to the reply link")
+	}
+
+	sender, err := s.NewSender(append([]LinkOption{LinkTargetAddress(address)}, opts...)...)
+	if err != nil {
+		_ = receiver.Close(context.Background())
+		return nil, err
+	}
+
+	rq := &Requester{
+		sender:   sender,
+		receiver: receiver,
+		prefix:   randString(12),
+		pending:  make(map[interface{}]chan *Message),
+		done:     make(chan struct{}),
+	}
+	go rq.receiveReplies()
+	return rq, nil
+}
+
+// ReplyTo returns the address replies are received from, as set in the
+// reply-to property of requests.
+func (rq *Requester) ReplyTo() string {
+	return rq.receiver.Address()
+}
+
+// Request sends msg and waits for its reply.
+//
+// The reply-to and correlation-id properties of msg are set, and its
+// message-id if it is nil. A message-id set by the caller must not be
+// used by another request waiting for its reply.
+func (rq *Requester) Request(ctx context.Context, msg *Message) (*Message, error) {
+	if msg.Properties == nil {
+		msg.Properties = new(MessageProperties)
+	}
+	if err := validateMessageID("MessageID", msg.Properties.MessageID); err != nil {
+		return nil, err
+	}
+
+	rq.mu.Lock()
+	select {
+	case <-rq.done:
+		rq.mu.Unlock()
+		return nil, rq.err
+	default:
+	}
+	rq.nextID++
+	id := fmt.Sprintf("%s-%d", rq.prefix, rq.nextID)
+	keys := []interface{}{id}
+	if msg.Properties.MessageID != nil {
+		key := replyKey(msg.Properties.MessageID)
+		if _, ok := rq.pending[key]; ok {
+			rq.mu.Unlock()
+			return nil, errorErrorf("message-id %v is already awaiting a reply", msg.Properties.MessageID)
+		}
+		keys = append(keys, key)
+	}
+	reply := make(chan *Message, 1)
+	for _, key := range keys {
+		rq.pending[key] = reply
+	}
+	rq.mu.Unlock()
+
+	defer func() {
+		rq.mu.Lock()
+		for _, key := range keys {
+			delete(rq.pending, key)
+		}
+		rq.mu.Unlock()
+	}()
+
+	msg.Properties.ReplyTo = rq.receiver.Address()
+	msg.Properties.CorrelationID = id
+	if msg.Properties.MessageID == nil {
+		msg.Properties.MessageID = id
+	}
+
+	if err := rq.sender.Send(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case m := <-reply:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-rq.done:
+		return nil, rq.err
+	}
+}
+
+// binaryID is the key of a binary message-id or correlation-id,
+// kept apart from string ids with the same bytes.
+type binaryID string
+
+// replyKey returns the pending key of a message-id or correlation-id.
+func replyKey(id interface{}) interface{} {
+	if b, ok := id.([]byte); ok {
+		return binaryID(b)
+	}
+	return id
+}
+
+// receiveReplies delivers replies to the waiting requests until the
+// reply receiver fails or is closed.
+func (rq *Requester) receiveReplies() {
+	for {
+		msg, err := rq.receiver.Receive(context.Background())
+		if err != nil {
+			rq.mu.Lock()
+			rq.err = err
+			close(rq.done)
+			rq.mu.Unlock()
+			return
+		}
+		_ = msg.Accept(context.Background())
+
+		var id interface{}
+		if msg.Properties != nil && msg.Properties.CorrelationID != nil {
+			id = replyKey(msg.Properties.CorrelationID)
+		}
+		rq.mu.Lock()
+		if reply, ok := rq.pending[id]; ok {
+			select {
+			case reply <- msg:
+			default:
+				// duplicate reply
+			}
+		}
+		rq.mu.Unlock()
+	}
+}
+
+// Close closes the request and reply links. Waiting requests
+// return an error.
+func (rq *Requester) Close(ctx context.Context) error {
+	err := rq.sender.Close(ctx)
+	if rerr := rq.receiver.Close(ctx); err == nil {
+		err = rerr
+	}
+	select {
+	case <-rq.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
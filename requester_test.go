@@ -0,0 +1,252 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp/internal/frames"
+	"github.com/Azure/go-amqp/internal/testbroker"
+)
+
+// runResponder stands in for a broker with a responder on address
+// "rpc", answering every batch of count requests in reverse order.
+// Replies are correlated to requests by the id returned by correlate.
+func runResponder(t *testing.T, conn net.Conn, count int, correlate func(req *Message) interface{}) {
+	var (
+		broker     = testbroker.New(t, conn)
+		replyTo    = "reply-1"
+		requests   []*Message
+		deliveryID uint32
+	)
+	broker.Attach = func(channel uint16, attach *frames.Attach) {
+		resp := broker.AttachResponse(attach)
+		if attach.Role == frames.RoleReceiver {
+			if attach.Source == nil || !attach.Source.Dynamic {
+				t.Errorf("reply link source %#v isn't dynamic", attach.Source)
+			}
+			resp.Source = &frames.Source{Address: replyTo}
+			resp.Target = &frames.Target{}
+			broker.Write(channel, resp)
+			return
+		}
+		if attach.Target == nil || attach.Target.Address != "rpc" {
+			t.Errorf("request link target = %#v, want address rpc", attach.Target)
+		}
+		resp.Source = &frames.Source{}
+		broker.Write(channel, resp)
+		credit, zero := uint32(100), uint32(0)
+		broker.Write(channel, &frames.Flow{
+			NextIncomingID: &zero,
+			IncomingWindow: 100,
+			OutgoingWindow: 100,
+			Handle:         &resp.Handle,
+			DeliveryCount:  &zero,
+			LinkCredit:     &credit,
+		})
+	}
+	broker.Transfer = func(channel uint16, transfer *frames.Transfer) {
+		req := new(Message)
+		if err := req.UnmarshalBinary(transfer.Payload); err != nil {
+			t.Error(err)
+			broker.Stop()
+			return
+		}
+		if req.Properties.ReplyTo != replyTo {
+			t.Errorf("request reply-to = %q, want %q", req.Properties.ReplyTo, replyTo)
+		}
+		if !transfer.Settled {
+			broker.Write(channel, &frames.Disposition{
+				Role:    frames.RoleReceiver,
+				First:   *transfer.DeliveryID,
+				Settled: true,
+				State:   &frames.Accepted{},
+			})
+		}
+		requests = append(requests, req)
+		if len(requests) < count {
+			return
+		}
+		for i := len(requests) - 1; i >= 0; i-- {
+			reply := NewMessage([]byte("re: " + string(requests[i].GetData())))
+			reply.Properties = &MessageProperties{CorrelationID: correlate(requests[i])}
+			payload, err := reply.MarshalBinary()
+			if err != nil {
+				t.Error(err)
+				broker.Stop()
+				return
+			}
+			id, format := deliveryID, uint32(0)
+			deliveryID++
+			broker.Write(channel, &frames.Transfer{
+				Handle:        0, // the reply link
+				DeliveryID:    &id,
+				DeliveryTag:   []byte{byte(id)},
+				MessageFormat: &format,
+				Settled:       true,
+				Payload:       payload,
+			})
+		}
+		requests = nil
+	}
+	broker.Run()
+}
+
+func TestRequester(t *testing.T) {
+	const count = 2
+	clientConn, peerConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runResponder(t, peerConn, count, func(req *Message) interface{} {
+			return req.Properties.CorrelationID
+		})
+	}()
+
+	client, err := New(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq, err := sess.NewRequester("rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rq.ReplyTo(); got != "reply-1" {
+		t.Errorf("ReplyTo() = %q, want %q", got, "reply-1")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// concurrent requests get their own replies, though answered out of order
+	type result struct {
+		req, reply *Message
+		err        error
+	}
+	results := make(chan result, count)
+	for i := 0; i < count; i++ {
+		req := NewMessage([]byte(fmt.Sprintf("request %d", i)))
+		go func() {
+			reply, err := rq.Request(ctx, req)
+			results <- result{req: req, reply: reply, err: err}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		res := <-results
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if want := "re: " + string(res.req.GetData()); string(res.reply.GetData()) != want {
+			t.Errorf("reply = %q, want %q", res.reply.GetData(), want)
+		}
+		if res.req.Properties.MessageID != res.req.Properties.CorrelationID {
+			t.Errorf("request message-id %v, want correlation-id %v", res.req.Properties.MessageID, res.req.Properties.CorrelationID)
+		}
+	}
+
+	if err := rq.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rq.Request(ctx, NewMessage(nil)); err == nil {
+		t.Error("expected error from Request after Close")
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("responder didn't finish")
+	}
+}
+
+func TestRequesterMessageID(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the responder replies with the request's message-id
+		runResponder(t, peerConn, 2, func(req *Message) interface{} {
+			return req.Properties.MessageID
+		})
+	}()
+
+	client, err := New(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq, err := sess.NewRequester("rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type result struct {
+		reply *Message
+		err   error
+	}
+	request := func(data string, messageID interface{}) chan result {
+		req := NewMessage([]byte(data))
+		req.Properties = &MessageProperties{MessageID: messageID}
+		results := make(chan result, 1)
+		go func() {
+			reply, err := rq.Request(ctx, req)
+			results <- result{reply: reply, err: err}
+		}()
+		return results
+	}
+	pending := func(key interface{}) bool {
+		rq.mu.Lock()
+		defer rq.mu.Unlock()
+		_, ok := rq.pending[key]
+		return ok
+	}
+
+	order := request("order", "order-42")
+	deadline := time.Now().Add(5 * time.Second)
+	for !pending("order-42") {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the request to be pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a message-id can only await one reply at a time
+	if _, err := rq.Request(ctx, &Message{Properties: &MessageProperties{MessageID: "order-42"}}); err == nil {
+		t.Error("expected error reusing a pending message-id")
+	}
+
+	binary := request("binary", []byte("order-42"))
+	for _, tt := range []struct {
+		results chan result
+		want    string
+	}{
+		{results: order, want: "re: order"},
+		{results: binary, want: "re: binary"},
+	} {
+		res := <-tt.results
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if string(res.reply.GetData()) != tt.want {
+			t.Errorf("reply = %q, want %q", res.reply.GetData(), tt.want)
+		}
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
@@ -32,6 +32,28 @@ func (s *saslCode) unmarshal(r *buffer) error {
 	return err
 }
 
+// ConnSASLMechanisms sets the order of preference of the enabled SASL
+// mechanisms, e.g. "PLAIN", "ANONYMOUS".
+//
+// The first mechanism in the list that the server offers is used, and
+// the connection fails if the server offers none of them. Each
+// mechanism must also be enabled with its ConnSASL option.
+//
+// By default, the first enabled mechanism in the server's order of
+// preference is used.
+func ConnSASLMechanisms(mechanisms ...string) ConnOption {
+	return func(c *conn) error {
+		if len(mechanisms) == 0 {
+			return errorNew("ConnSASLMechanisms requires at least one mechanism")
+		}
+		c.saslPrefer = make([]symbol, len(mechanisms))
+		for i, mech := range mechanisms {
+			c.saslPrefer[i] = symbol(mech)
+		}
+		return nil
+	}
+}
+
 // ConnSASLPlain enables SASL PLAIN authentication for the connection.
 //
 // SASL PLAIN transmits credentials in plain text and should only be used
@@ -52,7 +74,7 @@ func ConnSASLPlain(username, password string) ConnOption {
 				InitialResponse: []byte("\x00" + username + "\x00" + password),
 				Hostname:        "",
 			}
-			debug(1, "TX: %s", init)
+			c.debug(1, "TX: %s", init)
 			c.err = c.writeFrame(frame{
 				type_: frameTypeSASL,
 				body:  init,
@@ -82,7 +104,7 @@ func ConnSASLAnonymous() ConnOption {
 				Mechanism:       saslMechanismANONYMOUS,
 				InitialResponse: []byte("anonymous"),
 			}
-			debug(1, "TX: %s", init)
+			c.debug(1, "TX: %s", init)
 			c.err = c.writeFrame(frame{
 				type_: frameTypeSASL,
 				body:  init,
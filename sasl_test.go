@@ -243,3 +243,80 @@ func peerResponse(items ...interface{}) ([]byte, error) {
 	}
 	return buf, nil
 }
+
+func TestConnSASLMechanisms(t *testing.T) {
+	tests := []struct {
+		label   string
+		prefer  []string
+		offered []symbol
+		want    symbol
+		wantErr bool
+	}{
+		{
+			label:   "server order",
+			offered: []symbol{saslMechanismANONYMOUS, saslMechanismPLAIN},
+			want:    saslMechanismANONYMOUS,
+		},
+		{
+			label:   "client prefers first offered",
+			prefer:  []string{"PLAIN", "ANONYMOUS"},
+			offered: []symbol{saslMechanismPLAIN, saslMechanismANONYMOUS},
+			want:    saslMechanismPLAIN,
+		},
+		{
+			label:   "client prefers last offered",
+			prefer:  []string{"PLAIN", "ANONYMOUS"},
+			offered: []symbol{saslMechanismANONYMOUS, saslMechanismPLAIN},
+			want:    saslMechanismPLAIN,
+		},
+		{
+			label:   "fallback",
+			prefer:  []string{"PLAIN", "ANONYMOUS"},
+			offered: []symbol{saslMechanismXOAUTH2, saslMechanismANONYMOUS},
+			want:    saslMechanismANONYMOUS,
+		},
+		{
+			label:   "enabled but not preferred",
+			prefer:  []string{"PLAIN"},
+			offered: []symbol{saslMechanismANONYMOUS},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			opts := []ConnOption{ConnSASLAnonymous(), ConnSASLPlain("user", "pass")}
+			if tt.prefer != nil {
+				opts = append(opts, ConnSASLMechanisms(tt.prefer...))
+			}
+			c, err := newConn(nil, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.selectSASLMechanism(tt.offered)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatal(err)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatalf("selected %s, want error", got)
+			}
+			if got != tt.want {
+				t.Errorf("selected %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnSASLMechanismsInvalid(t *testing.T) {
+	for _, opts := range [][]ConnOption{
+		{ConnSASLMechanisms()},
+		{ConnSASLPlain("user", "pass"), ConnSASLMechanisms("PLAIN", "XOAUTH2")},
+	} {
+		if _, err := newConn(nil, opts...); err == nil {
+			t.Error("newConn() succeeded, want error")
+		}
+	}
+}
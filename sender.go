@@ -11,9 +11,53 @@ import (
 type Sender struct {
 	link *link
 
-	mu              sync.Mutex // protects buf and nextDeliveryTag
+	mu              sync.Mutex // protects buf, nextDeliveryTag and sendBufs
 	buf             buffer
 	nextDeliveryTag uint64
+	sendBufs        []*sendBuffer // free list of buffers for single frame transfers
+}
+
+const (
+	// maximum payload size of a message eligible for a pooled sendBuffer
+	sendBufferMaxPayload = 64 * 1024
+
+	// maximum number of free sendBuffers retained by a Sender
+	sendBufferMaxFree = 8
+)
+
+// sendBuffer holds the values referenced by a single frame transfer.
+//
+// Reusing it across sends avoids allocating them for each message.
+// It must only be reused once the transfer is known to have been
+// written, i.e. after its settlement has been received.
+type sendBuffer struct {
+	deliveryID  uint32
+	deliveryTag [8]byte
+	payload     []byte
+}
+
+// getSendBuffer returns a free sendBuffer, s.mu must be held.
+func (s *Sender) getSendBuffer() *sendBuffer {
+	if n := len(s.sendBufs); n > 0 {
+		sb := s.sendBufs[n-1]
+		s.sendBufs[n-1] = nil
+		s.sendBufs = s.sendBufs[:n-1]
+		return sb
+	}
+	return new(sendBuffer)
+}
+
+// putSendBuffer returns sb to the free list once its transfer
+// has been settled.
+func (s *Sender) putSendBuffer(sb *sendBuffer) {
+	if sb == nil {
+		return
+	}
+	s.mu.Lock()
+	if len(s.sendBufs) < sendBufferMaxFree {
+		s.sendBufs = append(s.sendBufs, sb)
+	}
+	s.mu.Unlock()
 }
 
 // Send sends a Message.
@@ -26,16 +70,122 @@ type Sender struct {
 // additional messages can be sent while the current goroutine is waiting
 // for the confirmation.
 func (s *Sender) Send(ctx context.Context, msg *Message) error {
-	done, err := s.send(ctx, msg)
+	if s.link.retryPolicy.MaxAttempts > 1 {
+		return s.sendWithRetry(ctx, msg)
+	}
+	return s.sendAndWait(ctx, msg)
+}
+
+func (s *Sender) sendAndWait(ctx context.Context, msg *Message) error {
+	done, sb, err := s.send(ctx, msg, nil, false, false)
+	if err != nil {
+		return err
+	}
+	return s.waitForSettlement(ctx, done, sb)
+}
+
+// sendWithRetry sends msg, resending it as set by the link's
+// RetryPolicy while it's rejected with a retryable error.
+func (s *Sender) sendWithRetry(ctx context.Context, msg *Message) error {
+	// all attempts must use the same delivery tag
+	if len(msg.DeliveryTag) == 0 {
+		m := *msg
+		m.DeliveryTag = make([]byte, 8)
+		s.mu.Lock()
+		binary.BigEndian.PutUint64(m.DeliveryTag, s.nextDeliveryTag)
+		s.nextDeliveryTag++
+		s.mu.Unlock()
+		msg = &m
+	}
+
+	var (
+		policy  = s.link.retryPolicy
+		backoff = policy.Backoff
+	)
+	for attempt := 1; ; attempt++ {
+		err := s.sendAndWait(ctx, msg)
+		if err == nil || attempt >= policy.MaxAttempts || !isRetryableRejection(err) {
+			return err
+		}
+		s.link.debug(1, "retrying send after %v, attempt %d: %v", backoff, attempt, err)
+
+		if backoff <= 0 {
+			continue
+		}
+		timer := s.link.session.conn.clock.NewTimer(backoff)
+		select {
+		case <-timer.C():
+		case <-s.link.done:
+			timer.Stop()
+			return s.link.err
+		case <-ctx.Done():
+			timer.Stop()
+			return errorWrapf(ctx.Err(), "awaiting send retry")
+		}
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// isRetryableRejection reports whether err is a rejection that may
+// succeed if the message is sent again.
+func isRetryableRejection(err error) bool {
+	e, ok := err.(*Error)
+	if !ok || e == nil {
+		return false
+	}
+	switch e.Condition {
+	case ErrorResourceLimitExceeded, ErrorTransferLimitExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// isThrottled reports whether e is a rejection by a peer
+// limiting the rate of transfers.
+func isThrottled(e *Error) bool {
+	return e != nil && e.Condition == ErrorTransferLimitExceeded
+}
+
+// TrySend sends a Message if the link has credit.
+//
+// If the peer hasn't granted credit to send the message, ErrWouldBlock is
+// returned immediately rather than waiting for credit, allowing the caller
+// to do other work and retry later. Otherwise TrySend behaves as Send.
+func (s *Sender) TrySend(ctx context.Context, msg *Message) error {
+	done, sb, err := s.send(ctx, msg, nil, false, true)
 	if err != nil {
 		return err
 	}
+	return s.waitForSettlement(ctx, done, sb)
+}
 
-	// wait for transfer to be confirmed
+// waitForSettlement waits for the transfer with the done channel
+// returned from send to be confirmed, then releases its sendBuffer.
+func (s *Sender) waitForSettlement(ctx context.Context, done chan deliveryState, sb *sendBuffer) error {
 	select {
 	case state := <-done:
-		if state, ok := state.(*stateRejected); ok {
+		s.putSendBuffer(sb)
+		switch state := state.(type) {
+		case nil, *stateAccepted:
+		case *stateRejected:
 			return state.Error
+		case *stateModified:
+			if s.link.requireAccepted {
+				return &OutcomeError{
+					Outcome:            OutcomeModified,
+					DeliveryFailed:     state.DeliveryFailed,
+					UndeliverableHere:  state.UndeliverableHere,
+					MessageAnnotations: state.MessageAnnotations,
+				}
+			}
+		default:
+			if s.link.requireAccepted {
+				return &OutcomeError{Outcome: outcomeOf(state)}
+			}
 		}
 		return nil
 	case <-s.link.done:
@@ -45,44 +195,136 @@ func (s *Sender) Send(ctx context.Context, msg *Message) error {
 	}
 }
 
+// SendFireAndForget sends a sender-settled Message without waiting
+// for it to be written to the network.
+//
+// Blocks until the message has been queued for sending, ctx completes,
+// or an error occurs. Errors writing the message are not reported;
+// they will cause the connection to close.
+//
+// The message must be sender-settled, either because the link's
+// sender settle mode is ModeSettled, or because it is ModeMixed and
+// msg.SendSettled is set to true. Otherwise, an error is returned.
+func (s *Sender) SendFireAndForget(ctx context.Context, msg *Message) error {
+	_, _, err := s.send(ctx, msg, nil, true, false)
+	return err
+}
+
+// SendRaw sends an already encoded message, such as one returned by
+// Message.MarshalBinary, without decoding or re-encoding it.
+//
+// payload must contain the message's sections, it's sent as is and split
+// across transfer frames as required. A delivery tag is generated and
+// the message format is 0. The message is sender-settled if the link's
+// sender settle mode is ModeSettled, or if it's ModeMixed and the link
+// was attached with LinkSenderDefaultSettled(true).
+//
+// Blocks until the message is sent, ctx completes, or an error occurs,
+// as Send does.
+func (s *Sender) SendRaw(ctx context.Context, payload []byte) error {
+	if len(payload) == 0 {
+		return errorNew("payload cannot be empty")
+	}
+	done, sb, err := s.send(ctx, &Message{}, payload, false, false)
+	if err != nil {
+		return err
+	}
+	return s.waitForSettlement(ctx, done, sb)
+}
+
+// senderSettled reports whether msg is sent settled. msg.SendSettled
+// takes precedence over the link's sender settle mode when set, but
+// must not contradict a mode of ModeSettled or ModeUnsettled.
+func (s *Sender) senderSettled(msg *Message) (bool, error) {
+	mode := s.link.senderSettleMode.value()
+	if msg.SendSettled == nil {
+		if mode == ModeMixed {
+			return s.link.defaultSendSettled, nil
+		}
+		return mode == ModeSettled, nil
+	}
+
+	settled := *msg.SendSettled
+	switch {
+	case settled && mode == ModeUnsettled:
+		return false, errorNew("message can't be sent settled when sender settle mode is unsettled")
+	case !settled && mode == ModeSettled:
+		return false, errorNew("message can't be sent unsettled when sender settle mode is settled")
+	}
+	return settled, nil
+}
+
 // send is separated from Send so that the mutex unlock can be deferred without
 // locking the transfer confirmation that happens in Send.
-func (s *Sender) send(ctx context.Context, msg *Message) (chan deliveryState, error) {
+//
+// If payload isn't nil, it's sent instead of encoding msg, msg is only
+// used for the delivery tag, message format and settlement.
+// If fireAndForget is true, no done channel is allocated and nil is returned.
+// If failFast is true, ErrWouldBlock is returned if the link has no credit.
+//
+// The returned sendBuffer, if not nil, is referenced by the transfer and
+// must be passed to putSendBuffer only once done has been received from.
+func (s *Sender) send(ctx context.Context, msg *Message, payload []byte, fireAndForget, failFast bool) (chan deliveryState, *sendBuffer, error) {
 	if len(msg.DeliveryTag) > maxDeliveryTagLength {
-		return nil, errorErrorf("delivery tag is over the allowed %v bytes, len: %v", maxDeliveryTagLength, len(msg.DeliveryTag))
+		return nil, nil, errorErrorf("delivery tag is over the allowed %v bytes, len: %v", maxDeliveryTagLength, len(msg.DeliveryTag))
+	}
+	if s.link.anonymous && payload == nil && (msg.Properties == nil || msg.Properties.To == "") {
+		return nil, nil, errorNew("message To must be set when sending to an anonymous target")
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if failFast && atomic.LoadUint32(&s.link.credit) == 0 {
+		return nil, nil, ErrWouldBlock
+	}
+
 	s.buf.reset()
-	err := msg.marshal(&s.buf)
-	if err != nil {
-		return nil, err
+	if payload != nil {
+		s.buf.write(payload)
+	} else if err := msg.marshal(&s.buf); err != nil {
+		return nil, nil, err
 	}
 
 	if s.link.maxMessageSize != 0 && uint64(s.buf.len()) > s.link.maxMessageSize {
-		return nil, errorErrorf("encoded message size exceeds max of %d", s.link.maxMessageSize)
+		return nil, nil, errorErrorf("encoded message size exceeds max of %d", s.link.maxMessageSize)
+	}
+
+	maxPayloadSize := int64(s.link.session.conn.peerMaxFrameSize) - maxTransferFrameHeader
+	senderSettled, err := s.senderSettled(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fireAndForget && !senderSettled {
+		return nil, nil, errorNew("fire and forget requires the message to be sender-settled")
 	}
 
+	// small single frame messages whose settlement will be waited
+	// on reuse a sendBuffer rather than allocating for each send
 	var (
-		maxPayloadSize = int64(s.link.session.conn.peerMaxFrameSize) - maxTransferFrameHeader
-		sndSettleMode  = s.link.senderSettleMode
-		senderSettled  = sndSettleMode != nil && (*sndSettleMode == ModeSettled || (*sndSettleMode == ModeMixed && msg.SendSettled))
-		deliveryID     = atomic.AddUint32(&s.link.session.nextDeliveryID, 1)
+		pooled = !fireAndForget && s.buf.len() <= sendBufferMaxPayload && int64(s.buf.len()) <= maxPayloadSize
+		sb     *sendBuffer
 	)
+	if pooled {
+		sb = s.getSendBuffer()
+	} else {
+		sb = new(sendBuffer)
+	}
+
+	sb.deliveryID = atomic.AddUint32(&s.link.session.nextDeliveryID, 1)
 
 	deliveryTag := msg.DeliveryTag
 	if len(deliveryTag) == 0 {
 		// use uint64 encoded as []byte as deliveryTag
-		deliveryTag = make([]byte, 8)
+		deliveryTag = sb.deliveryTag[:]
 		binary.BigEndian.PutUint64(deliveryTag, s.nextDeliveryTag)
 		s.nextDeliveryTag++
 	}
 
 	fr := performTransfer{
 		Handle:        s.link.handle,
-		DeliveryID:    &deliveryID,
+		DeliveryID:    &sb.deliveryID,
 		DeliveryTag:   deliveryTag,
 		MessageFormat: &msg.Format,
 		More:          s.buf.len() > 0,
@@ -90,7 +332,13 @@ func (s *Sender) send(ctx context.Context, msg *Message) (chan deliveryState, er
 
 	for fr.More {
 		buf, _ := s.buf.next(maxPayloadSize)
-		fr.Payload = append([]byte(nil), buf...)
+		if fr.DeliveryID != nil {
+			// the first frame's payload is held by the sendBuffer
+			sb.payload = append(sb.payload[:0], buf...)
+			fr.Payload = sb.payload
+		} else {
+			fr.Payload = append([]byte(nil), buf...)
+		}
 		fr.More = s.buf.len() > 0
 		if !fr.More {
 			// SSM=settled: overrides RSM; no acks.
@@ -101,16 +349,28 @@ func (s *Sender) send(ctx context.Context, msg *Message) (chan deliveryState, er
 			// mark final transfer as settled when sender mode is settled
 			fr.Settled = senderSettled
 
-			// set done on last frame
-			fr.done = make(chan deliveryState, 1)
+			// set done on last frame, unless the caller won't wait on it
+			if !fireAndForget {
+				fr.done = make(chan deliveryState, 1)
+			}
+		}
+
+		// the credit checked above may be used up by a transfer the mux
+		// hasn't accounted for yet, in which case the mux tells a failFast
+		// caller rather than leaving it blocked here
+		var noCredit chan struct{}
+		if failFast && fr.DeliveryID != nil {
+			noCredit = s.link.noCredit
 		}
 
 		select {
 		case s.link.transfers <- fr:
+		case <-noCredit:
+			return nil, nil, ErrWouldBlock
 		case <-s.link.done:
-			return nil, s.link.err
+			return nil, nil, s.link.err
 		case <-ctx.Done():
-			return nil, errorWrapf(ctx.Err(), "awaiting send")
+			return nil, nil, errorWrapf(ctx.Err(), "awaiting send")
 		}
 
 		// clear values that are only required on first message
@@ -119,7 +379,10 @@ func (s *Sender) send(ctx context.Context, msg *Message) (chan deliveryState, er
 		fr.MessageFormat = nil
 	}
 
-	return fr.done, nil
+	if !pooled {
+		return fr.done, nil, nil
+	}
+	return fr.done, sb, nil
 }
 
 // Address returns the link's address.
@@ -130,7 +393,76 @@ func (s *Sender) Address() string {
 	return s.link.target.Address
 }
 
+// Credit returns the Sender's link credit, the number of messages
+// the peer currently allows to be sent without blocking.
+//
+// The value is a snapshot and may be changed by the peer at any time.
+func (s *Sender) Credit() uint32 {
+	return atomic.LoadUint32(&s.link.credit)
+}
+
+// SettleMode returns the sender settlement mode negotiated with the peer
+// when the link was attached.
+func (s *Sender) SettleMode() SenderSettleMode {
+	return s.link.senderSettleMode.value()
+}
+
+// Available returns the available count in the last flow received
+// from the peer, or 0 if it wasn't set.
+//
+// The count is set by the peer at its discretion, receivers typically
+// don't set it, and is informational only.
+func (s *Sender) Available() uint32 {
+	return atomic.LoadUint32(&s.link.available)
+}
+
+// Target returns the target terminus as set by the peer when the link
+// was attached, or nil if the peer didn't set one.
+//
+// The peer may alter the requested target, e.g. by dropping
+// capabilities it doesn't support.
+func (s *Sender) Target() *Target {
+	return exportTarget(s.link.remoteTarget)
+}
+
+// Source returns the source terminus as set by the peer when the link
+// was attached, or nil if the peer didn't set one.
+func (s *Sender) Source() *Source {
+	return exportSource(s.link.remoteSource)
+}
+
+// Closed returns a channel that is closed once the Sender's link has
+// detached, whether by Close or by the peer, session or connection
+// ending it. The channel is closed exactly once.
+func (s *Sender) Closed() <-chan struct{} {
+	return s.link.done
+}
+
+// Err returns the error that ended the Sender's link, or nil if
+// the Closed channel hasn't been closed yet. ErrLinkClosed is
+// returned after Close.
+func (s *Sender) Err() error {
+	select {
+	case <-s.link.done:
+		return s.link.err
+	default:
+		return nil
+	}
+}
+
 // Close closes the Sender and AMQP link.
 func (s *Sender) Close(ctx context.Context) error {
 	return s.link.Close(ctx)
 }
+
+// Detach detaches the Sender's link without closing it.
+//
+// Unlike Close, the peer keeps the state of a durable target so the
+// link can be resumed by creating a new Sender with the same LinkName
+// and target options.
+//
+// The Sender can't be used after Detach. If ctx expires while waiting
+// for the server's response, ctx.Err() is returned.
+func (s *Sender) Detach(ctx context.Context) error {
+	return s.link.Detach(ctx)
+}
@@ -0,0 +1,1149 @@
+package amqp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// makeSender returns a Sender whose transfers are consumed by a goroutine
+// standing in for the link and session muxes. Done channels are closed as
+// they would be once connWriter has written the final frame.
+//
+// Close s.link.done to stop the goroutine.
+func makeSender(mode SenderSettleMode) *Sender {
+	l := &link{
+		transfers:        make(chan performTransfer),
+		done:             make(chan struct{}),
+		senderSettleMode: &mode,
+		session: &Session{
+			conn: &conn{peerMaxFrameSize: DefaultMaxFrameSize},
+		},
+	}
+	go func() {
+		for {
+			select {
+			case fr := <-l.transfers:
+				if fr.done != nil {
+					close(fr.done)
+				}
+			case <-l.done:
+				return
+			}
+		}
+	}()
+	return &Sender{link: l}
+}
+
+func TestSenderSendFireAndForget(t *testing.T) {
+	s := makeSender(ModeSettled)
+	defer close(s.link.done)
+
+	err := s.SendFireAndForget(context.Background(), NewMessage([]byte("hello")))
+	if err != nil {
+		t.Errorf("SendFireAndForget() error = %v", err)
+	}
+}
+
+func TestSenderSendFireAndForgetUnsettled(t *testing.T) {
+	s := makeSender(ModeUnsettled)
+	defer close(s.link.done)
+
+	err := s.SendFireAndForget(context.Background(), NewMessage([]byte("hello")))
+	if err == nil {
+		t.Error("expected error for unsettled sender")
+	}
+
+	s = makeSender(ModeMixed)
+	defer close(s.link.done)
+
+	msg := NewMessage([]byte("hello"))
+	msg.SendSettled = boolPtr(true)
+	err = s.SendFireAndForget(context.Background(), msg)
+	if err != nil {
+		t.Errorf("SendFireAndForget() error = %v", err)
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestSenderSendSettled(t *testing.T) {
+	tests := []struct {
+		label          string
+		mode           SenderSettleMode
+		defaultSettled bool
+		settled        *bool
+		want           bool
+		wantErr        bool
+	}{
+		{label: "settled default", mode: ModeSettled, want: true},
+		{label: "settled true", mode: ModeSettled, settled: boolPtr(true), want: true},
+		{label: "settled false", mode: ModeSettled, settled: boolPtr(false), wantErr: true},
+		{label: "unsettled default", mode: ModeUnsettled, want: false},
+		{label: "unsettled true", mode: ModeUnsettled, settled: boolPtr(true), wantErr: true},
+		{label: "unsettled false", mode: ModeUnsettled, settled: boolPtr(false), want: false},
+		{label: "mixed default", mode: ModeMixed, want: false},
+		{label: "mixed true", mode: ModeMixed, settled: boolPtr(true), want: true},
+		{label: "mixed false", mode: ModeMixed, settled: boolPtr(false), want: false},
+		{label: "mixed default settled", mode: ModeMixed, defaultSettled: true, want: true},
+		{label: "mixed default settled true", mode: ModeMixed, defaultSettled: true, settled: boolPtr(true), want: true},
+		{label: "mixed default settled false", mode: ModeMixed, defaultSettled: true, settled: boolPtr(false), want: false},
+		{label: "unsettled default settled", mode: ModeUnsettled, defaultSettled: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			mode := tt.mode
+			l := &link{
+				transfers:        make(chan performTransfer, 1),
+				done:             make(chan struct{}),
+				senderSettleMode: &mode,
+				session: &Session{
+					conn: &conn{peerMaxFrameSize: DefaultMaxFrameSize},
+				},
+			}
+			defer close(l.done)
+			if err := LinkSenderDefaultSettled(tt.defaultSettled)(l); err != nil {
+				t.Fatal(err)
+			}
+			s := &Sender{link: l}
+			if got := s.SettleMode(); got != tt.mode {
+				t.Errorf("SettleMode() = %s, want %s", &got, &mode)
+			}
+
+			msg := NewMessage([]byte("hello"))
+			msg.SendSettled = tt.settled
+			_, _, err := s.send(context.Background(), msg, nil, false, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fr := <-l.transfers; fr.Settled != tt.want {
+				t.Errorf("transfer Settled = %t, want %t", fr.Settled, tt.want)
+			}
+		})
+	}
+}
+
+func TestSenderTrySend(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	l, err := newLink(sess, nil, []LinkOption{LinkSenderSettle(ModeSettled)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.rx = make(chan frameBody)
+	l.transfers = make(chan performTransfer)
+	go l.mux()
+	s := &Sender{link: l}
+
+	msg := NewMessage([]byte("hello"))
+
+	// no credit has been granted
+	start := time.Now()
+	err = s.TrySend(context.Background(), msg)
+	if err != ErrWouldBlock {
+		t.Fatalf("TrySend() error = %v, want ErrWouldBlock", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("TrySend() took %v without credit", elapsed)
+	}
+
+	// grant a single credit; the second flow is only received once
+	// the mux has applied the first
+	credit, deliveryCount := uint32(1), uint32(0)
+	for i := 0; i < 2; i++ {
+		l.rx <- &performFlow{LinkCredit: &credit, DeliveryCount: &deliveryCount}
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.TrySend(context.Background(), msg)
+	}()
+	select {
+	case tr := <-sess.txTransfer:
+		if !tr.Settled {
+			t.Error("expected settled transfer")
+		}
+		close(tr.done)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for transfer")
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("TrySend() error = %v", err)
+	}
+
+	// the credit has been consumed
+	err = s.TrySend(context.Background(), msg)
+	if err != ErrWouldBlock {
+		t.Errorf("TrySend() error = %v, want ErrWouldBlock", err)
+	}
+}
+
+func TestSenderTrySendConcurrent(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	l, err := newLink(sess, nil, []LinkOption{LinkSenderSettle(ModeSettled)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.rx = make(chan frameBody)
+	l.transfers = make(chan performTransfer)
+	l.noCredit = make(chan struct{})
+	go l.mux()
+	s := &Sender{link: l}
+
+	// the race between a transfer using the last credit and the next
+	// sender checking it is narrow, so repeat it
+	const senders = 8
+	for round := uint32(0); round < 100; round++ {
+		// grant a single credit; the second flow is only received once
+		// the mux has applied the first
+		credit, deliveryCount := uint32(1), round
+		for i := 0; i < 2; i++ {
+			l.rx <- &performFlow{LinkCredit: &credit, DeliveryCount: &deliveryCount}
+		}
+
+		// only one of the senders gets the credit, the others
+		// mustn't block on the transfer
+		start := make(chan struct{})
+		errs := make(chan error, senders)
+		for i := 0; i < senders; i++ {
+			go func() {
+				<-start
+				_, _, err := s.send(context.Background(), NewMessage([]byte("hello")), nil, true, true)
+				errs <- err
+			}()
+		}
+		close(start)
+		select {
+		case <-sess.txTransfer:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("round %d: timed out waiting for transfer", round)
+		}
+
+		var sent int
+		for i := 0; i < senders; i++ {
+			select {
+			case err := <-errs:
+				switch err {
+				case nil:
+					sent++
+				case ErrWouldBlock:
+				default:
+					t.Fatalf("round %d: send() error = %v", round, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("round %d: %d senders blocked without credit", round, senders-i)
+			}
+		}
+		if sent != 1 {
+			t.Fatalf("round %d: %d messages sent with one credit", round, sent)
+		}
+	}
+}
+
+func TestSenderClosed(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	// stand in for the session mux
+	go func() {
+		for {
+			select {
+			case <-sess.tx:
+			case l := <-sess.deallocateHandle:
+				close(l.rx)
+			case <-sess.done:
+				return
+			}
+		}
+	}()
+
+	detached := make(chan error, 2)
+	l, err := newLink(sess, nil, []LinkOption{
+		LinkOnDetach(func(err error) { detached <- err }),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.rx = make(chan frameBody)
+	l.transfers = make(chan performTransfer)
+	go l.mux()
+	s := &Sender{link: l}
+
+	select {
+	case <-s.Closed():
+		t.Fatal("Closed() channel closed while attached")
+	default:
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf("Err() = %v while attached", err)
+	}
+
+	remoteErr := &Error{Condition: ErrorResourceDeleted, Description: "queue deleted"}
+	l.rx <- &performDetach{Handle: l.handle, Closed: true, Error: remoteErr}
+
+	select {
+	case <-s.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Closed()")
+	}
+	err = s.Err()
+	if err == nil || !strings.Contains(err.Error(), "queue deleted") {
+		t.Errorf("Err() = %v, want detach error", err)
+	}
+	select {
+	case got := <-detached:
+		if got != err {
+			t.Errorf("LinkOnDetach called with %v, want %v", got, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for LinkOnDetach")
+	}
+	if len(detached) != 0 {
+		t.Error("LinkOnDetach called more than once")
+	}
+}
+
+func BenchmarkSenderSendSettled(b *testing.B) {
+	s := makeSender(ModeSettled)
+	defer close(s.link.done)
+
+	msg := NewMessage([]byte("hello"))
+	ctx := context.Background()
+
+	b.Run("Send", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := s.Send(ctx, msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("SendFireAndForget", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := s.SendFireAndForget(ctx, msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSenderSendConcurrent(t *testing.T) {
+	mode := ModeUnsettled
+	l := &link{
+		transfers:        make(chan performTransfer),
+		done:             make(chan struct{}),
+		senderSettleMode: &mode,
+		session: &Session{
+			conn: &conn{peerMaxFrameSize: DefaultMaxFrameSize},
+		},
+	}
+	defer close(l.done)
+	s := &Sender{link: l}
+
+	// settle each transfer after a delay, checking its buffers weren't
+	// reused by another send while the transfer was outstanding
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case fr := <-l.transfers:
+				tag := string(fr.DeliveryTag)
+				payload := string(fr.Payload)
+				go func() {
+					time.Sleep(time.Millisecond)
+					if string(fr.DeliveryTag) != tag || string(fr.Payload) != payload {
+						select {
+						case errs <- fmt.Errorf("transfer %x modified before settlement", tag):
+						default:
+						}
+					}
+					fr.done <- &stateAccepted{}
+				}()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				msg := NewMessage([]byte(fmt.Sprintf("message %d-%d", i, j)))
+				if err := s.Send(context.Background(), msg); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	if n := len(s.sendBufs); n == 0 || n > sendBufferMaxFree {
+		t.Errorf("%d free send buffers, want 1-%d", n, sendBufferMaxFree)
+	}
+}
+
+func TestSenderSendRetry(t *testing.T) {
+	tests := []struct {
+		label        string
+		rejection    ErrorCondition
+		wantAttempts int
+		wantErr      bool
+	}{
+		{
+			label:        "retryable",
+			rejection:    ErrorResourceLimitExceeded,
+			wantAttempts: 2,
+		},
+		{
+			label:        "not retryable",
+			rejection:    ErrorNotAllowed,
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			l, err := newLink(nil, nil, []LinkOption{
+				LinkSenderSettle(ModeUnsettled),
+				LinkSenderRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.transfers = make(chan performTransfer)
+			l.done = make(chan struct{})
+			defer close(l.done)
+			l.session = &Session{
+				conn: &conn{peerMaxFrameSize: DefaultMaxFrameSize, clock: realClock{}},
+			}
+			s := &Sender{link: l}
+
+			// reject the first transfer, accept any others
+			tags := make(chan []byte, 3)
+			go func() {
+				for {
+					select {
+					case fr := <-l.transfers:
+						tags <- append([]byte(nil), fr.DeliveryTag...)
+						var state deliveryState = &stateAccepted{}
+						if len(tags) == 1 {
+							state = &stateRejected{Error: &Error{Condition: tt.rejection}}
+						}
+						fr.done <- state
+					case <-l.done:
+						return
+					}
+				}
+			}()
+
+			err = s.Send(context.Background(), NewMessage([]byte("hello")))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if len(tags) != tt.wantAttempts {
+				t.Fatalf("%d attempts, want %d", len(tags), tt.wantAttempts)
+			}
+			first := <-tags
+			for i := 1; i < tt.wantAttempts; i++ {
+				if tag := <-tags; !bytes.Equal(tag, first) {
+					t.Errorf("retry delivery tag %x, want %x", tag, first)
+				}
+			}
+		})
+	}
+}
+
+func TestSenderRequireAccepted(t *testing.T) {
+	modified := &stateModified{
+		DeliveryFailed:     true,
+		MessageAnnotations: Annotations{"x-opt-reason": "busy"},
+	}
+	tests := []struct {
+		label   string
+		state   deliveryState
+		require bool
+		wantErr *OutcomeError
+	}{
+		{label: "accepted", state: &stateAccepted{}, require: true},
+		{
+			label:   "released",
+			state:   &stateReleased{},
+			require: true,
+			wantErr: &OutcomeError{Outcome: OutcomeReleased},
+		},
+		{
+			label:   "modified",
+			state:   modified,
+			require: true,
+			wantErr: &OutcomeError{
+				Outcome:            OutcomeModified,
+				DeliveryFailed:     true,
+				MessageAnnotations: Annotations{"x-opt-reason": "busy"},
+			},
+		},
+		{label: "released not required", state: &stateReleased{}},
+		{label: "modified not required", state: modified},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			l, err := newLink(nil, nil, []LinkOption{
+				LinkSenderSettle(ModeUnsettled),
+				LinkSenderRequireAccepted(tt.require),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.transfers = make(chan performTransfer)
+			l.done = make(chan struct{})
+			defer close(l.done)
+			l.session = &Session{
+				conn: &conn{peerMaxFrameSize: DefaultMaxFrameSize},
+			}
+			s := &Sender{link: l}
+
+			go func() {
+				select {
+				case fr := <-l.transfers:
+					fr.done <- tt.state
+				case <-l.done:
+				}
+			}()
+
+			err = s.Send(context.Background(), NewMessage([]byte("hello")))
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Send() error = %v", err)
+				}
+				return
+			}
+			oerr, ok := err.(*OutcomeError)
+			if !ok {
+				t.Fatalf("Send() error = %#v, want *OutcomeError", err)
+			}
+			if !testEqual(oerr, tt.wantErr) {
+				t.Errorf("unexpected error:\n%s", testDiff(oerr, tt.wantErr))
+			}
+		})
+	}
+
+	_, err := newLink(nil, &Receiver{}, []LinkOption{LinkSenderRequireAccepted(true)})
+	if err == nil {
+		t.Error("expected error using LinkSenderRequireAccepted on a Receiver")
+	}
+}
+
+func TestSenderSendRaw(t *testing.T) {
+	msg := NewMessage([]byte("forward me unchanged"))
+	msg.Properties = &MessageProperties{MessageID: "id-1", To: "queue"}
+	msg.ApplicationProperties = map[string]interface{}{"hop": int64(1)}
+	payload, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// small frames to split the payload across transfers
+	mode := ModeUnsettled
+	l := &link{
+		transfers:        make(chan performTransfer),
+		done:             make(chan struct{}),
+		senderSettleMode: &mode,
+		session: &Session{
+			conn: &conn{peerMaxFrameSize: maxTransferFrameHeader + 16},
+		},
+	}
+	defer close(l.done)
+	s := &Sender{link: l}
+
+	frames := make(chan performTransfer, len(payload))
+	go func() {
+		for {
+			select {
+			case fr := <-l.transfers:
+				frames <- fr
+				if !fr.More {
+					fr.done <- &stateAccepted{}
+				}
+			case <-l.done:
+				return
+			}
+		}
+	}()
+
+	if err := s.SendRaw(context.Background(), payload); err != nil {
+		t.Fatalf("SendRaw() error = %v", err)
+	}
+	close(frames)
+
+	var forwarded []byte
+	var n int
+	for fr := range frames {
+		if n == 0 && len(fr.DeliveryTag) == 0 {
+			t.Error("first transfer has no delivery tag")
+		}
+		if fr.Settled {
+			t.Error("unexpected settled transfer")
+		}
+		forwarded = append(forwarded, fr.Payload...)
+		n++
+	}
+	if n < 2 {
+		t.Errorf("payload sent in %d transfers, want it split", n)
+	}
+	if !bytes.Equal(forwarded, payload) {
+		t.Errorf("forwarded payload doesn't match:\n got % x\nwant % x", forwarded, payload)
+	}
+
+	if err := s.SendRaw(context.Background(), nil); err == nil {
+		t.Error("expected error sending empty payload")
+	}
+}
+
+func BenchmarkSenderSendConcurrent(b *testing.B) {
+	s := makeSender(ModeSettled)
+	defer close(s.link.done)
+
+	msg := NewMessage([]byte("hello"))
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := s.Send(ctx, msg); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestSenderCredit(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	l, err := newLink(sess, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.rx = make(chan frameBody)
+	l.transfers = make(chan performTransfer)
+	go l.mux()
+	s := &Sender{link: l}
+
+	if got := s.Credit(); got != 0 {
+		t.Errorf("Credit() = %d before any flow, want 0", got)
+	}
+
+	// each flow is only received once the mux has applied the previous one
+	deliveryCount := uint32(0)
+	for _, credit := range []uint32{5, 3, 3} {
+		credit := credit
+		l.rx <- &performFlow{LinkCredit: &credit, DeliveryCount: &deliveryCount}
+	}
+	if got := s.Credit(); got != 3 {
+		t.Errorf("Credit() = %d, want 3", got)
+	}
+}
+
+func TestSenderRemoteTarget(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	// stand in for the session mux and the peer, the peer
+	// drops the requested durability and sets its own expiry policy
+	go func() {
+		l := <-sess.allocateHandle
+		l.rx <- nil
+		<-c.txFrame // attach
+		l.rx <- &performAttach{
+			Name:   l.key.name,
+			Role:   roleReceiver,
+			Source: &source{Address: "local"},
+			Target: &target{
+				Address:      "queue",
+				Durable:      DurabilityNone,
+				ExpiryPolicy: ExpiryLinkDetach,
+				Capabilities: multiSymbol{"queue"},
+			},
+		}
+	}()
+
+	l, err := attachLink(sess, nil, []LinkOption{
+		LinkTargetAddress("queue"),
+		LinkTargetDurability(DurabilityUnsettledState),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Sender{link: l}
+
+	wantTarget := &Target{
+		Address:      "queue",
+		ExpiryPolicy: ExpiryLinkDetach,
+		Capabilities: []string{"queue"},
+	}
+	if got := s.Target(); !testEqual(got, wantTarget) {
+		t.Error(testDiff(got, wantTarget))
+	}
+	wantSource := &Source{Address: "local", ExpiryPolicy: ExpirySessionEnd}
+	if got := s.Source(); !testEqual(got, wantSource) {
+		t.Error(testDiff(got, wantSource))
+	}
+}
+
+func TestLinkSettlementStoreSender(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	store := new(recordingStore)
+	l, err := newLink(sess, nil, []LinkOption{LinkSettlementStore(store)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode := ModeMixed
+	l.senderSettleMode = &mode
+	l.rx = make(chan frameBody)
+	l.transfers = make(chan performTransfer)
+	go l.mux()
+	s := &Sender{link: l}
+
+	credit, deliveryCount := uint32(2), uint32(0)
+	l.rx <- &performFlow{LinkCredit: &credit, DeliveryCount: &deliveryCount}
+
+	for _, settled := range []bool{false, true} {
+		msg := NewMessage([]byte("store"))
+		msg.DeliveryTag = []byte(fmt.Sprintf("settled-%t", settled))
+		msg.SendSettled = boolPtr(settled)
+		errs := make(chan error, 1)
+		go func() {
+			_, _, err := s.send(context.Background(), msg, nil, false, false)
+			errs <- err
+		}()
+		select {
+		case <-sess.txTransfer:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for transfer")
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l.rx <- &performDisposition{
+		Role:    roleReceiver,
+		First:   1,
+		Last:    uint32Ptr(2),
+		Settled: true,
+		State:   &stateAccepted{},
+	}
+	// the mux has handled the disposition once it takes the next frame
+	l.rx <- &performFlow{LinkCredit: &credit, DeliveryCount: &deliveryCount}
+
+	want := []string{"unsettled settled-false ", "settled settled-false"}
+	if got := store.Calls(); !testEqual(got, want) {
+		t.Error(testDiff(got, want))
+	}
+}
+
+func TestSenderSourceFilter(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	attaches := make(chan *performAttach, 1)
+	go func() {
+		l := <-sess.allocateHandle
+		l.rx <- nil
+		fr := <-c.txFrame
+		attach := fr.body.(*performAttach)
+		attaches <- attach
+		l.rx <- &performAttach{
+			Name:   l.key.name,
+			Role:   roleReceiver,
+			Source: attach.Source,
+			Target: attach.Target,
+		}
+	}()
+
+	_, err = attachLink(sess, nil, []LinkOption{
+		LinkTargetAddress("stream"),
+		LinkSourceAddress("producer"),
+		LinkSourceCapabilities("stream"),
+		LinkSourceFilter("rabbitmq:stream-filter", 0, "blue"),
+		LinkSelectorFilter("color = 'blue'"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attach := <-attaches
+	if attach.Role != roleSender {
+		t.Fatalf("attach Role = %v, want sender", attach.Role)
+	}
+	want := &source{
+		Address:      "producer",
+		Capabilities: multiSymbol{"stream"},
+		Filter: filter{
+			"rabbitmq:stream-filter": &DescribedType{
+				Descriptor: symbol("rabbitmq:stream-filter"),
+				Value:      "blue",
+			},
+			"apache.org:selector-filter:string": &DescribedType{
+				Descriptor: uint64(0x0000468C00000004),
+				Value:      "color = 'blue'",
+			},
+		},
+	}
+	if !testEqual(attach.Source, want) {
+		t.Error(testDiff(attach.Source, want))
+	}
+
+	// the filter set is marshaled into the attach source
+	var buf buffer
+	if err := attach.marshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded performAttach
+	if err := decoded.unmarshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.Source.Filter["rabbitmq:stream-filter"]; got == nil || got.Value != "blue" {
+		t.Errorf("decoded filter = %v, want value blue", got)
+	}
+}
+
+func TestSenderAnonymousTarget(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(c.done)
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	attaches := make(chan *performAttach, 1)
+	go func() {
+		l := <-sess.allocateHandle
+		l.rx <- nil
+		fr := <-c.txFrame
+		attach := fr.body.(*performAttach)
+		attaches <- attach
+		l.rx <- &performAttach{
+			Name:   l.key.name,
+			Role:   roleReceiver,
+			Source: attach.Source,
+			Target: attach.Target,
+		}
+	}()
+
+	l, err := attachLink(sess, nil, []LinkOption{LinkAnonymousTarget()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Sender{link: l}
+
+	// the target is sent with a null address
+	attach := <-attaches
+	var buf buffer
+	if err := attach.marshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded performAttach
+	if err := decoded.unmarshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Target == nil || decoded.Target.Address != "" {
+		t.Fatalf("attach Target = %+v, want target with null address", decoded.Target)
+	}
+
+	if _, _, err := s.send(context.Background(), NewMessage([]byte("no to")), nil, false, false); err == nil {
+		t.Error("expected error sending a message without To")
+	}
+
+	credit, deliveryCount := uint32(1), uint32(0)
+	l.rx <- &performFlow{LinkCredit: &credit, DeliveryCount: &deliveryCount}
+
+	msg := NewMessage([]byte("routed"))
+	msg.Properties = &MessageProperties{To: "queue/orders"}
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := s.send(context.Background(), msg, nil, false, false)
+		errs <- err
+	}()
+	var fr *performTransfer
+	select {
+	case fr = <-sess.txTransfer:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for transfer")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	var sent Message
+	if err := sent.unmarshal(&buffer{b: fr.Payload}); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Properties == nil || sent.Properties.To != "queue/orders" {
+		t.Errorf("sent Properties = %+v, want To queue/orders", sent.Properties)
+	}
+}
+
+func TestLinkAnonymousTargetInvalid(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(c, 0)
+
+	for i, opts := range [][]LinkOption{
+		{LinkAnonymousTarget(), LinkTargetAddress("queue")},
+		{LinkAnonymousTarget(), LinkAddressDynamic()},
+	} {
+		if _, err := newLink(sess, nil, opts); err == nil {
+			t.Errorf("case %d: expected error", i)
+		}
+	}
+	if _, err := newLink(sess, new(Receiver), []LinkOption{LinkAnonymousTarget()}); err == nil {
+		t.Error("expected error for Receiver")
+	}
+}
+
+func TestSenderDrain(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	l, err := newLink(sess, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode := ModeSettled
+	l.senderSettleMode = &mode
+	l.rx = make(chan frameBody)
+	// buffered so a send is queued before the mux has credit to take it
+	l.transfers = make(chan performTransfer, 1)
+	go l.mux()
+	s := &Sender{link: l}
+
+	// a send is waiting when the drain arrives
+	if _, _, err := s.send(context.Background(), NewMessage([]byte("drain")), nil, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	credit, deliveryCount, available := uint32(3), uint32(0), uint32(7)
+	l.rx <- &performFlow{
+		LinkCredit:    &credit,
+		DeliveryCount: &deliveryCount,
+		Available:     &available,
+		Drain:         true,
+	}
+
+	// the waiting transfer is sent before the credit is returned
+	select {
+	case <-sess.txTransfer:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for transfer")
+	}
+
+	var fr frame
+	select {
+	case fr = <-c.txFrame:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for flow")
+	}
+	flow, ok := fr.body.(*performFlow)
+	if !ok {
+		t.Fatalf("sent %T, want *performFlow", fr.body)
+	}
+	if !flow.Drain || *flow.DeliveryCount != 3 || *flow.LinkCredit != 0 {
+		t.Errorf("sent %s, want drain with delivery count 3 and no credit", flow)
+	}
+
+	// the mux has handled the flow once it takes the next frame
+	l.rx <- &performFlow{LinkCredit: &credit, DeliveryCount: flow.DeliveryCount}
+	if got := s.Available(); got != available {
+		t.Errorf("Available() = %d, want %d", got, available)
+	}
+}
+
+func TestSenderThrottled(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	l, err := newLink(sess, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.rx = make(chan frameBody)
+	l.transfers = make(chan performTransfer)
+	go l.mux()
+	s := &Sender{link: l}
+
+	credit, deliveryCount := uint32(2), uint32(0)
+	l.rx <- &performFlow{LinkCredit: &credit, DeliveryCount: &deliveryCount}
+
+	for i := 0; i < 2; i++ {
+		errs := make(chan error, 1)
+		go func() {
+			_, _, err := s.send(context.Background(), NewMessage([]byte("throttled")), nil, false, false)
+			errs <- err
+		}()
+		var tr *performTransfer
+		select {
+		case tr = <-sess.txTransfer:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for transfer %d", i)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		// the peer throttles the sender, which keeps the link
+		l.rx <- &performDisposition{
+			Role:    roleReceiver,
+			First:   *tr.DeliveryID,
+			Settled: true,
+			State: &stateRejected{
+				Error: &Error{Condition: ErrorTransferLimitExceeded},
+			},
+		}
+	}
+
+	// the mux has handled the disposition once it takes the next frame
+	l.rx <- &performFlow{LinkCredit: &credit, DeliveryCount: &credit}
+	select {
+	case <-l.done:
+		t.Fatalf("link detached: %v", l.err)
+	default:
+	}
+}
+
+func TestSenderUnexpectedFrame(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession(c, 0)
+	defer close(sess.done)
+
+	var frames []FrameKind
+	l, err := newLink(sess, nil, []LinkOption{
+		LinkOnUnexpectedFrame(func(kind FrameKind) error {
+			frames = append(frames, kind)
+			if len(frames) > 1 {
+				return fmt.Errorf("stray transfer")
+			}
+			return nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode := ModeSettled
+	l.senderSettleMode = &mode
+	l.rx = make(chan frameBody)
+	l.transfers = make(chan performTransfer)
+	go l.mux()
+	s := &Sender{link: l}
+
+	// the first stray transfer is ignored and the link keeps working
+	l.rx <- &performTransfer{Handle: 0, DeliveryID: uint32Ptr(0)}
+	credit, deliveryCount := uint32(1), uint32(0)
+	l.rx <- &performFlow{LinkCredit: &credit, DeliveryCount: &deliveryCount}
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := s.send(context.Background(), NewMessage([]byte("hello")), nil, true, false)
+		errs <- err
+	}()
+	select {
+	case <-sess.txTransfer:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for transfer after a stray frame")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0] != FrameTransfer {
+		t.Errorf("handler called with %q, want one transfer", frames)
+	}
+
+	// the second is refused by the handler, detaching the link
+	l.rx <- &performTransfer{Handle: 0, DeliveryID: uint32Ptr(1)}
+	var fr frameBody
+	select {
+	case fr = <-sess.tx:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for detach")
+	}
+	detach, ok := fr.(*performDetach)
+	if !ok {
+		t.Fatalf("sent %T, want *performDetach", fr)
+	}
+	want := &Error{Condition: ErrorNotAllowed, Description: "stray transfer"}
+	if !testEqual(detach.Error, want) {
+		t.Error(testDiff(detach.Error, want))
+	}
+}
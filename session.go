@@ -19,12 +19,16 @@ type Session struct {
 	txTransfer    chan *performTransfer // transfer frames to be sent; session must track disposition
 
 	// flow control
-	incomingWindow uint32
-	outgoingWindow uint32
+	incomingWindow    uint32
+	outgoingWindow    uint32
+	maxIncomingFrames uint32 // max transfer frames buffered for links, 0 delivers them synchronously
+
+	linkCredit uint32 // default link credit for new receivers
 
 	handleMax        uint32
-	allocateHandle   chan *link // link handles are allocated by sending a link on this channel, nil is sent on link.rx once allocated
-	deallocateHandle chan *link // link handles are deallocated by sending a link on this channel
+	allocateHandle   chan *link        // link handles are allocated by sending a link on this channel, nil is sent on link.rx once allocated
+	deallocateHandle chan *link        // link handles are deallocated by sending a link on this channel
+	attachedLinks    chan chan []*link // the links with allocated handles are sent on channels received here
 
 	nextDeliveryID uint32 // atomically accessed sequence for deliveryIDs
 
@@ -45,8 +49,10 @@ func newSession(c *conn, channel uint16) *Session {
 		incomingWindow:   DefaultWindow,
 		outgoingWindow:   DefaultWindow,
 		handleMax:        DefaultMaxLinks - 1,
+		linkCredit:       DefaultLinkCredit,
 		allocateHandle:   make(chan *link),
 		deallocateHandle: make(chan *link),
+		attachedLinks:    make(chan chan []*link),
 		close:            make(chan struct{}),
 		done:             make(chan struct{}),
 	}
@@ -69,6 +75,64 @@ func (s *Session) Close(ctx context.Context) error {
 	return s.err
 }
 
+// Drain closes the links attached on the session, waiting for the
+// server to confirm each detach, then closes the session as Close does,
+// so the server sees every link closed before the session ends.
+//
+// Links that have already detached are skipped. The first error closing
+// a link or the session is returned. If ctx expires, ctx.Err() is
+// returned and the session is left open.
+func (s *Session) Drain(ctx context.Context) error {
+	resp := make(chan []*link, 1)
+	select {
+	case s.attachedLinks <- resp:
+	case <-s.done:
+		return s.Close(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	links := <-resp
+
+	errs := make(chan error, len(links))
+	for _, l := range links {
+		go func(l *link) {
+			select {
+			case <-l.done:
+				errs <- nil
+			default:
+				errs <- l.Close(ctx)
+			}
+		}(l)
+	}
+	var err error
+	for range links {
+		if lerr := <-errs; err == nil {
+			err = lerr
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if serr := s.Close(ctx); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// incomingWindowFor returns the incoming-window to advertise to the peer
+// while buffered transfer frames are waiting to be delivered to links.
+func (s *Session) incomingWindowFor(buffered uint32) uint32 {
+	if s.maxIncomingFrames == 0 {
+		return s.incomingWindow
+	}
+	free := s.maxIncomingFrames - buffered
+	if free < s.incomingWindow {
+		return free
+	}
+	return s.incomingWindow
+}
+
 // txFrame sends a frame to the connWriter
 func (s *Session) txFrame(p frameBody, done chan deliveryState) error {
 	return s.conn.wantWriteFrame(frame{
@@ -84,7 +148,7 @@ func (s *Session) NewReceiver(opts ...LinkOption) (*Receiver, error) {
 	r := &Receiver{
 		batching:    DefaultLinkBatching,
 		batchMaxAge: DefaultLinkBatchMaxAge,
-		maxCredit:   DefaultLinkCredit,
+		maxCredit:   s.linkCredit,
 	}
 
 	l, err := attachLink(s, r, opts)
@@ -150,8 +214,73 @@ func (s *Session) mux(remoteBegin *performBegin) {
 		nextIncomingID       = remoteBegin.NextOutgoingID
 		remoteIncomingWindow = remoteBegin.IncomingWindow
 		remoteOutgoingWindow = remoteBegin.OutgoingWindow
+		incomingWindow       = s.incomingWindowFor(0) // transfers the peer may send before the next flow, as advertised in begin
+
+		// frames for links that weren't ready to receive them,
+		// only used when maxIncomingFrames is set
+		pending          []linkFrame
+		pendingByLink    = make(map[*link]int)
+		pendingTransfers uint32
 	)
 
+	// frameToLink sends fr to l. When maxIncomingFrames is set, fr is
+	// buffered rather than blocking the mux if l isn't ready for it.
+	frameToLink := func(l *link, fr frameBody) {
+		if s.maxIncomingFrames == 0 {
+			s.muxFrameToLink(l, fr)
+			return
+		}
+		// frames must be buffered behind any already buffered for l
+		if pendingByLink[l] == 0 {
+			select {
+			case l.rx <- fr:
+				return
+			case <-l.done:
+				return
+			default:
+			}
+		}
+		pending = append(pending, linkFrame{link: l, body: fr})
+		pendingByLink[l]++
+		if _, ok := fr.(*performTransfer); ok {
+			pendingTransfers++
+		}
+	}
+
+	// updateIncomingWindow sends a flow to replenish the peer's view of
+	// the incoming-window once half of it has been consumed.
+	updateIncomingWindow := func() {
+		window := s.incomingWindowFor(pendingTransfers)
+		if incomingWindow >= (window+1)/2 {
+			return
+		}
+		nID := nextIncomingID
+		flow := &performFlow{
+			NextIncomingID: &nID,
+			IncomingWindow: window,
+			NextOutgoingID: nextOutgoingID,
+			OutgoingWindow: s.outgoingWindow,
+		}
+		s.debug(1, "TX(Session): %s", flow)
+		s.txFrame(flow, nil)
+		incomingWindow = window
+	}
+
+	// popPending removes the first buffered frame after
+	// it has been delivered or its link has detached.
+	popPending := func() {
+		p := pending[0]
+		pending[0] = linkFrame{}
+		pending = pending[1:]
+		if pendingByLink[p.link]--; pendingByLink[p.link] == 0 {
+			delete(pendingByLink, p.link)
+		}
+		if _, ok := p.body.(*performTransfer); ok {
+			pendingTransfers--
+			updateIncomingWindow()
+		}
+	}
+
 	for {
 		txTransfer := s.txTransfer
 		// disable txTransfer if flow control windows have been exceeded
@@ -159,7 +288,26 @@ func (s *Session) mux(remoteBegin *performBegin) {
 			txTransfer = nil
 		}
 
+		// enable delivery of the first buffered frame
+		var (
+			pendingRx   chan frameBody
+			pendingDone chan struct{}
+			pendingBody frameBody
+		)
+		if len(pending) > 0 {
+			pendingRx = pending[0].link.rx
+			pendingDone = pending[0].link.done
+			pendingBody = pending[0].body
+		}
+
 		select {
+		case pendingRx <- pendingBody:
+			popPending()
+
+		// link detached with frames still buffered, discard them
+		case <-pendingDone:
+			popPending()
+
 		// conn has completed, exit
 		case <-s.conn.done:
 			s.err = s.conn.getErr()
@@ -194,19 +342,56 @@ func (s *Session) mux(remoteBegin *performBegin) {
 				continue
 			}
 
-			next, ok := handles.next()
-			if !ok {
-				l.err = errorErrorf("reached session handle max (%d)", s.handleMax)
-				l.rx <- nil
-				continue
+			var next uint32
+			if l.wantHandle != nil {
+				next = *l.wantHandle
+				if next > s.handleMax {
+					l.err = errorErrorf("handle %d exceeds session handle max (%d)", next, s.handleMax)
+					l.rx <- nil
+					continue
+				}
+				if handles.contains(next) {
+					l.err = errorErrorf("handle %d is already in use", next)
+					l.rx <- nil
+					continue
+				}
+				handles.add(next)
+			} else {
+				var ok bool
+				next, ok = handles.next()
+				if !ok {
+					l.err = errorErrorf("reached session handle max (%d)", s.handleMax)
+					l.rx <- nil
+					continue
+				}
 			}
 
 			l.handle = next       // allocate handle to the link
 			linksByKey[l.key] = l // add to mapping
 			l.rx <- nil           // send nil on channel to indicate allocation complete
 
+		// links are being closed by Drain
+		case resp := <-s.attachedLinks:
+			attached := make([]*link, 0, len(linksByKey))
+			for _, l := range linksByKey {
+				attached = append(attached, l)
+			}
+			resp <- attached
+
 		// handle deallocation request
 		case l := <-s.deallocateHandle:
+			if pendingByLink[l] > 0 {
+				kept := pending[:0]
+				for _, p := range pending {
+					if p.link != l {
+						kept = append(kept, p)
+					} else if _, ok := p.body.(*performTransfer); ok {
+						pendingTransfers--
+					}
+				}
+				pending = kept
+				delete(pendingByLink, l)
+			}
 			delete(links, l.remoteHandle)
 			delete(deliveryIDByHandle, l.handle)
 			delete(linksByKey, l.key)
@@ -215,7 +400,7 @@ func (s *Session) mux(remoteBegin *performBegin) {
 
 		// incoming frame for link
 		case fr := <-s.rx:
-			debug(1, "RX(Session): %s", fr.body)
+			s.debug(1, "RX(Session): %s", fr.body)
 
 			switch body := fr.body.(type) {
 			// Disposition frames can reference transfers from more than one
@@ -256,7 +441,7 @@ func (s *Session) mux(remoteBegin *performBegin) {
 						continue
 					}
 
-					s.muxFrameToLink(link, fr.body)
+					frameToLink(link, fr.body)
 				}
 				continue
 			case *performFlow:
@@ -289,8 +474,18 @@ func (s *Session) mux(remoteBegin *performBegin) {
 				// If the next-incoming-id field of the flow frame is not set, then remote-incoming-window is computed as follows:
 				//
 				// initial-outgoing-id(endpoint) + incoming-window(flow) - next-outgoing-id(endpoint)"
-				remoteIncomingWindow = body.IncomingWindow - nextOutgoingID
-				remoteIncomingWindow += *body.NextIncomingID
+				//
+				// Transfers sent after the peer sent the flow are already in
+				// its window. If they fill it the window is closed, rather
+				// than wrapping around and allowing the window to be exceeded.
+				remoteIncomingWindow = 0
+				inFlight := nextOutgoingID - *body.NextIncomingID
+				if int32(inFlight) < 0 {
+					inFlight = 0
+				}
+				if inFlight < body.IncomingWindow {
+					remoteIncomingWindow = body.IncomingWindow - inFlight
+				}
 
 				// Send to link if handle is set
 				if body.Handle != nil {
@@ -299,7 +494,7 @@ func (s *Session) mux(remoteBegin *performBegin) {
 						continue
 					}
 
-					s.muxFrameToLink(link, fr.body)
+					frameToLink(link, fr.body)
 					continue
 				}
 
@@ -307,12 +502,13 @@ func (s *Session) mux(remoteBegin *performBegin) {
 					niID := nextIncomingID
 					resp := &performFlow{
 						NextIncomingID: &niID,
-						IncomingWindow: s.incomingWindow,
+						IncomingWindow: s.incomingWindowFor(pendingTransfers),
 						NextOutgoingID: nextOutgoingID,
 						OutgoingWindow: s.outgoingWindow,
 					}
-					debug(1, "TX: %s", resp)
+					s.debug(1, "TX: %s", resp)
 					s.txFrame(resp, nil)
+					incomingWindow = resp.IncomingWindow
 				}
 
 			case *performAttach:
@@ -321,15 +517,23 @@ func (s *Session) mux(remoteBegin *performBegin) {
 				// attach frame.
 				//
 				// Note body.Role is the remote peer's role, we reverse for the local key.
+				//
+				// An attach for a link that wasn't requested locally can't be
+				// answered, end the session rather than dropping it so callers
+				// waiting on the session don't hang.
 				link, linkOk := linksByKey[linkKey{name: body.Name, role: !body.Role}]
 				if !linkOk {
-					break
+					s.muxEndWithError(&Error{
+						Condition:   ErrorNotAllowed,
+						Description: fmt.Sprintf("received attach for unknown link %q", body.Name),
+					})
+					return
 				}
 
 				link.remoteHandle = body.Handle
 				links[link.remoteHandle] = link
 
-				s.muxFrameToLink(link, fr.body)
+				frameToLink(link, fr.body)
 
 			case *performTransfer:
 				// "Upon receiving a transfer, the receiving endpoint will
@@ -339,50 +543,60 @@ func (s *Session) mux(remoteBegin *performBegin) {
 				// (depending on policy) decrement its incoming-window."
 				nextIncomingID++
 				remoteOutgoingWindow--
+				if incomingWindow > 0 {
+					incomingWindow--
+				}
 				link, ok := links[body.Handle]
 				if !ok {
 					continue
 				}
 
-				select {
-				case <-s.conn.done:
-				case link.rx <- fr.body:
+				frameToLink(link, fr.body)
+
+				// the peer must not send more transfers than the incoming-window
+				// allows, so the buffer can only overflow if it violates it
+				if s.maxIncomingFrames != 0 && pendingTransfers > s.maxIncomingFrames {
+					msg := fmt.Sprintf("received transfer exceeding incoming-window with %d frames buffered", pendingTransfers-1)
+					s.txFrame(&performEnd{
+						Error: &Error{
+							Condition:   ErrorWindowViolation,
+							Description: msg,
+						},
+					}, nil)
+					s.err = errorNew(msg)
+					return
 				}
 
 				// if this message is received unsettled and link rcv-settle-mode == second, add to handlesByRemoteDeliveryID
 				if !body.Settled && body.DeliveryID != nil && link.receiverSettleMode != nil && *link.receiverSettleMode == ModeSecond {
-					debug(1, "TX: adding handle to handlesByRemoteDeliveryID. linkCredit: %d", link.linkCredit)
+					s.debug(1, "TX: adding handle to handlesByRemoteDeliveryID. linkCredit: %d", link.linkCredit)
 					handlesByRemoteDeliveryID[*body.DeliveryID] = body.Handle
 				}
 
 				// Update peer's outgoing window if half has been consumed.
-				if remoteOutgoingWindow < s.incomingWindow/2 {
-					nID := nextIncomingID
-					flow := &performFlow{
-						NextIncomingID: &nID,
-						IncomingWindow: s.incomingWindow,
-						NextOutgoingID: nextOutgoingID,
-						OutgoingWindow: s.outgoingWindow,
-					}
-					debug(1, "TX(Session): %s", flow)
-					s.txFrame(flow, nil)
-					remoteOutgoingWindow = s.incomingWindow
-				}
+				updateIncomingWindow()
 
 			case *performDetach:
 				link, ok := links[body.Handle]
 				if !ok {
 					continue
 				}
-				s.muxFrameToLink(link, fr.body)
+				frameToLink(link, fr.body)
 
 			case *performEnd:
 				s.txFrame(&performEnd{}, nil)
-				s.err = errorErrorf("session ended by server: %s", body.Error)
+				s.err = &SessionError{RemoteError: body.Error}
 				return
 
+			// Transfer, flow and detach frames for unknown handles are
+			// ignored above as they may be in flight when a link is
+			// detached locally. Anything else is a protocol error.
 			default:
-				fmt.Printf("Unexpected frame: %s\n", body)
+				s.muxEndWithError(&Error{
+					Condition:   ErrorNotAllowed,
+					Description: fmt.Sprintf("unexpected frame on session: %s", body),
+				})
+				return
 			}
 
 		case fr := <-txTransfer:
@@ -415,7 +629,7 @@ func (s *Session) mux(remoteBegin *performBegin) {
 				fr.done = nil
 			}
 
-			debug(2, "TX(Session) - txtransfer: %s", fr)
+			s.debug(2, "TX(Session) - txtransfer: %s", fr)
 			s.txFrame(fr, fr.done)
 
 			// "Upon sending a transfer, the sending endpoint will increment
@@ -429,22 +643,36 @@ func (s *Session) mux(remoteBegin *performBegin) {
 			case *performFlow:
 				niID := nextIncomingID
 				fr.NextIncomingID = &niID
-				fr.IncomingWindow = s.incomingWindow
+				fr.IncomingWindow = s.incomingWindowFor(pendingTransfers)
 				fr.NextOutgoingID = nextOutgoingID
 				fr.OutgoingWindow = s.outgoingWindow
-				debug(1, "TX(Session) - tx: %s", fr)
+				s.debug(1, "TX(Session) - tx: %s", fr)
 				s.txFrame(fr, nil)
-				remoteOutgoingWindow = s.incomingWindow
+				incomingWindow = fr.IncomingWindow
 			case *performTransfer:
 				panic("transfer frames must use txTransfer")
 			default:
-				debug(1, "TX(Session) - default: %s", fr)
+				s.debug(1, "TX(Session) - default: %s", fr)
 				s.txFrame(fr, nil)
 			}
 		}
 	}
 }
 
+// muxEndWithError ends the session due to a protocol error
+// by the peer. It should only be called by Session.mux,
+// which must return after calling it.
+func (s *Session) muxEndWithError(e *Error) {
+	s.txFrame(&performEnd{Error: e}, nil)
+	s.err = e
+}
+
+// linkFrame is a frame buffered by Session.mux for delivery to a link.
+type linkFrame struct {
+	link *link
+	body frameBody
+}
+
 func (s *Session) muxFrameToLink(l *link, fr frameBody) {
 	select {
 	case l.rx <- fr:
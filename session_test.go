@@ -0,0 +1,548 @@
+package amqp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp/internal/frames"
+	"github.com/Azure/go-amqp/internal/testbroker"
+)
+
+func TestSessionRemoteEndError(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stand in for conn.mux and connWriter
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-c.txFrame:
+			case <-c.delSession:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	s := newSession(c, 0)
+	go s.mux(&performBegin{
+		IncomingWindow: DefaultWindow,
+		OutgoingWindow: DefaultWindow,
+		HandleMax:      DefaultMaxLinks - 1,
+	})
+
+	remoteErr := &Error{
+		Condition:   ErrorResourceLimitExceeded,
+		Description: "too many sessions",
+		Info:        map[string]interface{}{"limit": int64(10)},
+	}
+	s.rx <- frame{
+		type_:   frameTypeAMQP,
+		channel: 0,
+		body:    &performEnd{Error: remoteErr},
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for session to end")
+	}
+
+	err = s.Close(context.Background())
+	sessErr, ok := err.(*SessionError)
+	if !ok {
+		t.Fatalf("expected *SessionError, got %T: %v", err, err)
+	}
+	if !testEqual(sessErr.RemoteError, remoteErr) {
+		t.Error(testDiff(sessErr.RemoteError, remoteErr))
+	}
+	if sessErr.Unwrap() != error(sessErr.RemoteError) {
+		t.Errorf("Unwrap() = %v, want %v", sessErr.Unwrap(), sessErr.RemoteError)
+	}
+
+	// links attached to an ended session report the same error
+	_, err = s.NewSender(LinkTargetAddress("q1"))
+	if err != s.err {
+		t.Errorf("NewSender() error = %v, want %v", err, s.err)
+	}
+}
+
+func TestSessionMaxIncomingFrames(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stand in for conn.mux and connWriter, collecting sent flows
+	flows := make(chan *performFlow, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case fr := <-c.txFrame:
+				if flow, ok := fr.body.(*performFlow); ok {
+					flows <- flow
+				}
+			case <-c.delSession:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	nextFlow := func() *performFlow {
+		select {
+		case flow := <-flows:
+			return flow
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for flow")
+			return nil
+		}
+	}
+
+	s := newSession(c, 0)
+	err = SessionMaxIncomingFrames(3)(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := s.incomingWindowFor(0); w != 3 {
+		t.Fatalf("initial incoming-window = %d, want 3", w)
+	}
+	go s.mux(&performBegin{
+		IncomingWindow: DefaultWindow,
+		OutgoingWindow: DefaultWindow,
+		HandleMax:      DefaultMaxLinks - 1,
+	})
+
+	// attach a link that doesn't read its frames
+	l := &link{
+		key:  linkKey{name: "slow", role: roleReceiver},
+		rx:   make(chan frameBody),
+		done: make(chan struct{}),
+	}
+	s.allocateHandle <- l
+	<-l.rx
+	s.rx <- frame{body: &performAttach{Name: "slow", Role: roleSender, Handle: 0}}
+	<-l.rx
+
+	transfer := func(id uint32) frame {
+		return frame{body: &performTransfer{Handle: 0, DeliveryID: &id, Settled: true}}
+	}
+
+	// fill the buffer without blocking the session
+	for i := uint32(0); i < 3; i++ {
+		select {
+		case s.rx <- transfer(i):
+		case <-time.After(5 * time.Second):
+			t.Fatalf("session blocked on transfer %d", i)
+		}
+	}
+
+	// no window is left while the buffer is full
+	zero, three := uint32(0), uint32(3)
+	s.rx <- frame{body: &performFlow{
+		NextIncomingID: &zero,
+		IncomingWindow: DefaultWindow,
+		NextOutgoingID: 3,
+		OutgoingWindow: DefaultWindow,
+		Echo:           true,
+	}}
+	if flow := nextFlow(); flow.IncomingWindow != 0 {
+		t.Errorf("incoming-window = %d with full buffer, want 0", flow.IncomingWindow)
+	}
+
+	// delivering a buffered frame reopens the window
+	fr := <-l.rx
+	if tr, ok := fr.(*performTransfer); !ok || *tr.DeliveryID != 0 {
+		t.Fatalf("received %v, want transfer 0", fr)
+	}
+	flow := nextFlow()
+	if flow.IncomingWindow != 1 || *flow.NextIncomingID != three {
+		t.Errorf("flow = %v, want incoming-window 1 and next-incoming-id 3", flow)
+	}
+
+	// sending beyond the window ends the session
+	s.rx <- transfer(3)
+	s.rx <- transfer(4)
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for session to end")
+	}
+	if s.err == nil || !strings.Contains(s.err.Error(), "incoming-window") {
+		t.Errorf("unexpected session error: %v", s.err)
+	}
+}
+
+func TestSessionRemoteIncomingWindow(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stand in for conn.mux and connWriter, collecting sent transfers
+	transfers := make(chan *performTransfer, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case fr := <-c.txFrame:
+				if tr, ok := fr.body.(*performTransfer); ok {
+					transfers <- tr
+				}
+			case <-c.delSession:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	s := newSession(c, 0)
+	go s.mux(&performBegin{
+		IncomingWindow: 2,
+		OutgoingWindow: DefaultWindow,
+		HandleMax:      DefaultMaxLinks - 1,
+	})
+
+	// send reports whether the session takes the transfer
+	send := func(id uint32) bool {
+		select {
+		case s.txTransfer <- &performTransfer{Handle: 0, DeliveryID: &id, Settled: true}:
+			<-transfers
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+	flow := func(nextIncomingID, incomingWindow uint32) {
+		s.rx <- frame{body: &performFlow{
+			NextIncomingID: &nextIncomingID,
+			IncomingWindow: incomingWindow,
+			OutgoingWindow: DefaultWindow,
+		}}
+	}
+
+	for i := uint32(0); i < 2; i++ {
+		if !send(i) {
+			t.Fatalf("transfer %d blocked within the window", i)
+		}
+	}
+	if send(2) {
+		t.Fatal("transfer sent beyond the remote incoming-window")
+	}
+
+	// a flow sent before the peer received both transfers leaves
+	// no room once they're counted
+	flow(0, 1)
+	if send(2) {
+		t.Fatal("transfer sent beyond the window of a stale flow")
+	}
+	flow(1, 1)
+	if send(2) {
+		t.Fatal("transfer sent beyond the window of a stale flow")
+	}
+
+	// transfers resume once the peer opens the window
+	flow(2, 1)
+	if !send(2) {
+		t.Fatal("transfer blocked after the window was opened")
+	}
+	if send(3) {
+		t.Fatal("transfer sent beyond the remote incoming-window")
+	}
+}
+
+func TestSessionUnknownAttach(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stand in for conn.mux and connWriter, collecting sent ends
+	ends := make(chan *performEnd, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case fr := <-c.txFrame:
+				if end, ok := fr.body.(*performEnd); ok {
+					ends <- end
+				}
+			case <-c.delSession:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	s := newSession(c, 0)
+	go s.mux(&performBegin{
+		IncomingWindow: DefaultWindow,
+		OutgoingWindow: DefaultWindow,
+		HandleMax:      DefaultMaxLinks - 1,
+	})
+
+	// a caller waiting for its attach response
+	result := make(chan error, 1)
+	go func() {
+		_, err := attachLink(s, nil, []LinkOption{LinkName("wanted")})
+		result <- err
+	}()
+
+	// the peer attaches a different link
+	s.rx <- frame{body: &performAttach{Name: "other", Role: roleReceiver}}
+
+	select {
+	case err := <-result:
+		if amqpErr, ok := err.(*Error); !ok || amqpErr.Condition != ErrorNotAllowed || !strings.Contains(amqpErr.Description, `"other"`) {
+			t.Errorf("unexpected attach error: %#v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("attach hung after attach for unknown link")
+	}
+	select {
+	case end := <-ends:
+		if end.Error == nil || end.Error.Condition != ErrorNotAllowed {
+			t.Errorf("unexpected end %v", end)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for end")
+	}
+}
+
+func TestSessionDefaultLinkCredit(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSession(c, 0)
+	if err := SessionDefaultLinkCredit(25)(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// stand in for conn.mux, connWriter and the peer, answering
+	// attaches and collecting the flows receivers send
+	flows := make(chan *performFlow, 3)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case fr := <-c.txFrame:
+				switch body := fr.body.(type) {
+				case *performAttach:
+					resp := &performAttach{
+						Name:   body.Name,
+						Handle: body.Handle,
+						Role:   roleSender,
+						Source: &source{},
+					}
+					go func() { s.rx <- frame{body: resp} }()
+				case *performFlow:
+					flows <- body
+				}
+			case <-c.delSession:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	go s.mux(&performBegin{
+		IncomingWindow: DefaultWindow,
+		OutgoingWindow: DefaultWindow,
+		HandleMax:      DefaultMaxLinks - 1,
+	})
+
+	tests := []struct {
+		label string
+		opts  []LinkOption
+		want  uint32
+	}{
+		{label: "first", opts: []LinkOption{LinkName("first"), LinkSourceAddress("queue")}, want: 25},
+		{label: "second", opts: []LinkOption{LinkName("second"), LinkSourceAddress("queue")}, want: 25},
+		{label: "override", opts: []LinkOption{LinkName("override"), LinkSourceAddress("queue"), LinkCredit(5)}, want: 5},
+	}
+	for _, tt := range tests {
+		_, err := s.NewReceiver(tt.opts...)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.label, err)
+		}
+		select {
+		case flow := <-flows:
+			if *flow.LinkCredit != tt.want {
+				t.Errorf("%s: LinkCredit = %d, want %d", tt.label, *flow.LinkCredit, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for flow", tt.label)
+		}
+	}
+
+	if err := SessionDefaultLinkCredit(0)(newSession(nil, 0)); err == nil {
+		t.Error("expected error for zero credit")
+	}
+}
+
+func TestSessionLinkHandleAndDeliveryCount(t *testing.T) {
+	c, err := newConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSession(c, 0)
+	if err := SessionMaxLinks(16)(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// stand in for conn.mux, connWriter and the peer, answering
+	// attaches and collecting them as the peer decodes them
+	attaches := make(chan *performAttach, 3)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case fr := <-c.txFrame:
+				body, ok := fr.body.(*performAttach)
+				if !ok {
+					continue
+				}
+				var buf buffer
+				if err := marshal(&buf, body); err != nil {
+					panic(err)
+				}
+				decoded := new(performAttach)
+				if err := unmarshal(&buf, decoded); err != nil {
+					panic(err)
+				}
+				attaches <- decoded
+				resp := &performAttach{
+					Name:   body.Name,
+					Handle: body.Handle,
+					Role:   roleReceiver,
+					Target: &target{},
+				}
+				go func() { s.rx <- frame{body: resp} }()
+			case <-c.delSession:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	go s.mux(&performBegin{
+		IncomingWindow: DefaultWindow,
+		OutgoingWindow: DefaultWindow,
+		HandleMax:      DefaultMaxLinks - 1,
+	})
+
+	l, err := attachLink(s, nil, []LinkOption{
+		LinkName("resumed"),
+		LinkHandle(7),
+		LinkInitialDeliveryCount(42),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attach := <-attaches
+	if attach.Handle != 7 || l.handle != 7 {
+		t.Errorf("handle = %d (link %d), want 7", attach.Handle, l.handle)
+	}
+	if attach.InitialDeliveryCount != 42 || l.deliveryCount != 42 {
+		t.Errorf("initial-delivery-count = %d (link %d), want 42", attach.InitialDeliveryCount, l.deliveryCount)
+	}
+
+	// without options the lowest free handle and a zero count are used
+	l, err = attachLink(s, nil, []LinkOption{LinkName("default")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attach = <-attaches
+	if attach.Handle != 0 || attach.InitialDeliveryCount != 0 {
+		t.Errorf("handle = %d, initial-delivery-count = %d, want 0, 0", attach.Handle, attach.InitialDeliveryCount)
+	}
+
+	_, err = attachLink(s, nil, []LinkOption{LinkName("taken"), LinkHandle(7)})
+	if err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("unexpected error for handle in use: %v", err)
+	}
+	_, err = attachLink(s, nil, []LinkOption{LinkName("too-big"), LinkHandle(16)})
+	if err == nil || !strings.Contains(err.Error(), "handle max") {
+		t.Errorf("unexpected error for handle above max: %v", err)
+	}
+	_, err = newLink(s, &Receiver{}, []LinkOption{LinkInitialDeliveryCount(1)})
+	if err == nil {
+		t.Error("expected error for LinkInitialDeliveryCount on a Receiver")
+	}
+}
+
+func TestSessionDrain(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+
+	// the broker reports the detach and end frames it receives, in order
+	received := make(chan string, 10)
+	broker := testbroker.New(t, peerConn)
+	broker.Detach = func(channel uint16, detach *frames.Detach) {
+		received <- "detach"
+		broker.Write(channel, &frames.Detach{Handle: broker.Handle(detach.Handle), Closed: detach.Closed})
+	}
+	broker.End = func(channel uint16, end *frames.End) {
+		received <- "end"
+		broker.Write(channel, &frames.End{})
+	}
+	go func() {
+		defer close(received)
+		broker.Run()
+	}()
+
+	client, err := New(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := sess.NewSender(LinkTargetAddress("requests"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := sess.NewReceiver(LinkSourceAddress("replies"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sess.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.Err(); err != ErrLinkClosed {
+		t.Errorf("sender Err() = %v, want %v", err, ErrLinkClosed)
+	}
+	if err := receiver.Err(); err != ErrLinkClosed {
+		t.Errorf("receiver Err() = %v, want %v", err, ErrLinkClosed)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for frame := range received {
+		got = append(got, frame)
+	}
+	want := []string{"detach", "detach", "end"}
+	if !testEqual(got, want) {
+		t.Errorf("unexpected frames:\n%s", testDiff(got, want))
+	}
+}
@@ -168,6 +168,48 @@ type frameBody interface {
 	frameBody()
 }
 
+// FrameKind is the performative of a frame, as named in the AMQP spec.
+type FrameKind string
+
+// Frame Kinds
+const (
+	FrameOpen        FrameKind = "open"
+	FrameBegin       FrameKind = "begin"
+	FrameAttach      FrameKind = "attach"
+	FrameFlow        FrameKind = "flow"
+	FrameTransfer    FrameKind = "transfer"
+	FrameDisposition FrameKind = "disposition"
+	FrameDetach      FrameKind = "detach"
+	FrameEnd         FrameKind = "end"
+	FrameClose       FrameKind = "close"
+)
+
+// frameKind returns the performative of fr.
+func frameKind(fr frameBody) FrameKind {
+	switch fr.(type) {
+	case *performOpen:
+		return FrameOpen
+	case *performBegin:
+		return FrameBegin
+	case *performAttach:
+		return FrameAttach
+	case *performFlow:
+		return FrameFlow
+	case *performTransfer:
+		return FrameTransfer
+	case *performDisposition:
+		return FrameDisposition
+	case *performDetach:
+		return FrameDetach
+	case *performEnd:
+		return FrameEnd
+	case *performClose:
+		return FrameClose
+	default:
+		return FrameKind(fmt.Sprintf("%T", fr))
+	}
+}
+
 /*
 <type name="open" class="composite" source="list" provides="frame">
     <descriptor name="amqp:open:list" code="0x00000000:0x00000010"/>
@@ -586,6 +628,7 @@ func (rl role) marshal(wr *buffer) error {
 
 type deliveryState interface{} // TODO: http://docs.oasis-open.org/amqp/core/v1.0/os/amqp-core-transactions-v1.0-os.html#type-declared
 
+// unsettled maps delivery tags to delivery states.
 type unsettled map[string]deliveryState
 
 func (u unsettled) marshal(wr *buffer) error {
@@ -600,7 +643,21 @@ func (u *unsettled) unmarshal(r *buffer) error {
 
 	m := make(unsettled, count/2)
 	for i := uint32(0); i < count; i += 2 {
-		key, err := readString(r)
+		// delivery tags are binary, but accept strings from
+		// peers that encode them as such
+		var key string
+		type_, err := r.peekType()
+		if err != nil {
+			return err
+		}
+		switch type_ {
+		case typeCodeVbin8, typeCodeVbin32:
+			var tag []byte
+			tag, err = readBinary(r)
+			key = string(tag)
+		default:
+			key, err = readString(r)
+		}
 		if err != nil {
 			return err
 		}
@@ -615,7 +672,7 @@ func (u *unsettled) unmarshal(r *buffer) error {
 	return nil
 }
 
-type filter map[symbol]*describedType
+type filter map[symbol]*DescribedType
 
 func (f filter) marshal(wr *buffer) error {
 	return writeMap(wr, f)
@@ -633,7 +690,7 @@ func (f *filter) unmarshal(r *buffer) error {
 		if err != nil {
 			return err
 		}
-		var value describedType
+		var value DescribedType
 		err = unmarshal(r, &value)
 		if err != nil {
 			return err
@@ -744,7 +801,7 @@ type source struct {
 	// This field MUST be set by the sending end of the link if the endpoint supports more
 	// than one distribution-mode. This field MAY be set by the receiving end of the link
 	// to indicate a preference when a node supports multiple distribution modes.
-	DistributionMode symbol
+	DistributionMode DistributionMode
 
 	// a set of predicates to filter the messages admitted onto the link
 	//
@@ -788,7 +845,7 @@ func (s *source) marshal(wr *buffer) error {
 		{value: s.DynamicNodeProperties, omit: len(s.DynamicNodeProperties) == 0},
 		{value: &s.DistributionMode, omit: s.DistributionMode == ""},
 		{value: s.Filter, omit: len(s.Filter) == 0},
-		{value: &s.DefaultOutcome, omit: s.DefaultOutcome == nil},
+		{value: s.DefaultOutcome, omit: s.DefaultOutcome == nil},
 		{value: &s.Outcomes, omit: len(s.Outcomes) == 0},
 		{value: &s.Capabilities, omit: len(s.Capabilities) == 0},
 	})
@@ -962,6 +1019,166 @@ func (t target) String() string {
 	)
 }
 
+// Source is the source terminus of a link as set by the remote peer.
+//
+// The peer may alter the terminus requested when attaching; for example a
+// broker may apply a different filter than the one requested or none at all.
+type Source struct {
+	// The address of the node the messages are sent from.
+	Address string
+
+	// How the peer retains the terminus state.
+	Durable Durability
+
+	// When the expiry timer of the terminus starts.
+	ExpiryPolicy ExpiryPolicy
+
+	// Duration in seconds that the terminus is retained after expiry begins.
+	Timeout uint32
+
+	// Whether the node was dynamically created by the peer.
+	Dynamic bool
+
+	// Properties of the dynamically created node.
+	DynamicNodeProperties map[string]interface{}
+
+	// The distribution mode of the link, empty if not set.
+	DistributionMode DistributionMode
+
+	// The filters applied by the peer, keyed by filter name.
+	//
+	// Values are the filter values without their descriptors.
+	Filter map[string]interface{}
+
+	// The outcome applied to unsettled deliveries when the link ends,
+	// empty if not set.
+	DefaultOutcome Outcome
+
+	// The outcomes supported by the source.
+	Outcomes []Outcome
+
+	// The extension capabilities of the source.
+	Capabilities []string
+}
+
+// Target is the target terminus of a link as set by the remote peer.
+type Target struct {
+	// The address of the node the messages are sent to.
+	Address string
+
+	// How the peer retains the terminus state.
+	Durable Durability
+
+	// When the expiry timer of the terminus starts.
+	ExpiryPolicy ExpiryPolicy
+
+	// Duration in seconds that the terminus is retained after expiry begins.
+	Timeout uint32
+
+	// Whether the node was dynamically created by the peer.
+	Dynamic bool
+
+	// Properties of the dynamically created node.
+	DynamicNodeProperties map[string]interface{}
+
+	// The extension capabilities of the target.
+	Capabilities []string
+}
+
+func exportSource(s *source) *Source {
+	if s == nil {
+		return nil
+	}
+	src := &Source{
+		Address:               s.Address,
+		Durable:               s.Durable,
+		ExpiryPolicy:          expiryPolicyOrDefault(s.ExpiryPolicy),
+		Timeout:               s.Timeout,
+		Dynamic:               s.Dynamic,
+		DynamicNodeProperties: exportNodeProperties(s.DynamicNodeProperties),
+		DistributionMode:      s.DistributionMode,
+		DefaultOutcome:        outcomeOf(s.DefaultOutcome),
+		Capabilities:          exportSymbols(s.Capabilities),
+	}
+	if s.Filter != nil {
+		src.Filter = make(map[string]interface{}, len(s.Filter))
+		for name, f := range s.Filter {
+			var value interface{}
+			if f != nil {
+				value = f.Value
+			}
+			src.Filter[string(name)] = value
+		}
+	}
+	for _, o := range s.Outcomes {
+		src.Outcomes = append(src.Outcomes, Outcome(o))
+	}
+	return src
+}
+
+func exportTarget(t *target) *Target {
+	if t == nil {
+		return nil
+	}
+	return &Target{
+		Address:               t.Address,
+		Durable:               t.Durable,
+		ExpiryPolicy:          expiryPolicyOrDefault(t.ExpiryPolicy),
+		Timeout:               t.Timeout,
+		Dynamic:               t.Dynamic,
+		DynamicNodeProperties: exportNodeProperties(t.DynamicNodeProperties),
+		Capabilities:          exportSymbols(t.Capabilities),
+	}
+}
+
+// expiryPolicyOrDefault returns p, or the default expiry policy
+// if p isn't set.
+func expiryPolicyOrDefault(p ExpiryPolicy) ExpiryPolicy {
+	if p == "" {
+		return ExpirySessionEnd
+	}
+	return p
+}
+
+func exportNodeProperties(props map[symbol]interface{}) map[string]interface{} {
+	if props == nil {
+		return nil
+	}
+	m := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		m[string(k)] = v
+	}
+	return m
+}
+
+func exportSymbols(syms multiSymbol) []string {
+	if syms == nil {
+		return nil
+	}
+	s := make([]string, len(syms))
+	for i, sym := range syms {
+		s[i] = string(sym)
+	}
+	return s
+}
+
+// outcomeOf returns the Outcome corresponding to the terminal
+// delivery state, or an empty Outcome if state isn't an outcome.
+func outcomeOf(state interface{}) Outcome {
+	switch state.(type) {
+	case *stateAccepted:
+		return OutcomeAccepted
+	case *stateRejected:
+		return OutcomeRejected
+	case *stateReleased:
+		return OutcomeReleased
+	case *stateModified:
+		return OutcomeModified
+	default:
+		return ""
+	}
+}
+
 /*
 <type name="flow" class="composite" source="list" provides="frame">
     <descriptor name="amqp:flow:list" code="0x00000000:0x00000013"/>
@@ -1602,6 +1819,86 @@ func (e *Error) Error() string {
 	return e.String()
 }
 
+// Is reports whether target is the sentinel error corresponding to
+// e.Condition, such as ErrAddressNotFound for ErrorNotFound.
+func (e *Error) Is(target error) bool {
+	if e == nil {
+		return false
+	}
+	switch target {
+	case ErrAddressNotFound:
+		return e.Condition == ErrorNotFound
+	case ErrUnauthorized:
+		return e.Condition == ErrorUnauthorizedAccess
+	case ErrResourceLimitExceeded:
+		return e.Condition == ErrorResourceLimitExceeded
+	case ErrNotImplemented:
+		return e.Condition == ErrorNotImplemented
+	case ErrPreconditionFailed:
+		return e.Condition == ErrorPreconditionFailed
+	case ErrConnectionForced:
+		return e.Condition == ErrorConnectionForced
+	case ErrThrottled:
+		return e.Condition == ErrorTransferLimitExceeded
+	default:
+		return false
+	}
+}
+
+// Redirect is the location a connection or link is redirected to
+// by an ErrorConnectionRedirect or ErrorLinkRedirect error.
+type Redirect struct {
+	// the DNS hostname of the container to redirect to, used as the
+	// hostname in Open and the TLS ServerName when reconnecting
+	Hostname string
+
+	// the DNS hostname or IP address of the machine to connect to
+	NetworkHost string
+
+	// the port number on the machine to connect to
+	Port uint16
+
+	// the address of the node to attach to; link redirects only
+	Address string
+}
+
+// Redirect returns the redirect location carried in e.Info.
+//
+// ok is false if e's condition isn't ErrorConnectionRedirect or
+// ErrorLinkRedirect. Fields not present in Info are left empty.
+func (e *Error) Redirect() (r *Redirect, ok bool) {
+	if e == nil || (e.Condition != ErrorConnectionRedirect && e.Condition != ErrorLinkRedirect) {
+		return nil, false
+	}
+	r = new(Redirect)
+	r.Hostname, _ = e.Info["hostname"].(string)
+	r.NetworkHost, _ = e.Info["network-host"].(string)
+	r.Address, _ = e.Info["address"].(string)
+
+	// port is a ushort, but accept any integer a peer may send
+	switch port := e.Info["port"].(type) {
+	case uint16:
+		r.Port = port
+	case uint8:
+		r.Port = uint16(port)
+	case uint32:
+		r.Port = uint16(port)
+	case uint64:
+		r.Port = uint16(port)
+	case int8:
+		r.Port = uint16(port)
+	case int16:
+		r.Port = uint16(port)
+	case int32:
+		r.Port = uint16(port)
+	case int64:
+		r.Port = uint16(port)
+	case int:
+		r.Port = uint16(port)
+	}
+	return r, true
+}
+
 /*
 <type name="end" class="composite" source="list" provides="frame">
     <descriptor name="amqp:end:list" code="0x00000000:0x00000017"/>
@@ -1736,8 +2033,18 @@ type Message struct {
 	// The keys of this map are restricted to be of type string (which excludes
 	// the possibility of a null key) and the values are restricted to be of
 	// simple types only, that is, excluding map, list, and array types.
+	//
+	// This restriction is not enforced. Slices of the following types are
+	// encoded as AMQP arrays and decoded back to the same slice type:
+	// []int8, []int16, []int32, []int64, []uint16, []uint32, []uint64,
+	// []float32, []float64, []bool, []string, [][]byte, []time.Time,
+	// []UUID and ArrayUByte. Peers that enforce the restriction may
+	// reject such messages.
+	//
+	// Values that are explicitly null are decoded as Null, so they can be
+	// told apart from absent keys by comparing against nil.
 
-	// Data payloads.
+	// Data payloads, one element per data section, in order.
 	Data [][]byte
 	// A data section contains opaque binary data.
 	// TODO: this could be data(s), amqp-sequence(s), amqp-value rather than single data:
@@ -1754,10 +2061,20 @@ type Message struct {
 	// encryption details).
 	Footer Annotations
 
-	// Mark the message as settled when LinkSenderSettle is ModeMixed.
+	// Sections with descriptors not defined by the AMQP specification,
+	// such as proprietary sections added by a broker, as received.
+	// They're encoded after the body and before the footer when the
+	// message is sent, so a received message can be forwarded intact.
+	UnknownSections []DescribedType
+
+	// SendSettled controls whether the message is sent settled.
 	//
-	// This field is ignored when LinkSenderSettle is not ModeMixed.
-	SendSettled bool
+	// If nil, the link's sender settle mode decides: the message is sent
+	// settled with ModeSettled, or with ModeMixed if LinkSenderDefaultSettled
+	// is true. When ModeMixed is negotiated it can be set to choose per
+	// message. Setting it to true with ModeUnsettled, or to false with
+	// ModeSettled, causes the send to fail.
+	SendSettled *bool
 
 	receiver   *Receiver // Receiver the message was received from
 	deliveryID uint32    // used when sending disposition
@@ -1779,6 +2096,145 @@ func NewMessage(data []byte) *Message {
 	}
 }
 
+// NewMessageWithValue returns a *Message with v as its amqp-value body,
+// rather than data sections, as expected by some peers.
+//
+// v may be any type that can be encoded, such as a string, a number,
+// a map[string]interface{} or a []interface{}. Values of other types
+// cause the message to fail to send.
+func NewMessageWithValue(v interface{}) *Message {
+	return &Message{
+		Value:      v,
+		doneSignal: make(chan struct{}),
+	}
+}
+
+// Clone returns a deep copy of m that can be modified and sent
+// independently of m.
+//
+// Maps, slices and the Header and Properties are copied, including
+// nested maps and slices in ApplicationProperties, annotations and
+// Value. The clone isn't associated with the Receiver m was received
+// from, so it can't be used to settle m.
+func (m *Message) Clone() *Message {
+	c := &Message{
+		Format:      m.Format,
+		DeliveryTag: cloneBytes(m.DeliveryTag),
+		Value:       cloneValue(m.Value),
+		doneSignal:  make(chan struct{}),
+	}
+	if m.SendSettled != nil {
+		settled := *m.SendSettled
+		c.SendSettled = &settled
+	}
+	if m.Header != nil {
+		header := *m.Header
+		c.Header = &header
+	}
+	if m.Properties != nil {
+		props := *m.Properties
+		props.MessageID = cloneValue(props.MessageID)
+		props.UserID = cloneBytes(props.UserID)
+		props.CorrelationID = cloneValue(props.CorrelationID)
+		c.Properties = &props
+	}
+	if m.Data != nil {
+		c.Data = make([][]byte, len(m.Data))
+		for i, data := range m.Data {
+			c.Data[i] = cloneBytes(data)
+		}
+	}
+	if m.DeliveryAnnotations != nil {
+		c.DeliveryAnnotations = cloneValue(m.DeliveryAnnotations).(Annotations)
+	}
+	if m.Annotations != nil {
+		c.Annotations = cloneValue(m.Annotations).(Annotations)
+	}
+	if m.ApplicationProperties != nil {
+		c.ApplicationProperties = cloneValue(m.ApplicationProperties).(map[string]interface{})
+	}
+	if m.Footer != nil {
+		c.Footer = cloneValue(m.Footer).(Annotations)
+	}
+	if m.UnknownSections != nil {
+		c.UnknownSections = make([]DescribedType, len(m.UnknownSections))
+		for i, section := range m.UnknownSections {
+			c.UnknownSections[i] = cloneValue(section).(DescribedType)
+		}
+	}
+	return c
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// cloneValue returns a deep copy of the maps and slices in v,
+// other values are returned as is.
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return cloneBytes(v)
+	case DescribedType:
+		return DescribedType{Descriptor: cloneValue(v.Descriptor), Value: cloneValue(v.Value)}
+	case []interface{}:
+		if v == nil {
+			return v
+		}
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = cloneValue(e)
+		}
+		return c
+	case []string:
+		if v == nil {
+			return v
+		}
+		return append([]string{}, v...)
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c[k] = cloneValue(e)
+		}
+		return c
+	case map[symbol]interface{}:
+		if v == nil {
+			return v
+		}
+		c := make(map[symbol]interface{}, len(v))
+		for k, e := range v {
+			c[k] = cloneValue(e)
+		}
+		return c
+	case map[interface{}]interface{}:
+		if v == nil {
+			return v
+		}
+		c := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			c[k] = cloneValue(e)
+		}
+		return c
+	case Annotations:
+		if v == nil {
+			return v
+		}
+		c := make(Annotations, len(v))
+		for k, e := range v {
+			c[k] = cloneValue(e)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
 // done closes the internal doneSignal channel to let the receiver know that this message has been acted upon
 func (m *Message) done() {
 	// TODO: move initialization in ctor and use ctor everywhere?
@@ -1787,13 +2243,92 @@ func (m *Message) done() {
 	}
 }
 
-// GetData returns the first []byte from the Data field
+// GetData returns the message's Data sections concatenated in order,
 // or nil if Data is empty.
+//
+// When there's a single section it's returned without copying.
 func (m *Message) GetData() []byte {
-	if len(m.Data) < 1 {
+	switch len(m.Data) {
+	case 0:
 		return nil
+	case 1:
+		return m.Data[0]
+	}
+	var n int
+	for _, data := range m.Data {
+		n += len(data)
+	}
+	b := make([]byte, 0, n)
+	for _, data := range m.Data {
+		b = append(b, data...)
+	}
+	return b
+}
+
+// DeliveryCount returns the number of prior unsuccessful delivery
+// attempts of the message, as reported in its header, or 0 if the
+// message has no header.
+//
+// The count is incremented by the sender when a message is redelivered
+// after being modified with deliveryFailed set, and can be used to stop
+// processing messages that repeatedly fail.
+func (m *Message) DeliveryCount() uint32 {
+	if m.Header == nil {
+		return 0
 	}
-	return m.Data[0]
+	return m.Header.DeliveryCount
+}
+
+// ExpiryTime returns the time at which the message expires.
+//
+// This is Properties.AbsoluteExpiryTime if set, otherwise
+// Properties.CreationTime plus Header.TTL if both are set.
+// The zero time is returned if the message doesn't expire.
+func (m *Message) ExpiryTime() time.Time {
+	if m.Properties == nil {
+		return time.Time{}
+	}
+	if !m.Properties.AbsoluteExpiryTime.IsZero() {
+		return m.Properties.AbsoluteExpiryTime
+	}
+	if m.Header == nil || m.Header.TTL == 0 || m.Properties.CreationTime.IsZero() {
+		return time.Time{}
+	}
+	return m.Properties.CreationTime.Add(m.Header.TTL)
+}
+
+// Subject returns the application-specific subject of the message,
+// as set in Properties.Subject, or an empty string if the message has
+// no properties.
+func (m *Message) Subject() string {
+	if m.Properties == nil {
+		return ""
+	}
+	return m.Properties.Subject
+}
+
+// GroupID returns the group the message belongs to, as set in
+// Properties.GroupID, or an empty string if the message has no
+// properties.
+func (m *Message) GroupID() string {
+	if m.Properties == nil {
+		return ""
+	}
+	return m.Properties.GroupID
+}
+
+// GroupSequence returns the position of the message within its group,
+// as set in Properties.GroupSequence, or 0 if the message has no
+// properties.
+//
+// The sequence is an RFC-1982 serial number and wraps from
+// math.MaxUint32 to 0, so positions must be compared with serial
+// number arithmetic rather than as plain integers.
+func (m *Message) GroupSequence() uint32 {
+	if m.Properties == nil {
+		return 0
+	}
+	return m.Properties.GroupSequence
 }
 
 // GetLinkName returns associated link name or empty string if receiver or link is not defined.
@@ -1811,7 +2346,7 @@ func (m *Message) Accept(ctx context.Context) error {
 		return nil
 	}
 	defer m.done()
-	return m.receiver.messageDisposition(ctx, m.deliveryID, &stateAccepted{})
+	return m.receiver.messageDisposition(ctx, m, &stateAccepted{})
 }
 
 // Reject notifies the server that the message is invalid.
@@ -1822,7 +2357,7 @@ func (m *Message) Reject(ctx context.Context, e *Error) error {
 		return nil
 	}
 	defer m.done()
-	return m.receiver.messageDisposition(ctx, m.deliveryID, &stateRejected{Error: e})
+	return m.receiver.messageDisposition(ctx, m, &stateRejected{Error: e})
 }
 
 // Release releases the message back to the server. The message
@@ -1832,7 +2367,7 @@ func (m *Message) Release(ctx context.Context) error {
 		return nil
 	}
 	defer m.done()
-	return m.receiver.messageDisposition(ctx, m.deliveryID, &stateReleased{})
+	return m.receiver.messageDisposition(ctx, m, &stateReleased{})
 }
 
 // Modify notifies the server that the message was not acted upon
@@ -1846,14 +2381,15 @@ func (m *Message) Release(ctx context.Context) error {
 //
 // messageAnnotations is an optional annotation map to be merged
 // with the existing message annotations, overwriting existing keys
-// if necessary.
+// if necessary. The merge is applied by the peer, so the merged
+// annotations are only visible if the message is redelivered.
 func (m *Message) Modify(ctx context.Context, deliveryFailed, undeliverableHere bool, messageAnnotations Annotations) error {
 	if !m.shouldSendDisposition() {
 		return nil
 	}
 	defer m.done()
 	return m.receiver.messageDisposition(ctx,
-		m.deliveryID, &stateModified{
+		m, &stateModified{
 			DeliveryFailed:     deliveryFailed,
 			UndeliverableHere:  undeliverableHere,
 			MessageAnnotations: messageAnnotations,
@@ -1919,6 +2455,16 @@ func (m *Message) marshal(wr *buffer) error {
 		}
 	}
 
+	// reserve space for all data sections up front, rather than
+	// growing the buffer for each section. a single section is
+	// appended in one go anyway, without zeroing the space first
+	if len(m.Data) > 1 {
+		size := 0
+		for _, data := range m.Data {
+			size += 8 + len(data) // descriptor, type and length
+		}
+		wr.grow(size)
+	}
 	for _, data := range m.Data {
 		writeDescriptor(wr, typeCodeApplicationData)
 		err := writeBinary(wr, data)
@@ -1935,6 +2481,13 @@ func (m *Message) marshal(wr *buffer) error {
 		}
 	}
 
+	for _, section := range m.UnknownSections {
+		err := section.marshal(wr)
+		if err != nil {
+			return err
+		}
+	}
+
 	if m.Footer != nil {
 		writeDescriptor(wr, typeCodeFooter)
 		err := marshal(wr, m.Footer)
@@ -2006,8 +2559,19 @@ func (m *Message) unmarshal(r *buffer) error {
 		case typeCodeAMQPValue:
 			section = &m.Value
 
+		case typeCodeAMQPSequence:
+			return errorNew("amqp-sequence message sections are not supported")
+
 		default:
-			return errorErrorf("unknown message section %#02x", type_)
+			// a section this package doesn't know, keep it
+			// so it can be inspected and forwarded
+			var dt DescribedType
+			err = dt.unmarshal(r)
+			if err != nil {
+				return err
+			}
+			m.UnknownSections = append(m.UnknownSections, dt)
+			continue
 		}
 
 		if discardHeader {
@@ -2019,11 +2583,29 @@ func (m *Message) unmarshal(r *buffer) error {
 			return err
 		}
 	}
+
+	// only a null decodes as nil, mark them as explicit
+	for key, value := range m.ApplicationProperties {
+		if value == nil {
+			m.ApplicationProperties[key] = Null{}
+		}
+	}
+	for _, a := range []Annotations{m.DeliveryAnnotations, m.Annotations, m.Footer} {
+		for key, value := range a {
+			if value == nil {
+				a[key] = Null{}
+			}
+		}
+	}
 	return nil
 }
 
 // peekMessageType reads the message type without
 // modifying any data.
+//
+// Symbolic descriptors and numeric descriptors too large for a type
+// code are returned as 0, which isn't the code of any composite
+// decoded by descriptor.
 func peekMessageType(buf []byte) (uint8, error) {
 	if len(buf) < 3 {
 		return 0, errorNew("invalid message")
@@ -2046,6 +2628,10 @@ func peekMessageType(buf []byte) (uint8, error) {
 		return buf[2], nil
 	}
 
+	if t == typeCodeSym8 || t == typeCodeSym32 {
+		return 0, nil
+	}
+
 	if t != typeCodeUlong {
 		return 0, errorErrorf("invalid type for uint32 %02x", t)
 	}
@@ -2054,6 +2640,9 @@ func peekMessageType(buf []byte) (uint8, error) {
 		return 0, errorNew("invalid ulong")
 	}
 	v := binary.BigEndian.Uint64(buf[2:10])
+	if v > math.MaxUint8 {
+		return 0, nil
+	}
 
 	return uint8(v), nil
 }
@@ -2091,6 +2680,9 @@ func (a *Annotations) unmarshal(r *buffer) error {
 		if err != nil {
 			return err
 		}
+		if !validMapKey(key) {
+			return errorNew("invalid annotations key")
+		}
 		m[key] = value
 	}
 	*a = m
@@ -2110,11 +2702,23 @@ func (a *Annotations) unmarshal(r *buffer) error {
 
 // MessageHeader carries standard delivery details about the transfer
 // of a message.
+//
+// Fields left at their AMQP defaults are omitted from the encoded header.
 type MessageHeader struct {
-	Durable       bool
-	Priority      uint8
+	// Durable requests that intermediaries not lose the message
+	// if they fail or restart.
+	Durable bool
+
+	// Priority of the message, 0 (lowest) to 9 (highest).
+	//
+	// The AMQP default is 4. Note that the zero value is encoded
+	// as priority 0, so set 4 explicitly for normal priority.
+	Priority uint8
+
 	TTL           time.Duration // from milliseconds
 	FirstAcquirer bool
+
+	// DeliveryCount is the number of prior unsuccessful delivery attempts.
 	DeliveryCount uint32
 }
 
@@ -2223,9 +2827,13 @@ type MessageProperties struct {
 	ContentEncoding string
 
 	// An absolute time when this message is considered to be expired.
+	//
+	// Times are sent with millisecond precision, see TruncateTimestamp.
 	AbsoluteExpiryTime time.Time
 
 	// An absolute time when this message was created.
+	//
+	// Times are sent with millisecond precision, see TruncateTimestamp.
 	CreationTime time.Time
 
 	// Identifies the group the message belongs to.
@@ -2240,6 +2848,15 @@ type MessageProperties struct {
 }
 
 func (p *MessageProperties) marshal(wr *buffer) error {
+	err := validateMessageID("MessageID", p.MessageID)
+	if err != nil {
+		return err
+	}
+	err = validateMessageID("CorrelationID", p.CorrelationID)
+	if err != nil {
+		return err
+	}
+
 	return marshalComposite(wr, typeCodeMessageProperties, []marshalField{
 		{value: p.MessageID, omit: p.MessageID == nil},
 		{value: &p.UserID, omit: len(p.UserID) == 0},
@@ -2275,6 +2892,17 @@ func (p *MessageProperties) unmarshal(r *buffer) error {
 	}...)
 }
 
+// validateMessageID checks that id is one of the types permitted
+// for a message-id or correlation-id.
+func validateMessageID(field string, id interface{}) error {
+	switch id.(type) {
+	case nil, uint64, UUID, []byte, string:
+		return nil
+	default:
+		return errorErrorf("unsupported %s type %T, must be uint64, UUID, []byte, or string", field, id)
+	}
+}
+
 /*
 <type name="received" class="composite" source="list" provides="delivery-state">
     <descriptor name="amqp:received:list" code="0x00000000:0x00000023"/>
@@ -2670,12 +3298,7 @@ func (m *mapAnyAny) unmarshal(r *buffer) error {
 			return err
 		}
 
-		// https://golang.org/ref/spec#Map_types:
-		// The comparison operators == and != must be fully defined
-		// for operands of the key type; thus the key type must not
-		// be a function, map, or slice.
-		switch reflect.ValueOf(key).Kind() {
-		case reflect.Slice, reflect.Func, reflect.Map:
+		if !validMapKey(key) {
 			return errorNew("invalid map key")
 		}
 
@@ -2685,6 +3308,23 @@ func (m *mapAnyAny) unmarshal(r *buffer) error {
 	return nil
 }
 
+// validMapKey reports whether a decoded value can be used as a map key.
+//
+// https://golang.org/ref/spec#Map_types:
+// The comparison operators == and != must be fully defined
+// for operands of the key type; thus the key type must not
+// be a function, map, or slice.
+func validMapKey(key interface{}) bool {
+	if dt, ok := key.(DescribedType); ok {
+		return validMapKey(dt.Descriptor) && validMapKey(dt.Value)
+	}
+	switch reflect.ValueOf(key).Kind() {
+	case reflect.Slice, reflect.Func, reflect.Map:
+		return false
+	}
+	return true
+}
+
 // mapStringAny is used to decode AMQP maps that have string keys
 type mapStringAny map[string]interface{}
 
@@ -2762,6 +3402,20 @@ func (u UUID) String() string {
 	return string(buf[:])
 }
 
+// ParseUUID parses s in the hex encoded representation returned by
+// UUID.String, e.g. for use as a message-id or correlation-id.
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return u, errorErrorf("invalid UUID %q", s)
+	}
+	hexStr := s[:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	if _, err := hex.Decode(u[:], []byte(hexStr)); err != nil {
+		return u, errorErrorf("invalid UUID %q", s)
+	}
+	return u, nil
+}
+
 func (u UUID) marshal(wr *buffer) error {
 	wr.writeByte(byte(typeCodeUUID))
 	wr.write(u[:])
@@ -2774,16 +3428,38 @@ func (u *UUID) unmarshal(r *buffer) error {
 	return err
 }
 
-type lifetimePolicy uint8
+// LifetimePolicy specifies when a dynamically created node is deleted.
+type LifetimePolicy uint8
 
+// Lifetime Policies
 const (
-	deleteOnClose             = lifetimePolicy(typeCodeDeleteOnClose)
-	deleteOnNoLinks           = lifetimePolicy(typeCodeDeleteOnNoLinks)
-	deleteOnNoMessages        = lifetimePolicy(typeCodeDeleteOnNoMessages)
-	deleteOnNoLinksOrMessages = lifetimePolicy(typeCodeDeleteOnNoLinksOrMessages)
+	// The node is deleted when the link that caused its creation is closed.
+	LifetimeDeleteOnClose = LifetimePolicy(typeCodeDeleteOnClose)
+
+	// The node is deleted when there are no links attached to it.
+	LifetimeDeleteOnNoLinks = LifetimePolicy(typeCodeDeleteOnNoLinks)
+
+	// The node is deleted when it contains no messages.
+	LifetimeDeleteOnNoMessages = LifetimePolicy(typeCodeDeleteOnNoMessages)
+
+	// The node is deleted when there are no links attached to it
+	// and it contains no messages.
+	LifetimeDeleteOnNoLinksOrMessages = LifetimePolicy(typeCodeDeleteOnNoLinksOrMessages)
 )
 
-func (p lifetimePolicy) marshal(wr *buffer) error {
+func (p LifetimePolicy) validate() error {
+	switch p {
+	case LifetimeDeleteOnClose,
+		LifetimeDeleteOnNoLinks,
+		LifetimeDeleteOnNoMessages,
+		LifetimeDeleteOnNoLinksOrMessages:
+		return nil
+	default:
+		return errorErrorf("unknown lifetime-policy %#02x", uint8(p))
+	}
+}
+
+func (p LifetimePolicy) marshal(wr *buffer) error {
 	wr.write([]byte{
 		0x0,
 		byte(typeCodeSmallUlong),
@@ -2793,15 +3469,15 @@ func (p lifetimePolicy) marshal(wr *buffer) error {
 	return nil
 }
 
-func (p *lifetimePolicy) unmarshal(r *buffer) error {
+func (p *LifetimePolicy) unmarshal(r *buffer) error {
 	typ, fields, err := readCompositeHeader(r)
 	if err != nil {
 		return err
 	}
 	if fields != 0 {
-		return errorErrorf("invalid size %d for lifetime-policy")
+		return errorErrorf("invalid size %d for lifetime-policy", fields)
 	}
-	*p = lifetimePolicy(typ)
+	*p = LifetimePolicy(typ)
 	return nil
 }
 
@@ -3005,21 +3681,139 @@ func (e *ExpiryPolicy) String() string {
 	return string(*e)
 }
 
-type describedType struct {
-	descriptor interface{}
-	value      interface{}
+// Distribution Modes
+const (
+	// Messages are taken from the source node when they are
+	// acquired, so each message is delivered to a single link.
+	// This is the usual behavior of a queue.
+	DistributionModeMove DistributionMode = "move"
+
+	// Messages remain available at the source node when they are
+	// transferred, so each message may be delivered to other links.
+	// This is the usual behavior of a topic subscription.
+	DistributionModeCopy DistributionMode = "copy"
+)
+
+// DistributionMode specifies how messages from a source node are
+// distributed among the links attached to it.
+type DistributionMode symbol
+
+func (m DistributionMode) validate() error {
+	switch m {
+	case DistributionModeMove,
+		DistributionModeCopy:
+		return nil
+	default:
+		return errorErrorf("unknown distribution-mode %q", m)
+	}
+}
+
+func (m DistributionMode) marshal(wr *buffer) error {
+	return symbol(m).marshal(wr)
+}
+
+// unmarshal doesn't validate m, peers may use distribution
+// modes other than those defined by the specification.
+func (m *DistributionMode) unmarshal(r *buffer) error {
+	return unmarshal(r, (*symbol)(m))
+}
+
+func (m *DistributionMode) String() string {
+	if m == nil {
+		return "<nil>"
+	}
+	return string(*m)
 }
 
-func (t describedType) marshal(wr *buffer) error {
+// Outcomes
+const (
+	// The message was processed successfully.
+	OutcomeAccepted Outcome = "amqp:accepted:list"
+
+	// The message was not processed and will not be redelivered.
+	OutcomeRejected Outcome = "amqp:rejected:list"
+
+	// The message was not processed and may be redelivered.
+	OutcomeReleased Outcome = "amqp:released:list"
+
+	// The message was not processed and its annotations may be altered
+	// before it is redelivered.
+	OutcomeModified Outcome = "amqp:modified:list"
+)
+
+// Outcome is the descriptor of a terminal delivery state a link
+// may use to settle a message.
+type Outcome symbol
+
+func (o Outcome) validate() error {
+	switch o {
+	case OutcomeAccepted,
+		OutcomeRejected,
+		OutcomeReleased,
+		OutcomeModified:
+		return nil
+	default:
+		return errorErrorf("unknown outcome %q", o)
+	}
+}
+
+// state returns the delivery state for o with no fields set.
+func (o Outcome) state() deliveryState {
+	switch o {
+	case OutcomeAccepted:
+		return &stateAccepted{}
+	case OutcomeRejected:
+		return &stateRejected{}
+	case OutcomeReleased:
+		return &stateReleased{}
+	case OutcomeModified:
+		return &stateModified{}
+	default:
+		return nil
+	}
+}
+
+// Null is an explicit AMQP null.
+//
+// Null values in the application properties, annotations and footer of
+// a received message are decoded as Null rather than nil, and Null is
+// encoded as null.
+type Null struct{}
+
+func (Null) marshal(wr *buffer) error {
+	wr.writeByte(byte(typeCodeNull))
+	return nil
+}
+
+// DescribedType is an AMQP value annotated with a descriptor.
+//
+// Described values that don't correspond to a type known to this
+// package, such as those in message annotations, are decoded as a
+// DescribedType so they can be inspected and sent again unchanged.
+type DescribedType struct {
+	// Descriptor identifies the type with a uint64 code or a
+	// symbolic name. A string descriptor is encoded as a symbol
+	// and symbolic descriptors are decoded as strings.
+	Descriptor interface{}
+
+	// Value is the described value.
+	Value interface{}
+}
+
+func (t DescribedType) marshal(wr *buffer) error {
 	wr.writeByte(0x0) // descriptor constructor
-	err := marshal(wr, t.descriptor)
+	descriptor := t.Descriptor
+	if name, ok := descriptor.(string); ok {
+		descriptor = symbol(name)
+	}
+	err := marshal(wr, descriptor)
 	if err != nil {
 		return err
 	}
-	return marshal(wr, t.value)
+	return marshal(wr, t.Value)
 }
 
-func (t *describedType) unmarshal(r *buffer) error {
+func (t *DescribedType) unmarshal(r *buffer) error {
 	b, err := r.readByte()
 	if err != nil {
 		return err
@@ -3029,17 +3823,17 @@ func (t *describedType) unmarshal(r *buffer) error {
 		return errorErrorf("invalid described type header %02x", b)
 	}
 
-	err = unmarshal(r, &t.descriptor)
+	err = unmarshal(r, &t.Descriptor)
 	if err != nil {
 		return err
 	}
-	return unmarshal(r, &t.value)
+	return unmarshal(r, &t.Value)
 }
 
-func (t describedType) String() string {
-	return fmt.Sprintf("describedType{descriptor: %v, value: %v}",
-		t.descriptor,
-		t.value,
+func (t DescribedType) String() string {
+	return fmt.Sprintf("DescribedType{Descriptor: %v, Value: %v}",
+		t.Descriptor,
+		t.Value,
 	)
 }
 
@@ -3076,7 +3870,8 @@ func (a *ArrayUByte) unmarshal(r *buffer) error {
 	if !ok {
 		return errorErrorf("invalid length %d", length)
 	}
-	*a = append([]byte(nil), buf...)
+	// as with binary, an empty array is returned as non-nil
+	*a = append(make([]byte, 0, len(buf)), buf...)
 
 	return nil
 }
@@ -4030,6 +4825,16 @@ func (a *arrayBinary) unmarshal(r *buffer) error {
 	return nil
 }
 
+// TruncateTimestamp returns t as it's decoded once sent, e.g. as
+// a property or annotation value. Times are encoded as milliseconds
+// since the Unix epoch, so they're decoded in UTC and any precision
+// below a millisecond is lost.
+//
+// t is sent without loss of precision if t.Equal(TruncateTimestamp(t)).
+func TruncateTimestamp(t time.Time) time.Time {
+	return unixMilliTime(unixMilli(t))
+}
+
 type arrayTimestamp []time.Time
 
 func (a arrayTimestamp) marshal(wr *buffer) error {
@@ -4038,8 +4843,7 @@ func (a arrayTimestamp) marshal(wr *buffer) error {
 	writeArrayHeader(wr, len(a), typeSize, typeCodeTimestamp)
 
 	for _, element := range a {
-		ms := element.UnixNano() / int64(time.Millisecond)
-		wr.writeUint64(uint64(ms))
+		wr.writeUint64(uint64(unixMilli(element)))
 	}
 
 	return nil
@@ -4076,7 +4880,7 @@ func (a *arrayTimestamp) unmarshal(r *buffer) error {
 	for i := range aa {
 		ms := int64(binary.BigEndian.Uint64(buf[bufIdx:]))
 		bufIdx += typeSize
-		aa[i] = time.Unix(ms/1000, (ms%1000)*1000000).UTC()
+		aa[i] = unixMilliTime(ms)
 	}
 
 	*a = aa